@@ -0,0 +1,372 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"golang.org/x/net/context"
+)
+
+// The admin endpoints change the whole table. They only accept POST requests
+// with the admin token, as in
+//
+//	curl -X POST -H "Authorization: Bearer $SEARCH_ADMIN_TOKEN" \
+//		"http://localhost:8080/admin/reindex?analyzer=english"
+//
+// They are disabled if there is no admin token.
+
+// columnFamilies are the column families of the table, and their GC
+// policies: only the latest version of each cell is kept.
+var columnFamilies = []struct {
+	name   string
+	policy bigtable.GCPolicy
+}{
+	{indexColumnFamily, bigtable.MaxVersionsPolicy(1)},
+	{contentColumnFamily, bigtable.MaxVersionsPolicy(1)},
+}
+
+// schemaChanges are the changes made by bootstrap.
+type schemaChanges struct {
+	createdTable    bool
+	createdFamilies []string
+	gcPolicies      []string // the families whose GC policy was set.
+	analyzer        string   // the analyzer of the table.
+	setAnalyzer     bool     // whether the analyzer was set.
+}
+
+// String describes the changes, a line each.
+func (c *schemaChanges) String() string {
+	var lines []string
+	if c.createdTable {
+		lines = append(lines, "Created the table.")
+	}
+	for _, f := range c.createdFamilies {
+		lines = append(lines, fmt.Sprintf("Created column family %s.", f))
+	}
+	for _, f := range c.gcPolicies {
+		lines = append(lines, fmt.Sprintf("Set the GC policy of column family %s.", f))
+	}
+	if c.setAnalyzer {
+		lines = append(lines, fmt.Sprintf("Set the analyzer to %s.", c.analyzer))
+	} else {
+		lines = append(lines, fmt.Sprintf("The table uses analyzer %s.", c.analyzer))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// bootstrap creates the table and its column families if they don't exist,
+// and sets the GC policies of the families that don't have the right one.
+// It doesn't change existing data, so it is safe to call at any time.
+//
+// A table that doesn't name its analyzer is set to use a, or, if it already
+// has documents, the analyzer they were indexed with. The analyzer of a table
+// is changed by reindex.
+func bootstrap(ctx context.Context, adminClient *bigtable.AdminClient, client *bigtable.Client, name string, a *analyzer) (*schemaChanges, error) {
+	changes := &schemaChanges{}
+	tables, err := adminClient.Tables(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !contains(tables, name) {
+		if err := adminClient.CreateTable(ctx, name); err != nil {
+			return nil, fmt.Errorf("creating table %s: %v", name, err)
+		}
+		changes.createdTable = true
+	}
+
+	info, err := adminClient.TableInfo(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	policies := make(map[string]string)
+	for _, f := range info.FamilyInfos {
+		policies[f.Name] = f.GCPolicy
+	}
+	for _, f := range columnFamilies {
+		policy, ok := policies[f.name]
+		if !ok {
+			if err := adminClient.CreateColumnFamily(ctx, name, f.name); err != nil {
+				return nil, fmt.Errorf("creating column family %s: %v", f.name, err)
+			}
+			changes.createdFamilies = append(changes.createdFamilies, f.name)
+		}
+		if policy != f.policy.String() {
+			if err := adminClient.SetGCPolicy(ctx, name, f.name, f.policy); err != nil {
+				return nil, fmt.Errorf("setting the GC policy of column family %s: %v", f.name, err)
+			}
+			changes.gcPolicies = append(changes.gcPolicies, f.name)
+		}
+	}
+
+	table := client.Open(name)
+	current, err := tableAnalyzer(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+	if current != "" {
+		changes.analyzer = current
+		return changes, nil
+	}
+	empty, err := isEmpty(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+	if !empty {
+		// The documents were indexed before analyzers could be chosen.
+		a = analyzers[defaultAnalyzer]
+	}
+	if err := writeAnalyzer(ctx, table, a); err != nil {
+		return nil, err
+	}
+	changes.analyzer, changes.setAnalyzer = a.name, true
+	return changes, nil
+}
+
+// tableAnalyzer returns the name of the analyzer of table, or "" if it
+// doesn't name one.
+func tableAnalyzer(ctx context.Context, table *bigtable.Table) (string, error) {
+	row, err := table.ReadRow(ctx, metaRow, bigtable.RowFilter(bigtable.ChainFilters(
+		bigtable.ColumnFilter(regexp.QuoteMeta(analyzerColumn)), bigtable.LatestNFilter(1))))
+	if err != nil {
+		return "", err
+	}
+	for _, item := range row[indexColumnFamily] {
+		return string(item.Value), nil
+	}
+	return "", nil
+}
+
+// isEmpty reports whether table has no documents.
+func isEmpty(ctx context.Context, table *bigtable.Table) (bool, error) {
+	empty := true
+	err := table.ReadRows(ctx, bigtable.InfiniteRange(""), func(bigtable.Row) bool {
+		empty = false
+		return false
+	}, bigtable.RowFilter(bigtable.ChainFilters(
+		bigtable.FamilyFilter(contentColumnFamily), bigtable.StripValueFilter())), bigtable.LimitRows(1))
+	return empty, err
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// reindexBatchSize is the number of rows written at once by reindex.
+const reindexBatchSize = 500
+
+// reindex rebuilds the index of table from its documents, analyzed by a,
+// which becomes the analyzer of the table. The index is rebuilt in place:
+// the new entries are written next to the old ones, the table then switches
+// to a, and the old entries are deleted, so that searches find the documents
+// throughout. Documents changed while the new entries are written are indexed
+// with the previous analyzer, so writes should be paused until reindex
+// returns. It returns the number of documents indexed.
+func reindex(ctx context.Context, table *bigtable.Table, a *analyzer) (int64, error) {
+	// New index entries are written at start, and older ones are deleted.
+	// Bigtable keeps timestamps to the millisecond, so start is the
+	// millisecond after any entry written so far.
+	start := bigtable.Now().TruncateToMilliseconds() + 1000
+	// putDoc may write a document ahead of the clock. The entries of such
+	// documents are written a millisecond after their content instead, and
+	// the older ones deleted up to then.
+	ahead := make(map[string]bigtable.Timestamp)
+	end := start
+
+	var s corpusStats
+	b := &rowBatcher{table: table, size: reindexBatchSize}
+	err := b.readRows(ctx, func(row bigtable.Row) {
+		c := row[contentColumnFamily]
+		if len(c) == 0 {
+			return
+		}
+		ts := start
+		if contentTS := c[0].Timestamp.TruncateToMilliseconds(); contentTS >= start {
+			ts = contentTS + 1000
+			ahead[row.Key()] = ts
+			if ts > end {
+				end = ts
+			}
+		}
+		tokens := a.analyzeDoc(string(c[0].Value))
+		s.docs++
+		s.words += int64(docLength(tokens))
+		for word, p := range postings(tokens) {
+			b.mutation(word).Set(indexColumnFamily, row.Key(), ts, encodePosting(p))
+		}
+	}, bigtable.ChainFilters(bigtable.FamilyFilter(contentColumnFamily), bigtable.LatestNFilter(1)))
+	if err != nil {
+		return 0, err
+	}
+
+	// Queries are analyzed with a from now on, and only find the new
+	// entries.
+	if err := writeAnalyzer(ctx, table, a); err != nil {
+		return 0, err
+	}
+
+	// Delete the index entries written before the new ones.
+	err = b.readRows(ctx, func(row bigtable.Row) {
+		if row.Key() == metaRow {
+			return
+		}
+		deleted := make(map[string]bool)
+		for _, item := range row[indexColumnFamily] {
+			column := item.Column[len(indexColumnFamily)+1:]
+			ts, ok := ahead[column]
+			if !ok {
+				ts = start
+			}
+			if item.Timestamp >= ts || deleted[column] {
+				continue
+			}
+			deleted[column] = true
+			b.mutation(row.Key()).DeleteTimestampRange(indexColumnFamily, column, 0, ts)
+		}
+	}, bigtable.ChainFilters(
+		bigtable.FamilyFilter(indexColumnFamily),
+		bigtable.TimestampRangeFilterMicros(0, end),
+		bigtable.StripValueFilter()))
+	if err != nil {
+		return 0, err
+	}
+	return s.docs, writeStats(ctx, table, s)
+}
+
+// rowBatcher gathers mutations of rows, and applies them in batches.
+type rowBatcher struct {
+	table *bigtable.Table
+	size  int // the number of rows in a batch.
+	rows  []string
+	muts  map[string]*bigtable.Mutation
+}
+
+// mutation returns the mutation of row in the current batch.
+func (b *rowBatcher) mutation(row string) *bigtable.Mutation {
+	if b.muts == nil {
+		b.muts = make(map[string]*bigtable.Mutation)
+	}
+	mut, ok := b.muts[row]
+	if !ok {
+		mut = bigtable.NewMutation()
+		b.muts[row] = mut
+		b.rows = append(b.rows, row)
+	}
+	return mut
+}
+
+// flush applies the mutations of the current batch.
+func (b *rowBatcher) flush(ctx context.Context) error {
+	muts := make([]*bigtable.Mutation, len(b.rows))
+	for i, row := range b.rows {
+		muts[i] = b.muts[row]
+	}
+	err := applyBulk(ctx, b.table, b.rows, muts)
+	b.rows, b.muts = nil, nil
+	return err
+}
+
+// readRows calls f for each row of the table matching filter, applying the
+// mutations f adds whenever a batch is full, and once all rows are read.
+func (b *rowBatcher) readRows(ctx context.Context, f func(bigtable.Row), filter bigtable.Filter) error {
+	var writeErr error
+	err := b.table.ReadRows(ctx, bigtable.InfiniteRange(""), func(row bigtable.Row) bool {
+		f(row)
+		if len(b.rows) >= b.size {
+			writeErr = b.flush(ctx)
+		}
+		return writeErr == nil
+	}, bigtable.RowFilter(filter))
+	if err == nil {
+		err = writeErr
+	}
+	if err == nil {
+		err = b.flush(ctx)
+	}
+	return err
+}
+
+// requireAdmin returns a handler that calls h for POST requests with the
+// admin token in their Authorization header, as a bearer token. All requests
+// are refused if token is empty.
+func requireAdmin(token string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			http.Error(w, "Admin endpoints are disabled: no admin token is set.", http.StatusForbidden)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		const prefix = "Bearer "
+		if !strings.HasPrefix(auth, prefix) || subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="search admin"`)
+			http.Error(w, "Missing or wrong admin token.", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != "POST" {
+			http.Error(w, "POST requests only", http.StatusMethodNotAllowed)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// handleBootstrap creates the table and its column families if they don't
+// exist. The analyzer of a new table is given by the "analyzer" parameter, or
+// analyzerName.
+func handleBootstrap(w http.ResponseWriter, r *http.Request, table string, adminClient *bigtable.AdminClient, client *bigtable.Client, analyzerName string) {
+	if name := r.FormValue("analyzer"); name != "" {
+		analyzerName = name
+	}
+	a, err := lookupAnalyzer(analyzerName)
+	if err != nil {
+		http.Error(w, "Unknown analyzer: "+analyzerName, http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	changes, err := bootstrap(ctx, adminClient, client, table, a)
+	if err != nil {
+		http.Error(w, "Error initializing the table: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, changes)
+}
+
+// handleReindex rebuilds the index of the table. The "analyzer" parameter
+// changes the analyzer of the table.
+func handleReindex(w http.ResponseWriter, r *http.Request, table *bigtable.Table) {
+	// Large tables take long to reindex, so reindexing has no deadline.
+	ctx := context.Background()
+	_, a, err := readMeta(ctx, table)
+	if err != nil {
+		http.Error(w, "Error reading from Bigtable: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if name := r.FormValue("analyzer"); name != "" {
+		if a, err = lookupAnalyzer(name); err != nil {
+			http.Error(w, "Unknown analyzer: "+name, http.StatusBadRequest)
+			return
+		}
+	}
+	docs, err := reindex(ctx, table, a)
+	if err != nil {
+		log.Printf("Reindexing: %v", err)
+		http.Error(w, "Error rebuilding the index: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "Indexed %d documents with analyzer %s.\n", docs, a.name)
+}
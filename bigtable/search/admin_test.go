@@ -0,0 +1,170 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+
+	"cloud.google.com/go/bigtable"
+	"golang.org/x/net/context"
+)
+
+func TestBootstrap(t *testing.T) {
+	ctx := context.Background()
+	client, adminClient := newTestClients(t)
+
+	changes, err := bootstrap(ctx, adminClient, client, testTable, analyzers["english"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &schemaChanges{
+		createdTable:    true,
+		createdFamilies: []string{indexColumnFamily, contentColumnFamily},
+		gcPolicies:      []string{indexColumnFamily, contentColumnFamily},
+		analyzer:        "english",
+		setAnalyzer:     true,
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("bootstrapping a new table: got %+v, want %+v", changes, want)
+	}
+
+	// Bootstrapping again changes nothing.
+	if _, err := putDoc(ctx, client.Open(testTable), "doc", "Bigtable scales"); err != nil {
+		t.Fatal(err)
+	}
+	changes, err = bootstrap(ctx, adminClient, client, testTable, analyzers["ngram"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (&schemaChanges{analyzer: "english"}); !reflect.DeepEqual(changes, want) {
+		t.Errorf("bootstrapping again: got %+v, want %+v", changes, want)
+	}
+
+	// GC policies are set back.
+	if err := adminClient.SetGCPolicy(ctx, testTable, contentColumnFamily, bigtable.MaxVersionsPolicy(5)); err != nil {
+		t.Fatal(err)
+	}
+	changes, err = bootstrap(ctx, adminClient, client, testTable, analyzers["english"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{contentColumnFamily}; !reflect.DeepEqual(changes.gcPolicies, want) {
+		t.Errorf("bootstrapping after changing a GC policy: set %q, want %q", changes.gcPolicies, want)
+	}
+	if names := searchNames(t, client.Open(testTable), "scaling"); len(names) != 1 {
+		t.Errorf("search after bootstrapping = %q, want the document", names)
+	}
+}
+
+func TestBootstrapExistingTable(t *testing.T) {
+	ctx := context.Background()
+	client, adminClient := newTestClients(t)
+
+	// A table created before analyzers, without an index.
+	if err := adminClient.CreateTable(ctx, testTable); err != nil {
+		t.Fatal(err)
+	}
+	if err := adminClient.CreateColumnFamily(ctx, testTable, contentColumnFamily); err != nil {
+		t.Fatal(err)
+	}
+	mut := bigtable.NewMutation()
+	mut.Set(contentColumnFamily, "", bigtable.Now(), []byte("Indexing documents"))
+	if err := client.Open(testTable).Apply(ctx, "doc", mut); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := bootstrap(ctx, adminClient, client, testTable, analyzers["english"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(changes.gcPolicies)
+	want := &schemaChanges{
+		createdFamilies: []string{indexColumnFamily},
+		gcPolicies:      []string{contentColumnFamily, indexColumnFamily},
+		analyzer:        defaultAnalyzer,
+		setAnalyzer:     true,
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("got %+v, want %+v", changes, want)
+	}
+}
+
+func TestReindex(t *testing.T) {
+	ctx := context.Background()
+	table := newTestTable(t, "english")
+	putDocs(t, table, map[string]string{
+		"bigtable":  "Bigtable scales",
+		"datastore": "Datastore scales",
+	})
+	// An index entry of a document that doesn't exist.
+	mut := bigtable.NewMutation()
+	mut.Set(indexColumnFamily, "gone", bigtable.Now(), nil)
+	if err := table.Apply(ctx, "scale", mut); err != nil {
+		t.Fatal(err)
+	}
+
+	docs, err := reindex(ctx, table, analyzers["english"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if docs != 2 {
+		t.Errorf("reindex indexed %d documents, want 2", docs)
+	}
+	got := indexedDocs(t, table, "scale")
+	sort.Strings(got)
+	if want := []string{"bigtable", "datastore"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("documents containing scale = %q, want %q", got, want)
+	}
+
+	// Reindexing with another analyzer changes the words searched for.
+	if got := searchNames(t, table, "big"); len(got) != 0 {
+		t.Errorf("search for big = %q, want nothing", got)
+	}
+	if _, err := reindex(ctx, table, analyzers["english_prefix"]); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := searchNames(t, table, "big"), []string{"bigtable"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("search for big = %q, want %q", got, want)
+	}
+	stats, a, err := readMeta(ctx, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.name != "english_prefix" || stats != (corpusStats{docs: 2, words: 4}) {
+		t.Errorf("after reindexing, analyzer = %s and stats = %+v; want english_prefix, 2 documents of 4 words", a.name, stats)
+	}
+	if got := indexedDocs(t, table, "bi"); !reflect.DeepEqual(got, []string{"bigtable"}) {
+		t.Errorf("documents containing bi = %q, want the bigtable document", got)
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) }
+	for _, tc := range []struct {
+		token, method, auth string
+		want                int
+	}{
+		{"secret", "POST", "Bearer secret", http.StatusOK},
+		{"secret", "POST", "", http.StatusUnauthorized},
+		{"secret", "POST", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "POST", "secret", http.StatusUnauthorized},
+		{"secret", "GET", "Bearer secret", http.StatusMethodNotAllowed},
+		{"", "POST", "Bearer ", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest(tc.method, "/admin/reindex", nil)
+		if tc.auth != "" {
+			r.Header.Set("Authorization", tc.auth)
+		}
+		w := httptest.NewRecorder()
+		requireAdmin(tc.token, ok)(w, r)
+		if w.Code != tc.want {
+			t.Errorf("token %q, %s with Authorization %q: got status %d, want %d", tc.token, tc.method, tc.auth, w.Code, tc.want)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// token is a word in a text, and where it is.
+type token struct {
+	term       string // the word, as indexed.
+	pos        int    // the position of the word among the words of the text.
+	start, end int    // the byte offsets of the word in the text.
+}
+
+// An analyzer turns text into the tokens that are indexed, or searched for.
+// Char filters rewrite the text, a tokenizer splits it into tokens, and token
+// filters change, remove or add tokens.
+//
+// Documents and queries are analyzed by the same analyzer, except for its
+// index filters, which only apply to documents. They add tokens at the same
+// position as existing ones, such as the prefixes of words.
+type analyzer struct {
+	name         string
+	charFilters  []charFilter
+	tokenizer    tokenizer
+	filters      []tokenFilter
+	indexFilters []tokenFilter
+}
+
+// A charFilter rewrites text before it is tokenized. It must not move the
+// characters it keeps, so that tokens point at the original text: characters
+// are removed by replacing them with spaces.
+type charFilter func(text string) string
+
+// A tokenizer splits text into tokens.
+type tokenizer func(text string) []token
+
+// A tokenFilter changes, removes or adds tokens. Tokens at the same position
+// are alternatives for the same word.
+type tokenFilter func(tokens []token) []token
+
+// analyzers are the analyzers that tables can use. The analyzer of a table
+// is chosen when the table is initialized.
+var analyzers = map[string]*analyzer{
+	// simple is the analyzer of tables initialized before analyzers could
+	// be chosen: words are runs of letters.
+	"simple": {
+		tokenizer: letterTokenizer,
+		filters:   []tokenFilter{lowercaseFilter},
+	},
+	"standard": {
+		charFilters: []charFilter{htmlStripFilter},
+		tokenizer:   standardTokenizer,
+		filters:     []tokenFilter{lowercaseFilter, asciiFoldingFilter},
+	},
+	// english finds the different forms of words, such as "index" and
+	// "indexing", and ignores common words.
+	"english": {
+		charFilters: []charFilter{htmlStripFilter},
+		tokenizer:   standardTokenizer,
+		filters:     []tokenFilter{lowercaseFilter, asciiFoldingFilter, stopFilter(englishStopWords), stemFilter},
+	},
+	// english_prefix also matches words starting with the words searched
+	// for, such as "big" for "bigtable".
+	"english_prefix": {
+		charFilters:  []charFilter{htmlStripFilter},
+		tokenizer:    standardTokenizer,
+		filters:      []tokenFilter{lowercaseFilter, asciiFoldingFilter, stopFilter(englishStopWords), stemFilter},
+		indexFilters: []tokenFilter{edgeNGramFilter(2, 15)},
+	},
+	// ngram also matches words containing the words searched for, if they
+	// have 3 to 5 letters, such as "table" for "bigtable".
+	"ngram": {
+		charFilters:  []charFilter{htmlStripFilter},
+		tokenizer:    standardTokenizer,
+		filters:      []tokenFilter{lowercaseFilter, asciiFoldingFilter},
+		indexFilters: []tokenFilter{nGramFilter(3, 5)},
+	},
+}
+
+// defaultAnalyzer is the analyzer of tables that don't name one.
+const defaultAnalyzer = "simple"
+
+func init() {
+	for name, a := range analyzers {
+		a.name = name
+	}
+}
+
+// lookupAnalyzer returns the analyzer with the given name.
+func lookupAnalyzer(name string) (*analyzer, error) {
+	a, ok := analyzers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown analyzer %q", name)
+	}
+	return a, nil
+}
+
+// analyzerNames returns the names of the analyzers, sorted.
+func analyzerNames() []string {
+	var names []string
+	for name := range analyzers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// analyze returns the tokens of a query.
+func (a *analyzer) analyze(text string) []token {
+	for _, f := range a.charFilters {
+		text = f(text)
+	}
+	tokens := a.tokenizer(text)
+	for _, f := range a.filters {
+		tokens = f(tokens)
+	}
+	return tokens
+}
+
+// analyzeDoc returns the tokens of a document, as indexed.
+func (a *analyzer) analyzeDoc(text string) []token {
+	tokens := a.analyze(text)
+	for _, f := range a.indexFilters {
+		tokens = f(tokens)
+	}
+	return tokens
+}
+
+// docLength returns the number of words in tokens, counting the tokens at
+// the same position once.
+func docLength(tokens []token) int {
+	if len(tokens) == 0 {
+		return 0
+	}
+	return tokens[len(tokens)-1].pos + 1
+}
+
+// htmlStripFilter blanks out HTML tags and character references, so that
+// the words of markup aren't indexed.
+func htmlStripFilter(text string) string {
+	if !strings.ContainsAny(text, "<&") {
+		return text
+	}
+	b := []byte(text)
+	for i := 0; i < len(b); i++ {
+		var end int // the offset of the end of the markup from i.
+		switch b[i] {
+		case '<':
+			if end = strings.IndexByte(text[i:], '>'); end < 0 {
+				continue
+			}
+		case '&':
+			end = strings.IndexByte(text[i:], ';')
+			if end < 2 || end > 10 || strings.ContainsAny(text[i+1:i+end], " \t\n<&") {
+				continue
+			}
+		default:
+			continue
+		}
+		for j := i; j <= i+end; j++ {
+			b[j] = ' '
+		}
+		i += end
+	}
+	return string(b)
+}
+
+// letterTokenizer splits text into runs of letters.
+func letterTokenizer(text string) []token {
+	return splitTokens(text, unicode.IsLetter, nil)
+}
+
+// standardTokenizer splits text into runs of letters and digits. Chinese,
+// Japanese and Korean characters, which aren't separated by spaces, are
+// tokens by themselves: words made of several of them are found with phrase
+// queries.
+func standardTokenizer(text string) []token {
+	isWord := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsNumber(r) }
+	return splitTokens(text, isWord, isCJK)
+}
+
+// isCJK reports whether r is written without spaces between words.
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// splitTokens splits text into runs of the runes for which inWord is true.
+// Runes for which single is true are tokens by themselves.
+func splitTokens(text string, inWord, single func(rune) bool) []token {
+	var tokens []token
+	add := func(start, end int) {
+		tokens = append(tokens, token{term: text[start:end], pos: len(tokens), start: start, end: end})
+	}
+	start := -1
+	for i, r := range text {
+		switch {
+		case single != nil && single(r):
+			if start >= 0 {
+				add(start, i)
+				start = -1
+			}
+			add(i, i+len(string(r)))
+		case inWord(r):
+			if start < 0 {
+				start = i
+			}
+		case start >= 0:
+			add(start, i)
+			start = -1
+		}
+	}
+	if start >= 0 {
+		add(start, len(text))
+	}
+	return tokens
+}
+
+// mapTerms returns a filter that replaces the term of each token by f(term).
+// Tokens whose term becomes empty are removed.
+func mapTerms(f func(string) string) tokenFilter {
+	return func(tokens []token) []token {
+		out := tokens[:0]
+		for _, t := range tokens {
+			if t.term = f(t.term); t.term != "" {
+				out = append(out, t)
+			}
+		}
+		return renumber(out)
+	}
+}
+
+var lowercaseFilter = mapTerms(strings.ToLower)
+
+// asciiFoldingFilter replaces accented Latin letters by their unaccented
+// ASCII equivalents, so that "café" matches "cafe".
+var asciiFoldingFilter = mapTerms(func(term string) string {
+	return strings.Map(func(r rune) rune {
+		if folded, ok := asciiFolds[r]; ok {
+			return folded
+		}
+		return r
+	}, ligatures.Replace(term))
+})
+
+var asciiFolds = make(map[rune]rune)
+
+func init() {
+	for ascii, accented := range map[rune]string{
+		'a': "àáâãäåāăą", 'c': "çćĉċč", 'd': "ďđð", 'e': "èéêëēĕėęě",
+		'g': "ĝğġģ", 'h': "ĥħ", 'i': "ìíîïĩīĭįı", 'j': "ĵ", 'k': "ķ",
+		'l': "ĺļľŀł", 'n': "ñńņňŉ", 'o': "òóôõöøōŏő", 'r': "ŕŗř",
+		's': "śŝşš", 't': "ţťŧ", 'u': "ùúûüũūŭůűų", 'w': "ŵ", 'y': "ýÿŷ",
+		'z': "źżž",
+	} {
+		for _, r := range accented {
+			asciiFolds[r] = ascii
+			asciiFolds[unicode.ToUpper(r)] = unicode.ToUpper(ascii)
+		}
+	}
+}
+
+var ligatures = strings.NewReplacer("æ", "ae", "Æ", "AE", "œ", "oe", "Œ", "OE", "ß", "ss", "þ", "th", "Þ", "TH")
+
+// englishStopWords are common English words, which aren't worth indexing.
+var englishStopWords = []string{
+	"a", "an", "and", "are", "as", "at", "be", "but", "by", "for", "if", "in",
+	"into", "is", "it", "no", "not", "of", "on", "or", "such", "that", "the",
+	"their", "then", "there", "these", "they", "this", "to", "was", "will",
+	"with",
+}
+
+// stopFilter returns a filter that removes the given words. The positions of
+// the remaining tokens are renumbered, so that phrases still match across
+// the removed words.
+func stopFilter(words []string) tokenFilter {
+	stop := make(map[string]bool)
+	for _, w := range words {
+		stop[w] = true
+	}
+	return mapTerms(func(term string) string {
+		if stop[term] {
+			return ""
+		}
+		return term
+	})
+}
+
+// stemFilter reduces English words to their stem, such as "index" for
+// "indexing" and "indexes".
+var stemFilter = mapTerms(porterStem)
+
+// edgeNGramFilter returns a filter that adds the prefixes of each token with
+// min to max letters.
+func edgeNGramFilter(min, max int) tokenFilter {
+	return func(tokens []token) []token {
+		var out []token
+		for _, t := range tokens {
+			out = append(out, t)
+			runes := []rune(t.term)
+			for n := min; n <= max && n < len(runes); n++ {
+				gram := t
+				gram.term = string(runes[:n])
+				out = append(out, gram)
+			}
+		}
+		return out
+	}
+}
+
+// nGramFilter returns a filter that adds the substrings of each token with
+// min to max letters.
+func nGramFilter(min, max int) tokenFilter {
+	return func(tokens []token) []token {
+		var out []token
+		for _, t := range tokens {
+			out = append(out, t)
+			runes := []rune(t.term)
+			seen := map[string]bool{t.term: true}
+			for n := min; n <= max && n < len(runes); n++ {
+				for i := 0; i+n <= len(runes); i++ {
+					gram := t
+					gram.term = string(runes[i : i+n])
+					if !seen[gram.term] {
+						seen[gram.term] = true
+						out = append(out, gram)
+					}
+				}
+			}
+		}
+		return out
+	}
+}
+
+// renumber makes the positions of tokens consecutive, keeping tokens at the
+// same position together.
+func renumber(tokens []token) []token {
+	pos, last := -1, -1
+	for i := range tokens {
+		if tokens[i].pos != last || pos < 0 {
+			pos++
+		}
+		last = tokens[i].pos
+		tokens[i].pos = pos
+	}
+	return tokens
+}
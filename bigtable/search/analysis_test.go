@@ -0,0 +1,192 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// terms returns the terms of tokens.
+func terms(tokens []token) []string {
+	var terms []string
+	for _, t := range tokens {
+		terms = append(terms, t.term)
+	}
+	return terms
+}
+
+func TestAnalyzers(t *testing.T) {
+	for _, tc := range []struct {
+		analyzer, in string
+		want         []string
+	}{
+		{"simple", "Cloud Bigtable, e-mail 2018", []string{"cloud", "bigtable", "e", "mail"}},
+		{"standard", "<p>Café &amp; crème brûlée, 2018</p>", []string{"cafe", "creme", "brulee", "2018"}},
+		{"standard", "Bigtable表格", []string{"bigtable", "表", "格"}},
+		{"english", "The indexing of indexes", []string{"index", "index"}},
+		{"english", "Relational databases are generalizations", []string{"relat", "databas", "gener"}},
+		{"ngram", "Bigtable", []string{"bigtable"}},
+	} {
+		a, err := lookupAnalyzer(tc.analyzer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := terms(a.analyze(tc.in)); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s analyzer: analyze(%q) = %q, want %q", tc.analyzer, tc.in, got, tc.want)
+		}
+	}
+
+	if _, err := lookupAnalyzer("klingon"); err == nil {
+		t.Error("lookupAnalyzer of an unknown analyzer: got no error")
+	}
+}
+
+func TestTokenOffsets(t *testing.T) {
+	got := analyzers["simple"].analyze("Hello, Wörld!")
+	want := []token{{"hello", 0, 0, 5}, {"wörld", 1, 7, 13}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// Markup is removed without moving the words after it.
+	got = analyzers["english"].analyze("<b>Café</b> &amp; crème")
+	want = []token{{"cafe", 0, 3, 8}, {"creme", 1, 19, 25}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestHTMLStripFilter(t *testing.T) {
+	for in, want := range map[string]string{
+		"no markup":              "no markup",
+		"a<b>c</b>d":             "a   c    d",
+		"fish &amp; chips":       "fish       chips",
+		"1 < 2 & 3 > 2":          "1           2",
+		"AT&T; R&D":              "AT    R&D",
+		"unclosed <tag":          "unclosed <tag",
+		"&notanentitybecauseit;": "&notanentitybecauseit;",
+	} {
+		if got := htmlStripFilter(in); got != want {
+			t.Errorf("htmlStripFilter(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestStopFilter(t *testing.T) {
+	got := stopFilter([]string{"the", "of"})(letterTokenizer("state of the art"))
+	want := []token{{"state", 0, 0, 5}, {"art", 1, 13, 16}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestNGramFilters(t *testing.T) {
+	tokens := []token{{"table", 0, 3, 8}}
+	got := edgeNGramFilter(2, 4)(tokens)
+	if want := []string{"table", "ta", "tab", "tabl"}; !reflect.DeepEqual(terms(got), want) {
+		t.Errorf("edge n-grams = %q, want %q", terms(got), want)
+	}
+	for _, tok := range got {
+		if tok.pos != 0 || tok.start != 3 || tok.end != 8 {
+			t.Errorf("n-gram %+v isn't where its word is", tok)
+		}
+	}
+
+	got = nGramFilter(3, 4)([]token{{"aaaa", 0, 0, 4}})
+	if want := []string{"aaaa", "aaa"}; !reflect.DeepEqual(terms(got), want) {
+		t.Errorf("n-grams = %q, want %q", terms(got), want)
+	}
+	if n := docLength(got); n != 1 {
+		t.Errorf("docLength of n-grams = %d, want 1", n)
+	}
+}
+
+// TestAnalyzedSearch checks that documents are found by queries analyzed by
+// the same analyzer.
+func TestAnalyzedSearch(t *testing.T) {
+	for _, tc := range []struct {
+		analyzer, doc, query string
+		want                 bool
+	}{
+		{"simple", "Indexing documents", "index", false},
+		{"english", "Indexing documents", "index", true},
+		{"english", "Indexing documents", `"indexes document"`, true},
+		{"english", "The state of the art", `"state of the art"`, true},
+		{"english", "The state of art", `"art state"`, false},
+		{"english", "Café crème", "cafe", true},
+		{"english", "Bigtable", "big", false},
+		{"english_prefix", "Bigtable", "big", true},
+		{"english_prefix", "Bigtable", "table", false},
+		{"ngram", "Bigtable", "table", true},
+		{"ngram", "Bigtable stores rows", `"table stores"`, true},
+	} {
+		a := analyzers[tc.analyzer]
+		q, err := parseQuery(tc.query, a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := q.matches(postings(a.analyzeDoc(tc.doc))); got != tc.want {
+			t.Errorf("%s analyzer: query %q matches %q = %v, want %v", tc.analyzer, tc.query, tc.doc, got, tc.want)
+		}
+	}
+}
+
+func TestSnippetNGrams(t *testing.T) {
+	got := snippet("Cloud Bigtable", map[string]bool{"table": true, "tab": true}, analyzers["ngram"])
+	want := []snippetPart{{"Cloud ", false}, {"Bigtable", true}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestPorterStem(t *testing.T) {
+	for in, want := range map[string]string{
+		"caresses":        "caress",
+		"ponies":          "poni",
+		"ties":            "ti",
+		"caress":          "caress",
+		"cats":            "cat",
+		"feed":            "feed",
+		"agreed":          "agre",
+		"plastered":       "plaster",
+		"bled":            "bled",
+		"motoring":        "motor",
+		"sing":            "sing",
+		"conflated":       "conflat",
+		"troubled":        "troubl",
+		"sized":           "size",
+		"hopping":         "hop",
+		"falling":         "fall",
+		"hissing":         "hiss",
+		"filing":          "file",
+		"happy":           "happi",
+		"sky":             "sky",
+		"relational":      "relat",
+		"conditional":     "condit",
+		"valenci":         "valenc",
+		"digitizer":       "digit",
+		"generalizations": "gener",
+		"triplicate":      "triplic",
+		"hopeful":         "hope",
+		"goodness":        "good",
+		"revival":         "reviv",
+		"allowance":       "allow",
+		"adjustment":      "adjust",
+		"adoption":        "adopt",
+		"decision":        "decis",
+		"controll":        "control",
+		"roll":            "roll",
+		"probate":         "probat",
+		"rate":            "rate",
+		"as":              "as",
+		"café":            "café",
+		"mp3":             "mp3",
+	} {
+		if got := porterStem(in); got != want {
+			t.Errorf("porterStem(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
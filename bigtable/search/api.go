@@ -0,0 +1,216 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"golang.org/x/net/context"
+)
+
+// The JSON API:
+//
+//	GET    /api/search?q=...&rank=...&page=...&pageSize=...
+//	GET    /api/docs/{name}
+//	PUT    /api/docs/{name}    with a body of {"content": "..."}
+//	DELETE /api/docs/{name}
+//
+// Errors are reported as {"error": "..."}.
+
+const (
+	apiDocsPath = "/api/docs/"
+
+	// defaultPageSize and maxPageSize are the default and largest numbers of
+	// results returned by /api/search.
+	defaultPageSize = 10
+	maxPageSize     = 100
+
+	// maxPage is the last page of results that can be requested.
+	maxPage = 1000
+
+	// maxDocSize is the largest request body accepted by PUT /api/docs.
+	maxDocSize = 1 << 20
+)
+
+// apiSearchResponse is the response to /api/search.
+type apiSearchResponse struct {
+	Query    string `json:"query"`
+	Total    int    `json:"total"`
+	Page     int    `json:"page"`
+	PageSize int    `json:"pageSize"`
+	NextPage int    `json:"nextPage,omitempty"`
+	Results  []hit  `json:"results"`
+}
+
+// apiDoc is a document, as sent and returned by /api/docs.
+type apiDoc struct {
+	Name    string `json:"name"`
+	Content string `json:"content"`
+}
+
+// handleAPISearch responds to search queries with the matching documents, as
+// JSON, a page at a time.
+func handleAPISearch(w http.ResponseWriter, r *http.Request, table *bigtable.Table) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeJSONError(w, http.StatusMethodNotAllowed, "GET requests only")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	query := r.FormValue("q")
+	rankFn, err := lookupRanking(r.FormValue("rank"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	page, err := intParam(r, "page", 1, 1, maxPage)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	pageSize, err := intParam(r, "pageSize", defaultPageSize, 1, maxPageSize)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	results, err := searchDocs(ctx, table, query, rankFn, (page-1)*pageSize, pageSize)
+	if err == errEmptyQuery {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "error reading index: "+err.Error())
+		return
+	}
+	resp := apiSearchResponse{
+		Query:    query,
+		Total:    results.Total,
+		Page:     page,
+		PageSize: pageSize,
+		Results:  results.Hits,
+	}
+	if page*pageSize < results.Total {
+		resp.NextPage = page + 1
+	}
+	if resp.Results == nil {
+		resp.Results = []hit{}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// intParam returns the value of an integer query parameter, or def if it's
+// missing. The value must be from min to max.
+func intParam(r *http.Request, name string, def, min, max int) (int, error) {
+	s := r.FormValue(name)
+	if s == "" {
+		return def, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < min || v > max {
+		return 0, fmt.Errorf("%s must be a number from %d to %d", name, min, max)
+	}
+	return v, nil
+}
+
+// handleAPIDoc gets, adds, replaces or deletes the document named by the
+// path, which starts with apiDocsPath.
+func handleAPIDoc(w http.ResponseWriter, r *http.Request, table *bigtable.Table) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	name := strings.TrimPrefix(r.URL.Path, apiDocsPath)
+	if err := checkDocName(name); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		content, err := readContent(ctx, table, name)
+		if err == errDocNotFound {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "error reading from Bigtable: "+err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, apiDoc{name, content})
+
+	case "PUT":
+		var doc apiDoc
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxDocSize)).Decode(&doc); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "could not decode document: "+err.Error())
+			return
+		}
+		created, err := putDoc(ctx, table, name, doc.Content)
+		if err == errEmptyContent {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err == errDocBusy {
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "error writing to Bigtable: "+err.Error())
+			return
+		}
+		code := http.StatusOK
+		if created {
+			code = http.StatusCreated
+		}
+		writeJSON(w, code, apiDoc{name, doc.Content})
+
+	case "DELETE":
+		err := deleteDoc(ctx, table, name)
+		if err == errDocNotFound {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if err == errDocBusy {
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "error writing to Bigtable: "+err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		writeJSONError(w, http.StatusMethodNotAllowed, "GET, PUT and DELETE requests only")
+	}
+}
+
+// writeJSON responds with v encoded as JSON.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "Error encoding response: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+// writeJSONError responds with an error message, as {"error": message}.
+func writeJSONError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, struct {
+		Error string `json:"error"`
+	}{message})
+}
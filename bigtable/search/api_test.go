@@ -0,0 +1,325 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/bigtable"
+	"cloud.google.com/go/bigtable/bttest"
+	"golang.org/x/net/context"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+const testTable = "docindex"
+
+// newTestClients returns clients of a new Bigtable emulator.
+func newTestClients(t *testing.T) (*bigtable.Client, *bigtable.AdminClient) {
+	ctx := context.Background()
+	srv, err := bttest.NewServer("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminClient, err := bigtable.NewAdminClient(ctx, "project", "instance", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := bigtable.NewClient(ctx, "project", "instance", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, adminClient
+}
+
+// createTestTable creates a table initialized to use the given analyzer.
+func createTestTable(t *testing.T, client *bigtable.Client, adminClient *bigtable.AdminClient, name, analyzer string) *bigtable.Table {
+	ctx := context.Background()
+	if err := adminClient.CreateTable(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range []string{indexColumnFamily, contentColumnFamily} {
+		if err := adminClient.CreateColumnFamily(ctx, name, family); err != nil {
+			t.Fatal(err)
+		}
+	}
+	table := client.Open(name)
+	if err := writeAnalyzer(ctx, table, analyzers[analyzer]); err != nil {
+		t.Fatal(err)
+	}
+	return table
+}
+
+// newTestTable returns a table of a new Bigtable emulator, initialized to use
+// the given analyzer.
+func newTestTable(t *testing.T, analyzer string) *bigtable.Table {
+	client, adminClient := newTestClients(t)
+	return createTestTable(t, client, adminClient, testTable, analyzer)
+}
+
+// apiRequest sends a request to the JSON API, decoding the response into v if
+// it isn't nil, and returns the status code of the response.
+func apiRequest(t *testing.T, table *bigtable.Table, method, target, body string, v interface{}) int {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	if strings.HasPrefix(target, apiDocsPath) {
+		handleAPIDoc(w, r, table)
+	} else {
+		handleAPISearch(w, r, table)
+	}
+	if ct := w.Header().Get("Content-Type"); w.Code != http.StatusNoContent && !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("%s %s: Content-Type = %q, want JSON", method, target, ct)
+	}
+	if v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: decoding %q: %v", method, target, w.Body, err)
+		}
+	}
+	return w.Code
+}
+
+// putDocs adds documents through the JSON API.
+func putDocs(t *testing.T, table *bigtable.Table, docs map[string]string) {
+	for name, content := range docs {
+		body, _ := json.Marshal(apiDoc{Content: content})
+		if code := apiRequest(t, table, "PUT", apiDocsPath+name, string(body), nil); code != http.StatusCreated {
+			t.Fatalf("PUT %s: got status %d, want %d", name, code, http.StatusCreated)
+		}
+	}
+}
+
+// searchNames returns the names of the documents found by a search through
+// the JSON API.
+func searchNames(t *testing.T, table *bigtable.Table, query string) []string {
+	var resp apiSearchResponse
+	if code := apiRequest(t, table, "GET", "/api/search?q="+url.QueryEscape(query), "", &resp); code != http.StatusOK {
+		t.Fatalf("search %q: got status %d", query, code)
+	}
+	var names []string
+	for _, h := range resp.Results {
+		names = append(names, h.Name)
+	}
+	return names
+}
+
+// indexedDocs returns the documents in the index row of a word, reading the
+// latest entries like searches do.
+func indexedDocs(t *testing.T, table *bigtable.Table, word string) []string {
+	row, err := table.ReadRow(context.Background(), word, bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var docs []string
+	for _, item := range row[indexColumnFamily] {
+		docs = append(docs, strings.TrimPrefix(item.Column, indexColumnFamily+":"))
+	}
+	return docs
+}
+
+func TestAPISearch(t *testing.T) {
+	table := newTestTable(t, "english")
+	putDocs(t, table, map[string]string{
+		"short":    "Bigtable scales.",
+		"long":     "Bigtable is a database, and this document says a lot about many other things.",
+		"repeated": "Bigtable, Bigtable and more Bigtable.",
+		"other":    "Datastore scales.",
+	})
+
+	var resp apiSearchResponse
+	if code := apiRequest(t, table, "GET", "/api/search?q=bigtable&pageSize=2", "", &resp); code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", code, http.StatusOK)
+	}
+	if resp.Total != 3 || resp.Page != 1 || resp.PageSize != 2 || resp.NextPage != 2 || len(resp.Results) != 2 {
+		t.Fatalf("first page = %+v, want 2 of 3 results and a next page", resp)
+	}
+	if resp.Results[0].Name != "repeated" || resp.Results[1].Name != "short" {
+		t.Errorf("first page = %+v, want repeated, then short", resp.Results)
+	}
+	if resp.Results[0].Score <= resp.Results[1].Score {
+		t.Errorf("scores of first page = %v, %v; want descending", resp.Results[0].Score, resp.Results[1].Score)
+	}
+	want := []snippetPart{{"Bigtable", true}, {" scales.", false}}
+	if !reflect.DeepEqual(resp.Results[1].Snippet, want) {
+		t.Errorf("snippet = %+v, want %+v", resp.Results[1].Snippet, want)
+	}
+
+	resp = apiSearchResponse{}
+	apiRequest(t, table, "GET", "/api/search?q=bigtable&pageSize=2&page=2", "", &resp)
+	if len(resp.Results) != 1 || resp.Results[0].Name != "long" || resp.NextPage != 0 {
+		t.Errorf("second page = %+v, want the long document and no next page", resp)
+	}
+
+	resp = apiSearchResponse{}
+	apiRequest(t, table, "GET", "/api/search?q=bigtable&page=5", "", &resp)
+	if resp.Total != 3 || resp.Results == nil || len(resp.Results) != 0 {
+		t.Errorf("page after the last = %+v, want no results", resp)
+	}
+
+	if got, want := searchNames(t, table, "scaling -datastore"), []string{"short"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("search for scaling -datastore = %q, want %q", got, want)
+	}
+
+	for _, target := range []string{
+		"/api/search?q=",
+		"/api/search?q=the",
+		"/api/search?q=bigtable&rank=pagerank",
+		"/api/search?q=bigtable&page=0",
+		"/api/search?q=bigtable&pageSize=1000",
+		"/api/search?q=bigtable&page=x",
+	} {
+		var e struct{ Error string }
+		if code := apiRequest(t, table, "GET", target, "", &e); code != http.StatusBadRequest || e.Error == "" {
+			t.Errorf("GET %s: got status %d and error %q, want %d and an error", target, code, e.Error, http.StatusBadRequest)
+		}
+	}
+	if code := apiRequest(t, table, "POST", "/api/search?q=bigtable", "", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /api/search: got status %d, want %d", code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestAPIPutReplacesDocument(t *testing.T) {
+	table := newTestTable(t, "english")
+	putDocs(t, table, map[string]string{
+		"doc":   "Bigtable and Datastore",
+		"other": "Datastore",
+	})
+
+	body := `{"content": "Bigtable and Spanner"}`
+	var doc apiDoc
+	if code := apiRequest(t, table, "PUT", apiDocsPath+"doc", body, &doc); code != http.StatusOK {
+		t.Errorf("replacing a document: got status %d, want %d", code, http.StatusOK)
+	}
+	if doc.Name != "doc" || doc.Content != "Bigtable and Spanner" {
+		t.Errorf("replacing a document: got %+v", doc)
+	}
+
+	// The document is only in the index rows of the words it contains.
+	if got, want := indexedDocs(t, table, "datastor"), []string{"other"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("documents containing datastore = %q, want %q", got, want)
+	}
+	if got, want := searchNames(t, table, "datastore"), []string{"other"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("search for datastore = %q, want %q", got, want)
+	}
+	if got, want := searchNames(t, table, "spanner"), []string{"doc"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("search for spanner = %q, want %q", got, want)
+	}
+
+	doc = apiDoc{}
+	if code := apiRequest(t, table, "GET", apiDocsPath+"doc", "", &doc); code != http.StatusOK || doc.Content != "Bigtable and Spanner" {
+		t.Errorf("GET the replaced document: got status %d and %+v", code, doc)
+	}
+
+	stats, _, err := readMeta(context.Background(), table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (corpusStats{docs: 2, words: 3}); stats != want {
+		t.Errorf("stats = %+v, want %+v", stats, want)
+	}
+
+	for _, tc := range []struct {
+		target, body string
+		want         int
+	}{
+		{apiDocsPath + "doc", `{"content": ""}`, http.StatusBadRequest},
+		{apiDocsPath + "doc", `not json`, http.StatusBadRequest},
+		{apiDocsPath, `{"content": "text"}`, http.StatusBadRequest},
+		{apiDocsPath + url.PathEscape(metaRow), `{"content": "text"}`, http.StatusBadRequest},
+	} {
+		if code := apiRequest(t, table, "PUT", tc.target, tc.body, nil); code != tc.want {
+			t.Errorf("PUT %s %s: got status %d, want %d", tc.target, tc.body, code, tc.want)
+		}
+	}
+}
+
+func TestPutDocConcurrently(t *testing.T) {
+	ctx := context.Background()
+	table := newTestTable(t, "simple")
+	// Each writer gives way to each of the others at most once, so none
+	// gives up.
+	words := []string{"apple", "banana", "cherry", "damson", "elder"}[:maxDocAttempts]
+
+	var wg sync.WaitGroup
+	for _, w := range words {
+		wg.Add(1)
+		go func(w string) {
+			defer wg.Done()
+			if _, err := putDoc(ctx, table, "doc", w+" shared"); err != nil {
+				t.Errorf("putDoc(%q): %v", w, err)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// Whichever content was written last, the index and the statistics
+	// agree with it.
+	content, err := readContent(ctx, table, "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range append(words, "shared") {
+		var want []string
+		if strings.Contains(content, w) {
+			want = []string{"doc"}
+		}
+		if got := indexedDocs(t, table, w); !reflect.DeepEqual(got, want) {
+			t.Errorf("with content %q, documents containing %s = %q, want %q", content, w, got, want)
+		}
+	}
+	stats, _, err := readMeta(ctx, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (corpusStats{docs: 1, words: 2}); stats != want {
+		t.Errorf("stats = %+v, want %+v", stats, want)
+	}
+}
+
+func TestAPIDelete(t *testing.T) {
+	table := newTestTable(t, "english")
+	putDocs(t, table, map[string]string{
+		"scale": "Bigtable scales",
+		"other": "Datastore scales",
+	})
+
+	// The document's row is also the index row of the word "scale".
+	if code := apiRequest(t, table, "DELETE", apiDocsPath+"scale", "", nil); code != http.StatusNoContent {
+		t.Fatalf("DELETE: got status %d, want %d", code, http.StatusNoContent)
+	}
+	if code := apiRequest(t, table, "GET", apiDocsPath+"scale", "", nil); code != http.StatusNotFound {
+		t.Errorf("GET a deleted document: got status %d, want %d", code, http.StatusNotFound)
+	}
+	if code := apiRequest(t, table, "DELETE", apiDocsPath+"scale", "", nil); code != http.StatusNotFound {
+		t.Errorf("DELETE a deleted document: got status %d, want %d", code, http.StatusNotFound)
+	}
+	if got := indexedDocs(t, table, "bigtabl"); len(got) != 0 {
+		t.Errorf("documents containing bigtable = %q, want none", got)
+	}
+	if got, want := indexedDocs(t, table, "scale"), []string{"other"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("documents containing scale = %q, want %q", got, want)
+	}
+	if got, want := searchNames(t, table, "scales"), []string{"other"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("search for scales = %q, want %q", got, want)
+	}
+
+	stats, _, err := readMeta(context.Background(), table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (corpusStats{docs: 1, words: 2}); stats != want {
+		t.Errorf("stats = %+v, want %+v", stats, want)
+	}
+}
@@ -0,0 +1,331 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"golang.org/x/net/context"
+)
+
+// A table is copied by splitting its rows into shards, at the row keys
+// sampled by Bigtable, which are copied in parallel by a pool of workers.
+// Each worker scans a shard in order, and writes its rows in batches.
+//
+// After each batch, the next row key to copy in the shard is saved in a
+// checkpoint, in column "i:copy:<source table>" of the meta row of the
+// destination table, so that a copy that failed resumes where it stopped.
+// The checkpoint is removed when the copy is done.
+
+const (
+	// copyWorkers is the number of shards copied at the same time.
+	copyWorkers = 8
+
+	// copyBatchSize is the number of rows written at once.
+	copyBatchSize = 500
+
+	// copyBatchTimeout limits the time to write a batch.
+	copyBatchTimeout = time.Minute
+
+	checkpointColumnPrefix = "copy:"
+)
+
+// copyShard is a range of rows to copy.
+type copyShard struct {
+	Start string `json:"start"` // the first row key of the shard.
+	End   string `json:"end"`   // the row key after the shard, or "" for the end of the table.
+	Next  string `json:"next"`  // the row key to resume copying from.
+	Done  bool   `json:"done"`
+}
+
+// rowRange returns the rows of the shard left to copy.
+func (s copyShard) rowRange() bigtable.RowRange {
+	if s.End == "" {
+		return bigtable.InfiniteRange(s.Next)
+	}
+	return bigtable.NewRange(s.Next, s.End)
+}
+
+// copyCheckpoint records the progress of a copy.
+type copyCheckpoint struct {
+	Shards []copyShard `json:"shards"`
+	Rows   int64       `json:"rows"` // the number of rows copied.
+}
+
+// copyProgress is reported after each batch of rows is copied.
+type copyProgress struct {
+	Rows       int64 // the number of rows copied, including before resuming.
+	Shards     int   // the number of shards.
+	ShardsDone int   // the number of shards copied.
+	Resumed    bool  // whether the copy resumed from a checkpoint.
+}
+
+// copier copies the documents and index of a table to another.
+type copier struct {
+	src, dst  *bigtable.Table
+	srcName   string
+	workers   int
+	batchSize int
+	progress  func(copyProgress) // if not nil, called after each batch.
+
+	mu      sync.Mutex // protects cp
+	cp      copyCheckpoint
+	resumed bool
+}
+
+// copyTable copies the documents and index of table src to table dst,
+// resuming a previous copy that failed. Both tables must use the same
+// analyzer. If progress isn't nil, it is called after each batch of rows,
+// one call at a time.
+func copyTable(ctx context.Context, src, dst string, client *bigtable.Client, progress func(copyProgress)) error {
+	if src == "" || src == dst {
+		return nil
+	}
+	c := &copier{
+		src:       client.Open(src),
+		dst:       client.Open(dst),
+		srcName:   src,
+		workers:   copyWorkers,
+		batchSize: copyBatchSize,
+		progress:  progress,
+	}
+	return c.run(ctx)
+}
+
+// run copies the table.
+func (c *copier) run(ctx context.Context) error {
+	// The index of the source table is only valid in the destination table
+	// if the documents of both are analyzed the same way.
+	_, srcAnalyzer, err := readMeta(ctx, c.src)
+	if err != nil {
+		return err
+	}
+	_, dstAnalyzer, err := readMeta(ctx, c.dst)
+	if err != nil {
+		return err
+	}
+	if srcAnalyzer != dstAnalyzer {
+		return fmt.Errorf("table %s uses analyzer %s, but the destination table uses %s", c.srcName, srcAnalyzer.name, dstAnalyzer.name)
+	}
+
+	cp, err := c.loadCheckpoint(ctx)
+	if err != nil {
+		return err
+	}
+	if cp != nil {
+		c.cp, c.resumed = *cp, true
+	} else {
+		shards, err := planShards(ctx, c.src)
+		if err != nil {
+			return err
+		}
+		c.cp = copyCheckpoint{Shards: shards}
+		if err := c.saveCheckpoint(ctx); err != nil {
+			return err
+		}
+	}
+
+	// Copy the shards left to copy, stopping the other workers when one
+	// fails.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	shards := make(chan int)
+	errc := make(chan error, len(c.cp.Shards))
+	var wg sync.WaitGroup
+	for i := 0; i < c.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range shards {
+				if err := c.copyShard(ctx, i); err != nil {
+					errc <- err
+					cancel()
+				}
+			}
+		}()
+	}
+feed:
+	for i, s := range c.cp.Shards {
+		if s.Done {
+			continue
+		}
+		select {
+		case shards <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(shards)
+	wg.Wait()
+	close(errc)
+	if err := <-errc; err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := recomputeStats(ctx, c.dst, dstAnalyzer); err != nil {
+		return err
+	}
+	return c.clearCheckpoint(ctx)
+}
+
+// planShards splits the rows of table at the row keys sampled by Bigtable.
+func planShards(ctx context.Context, table *bigtable.Table) ([]copyShard, error) {
+	keys, err := table.SampleRowKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	var shards []copyShard
+	start := ""
+	for _, key := range keys {
+		if key == start {
+			// Skip duplicates, and the empty key marking the end of the
+			// table.
+			continue
+		}
+		shards = append(shards, copyShard{Start: start, End: key, Next: start})
+		start = key
+	}
+	return append(shards, copyShard{Start: start, Next: start}), nil
+}
+
+// copyShard copies the rows of shard i, from where it was left.
+func (c *copier) copyShard(ctx context.Context, i int) error {
+	c.mu.Lock()
+	shard := c.cp.Shards[i]
+	c.mu.Unlock()
+
+	var (
+		rows     []string
+		muts     []*bigtable.Mutation
+		writeErr error
+	)
+	flush := func() error {
+		if len(rows) == 0 {
+			return nil
+		}
+		bctx, cancel := context.WithTimeout(ctx, copyBatchTimeout)
+		defer cancel()
+		if err := applyBulk(bctx, c.dst, rows, muts); err != nil {
+			return err
+		}
+		// Resume after the last row written.
+		next := rows[len(rows)-1] + "\x00"
+		n := int64(len(rows))
+		rows, muts = rows[:0], muts[:0]
+		return c.checkpoint(ctx, i, next, false, n)
+	}
+
+	// Only copy the latest version of the columns of the documents and
+	// index.
+	filter := bigtable.ChainFilters(
+		bigtable.FamilyFilter(indexColumnFamily+"|"+contentColumnFamily),
+		bigtable.LatestNFilter(1))
+	err := c.src.ReadRows(ctx, shard.rowRange(), func(row bigtable.Row) bool {
+		if row.Key() == metaRow {
+			// The statistics are recomputed once the documents are copied.
+			return true
+		}
+		mut := bigtable.NewMutation()
+		for family, items := range row {
+			for _, item := range items {
+				// Get the column name, excluding the column family name and ':' character.
+				columnWithoutFamily := item.Column[len(family)+1:]
+				mut.Set(family, columnWithoutFamily, item.Timestamp, item.Value)
+			}
+		}
+		rows, muts = append(rows, row.Key()), append(muts, mut)
+		if len(rows) >= c.batchSize {
+			writeErr = flush()
+		}
+		return writeErr == nil
+	}, bigtable.RowFilter(filter))
+	if err == nil {
+		err = writeErr
+	}
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return err
+	}
+	return c.checkpoint(ctx, i, shard.End, true, 0)
+}
+
+// checkpoint records the progress of shard i, and reports the progress of
+// the copy.
+func (c *copier) checkpoint(ctx context.Context, i int, next string, done bool, rows int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cp.Shards[i].Next = next
+	c.cp.Shards[i].Done = done
+	c.cp.Rows += rows
+	if err := c.saveCheckpointLocked(ctx); err != nil {
+		return err
+	}
+	if c.progress != nil {
+		p := copyProgress{Rows: c.cp.Rows, Shards: len(c.cp.Shards), Resumed: c.resumed}
+		for _, s := range c.cp.Shards {
+			if s.Done {
+				p.ShardsDone++
+			}
+		}
+		c.progress(p)
+	}
+	return nil
+}
+
+func (c *copier) checkpointColumn() string {
+	return checkpointColumnPrefix + c.srcName
+}
+
+// loadCheckpoint returns the checkpoint of a previous copy from the same
+// table, or nil.
+func (c *copier) loadCheckpoint(ctx context.Context) (*copyCheckpoint, error) {
+	row, err := c.dst.ReadRow(ctx, metaRow, bigtable.RowFilter(bigtable.ChainFilters(
+		bigtable.ColumnFilter(regexp.QuoteMeta(c.checkpointColumn())), bigtable.LatestNFilter(1))))
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range row[indexColumnFamily] {
+		var cp copyCheckpoint
+		if err := json.Unmarshal(item.Value, &cp); err != nil {
+			return nil, fmt.Errorf("reading the checkpoint of the copy from %s: %v", c.srcName, err)
+		}
+		return &cp, nil
+	}
+	return nil, nil
+}
+
+func (c *copier) saveCheckpoint(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.saveCheckpointLocked(ctx)
+}
+
+func (c *copier) saveCheckpointLocked(ctx context.Context) error {
+	b, err := json.Marshal(c.cp)
+	if err != nil {
+		return err
+	}
+	mut := bigtable.NewMutation()
+	mut.Set(indexColumnFamily, c.checkpointColumn(), bigtable.Now(), b)
+	return c.dst.Apply(ctx, metaRow, mut)
+}
+
+func (c *copier) clearCheckpoint(ctx context.Context) error {
+	mut := bigtable.NewMutation()
+	mut.DeleteCellsInColumn(indexColumnFamily, c.checkpointColumn())
+	return c.dst.Apply(ctx, metaRow, mut)
+}
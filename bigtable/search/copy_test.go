@@ -0,0 +1,159 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/bigtable"
+	"golang.org/x/net/context"
+)
+
+// newCopyTest returns a source table with documents, and an empty destination
+// table, both using the given analyzers.
+func newCopyTest(t *testing.T, srcAnalyzer, dstAnalyzer string) (src, dst *bigtable.Table) {
+	client, adminClient := newTestClients(t)
+	src = createTestTable(t, client, adminClient, "src", srcAnalyzer)
+	dst = createTestTable(t, client, adminClient, "dst", dstAnalyzer)
+	ctx := context.Background()
+	for i := 0; i < 40; i++ {
+		content := fmt.Sprintf("Document %d is about Bigtable, and the number %d.", i, i)
+		if _, err := putDoc(ctx, src, fmt.Sprintf("doc%02d", i), content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return src, dst
+}
+
+// newTestCopier returns a copier of small batches from src to dst.
+func newTestCopier(src, dst *bigtable.Table, progress func(copyProgress)) *copier {
+	return &copier{src: src, dst: dst, srcName: "src", workers: 3, batchSize: 4, progress: progress}
+}
+
+// readAll returns the values of the cells of the documents and index in
+// table, by row key and column.
+func readAll(t *testing.T, table *bigtable.Table) map[string]map[string]string {
+	rows := make(map[string]map[string]string)
+	err := table.ReadRows(context.Background(), bigtable.InfiniteRange(""), func(row bigtable.Row) bool {
+		if row.Key() == metaRow {
+			return true
+		}
+		rows[row.Key()] = make(map[string]string)
+		for _, items := range row {
+			for _, item := range items {
+				rows[row.Key()][item.Column] = string(item.Value)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+// checkCopy checks that dst is a complete copy of src.
+func checkCopy(t *testing.T, src, dst *bigtable.Table) {
+	ctx := context.Background()
+	want := readAll(t, src)
+	if got := readAll(t, dst); !reflect.DeepEqual(got, want) {
+		t.Errorf("copied %d rows, want %d", len(got), len(want))
+	}
+	srcStats, _, err := readMeta(ctx, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstStats, _, err := readMeta(ctx, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dstStats != srcStats {
+		t.Errorf("statistics of the copy = %+v, want %+v", dstStats, srcStats)
+	}
+	c := newTestCopier(src, dst, nil)
+	if cp, err := c.loadCheckpoint(ctx); err != nil || cp != nil {
+		t.Errorf("checkpoint after the copy = %+v, %v; want none", cp, err)
+	}
+}
+
+func TestCopyTable(t *testing.T) {
+	src, dst := newCopyTest(t, "english", "english")
+	var last copyProgress
+	c := newTestCopier(src, dst, func(p copyProgress) {
+		if p.Rows < last.Rows || p.ShardsDone < last.ShardsDone {
+			t.Errorf("progress went from %+v to %+v", last, p)
+		}
+		last = p
+	})
+	if err := c.run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkCopy(t, src, dst)
+
+	if rows := int64(len(readAll(t, src))); last.Rows != rows || last.ShardsDone != last.Shards || last.Shards < 2 || last.Resumed {
+		t.Errorf("last progress = %+v, want %d rows in several shards, all done", last, rows)
+	}
+}
+
+func TestCopyTableResumes(t *testing.T) {
+	src, dst := newCopyTest(t, "english", "english")
+
+	// Fail the copy after its first batch.
+	ctx, cancel := context.WithCancel(context.Background())
+	var failed copyProgress
+	c := newTestCopier(src, dst, func(p copyProgress) {
+		failed = p
+		cancel()
+	})
+	if err := c.run(ctx); err == nil {
+		t.Fatal("copy didn't fail")
+	}
+	if failed.Rows == 0 {
+		t.Fatal("no rows were copied before the copy failed")
+	}
+	if cp, err := c.loadCheckpoint(context.Background()); err != nil || cp == nil || cp.Rows != failed.Rows {
+		t.Fatalf("checkpoint after failing = %+v, %v; want %d rows copied", cp, err, failed.Rows)
+	}
+
+	var last copyProgress
+	c = newTestCopier(src, dst, func(p copyProgress) { last = p })
+	if err := c.run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkCopy(t, src, dst)
+
+	// Rows copied before failing aren't copied again.
+	if rows := int64(len(readAll(t, src))); !last.Resumed || last.Rows != rows {
+		t.Errorf("last progress = %+v, want a resumed copy of %d rows", last, rows)
+	}
+}
+
+func TestCopyTableAnalyzers(t *testing.T) {
+	src, dst := newCopyTest(t, "english", "simple")
+	if err := newTestCopier(src, dst, nil).run(context.Background()); err == nil {
+		t.Error("copying between tables with different analyzers: got no error")
+	}
+}
+
+func TestPlanShards(t *testing.T) {
+	src, _ := newCopyTest(t, "english", "english")
+	shards, err := planShards(context.Background(), src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shards) < 2 || shards[0].Start != "" || shards[len(shards)-1].End != "" {
+		t.Fatalf("shards = %+v, want several covering the whole table", shards)
+	}
+	for i, s := range shards {
+		if s.Next != s.Start || s.Done {
+			t.Errorf("shard %d = %+v, want it to start at the beginning", i, s)
+		}
+		if i > 0 && s.Start != shards[i-1].End {
+			t.Errorf("shard %d starts at %q, want %q", i, s.Start, shards[i-1].End)
+		}
+	}
+}
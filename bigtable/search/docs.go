@@ -0,0 +1,317 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"cloud.google.com/go/bigtable"
+	"golang.org/x/net/context"
+)
+
+var (
+	errDocNotFound  = errors.New("document not found")
+	errEmptyName    = errors.New("empty document name")
+	errReservedName = errors.New("reserved document name")
+	errEmptyContent = errors.New("empty document content")
+	errDocBusy      = errors.New("document is being changed by others; try again")
+)
+
+// maxDocAttempts is how many times putDoc and deleteDoc try to change a
+// document that others keep changing at the same time.
+const maxDocAttempts = 5
+
+// checkDocName returns an error if documents can't be called name.
+func checkDocName(name string) error {
+	switch name {
+	case "":
+		return errEmptyName
+	case metaRow:
+		return errReservedName
+	}
+	return nil
+}
+
+// readContent returns the content of a document, or errDocNotFound.
+func readContent(ctx context.Context, table *bigtable.Table, name string) (string, error) {
+	content, _, err := readDoc(ctx, table, name)
+	return content, err
+}
+
+// readDoc returns the content of a document and the time it was written, or
+// errDocNotFound.
+func readDoc(ctx context.Context, table *bigtable.Table, name string) (string, bigtable.Timestamp, error) {
+	row, err := table.ReadRow(ctx, name, bigtable.RowFilter(bigtable.ChainFilters(
+		bigtable.FamilyFilter(contentColumnFamily), bigtable.LatestNFilter(1))))
+	if err != nil {
+		return "", 0, err
+	}
+	c := row[contentColumnFamily]
+	if len(c) == 0 {
+		return "", 0, errDocNotFound
+	}
+	return string(c[0].Value), c[0].Timestamp, nil
+}
+
+// applyIfUnchanged applies mut to the row of a document, unless its content
+// was changed since readDoc returned it. The content was written at ts, or
+// the document didn't exist if found is false. It reports whether mut was
+// applied.
+func applyIfUnchanged(ctx context.Context, table *bigtable.Table, name string, found bool, ts bigtable.Timestamp, mut *bigtable.Mutation) (bool, error) {
+	var cond *bigtable.Mutation
+	if found {
+		// The latest content must still be the one written at ts. Bigtable
+		// keeps timestamps to the millisecond.
+		ts = ts.TruncateToMilliseconds()
+		cond = bigtable.NewCondMutation(bigtable.ChainFilters(
+			bigtable.FamilyFilter(contentColumnFamily),
+			bigtable.LatestNFilter(1),
+			bigtable.TimestampRangeFilterMicros(ts, ts+1000)), mut, nil)
+	} else {
+		// There must still be no content. The row may be the index row of a
+		// word, so only the content family is checked.
+		cond = bigtable.NewCondMutation(bigtable.FamilyFilter(contentColumnFamily), nil, mut)
+	}
+	var matched bool
+	if err := table.Apply(ctx, name, cond, bigtable.GetCondMutationResult(&matched)); err != nil {
+		return false, err
+	}
+	return matched == found, nil
+}
+
+// deletePostings removes a document from the index rows of words, deleting
+// its entries written up to the millisecond of ts. Entries written later
+// belong to later changes of the document, and are kept.
+func deletePostings(ctx context.Context, table *bigtable.Table, name string, words map[string]posting, ts bigtable.Timestamp) error {
+	var rows []string
+	var muts []*bigtable.Mutation
+	for word := range words {
+		mut := bigtable.NewMutation()
+		mut.DeleteTimestampRange(indexColumnFamily, name, 0, ts.TruncateToMilliseconds()+1000)
+		rows, muts = append(rows, word), append(muts, mut)
+	}
+	return applyBulk(ctx, table, rows, muts)
+}
+
+// putDoc adds a document to table, or replaces it, reporting whether it was
+// added. The document is removed from the index rows of the words it no
+// longer contains.
+//
+// The document is written to the index rows of its words first, and then
+// its content is written only if nobody changed it meanwhile; otherwise
+// putDoc starts again. Once the content is written, the document is removed
+// from the rows of the words it no longer contains. So the statistics count
+// each change once, and the index agrees with the last content written. If
+// putDoc gives up with errDocBusy, its words may be left in the index.
+func putDoc(ctx context.Context, table *bigtable.Table, name, content string) (created bool, err error) {
+	if err := checkDocName(name); err != nil {
+		return false, err
+	}
+	if content == "" {
+		return false, errEmptyContent
+	}
+	_, a, err := readMeta(ctx, table)
+	if err != nil {
+		return false, err
+	}
+	tokens := a.analyzeDoc(content)
+	newPostings := postings(tokens)
+
+	for attempt := 0; attempt < maxDocAttempts; attempt++ {
+		old, oldTS, err := readDoc(ctx, table, name)
+		created = err == errDocNotFound
+		if err != nil && !created {
+			return false, err
+		}
+
+		// Write the document in the index row of each of its words. The
+		// content is written later than the one it replaces, even if the
+		// clocks disagree.
+		var rows []string
+		var muts []*bigtable.Mutation
+		ts := bigtable.Now().TruncateToMilliseconds()
+		if !created && ts <= oldTS {
+			ts = oldTS.TruncateToMilliseconds() + 1000
+		}
+		for word, p := range newPostings {
+			mut := bigtable.NewMutation()
+			mut.Set(indexColumnFamily, name, ts, encodePosting(p))
+			rows, muts = append(rows, word), append(muts, mut)
+		}
+		if err := applyBulk(ctx, table, rows, muts); err != nil {
+			return false, err
+		}
+
+		mut := bigtable.NewMutation()
+		mut.Set(contentColumnFamily, "", ts, []byte(content))
+		applied, err := applyIfUnchanged(ctx, table, name, !created, oldTS, mut)
+		if err != nil {
+			return false, err
+		}
+		if !applied {
+			continue
+		}
+
+		if created {
+			return true, updateStats(ctx, table, 1, int64(docLength(tokens)))
+		}
+		// Remove the document from the rows of the words it no longer
+		// contains.
+		oldTokens := a.analyzeDoc(old)
+		stale := postings(oldTokens)
+		for word := range newPostings {
+			delete(stale, word)
+		}
+		if err := deletePostings(ctx, table, name, stale, oldTS); err != nil {
+			return false, err
+		}
+		return false, updateStats(ctx, table, 0, int64(docLength(tokens)-docLength(oldTokens)))
+	}
+	return false, errDocBusy
+}
+
+// deleteDoc removes a document from table and from the index, or returns
+// errDocNotFound. Like putDoc, it only deletes the content if nobody changed
+// it meanwhile, and then deletes the index entries up to the time of the
+// deleted content.
+func deleteDoc(ctx context.Context, table *bigtable.Table, name string) error {
+	if err := checkDocName(name); err != nil {
+		return err
+	}
+	_, a, err := readMeta(ctx, table)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; attempt < maxDocAttempts; attempt++ {
+		content, contentTS, err := readDoc(ctx, table, name)
+		if err != nil {
+			return err
+		}
+
+		// The row may also be the index row of a word, so only the content
+		// is deleted.
+		mut := bigtable.NewMutation()
+		mut.DeleteCellsInFamily(contentColumnFamily)
+		applied, err := applyIfUnchanged(ctx, table, name, true, contentTS, mut)
+		if err != nil {
+			return err
+		}
+		if !applied {
+			continue
+		}
+
+		tokens := a.analyzeDoc(content)
+		if err := deletePostings(ctx, table, name, postings(tokens), contentTS); err != nil {
+			return err
+		}
+		return updateStats(ctx, table, -1, -int64(docLength(tokens)))
+	}
+	return errDocBusy
+}
+
+// applyBulk applies mutations to rows, returning the first error.
+func applyBulk(ctx context.Context, table *bigtable.Table, rows []string, muts []*bigtable.Mutation) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	errs, err := table.ApplyBulk(ctx, rows, muts)
+	if err != nil {
+		return err
+	}
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("writing row %q: %v", rows[i], err)
+		}
+	}
+	return nil
+}
+
+// hit is a document matching a search.
+type hit struct {
+	Name    string        `json:"name"`
+	Score   float64       `json:"score"`
+	Snippet []snippetPart `json:"snippet"`
+}
+
+// searchResults are a page of the documents matching a search.
+type searchResults struct {
+	Total int   // the number of documents matching the search.
+	Hits  []hit // the documents on the page, best first.
+}
+
+// lookupRanking returns the ranking with the given name, or the default
+// ranking if name is empty.
+func lookupRanking(name string) (ranking, error) {
+	if name == "" {
+		name = defaultRanking
+	}
+	rankFn, ok := rankings[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown ranking %q", name)
+	}
+	return rankFn, nil
+}
+
+// searchDocs returns the documents matching a query, ranked by rankFn,
+// skipping the first offset ones and returning at most limit.
+func searchDocs(ctx context.Context, table *bigtable.Table, query string, rankFn ranking, offset, limit int) (*searchResults, error) {
+	stats, a, err := readMeta(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+	q, err := parseQuery(query, a)
+	if err != nil {
+		return nil, err
+	}
+
+	// For each query word, get the documents containing it.
+	words := q.words()
+	rows, err := readRows(ctx, table, words)
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[string]map[string]posting)
+	for i, row := range rows {
+		index[words[i]] = make(map[string]posting)
+		for _, item := range row[indexColumnFamily] {
+			p, err := decodePosting(item.Value)
+			if err != nil {
+				return nil, err
+			}
+			index[words[i]][item.Column[len(indexColumnFamily+":"):]] = p
+		}
+	}
+
+	// Rank the documents matching the query, and fetch the content of the
+	// ones on the page from the Bigtable.
+	matches := rank(q, index, rankFn, stats)
+	results := &searchResults{Total: len(matches)}
+	if offset >= len(matches) {
+		return results, nil
+	}
+	matches = matches[offset:]
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	names := make([]string, len(matches))
+	for i, m := range matches {
+		names[i] = m.name
+	}
+	content, err := readRows(ctx, table, names)
+	if err != nil {
+		return nil, err
+	}
+	highlighted := q.highlighted()
+	for i, m := range matches {
+		var text string
+		if c := content[i][contentColumnFamily]; len(c) > 0 {
+			text = string(c[0].Value)
+		}
+		results.Hits = append(results.Hits, hit{m.name, m.score, snippet(text, highlighted, a)})
+	}
+	return results, nil
+}
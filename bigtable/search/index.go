@@ -0,0 +1,201 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"cloud.google.com/go/bigtable"
+	"golang.org/x/net/context"
+)
+
+// The table holds both the documents and the index:
+//
+// - The content of a document is in column "c:" of the row named after the
+//   document.
+// - The index has a row for each word, with a column "i:<document name>" for
+//   each document containing the word. The value of the cell is a posting:
+//   the length of the document in words, followed by the positions of the
+//   word in the document, as uvarints. Positions are delta-encoded.
+// - The row metaRow holds statistics about all the documents, used to rank
+//   results: their number, and their total length in words, as 64-bit
+//   big-endian counters in columns "i:docs" and "i:words". Its column
+//   "i:analyzer" names the analyzer of the table.
+
+// metaRow is the key of the row holding the statistics of the table. It
+// can't be a word, as words are made of letters and digits.
+const metaRow = "\x00meta"
+
+const (
+	docsColumn     = "docs"
+	wordsColumn    = "words"
+	analyzerColumn = "analyzer"
+)
+
+// posting is the entry of a document in the index row of a word.
+type posting struct {
+	docLength int   // the number of words in the document.
+	positions []int // the positions of the word in the document, ascending.
+}
+
+// tf returns the number of times the word appears in the document.
+func (p posting) tf() int {
+	if len(p.positions) == 0 {
+		// Documents indexed before positions were kept contain the word
+		// at least once.
+		return 1
+	}
+	return len(p.positions)
+}
+
+// postings returns the posting of each word in tokens.
+func postings(tokens []token) map[string]posting {
+	ps := make(map[string]posting)
+	for _, t := range tokens {
+		p := ps[t.term]
+		p.docLength = docLength(tokens)
+		p.positions = append(p.positions, t.pos)
+		ps[t.term] = p
+	}
+	return ps
+}
+
+func encodePosting(p posting) []byte {
+	b := make([]byte, 0, binary.MaxVarintLen64*(len(p.positions)+1))
+	b = appendUvarint(b, uint64(p.docLength))
+	last := 0
+	for _, pos := range p.positions {
+		b = appendUvarint(b, uint64(pos-last))
+		last = pos
+	}
+	return b
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+var errBadPosting = errors.New("malformed index entry")
+
+func decodePosting(b []byte) (posting, error) {
+	var p posting
+	if len(b) == 0 {
+		return p, nil
+	}
+	v, n := binary.Uvarint(b)
+	if n <= 0 {
+		return p, errBadPosting
+	}
+	p.docLength = int(v)
+	last := 0
+	for b = b[n:]; len(b) > 0; b = b[n:] {
+		v, n = binary.Uvarint(b)
+		if n <= 0 {
+			return p, errBadPosting
+		}
+		last += int(v)
+		p.positions = append(p.positions, last)
+	}
+	return p, nil
+}
+
+// corpusStats are the statistics of the documents in a table.
+type corpusStats struct {
+	docs  int64 // the number of documents.
+	words int64 // the total number of words in the documents.
+}
+
+// avgLength returns the average length of the documents, in words.
+func (s corpusStats) avgLength() float64 {
+	if s.docs <= 0 {
+		return 0
+	}
+	return float64(s.words) / float64(s.docs)
+}
+
+// readMeta reads the statistics of the documents in table, and the analyzer
+// of the table.
+func readMeta(ctx context.Context, table *bigtable.Table) (corpusStats, *analyzer, error) {
+	var s corpusStats
+	row, err := table.ReadRow(ctx, metaRow, bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	if err != nil {
+		return s, nil, err
+	}
+	name := defaultAnalyzer
+	for _, item := range row[indexColumnFamily] {
+		if item.Column == indexColumnFamily+":"+analyzerColumn {
+			name = string(item.Value)
+			continue
+		}
+		if len(item.Value) != 8 {
+			continue
+		}
+		v := int64(binary.BigEndian.Uint64(item.Value))
+		switch item.Column {
+		case indexColumnFamily + ":" + docsColumn:
+			s.docs = v
+		case indexColumnFamily + ":" + wordsColumn:
+			s.words = v
+		}
+	}
+	a, err := lookupAnalyzer(name)
+	return s, a, err
+}
+
+// writeAnalyzer sets the analyzer of table, which analyzes the documents
+// added and the queries from then on. Documents that are already indexed
+// aren't analyzed again: the analyzer of a table with documents is changed by
+// reindex.
+func writeAnalyzer(ctx context.Context, table *bigtable.Table, a *analyzer) error {
+	mut := bigtable.NewMutation()
+	mut.Set(indexColumnFamily, analyzerColumn, bigtable.Now(), []byte(a.name))
+	return table.Apply(ctx, metaRow, mut)
+}
+
+// updateStats adds the given numbers of documents and words to the statistics
+// of table.
+func updateStats(ctx context.Context, table *bigtable.Table, docs, words int64) error {
+	if docs == 0 && words == 0 {
+		return nil
+	}
+	rmw := bigtable.NewReadModifyWrite()
+	rmw.Increment(indexColumnFamily, docsColumn, docs)
+	rmw.Increment(indexColumnFamily, wordsColumn, words)
+	_, err := table.ApplyReadModifyWrite(ctx, metaRow, rmw)
+	return err
+}
+
+// recomputeStats counts the documents in table and their words, as analyzed
+// by a, replacing the statistics of the table.
+func recomputeStats(ctx context.Context, table *bigtable.Table, a *analyzer) error {
+	var s corpusStats
+	err := table.ReadRows(ctx, bigtable.InfiniteRange(""), func(row bigtable.Row) bool {
+		if c := row[contentColumnFamily]; len(c) > 0 {
+			s.docs++
+			s.words += int64(docLength(a.analyzeDoc(string(c[0].Value))))
+		}
+		return true
+	}, bigtable.RowFilter(bigtable.ChainFilters(
+		bigtable.FamilyFilter(contentColumnFamily), bigtable.LatestNFilter(1))))
+	if err != nil {
+		return err
+	}
+	return writeStats(ctx, table, s)
+}
+
+// writeStats replaces the statistics of table.
+func writeStats(ctx context.Context, table *bigtable.Table, s corpusStats) error {
+	counter := func(v int64) []byte {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, uint64(v))
+		return b
+	}
+	mut := bigtable.NewMutation()
+	mut.Set(indexColumnFamily, docsColumn, bigtable.Now(), counter(s.docs))
+	mut.Set(indexColumnFamily, wordsColumn, bigtable.Now(), counter(s.words))
+	return table.Apply(ctx, metaRow, mut)
+}
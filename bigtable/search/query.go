@@ -0,0 +1,405 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// A query matches documents containing all of its words, or phrases in
+// double quotes:
+//
+//	bigtable "column family"     documents containing both
+//	bigtable OR datastore        documents containing either
+//	bigtable NOT hbase           documents containing bigtable, but not hbase
+//	bigtable -hbase              the same
+//
+// OR binds tighter than the implicit AND: "a b OR c" matches documents
+// containing a, and b or c.
+type query struct {
+	// all are the clauses that documents must match. A clause matches if
+	// any of its phrases does.
+	all [][]phrase
+
+	// none are the phrases that documents must not contain.
+	none []phrase
+}
+
+// phrase is a sequence of words that must appear next to each other.
+type phrase []string
+
+var errEmptyQuery = errors.New("empty query")
+
+// parseQuery parses a query typed into the search box. Its words are
+// analyzed by a, as those of the documents were.
+func parseQuery(s string, a *analyzer) (*query, error) {
+	q := &query{}
+	negate, or := false, false
+	for _, item := range splitQuery(s) {
+		if !item.quoted {
+			switch item.text {
+			case "OR":
+				or = true
+				continue
+			case "NOT":
+				negate = true
+				continue
+			}
+			if strings.HasPrefix(item.text, "-") {
+				negate, item.text = true, item.text[1:]
+				if item.text == "" {
+					// A minus before a quoted phrase.
+					continue
+				}
+			}
+		}
+
+		// A word that is analyzed into several words, such as "e-mail", is
+		// a phrase.
+		var p phrase
+		for _, t := range a.analyze(item.text) {
+			p = append(p, t.term)
+		}
+		switch {
+		case len(p) == 0:
+		case negate:
+			q.none = append(q.none, p)
+		case or && len(q.all) > 0:
+			last := len(q.all) - 1
+			q.all[last] = append(q.all[last], p)
+		default:
+			q.all = append(q.all, []phrase{p})
+		}
+		negate, or = false, false
+	}
+	if len(q.all) == 0 {
+		return nil, errEmptyQuery
+	}
+	return q, nil
+}
+
+// queryItem is a word or a quoted phrase of a query.
+type queryItem struct {
+	text   string
+	quoted bool
+}
+
+// splitQuery splits a query into words and quoted phrases. A missing closing
+// quote ends the phrase at the end of the query.
+func splitQuery(s string) []queryItem {
+	var items []queryItem
+	for s = strings.TrimLeftFunc(s, unicode.IsSpace); s != ""; s = strings.TrimLeftFunc(s, unicode.IsSpace) {
+		if s[0] == '"' {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				items = append(items, queryItem{s[1:], true})
+				break
+			}
+			items = append(items, queryItem{s[1 : end+1], true})
+			s = s[end+2:]
+			continue
+		}
+		end := strings.IndexFunc(s, func(r rune) bool { return unicode.IsSpace(r) || r == '"' })
+		if end < 0 {
+			end = len(s)
+		}
+		items = append(items, queryItem{s[:end], false})
+		s = s[end:]
+	}
+	return items
+}
+
+// words returns the distinct words in the query, including those documents
+// must not contain.
+func (q *query) words() []string {
+	seen := make(map[string]bool)
+	var words []string
+	add := func(p phrase) {
+		for _, w := range p {
+			if !seen[w] {
+				seen[w] = true
+				words = append(words, w)
+			}
+		}
+	}
+	for _, clause := range q.all {
+		for _, p := range clause {
+			add(p)
+		}
+	}
+	for _, p := range q.none {
+		add(p)
+	}
+	return words
+}
+
+// highlighted returns the words to highlight in the matching documents.
+func (q *query) highlighted() map[string]bool {
+	words := make(map[string]bool)
+	for _, clause := range q.all {
+		for _, p := range clause {
+			for _, w := range p {
+				words[w] = true
+			}
+		}
+	}
+	return words
+}
+
+// matches reports whether a document matches the query, given the postings
+// of the query's words in the document.
+func (q *query) matches(doc map[string]posting) bool {
+	for _, p := range q.none {
+		if p.in(doc) {
+			return false
+		}
+	}
+	for _, clause := range q.all {
+		matched := false
+		for _, p := range clause {
+			if p.in(doc) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// in reports whether a document contains the phrase, given the postings of
+// its words in the document.
+func (p phrase) in(doc map[string]posting) bool {
+	first, ok := doc[p[0]]
+	if !ok {
+		return false
+	}
+	if len(p) == 1 {
+		return true
+	}
+	// Look for a position of the first word followed by the other words.
+	positions := make([]map[int]bool, len(p))
+	for i, w := range p[1:] {
+		posting, ok := doc[w]
+		if !ok {
+			return false
+		}
+		positions[i+1] = make(map[int]bool)
+		for _, pos := range posting.positions {
+			positions[i+1][pos] = true
+		}
+	}
+	for _, start := range first.positions {
+		i := 1
+		for i < len(p) && positions[i][start+i] {
+			i++
+		}
+		if i == len(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// A ranking scores how relevant a document is to a query word, given the
+// number of times the word is in the document (tf), the number of documents
+// containing the word (df), and the length of the document.
+type ranking func(tf, df, docLength int, stats corpusStats) float64
+
+// rankings are the rankings that can be chosen with the "rank" parameter of
+// a search.
+var rankings = map[string]ranking{
+	"bm25":  bm25,
+	"tfidf": tfidf,
+}
+
+const defaultRanking = "bm25"
+
+// BM25 parameters: k1 limits the weight of repeated words, and b how much
+// long documents are penalized.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// bm25 is the Okapi BM25 ranking function.
+func bm25(tf, df, docLength int, stats corpusStats) float64 {
+	avg := stats.avgLength()
+	if avg == 0 {
+		avg = float64(docLength)
+	}
+	norm := 1.0
+	if avg > 0 {
+		norm = 1 - bm25B + bm25B*float64(docLength)/avg
+	}
+	n := math.Max(float64(stats.docs), float64(df))
+	idf := math.Log(1 + (n-float64(df)+0.5)/(float64(df)+0.5))
+	return idf * float64(tf) * (bm25K1 + 1) / (float64(tf) + bm25K1*norm)
+}
+
+// tfidf weighs the logarithm of the number of times the word is in the
+// document by the inverse document frequency of the word.
+func tfidf(tf, df, docLength int, stats corpusStats) float64 {
+	if tf == 0 || df == 0 {
+		return 0
+	}
+	n := math.Max(float64(stats.docs), float64(df))
+	return (1 + math.Log(float64(tf))) * math.Log(1+n/float64(df))
+}
+
+// scoredDoc is a document matching a query.
+type scoredDoc struct {
+	name  string
+	score float64
+}
+
+// rank returns the documents matching q, best first, given the postings of
+// each of the query's words, by document name.
+func rank(q *query, index map[string]map[string]posting, rankFn ranking, stats corpusStats) []scoredDoc {
+	// Gather the postings of each candidate document.
+	docs := make(map[string]map[string]posting)
+	for word, postings := range index {
+		for doc, p := range postings {
+			if docs[doc] == nil {
+				docs[doc] = make(map[string]posting)
+			}
+			docs[doc][word] = p
+		}
+	}
+
+	highlighted := q.highlighted()
+	var results []scoredDoc
+	for name, doc := range docs {
+		if !q.matches(doc) {
+			continue
+		}
+		var score float64
+		for _, word := range q.words() {
+			if p, ok := doc[word]; ok && highlighted[word] {
+				score += rankFn(p.tf(), len(index[word]), p.docLength, stats)
+			}
+		}
+		results = append(results, scoredDoc{name, score})
+	}
+	sort.Sort(byScore(results))
+	return results
+}
+
+// byScore implements sort.Interface, ordering documents by descending score,
+// then by name.
+type byScore []scoredDoc
+
+func (s byScore) Len() int      { return len(s) }
+func (s byScore) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byScore) Less(i, j int) bool {
+	if s[i].score != s[j].score {
+		return s[i].score > s[j].score
+	}
+	return s[i].name < s[j].name
+}
+
+// snippetPart is a piece of a snippet, which is highlighted if it matches
+// the query.
+type snippetPart struct {
+	Text  string `json:"text"`
+	Match bool   `json:"match"`
+}
+
+// snippetWords is the number of words in a snippet.
+const snippetWords = 30
+
+// snippet returns the part of content with the most words to highlight,
+// with those words highlighted. Content is analyzed by a, as it was when it
+// was indexed.
+func snippet(content string, highlighted map[string]bool, a *analyzer) []snippetPart {
+	// Gather the words of content: tokens at the same position, such as the
+	// prefixes of a word, are the same word.
+	var words []token
+	var match []bool
+	for _, t := range a.analyzeDoc(content) {
+		if len(words) == 0 || t.pos != words[len(words)-1].pos {
+			words = append(words, t)
+			match = append(match, false)
+		}
+		if highlighted[t.term] {
+			match[len(match)-1] = true
+		}
+	}
+	if len(words) == 0 {
+		return nil
+	}
+
+	// Find the window of snippetWords words with the most matches.
+	best, bestCount, count := 0, 0, 0
+	for i := range words {
+		if match[i] {
+			count++
+		}
+		if i >= snippetWords && match[i-snippetWords] {
+			count--
+		}
+		if count > bestCount {
+			best, bestCount = i-snippetWords+1, count
+		}
+	}
+	// Center the window on its matches.
+	if bestCount > 0 {
+		first, last := -1, 0
+		for i := best; i < best+snippetWords && i < len(words); i++ {
+			if i >= 0 && match[i] {
+				if first < 0 {
+					first = i
+				}
+				last = i
+			}
+		}
+		best = (first+last)/2 - snippetWords/2
+	}
+	if best > len(words)-snippetWords {
+		best = len(words) - snippetWords
+	}
+	if best < 0 {
+		best = 0
+	}
+	last := best + snippetWords - 1
+	if last >= len(words) {
+		last = len(words) - 1
+	}
+
+	var parts []snippetPart
+	add := func(text string, match bool) {
+		if text != "" {
+			parts = append(parts, snippetPart{text, match})
+		}
+	}
+	start, end := words[best].start, words[last].end
+	if best > 0 {
+		add("...", false)
+	} else {
+		start = 0
+	}
+	if last == len(words)-1 {
+		end = len(content)
+	}
+	offset := start
+	for i := best; i <= last; i++ {
+		if match[i] {
+			add(content[offset:words[i].start], false)
+			add(content[words[i].start:words[i].end], true)
+			offset = words[i].end
+		}
+	}
+	add(content[offset:end], false)
+	if end < len(content) {
+		add("...", false)
+	}
+	return parts
+}
@@ -0,0 +1,153 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// simple is the analyzer of the tests that don't depend on it.
+var simple = analyzers["simple"]
+
+func TestParseQuery(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want *query
+	}{
+		{"Cloud bigtable", &query{all: [][]phrase{{{"cloud"}}, {{"bigtable"}}}}},
+		{`"column family" gc`, &query{all: [][]phrase{{{"column", "family"}}, {{"gc"}}}}},
+		{"a b OR c", &query{all: [][]phrase{{{"a"}}, {{"b"}, {"c"}}}}},
+		{"a NOT b -c", &query{all: [][]phrase{{{"a"}}}, none: []phrase{{"b"}, {"c"}}}},
+		{`e-mail "unclosed quote`, &query{all: [][]phrase{{{"e", "mail"}}, {{"unclosed", "quote"}}}}},
+		{"OR a", &query{all: [][]phrase{{{"a"}}}}},
+	} {
+		got, err := parseQuery(tc.in, simple)
+		if err != nil {
+			t.Errorf("parseQuery(%q): %v", tc.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseQuery(%q) = %+v, want %+v", tc.in, got, tc.want)
+		}
+	}
+
+	for _, in := range []string{"", "  ", "NOT a", "-a", "..."} {
+		if _, err := parseQuery(in, simple); err != errEmptyQuery {
+			t.Errorf("parseQuery(%q): got %v, want errEmptyQuery", in, err)
+		}
+	}
+}
+
+// docPostings returns the postings of the words of content.
+func docPostings(content string) map[string]posting {
+	return postings(simple.analyzeDoc(content))
+}
+
+func TestQueryMatches(t *testing.T) {
+	doc := docPostings("Bigtable stores column families; a column family groups columns.")
+	for q, want := range map[string]bool{
+		"bigtable":                  true,
+		"bigtable datastore":        false,
+		"bigtable OR datastore":     true,
+		`"column family"`:           true,
+		`"family column"`:           false,
+		`"stores column families"`:  true,
+		"bigtable NOT datastore":    true,
+		"bigtable -columns":         false,
+		`bigtable -"family groups"`: false,
+	} {
+		parsed, err := parseQuery(q, simple)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := parsed.matches(doc); got != want {
+			t.Errorf("query %q matches = %v, want %v", q, got, want)
+		}
+	}
+}
+
+func TestRank(t *testing.T) {
+	docs := map[string]string{
+		"short":    "bigtable scales",
+		"long":     "bigtable is a database, and this document says a lot about many other things too",
+		"repeated": "bigtable bigtable bigtable scales",
+		"other":    "datastore scales",
+	}
+	index := make(map[string]map[string]posting)
+	stats := corpusStats{}
+	for name, content := range docs {
+		tokens := simple.analyzeDoc(content)
+		stats.docs++
+		stats.words += int64(docLength(tokens))
+		for word, p := range postings(tokens) {
+			if index[word] == nil {
+				index[word] = make(map[string]posting)
+			}
+			index[word][name] = p
+		}
+	}
+
+	q, err := parseQuery("bigtable", simple)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := func(rankFn ranking) []string {
+		var names []string
+		for _, d := range rank(q, index, rankFn, stats) {
+			names = append(names, d.name)
+		}
+		return names
+	}
+	// BM25 prefers short documents; TF-IDF ignores the length.
+	if got, want := names(bm25), []string{"repeated", "short", "long"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("bm25: got %v, want %v", got, want)
+	}
+	if got, want := names(tfidf), []string{"repeated", "long", "short"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("tfidf: got %v, want %v", got, want)
+	}
+
+	// Rare words weigh more than common ones.
+	if common, rare := bm25(1, 3, 5, stats), bm25(1, 1, 5, stats); common >= rare {
+		t.Errorf("bm25 of a word in 3 documents = %v, want less than in 1 document (%v)", common, rare)
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	highlighted := map[string]bool{"bigtable": true}
+	got := snippet("Cloud Bigtable is fast.", highlighted, simple)
+	want := []snippetPart{{"Cloud ", false}, {"Bigtable", true}, {" is fast.", false}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// Long documents are cut around the matches.
+	long := "filler words "
+	for i := 0; i < 5; i++ {
+		long += long
+	}
+	got = snippet(long+"about bigtable here "+long, highlighted, simple)
+	if len(got) != 5 || got[0].Text != "..." || !got[2].Match || got[4].Text != "..." {
+		t.Errorf("snippet of a long document = %+v", got)
+	}
+}
+
+func TestPostingEncoding(t *testing.T) {
+	p := posting{docLength: 300, positions: []int{0, 7, 200, 299}}
+	got, err := decodePosting(encodePosting(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, p) {
+		t.Errorf("got %+v, want %+v", got, p)
+	}
+	if _, err := decodePosting([]byte{0x80}); err != errBadPosting {
+		t.Errorf("decoding a truncated posting: got %v, want errBadPosting", err)
+	}
+	// Cells written before postings were stored are empty.
+	if p, err := decodePosting(nil); err != nil || p.tf() != 1 {
+		t.Errorf("empty posting = %+v, %v; want a tf of 1", p, err)
+	}
+}
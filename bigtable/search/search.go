@@ -4,15 +4,28 @@
 
 // Search is a sample web server that uses Cloud Bigtable as the storage layer
 // for a simple document-storage and full-text-search service.
-// It has four functions:
-// - Initialize and clear the table.
+// It has five functions:
+// - Initialize the table.  This creates the table and its column families if
+//   they don't exist, when the server starts or from /admin/bootstrap.
+//   /admin/reindex rebuilds the index from the documents, for example to use a
+//   different analyzer.  Admin endpoints require the admin token.
 // - Add a document.  This adds the content of a user-supplied document to the
 //   Bigtable, and adds references to the document to an index in the Bigtable.
-//   The document is indexed under each unique word in the document.
-// - Search the index.  This returns documents containing each word in a user
-//   query, with snippets and links to view the whole document.
-// - Copy table.  This copies the documents and index from another table and
-//   adds them to the current one.
+//   The document is indexed under each unique word in the document, with the
+//   positions of the word in the document.
+// - Search the index.  This returns the documents matching a user query, best
+//   first, with snippets highlighting the matching words and links to view the
+//   whole document.  Queries can contain quoted phrases, OR and NOT.
+//   Documents and queries are split into words by the analyzer of the table,
+//   which is chosen when the table is created: it can find the different
+//   forms of English words, or parts of words.
+// - JSON API.  /api/search returns the results of a search, with their
+//   scores, a page at a time, and /api/docs/{name} gets, adds, replaces or
+//   deletes a document.  Replacing a document removes it from the index of
+//   the words it no longer contains.
+// - Copy table.  /admin/copy copies the documents and index from another table
+//   and adds them to the current one.  Rows are copied in parallel, in batches,
+//   and a copy that fails resumes where it stopped.
 package main
 
 import (
@@ -23,11 +36,11 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
-	"unicode"
 
 	"cloud.google.com/go/bigtable"
 	"golang.org/x/net/context"
@@ -46,8 +59,8 @@ Added {{.Title}}
 	searchTemplate = template.Must(template.New("").Parse(`<html><body>
 Results for <b>{{.Query}}</b>:<br><br>
 {{range .Results}}
-<a href="/content?name={{.Title}}">{{.Title}}</a><br>
-<i>{{.Snippet}}</i><br><br>
+<a href="/content?name={{.Name}}">{{.Name}}</a> ({{printf "%.3f" .Score}})<br>
+<i>{{range .Snippet}}{{if .Match}}<b>{{.Text}}</b>{{else}}{{.Text}}{{end}}{{end}}</i><br><br>
 {{end}}
 </body></html>`))
 )
@@ -55,20 +68,23 @@ Results for <b>{{.Query}}</b>:<br><br>
 const (
 	indexColumnFamily   = "i"
 	contentColumnFamily = "c"
-	mainPage            = `
+
+	// maxResults is the number of results shown for a search.
+	maxResults = 20
+
+	mainPage = `
 	<html>
 		<head>
 			<title>Document Search</title>
 		</head>
 		<body>
-			Initialize and clear table:
-			<form action="/reset" method="post">
-				<div><input type="submit" value="Init"></div>
-			</form>
-
-			Search for documents:
+			Search for documents, using "quoted phrases", OR and NOT:
 			<form action="/search" method="post">
 				<div><input type="text" name="q" size=80></div>
+				<div>Rank by <select name="rank">
+					<option value="bm25">BM25</option>
+					<option value="tfidf">TF-IDF</option>
+				</select></div>
 				<div><input type="submit" value="Search"></div>
 			</form>
 
@@ -81,12 +97,9 @@ const (
 				<div><input type="submit" value="Submit"></div>
 			</form>
 
-			Copy data from another table:
-			<form action="/copy" method="post">
-				Source table name:
-				<div><input type="text" name="name" size=80></div>
-				<div><input type="submit" value="Copy"></div>
-			</form>
+			Administrators can initialize the table, rebuild its index, or copy
+			another table into it with POST requests to /admin/bootstrap,
+			/admin/reindex and /admin/copy, authorized by the admin token.
 		</body>
 	</html>
 	`
@@ -98,8 +111,15 @@ func main() {
 		instance  = flag.String("instance", "", "The name of the Cloud Bigtable instance.")
 		tableName = flag.String("table", "docindex", "The name of the table containing the documents and index.")
 		port      = flag.Int("port", 8080, "TCP port for server.")
+		analyzer  = flag.String("analyzer", "english", "The analyzer of new tables: one of "+strings.Join(analyzerNames(), ", ")+".")
+		doInit    = flag.Bool("bootstrap", true, "Create the table and its column families at startup, if they don't exist.")
+
+		adminToken = flag.String("admin_token", os.Getenv("SEARCH_ADMIN_TOKEN"), "The token of the admin endpoints, which are disabled if it is empty. Defaults to $SEARCH_ADMIN_TOKEN.")
 	)
 	flag.Parse()
+	if _, err := lookupAnalyzer(*analyzer); err != nil {
+		log.Fatal(err)
+	}
 
 	// Make an admin client.
 	adminClient, err := bigtable.NewAdminClient(context.Background(), *project, *instance)
@@ -115,13 +135,28 @@ func main() {
 
 	// Open the table.
 	table := client.Open(*tableName)
+	if *doInit {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		a, _ := lookupAnalyzer(*analyzer)
+		changes, err := bootstrap(ctx, adminClient, client, *tableName, a)
+		cancel()
+		if err != nil {
+			log.Fatal("Initializing the table: ", err)
+		}
+		log.Print(changes)
+	}
 
 	// Set up HTML handlers, and start the web server.
 	http.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) { handleSearch(w, r, table) })
 	http.HandleFunc("/content", func(w http.ResponseWriter, r *http.Request) { handleContent(w, r, table) })
 	http.HandleFunc("/add", func(w http.ResponseWriter, r *http.Request) { handleAddDoc(w, r, table) })
-	http.HandleFunc("/reset", func(w http.ResponseWriter, r *http.Request) { handleReset(w, r, *tableName, adminClient) })
-	http.HandleFunc("/copy", func(w http.ResponseWriter, r *http.Request) { handleCopy(w, r, *tableName, client, adminClient) })
+	http.HandleFunc("/admin/bootstrap", requireAdmin(*adminToken, func(w http.ResponseWriter, r *http.Request) {
+		handleBootstrap(w, r, *tableName, adminClient, client, *analyzer)
+	}))
+	http.HandleFunc("/admin/reindex", requireAdmin(*adminToken, func(w http.ResponseWriter, r *http.Request) { handleReindex(w, r, table) }))
+	http.HandleFunc("/admin/copy", requireAdmin(*adminToken, func(w http.ResponseWriter, r *http.Request) { handleCopy(w, r, *tableName, client) }))
+	http.HandleFunc("/api/search", func(w http.ResponseWriter, r *http.Request) { handleAPISearch(w, r, table) })
+	http.HandleFunc(apiDocsPath, func(w http.ResponseWriter, r *http.Request) { handleAPIDoc(w, r, table) })
 	http.HandleFunc("/", handleMain)
 	log.Fatal(http.ListenAndServe(":"+strconv.Itoa(*port), nil))
 }
@@ -131,22 +166,6 @@ func handleMain(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, mainPage)
 }
 
-// tokenize splits a string into tokens.
-// This is very simple, it's not a good tokenization function.
-func tokenize(s string) []string {
-	wordMap := make(map[string]bool)
-	f := strings.FieldsFunc(s, func(r rune) bool { return !unicode.IsLetter(r) })
-	for _, word := range f {
-		word = strings.ToLower(word)
-		wordMap[word] = true
-	}
-	words := make([]string, 0, len(wordMap))
-	for word := range wordMap {
-		words = append(words, word)
-	}
-	return words
-}
-
 // handleContent fetches the content of a document from the Bigtable and returns it.
 func handleContent(w http.ResponseWriter, r *http.Request, table *bigtable.Table) {
 	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
@@ -174,86 +193,31 @@ func handleContent(w http.ResponseWriter, r *http.Request, table *bigtable.Table
 	io.Copy(w, &buf)
 }
 
-// handleSearch responds to search queries, returning links and snippets for matching documents.
+// handleSearch responds to search queries, returning links and snippets for
+// the best matching documents.
 func handleSearch(w http.ResponseWriter, r *http.Request, table *bigtable.Table) {
 	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
 	query := r.FormValue("q")
-	// Split the query into words.
-	words := tokenize(query)
-	if len(words) == 0 {
-		http.Error(w, "Empty query.", http.StatusBadRequest)
-		return
-	}
-
-	// readRows reads from many rows concurrently.
-	readRows := func(rows []string) ([]bigtable.Row, error) {
-		results := make([]bigtable.Row, len(rows))
-		errors := make([]error, len(rows))
-		var wg sync.WaitGroup
-		for i, row := range rows {
-			wg.Add(1)
-			go func(i int, row string) {
-				defer wg.Done()
-				results[i], errors[i] = table.ReadRow(ctx, row, bigtable.RowFilter(bigtable.LatestNFilter(1)))
-			}(i, row)
-		}
-		wg.Wait()
-		for _, err := range errors {
-			if err != nil {
-				return nil, err
-			}
-		}
-		return results, nil
-	}
-
-	// For each query word, get the list of documents containing it.
-	results, err := readRows(words)
+	rankFn, err := lookupRanking(r.FormValue("rank"))
 	if err != nil {
-		http.Error(w, "Error reading index: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Unknown ranking: "+r.FormValue("rank"), http.StatusBadRequest)
 		return
 	}
-
-	// Count how many of the query words each result contained.
-	hits := make(map[string]int)
-	for _, r := range results {
-		for _, r := range r[indexColumnFamily] {
-			hits[r.Column]++
-		}
-	}
-
-	// Build a slice of all the documents that matched every query word.
-	var matches []string
-	for doc, count := range hits {
-		if count == len(words) {
-			matches = append(matches, doc[len(indexColumnFamily+":"):])
-		}
+	results, err := searchDocs(ctx, table, query, rankFn, 0, maxResults)
+	if err == errEmptyQuery {
+		http.Error(w, "Empty query.", http.StatusBadRequest)
+		return
 	}
-
-	// Fetch the content of those documents from the Bigtable.
-	content, err := readRows(matches)
 	if err != nil {
-		http.Error(w, "Error reading results: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Error reading index: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	type result struct{ Title, Snippet string }
+	// Output links and snippets.
 	data := struct {
 		Query   string
-		Results []result
-	}{query, nil}
-
-	// Output links and snippets.
-	for i, doc := range matches {
-		var text string
-		c := content[i][contentColumnFamily]
-		if len(c) > 0 {
-			text = string(c[0].Value)
-		}
-		if len(text) > 100 {
-			text = text[:100] + "..."
-		}
-		data.Results = append(data.Results, result{doc, text})
-	}
+		Results []hit
+	}{query, results.Hits}
 	var buf bytes.Buffer
 	if err := searchTemplate.ExecuteTemplate(&buf, "", data); err != nil {
 		http.Error(w, "Error executing HTML template: "+err.Error(), http.StatusInternalServerError)
@@ -262,7 +226,28 @@ func handleSearch(w http.ResponseWriter, r *http.Request, table *bigtable.Table)
 	io.Copy(w, &buf)
 }
 
-// handleAddDoc adds a document to the index.
+// readRows reads the latest version of many rows concurrently.
+func readRows(ctx context.Context, table *bigtable.Table, rows []string) ([]bigtable.Row, error) {
+	results := make([]bigtable.Row, len(rows))
+	errors := make([]error, len(rows))
+	var wg sync.WaitGroup
+	for i, row := range rows {
+		wg.Add(1)
+		go func(i int, row string) {
+			defer wg.Done()
+			results[i], errors[i] = table.ReadRow(ctx, row, bigtable.RowFilter(bigtable.LatestNFilter(1)))
+		}(i, row)
+	}
+	wg.Wait()
+	for _, err := range errors {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// handleAddDoc adds a document to the index, or replaces it.
 func handleAddDoc(w http.ResponseWriter, r *http.Request, table *bigtable.Table) {
 	if r.Method != "POST" {
 		http.Error(w, "POST requests only", http.StatusMethodNotAllowed)
@@ -272,63 +257,24 @@ func handleAddDoc(w http.ResponseWriter, r *http.Request, table *bigtable.Table)
 	ctx, _ := context.WithTimeout(context.Background(), time.Minute)
 
 	name := r.FormValue("name")
-	if len(name) == 0 {
+	content := r.FormValue("content")
+	_, err := putDoc(ctx, table, name, content)
+	switch err {
+	case nil:
+	case errEmptyName:
 		http.Error(w, "Empty document name!", http.StatusBadRequest)
 		return
-	}
-
-	content := r.FormValue("content")
-	if len(content) == 0 {
+	case errEmptyContent:
 		http.Error(w, "Empty document content!", http.StatusBadRequest)
 		return
-	}
-
-	var (
-		writeErr error          // Set if any write fails.
-		mu       sync.Mutex     // Protects writeErr
-		wg       sync.WaitGroup // Used to wait for all writes to finish.
-	)
-
-	// writeOneColumn writes one column in one row, updates err if there is an error,
-	// and signals wg that one operation has finished.
-	writeOneColumn := func(row, family, column, value string, ts bigtable.Timestamp) {
-		mut := bigtable.NewMutation()
-		mut.Set(family, column, ts, []byte(value))
-		err := table.Apply(ctx, row, mut)
-		if err != nil {
-			mu.Lock()
-			writeErr = err
-			mu.Unlock()
-		}
-	}
-
-	// Start a write to store the document content.
-	wg.Add(1)
-	go func() {
-		writeOneColumn(name, contentColumnFamily, "", content, bigtable.Now())
-		wg.Done()
-	}()
-
-	// Start writes to store the document name in the index for each word in the document.
-	words := tokenize(content)
-	for _, word := range words {
-		var (
-			row    = word
-			family = indexColumnFamily
-			column = name
-			value  = ""
-			ts     = bigtable.Now()
-		)
-		wg.Add(1)
-		go func() {
-			// TODO: should use a semaphore to limit the number of concurrent writes.
-			writeOneColumn(row, family, column, value, ts)
-			wg.Done()
-		}()
-	}
-	wg.Wait()
-	if writeErr != nil {
-		http.Error(w, "Error writing to Bigtable: "+writeErr.Error(), http.StatusInternalServerError)
+	case errReservedName:
+		http.Error(w, "Reserved document name!", http.StatusBadRequest)
+		return
+	case errDocBusy:
+		http.Error(w, "Document is being changed by others, try again!", http.StatusConflict)
+		return
+	default:
+		http.Error(w, "Error writing to Bigtable: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 	var buf bytes.Buffer
@@ -339,102 +285,46 @@ func handleAddDoc(w http.ResponseWriter, r *http.Request, table *bigtable.Table)
 	io.Copy(w, &buf)
 }
 
-// handleReset deletes the table if it exists, creates it again, and creates its column families.
-func handleReset(w http.ResponseWriter, r *http.Request, table string, adminClient *bigtable.AdminClient) {
-	if r.Method != "POST" {
-		http.Error(w, "POST requests only", http.StatusMethodNotAllowed)
+// handleCopy copies data from one table to another, reporting its progress.
+// A copy that fails resumes where it stopped when it is started again.
+func handleCopy(w http.ResponseWriter, r *http.Request, dst string, client *bigtable.Client) {
+	src := r.FormValue("name")
+	if src == "" {
+		http.Error(w, "No source table specified.", http.StatusBadRequest)
 		return
 	}
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Minute)
-	adminClient.DeleteTable(ctx, table)
-	if err := adminClient.CreateTable(ctx, table); err != nil {
-		http.Error(w, "Error creating Bigtable: "+err.Error(), http.StatusInternalServerError)
+	if src == dst {
+		http.Error(w, "Cannot copy a table to itself.", http.StatusBadRequest)
 		return
 	}
-	time.Sleep(20 * time.Second)
-	// Create two column families, and set the GC policy for each one to keep one version.
-	for _, family := range []string{indexColumnFamily, contentColumnFamily} {
-		if err := adminClient.CreateColumnFamily(ctx, table, family); err != nil {
-			http.Error(w, "Error creating column family: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-		if err := adminClient.SetGCPolicy(ctx, table, family, bigtable.MaxVersionsPolicy(1)); err != nil {
-			http.Error(w, "Error setting GC policy: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-	}
-	w.Write([]byte("<html><body>Done.</body></html>"))
-	return
-}
-
-// copyTable copies data from one table to another.
-func copyTable(src, dst string, client *bigtable.Client, adminClient *bigtable.AdminClient) error {
-	if src == "" || src == dst {
-		return nil
-	}
-	ctx, _ := context.WithTimeout(context.Background(), time.Minute)
-
-	// Open the source and destination tables.
-	srcTable := client.Open(src)
-	dstTable := client.Open(dst)
 
+	// Report the progress at most once a second.
 	var (
-		writeErr error          // Set if any write fails.
-		mu       sync.Mutex     // Protects writeErr
-		wg       sync.WaitGroup // Used to wait for all writes to finish.
+		started    bool
+		lastReport time.Time
 	)
-	copyRowToTable := func(row bigtable.Row) bool {
-		mu.Lock()
-		failed := writeErr != nil
-		mu.Unlock()
-		if failed {
-			return false
+	progress := func(p copyProgress) {
+		if time.Since(lastReport) < time.Second {
+			return
 		}
-		mut := bigtable.NewMutation()
-		for family, items := range row {
-			for _, item := range items {
-				// Get the column name, excluding the column family name and ':' character.
-				columnWithoutFamily := item.Column[len(family)+1:]
-				mut.Set(family, columnWithoutFamily, bigtable.Now(), item.Value)
-			}
+		lastReport = time.Now()
+		if !started && p.Resumed {
+			fmt.Fprintf(w, "Resuming the copy from %s.\n", src)
+		}
+		started = true
+		fmt.Fprintf(w, "Copied %d rows, %d of %d shards done.\n", p.Rows, p.ShardsDone, p.Shards)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
 		}
-		wg.Add(1)
-		go func() {
-			// TODO: should use a semaphore to limit the number of concurrent writes.
-			if err := dstTable.Apply(ctx, row.Key(), mut); err != nil {
-				mu.Lock()
-				writeErr = err
-				mu.Unlock()
-			}
-			wg.Done()
-		}()
-		return true
-	}
-
-	// Create a filter that only accepts the column families we're interested in.
-	filter := bigtable.FamilyFilter(indexColumnFamily + "|" + contentColumnFamily)
-	// Read every row from srcTable, and call copyRowToTable to copy it to our table.
-	err := srcTable.ReadRows(ctx, bigtable.InfiniteRange(""), copyRowToTable, bigtable.RowFilter(filter))
-	wg.Wait()
-	if err != nil {
-		return err
-	}
-	return writeErr
-}
-
-// handleCopy copies data from one table to another.
-func handleCopy(w http.ResponseWriter, r *http.Request, dst string, client *bigtable.Client, adminClient *bigtable.AdminClient) {
-	if r.Method != "POST" {
-		http.Error(w, "POST requests only", http.StatusMethodNotAllowed)
-		return
-	}
-	src := r.FormValue("name")
-	if src == "" {
-		http.Error(w, "No source table specified.", http.StatusBadRequest)
-		return
 	}
-	if err := copyTable(src, dst, client, adminClient); err != nil {
-		http.Error(w, "Failed to rebuild index: "+err.Error(), http.StatusInternalServerError)
+	// Large tables take long to copy, so the copy has no deadline.
+	if err := copyTable(context.Background(), src, dst, client, progress); err != nil {
+		log.Printf("Copying table %s: %v", src, err)
+		if !started {
+			http.Error(w, "Failed to copy table: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "Failed to copy table: %v. Copy it again to resume.\n", err)
 		return
 	}
 	fmt.Fprint(w, "Copied table.\n")
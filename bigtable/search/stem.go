@@ -0,0 +1,190 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import "strings"
+
+// porterStem returns the stem of an English word, using the Porter stemming
+// algorithm (https://tartarus.org/martin/PorterStemmer/def.txt). Words that
+// aren't made of lowercase ASCII letters are returned unchanged.
+//
+// Stems aren't always words: "ponies" and "pony" both become "poni".
+func porterStem(w string) string {
+	if len(w) <= 2 {
+		return w
+	}
+	for i := 0; i < len(w); i++ {
+		if w[i] < 'a' || w[i] > 'z' {
+			return w
+		}
+	}
+	w = stemStep1(w)
+	w = replaceSuffix(w, step2Rules, func(stem string) bool { return measure(stem) > 0 })
+	w = replaceSuffix(w, step3Rules, func(stem string) bool { return measure(stem) > 0 })
+	w = replaceSuffix(w, step4Rules, func(stem string) bool {
+		// -ion is only removed after an s or a t.
+		if strings.HasSuffix(w, "ion") && !strings.HasSuffix(stem, "s") && !strings.HasSuffix(stem, "t") {
+			return false
+		}
+		return measure(stem) > 1
+	})
+	return stemStep5(w)
+}
+
+// stemRule replaces a suffix of a word.
+type stemRule struct {
+	suffix, replacement string
+}
+
+// replaceSuffix applies the rule with the longest suffix of w, if the rest of
+// w meets cond. Rules with shorter suffixes aren't tried if it doesn't.
+func replaceSuffix(w string, rules []stemRule, cond func(stem string) bool) string {
+	var match *stemRule
+	for i, r := range rules {
+		if strings.HasSuffix(w, r.suffix) && (match == nil || len(r.suffix) > len(match.suffix)) {
+			match = &rules[i]
+		}
+	}
+	if match == nil {
+		return w
+	}
+	stem := w[:len(w)-len(match.suffix)]
+	if !cond(stem) {
+		return w
+	}
+	return stem + match.replacement
+}
+
+var step1aRules = []stemRule{
+	{"sses", "ss"}, {"ies", "i"}, {"ss", "ss"}, {"s", ""},
+}
+
+// stemStep1 removes plurals and -ed or -ing suffixes.
+func stemStep1(w string) string {
+	w = replaceSuffix(w, step1aRules, func(string) bool { return true })
+
+	switch {
+	case strings.HasSuffix(w, "eed"):
+		if stem := w[:len(w)-3]; measure(stem) > 0 {
+			w = stem + "ee"
+		}
+	case strings.HasSuffix(w, "ed") && hasVowel(w[:len(w)-2]):
+		w = fixStem(w[:len(w)-2])
+	case strings.HasSuffix(w, "ing") && hasVowel(w[:len(w)-3]):
+		w = fixStem(w[:len(w)-3])
+	}
+
+	if strings.HasSuffix(w, "y") && hasVowel(w[:len(w)-1]) {
+		w = w[:len(w)-1] + "i"
+	}
+	return w
+}
+
+// fixStem tidies up a word whose -ed or -ing suffix was removed, so that
+// "hopping" becomes "hop", and "hoping" "hope".
+func fixStem(w string) string {
+	switch {
+	case strings.HasSuffix(w, "at"), strings.HasSuffix(w, "bl"), strings.HasSuffix(w, "iz"):
+		return w + "e"
+	case endsDoubleConsonant(w) && !strings.ContainsAny(w[len(w)-1:], "lsz"):
+		return w[:len(w)-1]
+	case measure(w) == 1 && endsCVC(w):
+		return w + "e"
+	}
+	return w
+}
+
+var step2Rules = []stemRule{
+	{"ational", "ate"}, {"tional", "tion"}, {"enci", "ence"}, {"anci", "ance"},
+	{"izer", "ize"}, {"bli", "ble"}, {"alli", "al"}, {"entli", "ent"},
+	{"eli", "e"}, {"ousli", "ous"}, {"ization", "ize"}, {"ation", "ate"},
+	{"ator", "ate"}, {"alism", "al"}, {"iveness", "ive"}, {"fulness", "ful"},
+	{"ousness", "ous"}, {"aliti", "al"}, {"iviti", "ive"}, {"biliti", "ble"},
+	{"logi", "log"},
+}
+
+var step3Rules = []stemRule{
+	{"icate", "ic"}, {"ative", ""}, {"alize", "al"}, {"iciti", "ic"},
+	{"ical", "ic"}, {"ful", ""}, {"ness", ""},
+}
+
+var step4Rules = []stemRule{
+	{"al", ""}, {"ance", ""}, {"ence", ""}, {"er", ""}, {"ic", ""},
+	{"able", ""}, {"ible", ""}, {"ant", ""}, {"ement", ""}, {"ment", ""},
+	{"ent", ""}, {"ion", ""}, {"ou", ""}, {"ism", ""},
+	{"ate", ""}, {"iti", ""}, {"ous", ""}, {"ive", ""}, {"ize", ""},
+}
+
+// stemStep5 removes a final -e, and a double l.
+func stemStep5(w string) string {
+	if strings.HasSuffix(w, "e") {
+		stem := w[:len(w)-1]
+		if m := measure(stem); m > 1 || m == 1 && !endsCVC(stem) {
+			w = stem
+		}
+	}
+	if measure(w) > 1 && endsDoubleConsonant(w) && strings.HasSuffix(w, "l") {
+		w = w[:len(w)-1]
+	}
+	return w
+}
+
+// isConsonant reports whether the letter at i in w is a consonant: a letter
+// other than a, e, i, o or u, and other than a y following a consonant.
+func isConsonant(w string, i int) bool {
+	switch w[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !isConsonant(w, i-1)
+	}
+	return true
+}
+
+// measure returns the number of times a sequence of vowels is followed by a
+// sequence of consonants in w.
+func measure(w string) int {
+	m, i := 0, 0
+	for i < len(w) && isConsonant(w, i) {
+		i++
+	}
+	for i < len(w) {
+		for i < len(w) && !isConsonant(w, i) {
+			i++
+		}
+		if i == len(w) {
+			break
+		}
+		for i < len(w) && isConsonant(w, i) {
+			i++
+		}
+		m++
+	}
+	return m
+}
+
+// hasVowel reports whether w contains a vowel.
+func hasVowel(w string) bool {
+	for i := range w {
+		if !isConsonant(w, i) {
+			return true
+		}
+	}
+	return false
+}
+
+// endsDoubleConsonant reports whether w ends with two identical consonants.
+func endsDoubleConsonant(w string) bool {
+	n := len(w)
+	return n >= 2 && w[n-1] == w[n-2] && isConsonant(w, n-1)
+}
+
+// endsCVC reports whether w ends with a consonant, a vowel and a consonant
+// other than w, x or y, as in "hop".
+func endsCVC(w string) bool {
+	n := len(w)
+	return n >= 3 && isConsonant(w, n-3) && !isConsonant(w, n-2) && isConsonant(w, n-1) &&
+		!strings.ContainsAny(w[n-1:], "wxy")
+}
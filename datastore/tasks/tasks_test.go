@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 
@@ -109,3 +111,39 @@ func listAndGetTask(t *testing.T, desc string) *Task {
 
 	return foundTask
 }
+
+func TestMainCommands(t *testing.T) {
+	tc := testutil.SystemTest(t)
+	m := testutil.BuildMain(t)
+	defer m.Cleanup()
+	if !m.Built() {
+		t.Fatal("failed to build the sample")
+	}
+	run := func(input string) *testutil.Result {
+		return m.Exec(testutil.Cmd{
+			Env:   map[string]string{"DATASTORE_PROJECT_ID": tc.ProjectID},
+			Stdin: strings.NewReader(input),
+		})
+	}
+
+	desc := makeDesc()
+	res := run("new " + desc + "\n")
+	match := regexp.MustCompile(`Created new task with ID (\d+)`).FindStringSubmatch(res.Stdout.String())
+	if !res.Success() || match == nil {
+		t.Fatalf("new: got %v; want the ID of the new task", res)
+	}
+	id := match[1]
+
+	res = run("done " + id + "\ndelete " + id + "\nnew\n")
+	if !res.Success() {
+		t.Fatalf("done and delete: %v", res)
+	}
+	for _, want := range []string{"Task " + id + " marked done", "Task " + id + " deleted", "Usage:"} {
+		if !strings.Contains(res.Stdout.String(), want) {
+			t.Errorf("done and delete: got %v; want the output to contain %q", res, want)
+		}
+	}
+	if want := `Missing description in "new" command`; !strings.Contains(res.Stderr.String(), want) {
+		t.Errorf("new without a description: got %v; want an error %q", res, want)
+	}
+}
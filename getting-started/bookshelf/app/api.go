@@ -0,0 +1,382 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+)
+
+// maxAPIBodySize limits the size of JSON request bodies accepted by the API.
+const maxAPIBodySize = 1 << 20 // 1 MB
+
+// registerAPIHandlers adds the versioned JSON API to the router. The API
+// exposes the same books as the HTML handlers, as JSON-encoded
+// bookshelf.Book values. Requests that change data must be sent as JSON, or
+// carry a CSRF token; see verifyAPIRequest.
+func registerAPIHandlers(r *mux.Router) {
+	api := r.PathPrefix("/api/v1").Subrouter()
+
+	api.Methods("GET").Path("/books").
+		Handler(apiHandler(apiListHandler))
+	api.Methods("GET").Path("/books/mine").
+		Handler(apiHandler(apiListMineHandler))
+	api.Methods("POST").Path("/books").
+		Handler(apiHandler(apiCreateHandler))
+	api.Methods("GET").Path("/books/{id:[0-9]+}").
+		Handler(apiHandler(apiGetHandler))
+	api.Methods("PUT").Path("/books/{id:[0-9]+}").
+		Handler(apiHandler(apiReplaceHandler))
+	api.Methods("PATCH").Path("/books/{id:[0-9]+}").
+		Handler(apiHandler(apiPatchHandler))
+	api.Methods("DELETE").Path("/books/{id:[0-9]+}").
+		Handler(apiHandler(apiDeleteHandler))
+}
+
+// apiListHandler responds with a page of books in the database. It accepts
+// the same query parameters as listHandler. Links to the adjacent pages are
+// given in the Link header.
+func apiListHandler(w http.ResponseWriter, r *http.Request) *appError {
+	page, appErr := listPage(r, "")
+	if appErr != nil {
+		return appErr
+	}
+	return writeBookPageJSON(w, r, page)
+}
+
+// apiListMineHandler responds with a page of books created by the currently
+// authenticated user.
+func apiListMineHandler(w http.ResponseWriter, r *http.Request) *appError {
+	user := profileFromSession(r)
+	if user == nil {
+		err := errors.New("not logged in")
+		return appErrorCodef(http.StatusUnauthorized, err, "%v", err)
+	}
+
+	page, appErr := listPage(r, user.ID)
+	if appErr != nil {
+		return appErr
+	}
+	return writeBookPageJSON(w, r, page)
+}
+
+// apiGetHandler responds with a single book.
+func apiGetHandler(w http.ResponseWriter, r *http.Request) *appError {
+	book, appErr := bookFromAPIRequest(r)
+	if appErr != nil {
+		return appErr
+	}
+	return writeBookJSON(w, http.StatusOK, book)
+}
+
+// apiCreateHandler adds the book in the request body to the database. The ID
+// and creator of the book are assigned by the server.
+func apiCreateHandler(w http.ResponseWriter, r *http.Request) *appError {
+	book := &bookshelf.Book{}
+	if appErr := decodeBook(r, book); appErr != nil {
+		return appErr
+	}
+	if book.ID != 0 {
+		err := errors.New("id must not be set when creating a book")
+		return appErrorCodef(http.StatusBadRequest, err, "%v", err)
+	}
+	if appErr := validateBook(book); appErr != nil {
+		return appErr
+	}
+	setCreatorFromSession(r, book)
+
+	id, err := booksAs(r).AddBook(book)
+	if err != nil {
+		return appErrorf(err, "could not save book: %v", err)
+	}
+	book.ID = id
+	go publishUpdate(requestID(r), id)
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/books/%d", id))
+	return writeBookJSON(w, http.StatusCreated, book)
+}
+
+// apiReplaceHandler replaces all user-editable fields of a book with the
+// book in the request body. The request must give the version it replaces,
+// in the If-Match header or the body, so that clients can't overwrite changes
+// they have not seen.
+func apiReplaceHandler(w http.ResponseWriter, r *http.Request) *appError {
+	existing, appErr := bookFromAPIRequest(r)
+	if appErr != nil {
+		return appErr
+	}
+
+	if appErr := authorize(r, existing, canEdit, "edit"); appErr != nil {
+		return appErr
+	}
+
+	book := &bookshelf.Book{}
+	if appErr := decodeBook(r, book); appErr != nil {
+		return appErr
+	}
+	if book.Version == 0 && r.Header.Get("If-Match") == "" {
+		err := errors.New("If-Match header or version is required")
+		return appErrorCodef(http.StatusPreconditionRequired, err, "%v", err)
+	}
+	return saveAPIBook(w, r, existing, book)
+}
+
+// apiPatchHandler updates only the fields of a book that are present in the
+// request body. Without an If-Match header or a version in the body, the
+// fields are changed whatever the version of the stored book.
+func apiPatchHandler(w http.ResponseWriter, r *http.Request) *appError {
+	existing, appErr := bookFromAPIRequest(r)
+	if appErr != nil {
+		return appErr
+	}
+
+	if appErr := authorize(r, existing, canEdit, "edit"); appErr != nil {
+		return appErr
+	}
+
+	// Decode on top of a copy of the stored book, so that fields missing from
+	// the request body keep their current values.
+	book := *existing
+	if appErr := decodeBook(r, &book); appErr != nil {
+		return appErr
+	}
+	return saveAPIBook(w, r, existing, &book)
+}
+
+// saveAPIBook writes book to the database in place of existing and responds
+// with the result. The ID and creator of existing are retained.
+//
+// The update only succeeds if the stored book is still at the version given
+// by the If-Match header, or failing that the version in the body. If neither
+// is given, the update is made to the current version.
+func saveAPIBook(w http.ResponseWriter, r *http.Request, existing, book *bookshelf.Book) *appError {
+	if book.ID != 0 && book.ID != existing.ID {
+		err := fmt.Errorf("id %d in body does not match id %d in path", book.ID, existing.ID)
+		return appErrorCodef(http.StatusBadRequest, err, "%v", err)
+	}
+	if appErr := validateBook(book); appErr != nil {
+		return appErr
+	}
+
+	version, ok, appErr := ifMatchVersion(r, existing)
+	if appErr != nil {
+		return appErr
+	}
+	switch {
+	case ok:
+		book.Version = version
+	case book.Version == 0:
+		book.Version = existing.Version
+	}
+
+	book.ID = existing.ID
+	book.CreatedBy = existing.CreatedBy
+	book.CreatedByID = existing.CreatedByID
+
+	err := booksAs(r).UpdateBook(book)
+	if err == bookshelf.ErrConflict {
+		return appErrorCodef(http.StatusConflict, err,
+			"book %d has been modified since version %d", book.ID, book.Version)
+	}
+	if err != nil {
+		return appErrorf(err, "could not save book: %v", err)
+	}
+	if book.ImageURL != existing.ImageURL {
+		deleteOldCover(r, book.ID, existing.ImageURL)
+	}
+	go publishUpdate(requestID(r), book.ID)
+
+	return writeBookJSON(w, http.StatusOK, book)
+}
+
+// apiDeleteHandler deletes a given book.
+func apiDeleteHandler(w http.ResponseWriter, r *http.Request) *appError {
+	book, appErr := bookFromAPIRequest(r)
+	if appErr != nil {
+		return appErr
+	}
+	if appErr := authorize(r, book, canDelete, "delete"); appErr != nil {
+		return appErr
+	}
+	version, ok, appErr := ifMatchVersion(r, book)
+	if appErr != nil {
+		return appErr
+	}
+	// With If-Match, the book is only deleted if nobody changed it since it
+	// was read above.
+	var err error
+	if ok {
+		err = bookshelf.DeleteBookVersion(booksAs(r), book.ID, version)
+	} else {
+		err = booksAs(r).DeleteBook(book.ID)
+	}
+	if err == bookshelf.ErrConflict {
+		return appErrorCodef(http.StatusConflict, err,
+			"book %d has been modified since version %d", book.ID, version)
+	}
+	if err == bookshelf.ErrNotFound {
+		return appErrorCodef(http.StatusNotFound, err, "no book with id %d", book.ID)
+	}
+	if err != nil {
+		return appErrorf(err, "could not delete book: %v", err)
+	}
+	deleteCoverOfDeleted(r, book)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// bookFromAPIRequest retrieves a book from the database given a book ID in
+// the URL's path, distinguishing malformed and unknown IDs from other
+// failures.
+func bookFromAPIRequest(r *http.Request) (*bookshelf.Book, *appError) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return nil, appErrorCodef(http.StatusBadRequest, err, "bad book id: %v", err)
+	}
+	book, err := bookshelf.DB.GetBook(id)
+	if err == bookshelf.ErrNotFound {
+		return nil, appErrorCodef(http.StatusNotFound, err, "no book with id %d", id)
+	}
+	if err != nil {
+		return nil, appErrorf(err, "could not get book: %v", err)
+	}
+	return book, nil
+}
+
+// decodeBook reads the JSON request body into book. Unknown fields are
+// rejected so that typos are reported rather than silently ignored.
+func decodeBook(r *http.Request, book *bookshelf.Book) *appError {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxAPIBodySize))
+	if err != nil {
+		return appErrorCodef(http.StatusBadRequest, err, "could not read book: %v", err)
+	}
+	if err := bookshelf.UnmarshalStrictJSON(body, book); err != nil {
+		return appErrorCodef(http.StatusBadRequest, err, "could not decode book: %v", err)
+	}
+	return nil
+}
+
+// ifMatchVersion returns the book version in the request's If-Match header.
+// ok is false if the header is absent. The wildcard "*" matches the version
+// of the existing book.
+func ifMatchVersion(r *http.Request, existing *bookshelf.Book) (version int64, ok bool, appErr *appError) {
+	h := strings.TrimSpace(r.Header.Get("If-Match"))
+	if h == "" {
+		return 0, false, nil
+	}
+	if h == "*" {
+		return existing.Version, true, nil
+	}
+	tag := strings.Trim(strings.TrimPrefix(h, "W/"), `"`)
+	version, err := strconv.ParseInt(tag, 10, 64)
+	if err != nil {
+		return 0, false, appErrorCodef(http.StatusBadRequest, err, "bad If-Match header %q", h)
+	}
+	return version, true, nil
+}
+
+// validateBook checks that a book received through the API can be saved.
+func validateBook(book *bookshelf.Book) *appError {
+	if book.Title == "" {
+		err := errors.New("title is required")
+		return appErrorCodef(http.StatusBadRequest, err, "%v", err)
+	}
+	return nil
+}
+
+// writeJSON responds with v encoded as JSON.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) *appError {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return appErrorf(err, "could not encode response: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(b)
+	return nil
+}
+
+// writeBookJSON responds with a book encoded as JSON, with the book's version
+// as its ETag.
+func writeBookJSON(w http.ResponseWriter, code int, book *bookshelf.Book) *appError {
+	w.Header().Set("ETag", fmt.Sprintf(`"%d"`, book.Version))
+	return writeJSON(w, code, book)
+}
+
+// writeBookPageJSON responds with the books on a page as a JSON array, and
+// links to the adjacent pages in a Link header (RFC 5988). An empty page is
+// encoded as [] rather than null.
+func writeBookPageJSON(w http.ResponseWriter, r *http.Request, page *bookshelf.BookPage) *appError {
+	var links []string
+	if u := pageURL(r, page.NextCursor); u != "" {
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, u))
+	}
+	if u := pageURL(r, page.PrevCursor); u != "" {
+		links = append(links, fmt.Sprintf(`<%s>; rel="prev"`, u))
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+
+	books := page.Books
+	if books == nil {
+		books = []*bookshelf.Book{}
+	}
+	return writeJSON(w, http.StatusOK, books)
+}
+
+// verifyAPIRequest rejects API requests that may change data unless they
+// are JSON or carry the CSRF token of the browser making them. The API is
+// authenticated by the session cookie, so other sites could otherwise forge
+// requests with forms. They can't send JSON: browsers would first ask this
+// app, with a preflight request, which it doesn't allow.
+func verifyAPIRequest(r *http.Request) *appError {
+	if safeMethod(r.Method) {
+		return nil
+	}
+	if r.Header.Get(csrfHeader) != "" {
+		if err := verifyCSRF(r); err != nil {
+			return appErrorCodef(http.StatusForbidden, err, "%v", err)
+		}
+		return nil
+	}
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		err := errors.New("requests that change data must have Content-Type application/json or an " + csrfHeader + " header")
+		return appErrorCodef(http.StatusUnsupportedMediaType, err, "%v", err)
+	}
+	return nil
+}
+
+// apiHandler is the JSON counterpart of appHandler: errors are reported to
+// the client as a JSON object with an "error" field.
+type apiHandler func(http.ResponseWriter, *http.Request) *appError
+
+func (fn apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e := verifyAPIRequest(r)
+	if e == nil {
+		e = fn(w, r)
+	}
+	if e != nil {
+		log.Printf("[request %s] API handler error: status code: %d, message: %s, underlying err: %#v",
+			requestID(r), e.Code, e.Message, e.Error)
+
+		if wErr := writeJSON(w, e.Code, struct {
+			Error string `json:"error"`
+		}{e.Message}); wErr != nil {
+			http.Error(w, e.Message, e.Code)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+)
+
+// apiDo performs an API request with an optional JSON body, decoding the
+// JSON response into v if v is non-nil. Requests that may change data are
+// sent as JSON, even without a body, as the API requires.
+func apiDo(t *testing.T, method, path, body string, v interface{}) *http.Response {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req := wt.NewRequest(method, path, r)
+	if body != "" || !safeMethod(method) {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := wt.Client.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s: could not decode response: %v", method, path, err)
+		}
+	}
+	return resp
+}
+
+func TestAPICreateGetDelete(t *testing.T) {
+	var created bookshelf.Book
+	resp := apiDo(t, "POST", "/api/v1/books",
+		`{"title": "api mcbook", "author": "homer", "createdById": "bart"}`, &created)
+	if got, want := resp.StatusCode, http.StatusCreated; got != want {
+		t.Fatalf("POST status: got %d, want %d", got, want)
+	}
+	if created.ID == 0 {
+		t.Fatal("POST: want non-zero id")
+	}
+	if got, want := created.CreatedByID, "anonymous"; got != want {
+		t.Errorf("POST createdById: got %q, want %q", got, want)
+	}
+	bookPath := fmt.Sprintf("/api/v1/books/%d", created.ID)
+	if got := resp.Header.Get("Location"); got != bookPath {
+		t.Errorf("POST Location: got %q, want %q", got, bookPath)
+	}
+
+	var got bookshelf.Book
+	resp = apiDo(t, "GET", bookPath, "", &got)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET status: got %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got != created {
+		t.Errorf("GET: got %+v, want %+v", got, created)
+	}
+
+	var list []bookshelf.Book
+	apiDo(t, "GET", "/api/v1/books", "", &list)
+	found := false
+	for _, b := range list {
+		if b.ID == created.ID {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("GET list: book %d not in %+v", created.ID, list)
+	}
+
+	resp = apiDo(t, "DELETE", bookPath, "", nil)
+	if got, want := resp.StatusCode, http.StatusNoContent; got != want {
+		t.Errorf("DELETE status: got %d, want %d", got, want)
+	}
+	resp = apiDo(t, "GET", bookPath, "", nil)
+	if got, want := resp.StatusCode, http.StatusNotFound; got != want {
+		t.Errorf("GET after DELETE status: got %d, want %d", got, want)
+	}
+}
+
+func TestAPIUpdate(t *testing.T) {
+	id, err := bookshelf.DB.AddBook(&bookshelf.Book{
+		Title:       "book mcbook",
+		Author:      "homer",
+		Description: "desc",
+		CreatedByID: "marge",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bookshelf.DB.DeleteBook(id)
+	bookPath := fmt.Sprintf("/api/v1/books/%d", id)
+
+	var patched bookshelf.Book
+	resp := apiDo(t, "PATCH", bookPath, `{"author": "bart"}`, &patched)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PATCH status: got %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	want := bookshelf.Book{
+		ID:          id,
+		Title:       "book mcbook",
+		Author:      "bart",
+		Description: "desc",
+		CreatedByID: "marge",
+		Version:     2,
+	}
+	if patched != want {
+		t.Errorf("PATCH: got %+v, want %+v", patched, want)
+	}
+
+	var replaced bookshelf.Book
+	resp = apiDo(t, "PUT", bookPath, `{"title": "simpsons", "createdById": "bart", "version": 2}`, &replaced)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT status: got %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	want = bookshelf.Book{
+		ID:          id,
+		Title:       "simpsons",
+		CreatedByID: "marge",
+		Version:     3,
+	}
+	if replaced != want {
+		t.Errorf("PUT: got %+v, want %+v", replaced, want)
+	}
+
+	stored, err := bookshelf.DB.GetBook(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *stored != want {
+		t.Errorf("stored: got %+v, want %+v", *stored, want)
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	id, err := bookshelf.DB.AddBook(&bookshelf.Book{Title: "book mcbook"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bookshelf.DB.DeleteBook(id)
+	bookPath := fmt.Sprintf("/api/v1/books/%d", id)
+
+	tests := []struct {
+		method, path, body string
+		want               int
+	}{
+		{"GET", "/api/v1/books/0", "", http.StatusNotFound},
+		{"PUT", "/api/v1/books/0", `{"title": "t"}`, http.StatusNotFound},
+		{"PATCH", "/api/v1/books/0", `{"title": "t"}`, http.StatusNotFound},
+		{"DELETE", "/api/v1/books/0", "", http.StatusNotFound},
+		{"GET", "/api/v1/books/99999999999999999999", "", http.StatusBadRequest},
+		{"POST", "/api/v1/books", `{"title": `, http.StatusBadRequest},
+		{"POST", "/api/v1/books", `{"author": "homer"}`, http.StatusBadRequest},
+		{"POST", "/api/v1/books", `{"title": "t", "colour": "red"}`, http.StatusBadRequest},
+		{"POST", "/api/v1/books", `{"id": 5, "title": "t"}`, http.StatusBadRequest},
+		{"PATCH", bookPath, `{"title": ""}`, http.StatusBadRequest},
+		{"PUT", bookPath, fmt.Sprintf(`{"id": %d, "title": "t", "version": 1}`, id+1), http.StatusBadRequest},
+		{"PUT", bookPath, `{"title": "t"}`, http.StatusPreconditionRequired},
+		{"GET", "/api/v1/books/mine", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		var body struct {
+			Error string `json:"error"`
+		}
+		resp := apiDo(t, tt.method, tt.path, tt.body, &body)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s %s %s: got status %d, want %d", tt.method, tt.path, tt.body, resp.StatusCode, tt.want)
+		}
+		if body.Error == "" {
+			t.Errorf("%s %s %s: want non-empty error message", tt.method, tt.path, tt.body)
+		}
+	}
+}
+
+func TestAPIListPages(t *testing.T) {
+	for _, title := range []string{"a", "b", "c"} {
+		id, err := bookshelf.DB.AddBook(&bookshelf.Book{Title: title, Author: "api-pager"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bookshelf.DB.DeleteBook(id)
+	}
+
+	var books []bookshelf.Book
+	resp := apiDo(t, "GET", "/api/v1/books?author=api-pager&pageSize=2", "", &books)
+	if got, want := len(books), 2; got != want {
+		t.Fatalf("first page: got %d books, want %d", got, want)
+	}
+	link := resp.Header.Get("Link")
+	if !strings.Contains(link, `rel="next"`) || strings.Contains(link, `rel="prev"`) {
+		t.Fatalf("first page: got Link %q, want only a next link", link)
+	}
+
+	next := strings.TrimPrefix(strings.SplitN(link, ">", 2)[0], "<")
+	resp = apiDo(t, "GET", next, "", &books)
+	if got, want := len(books), 1; got != want {
+		t.Errorf("second page: got %d books, want %d", got, want)
+	}
+	if link := resp.Header.Get("Link"); !strings.Contains(link, `rel="prev"`) {
+		t.Errorf("second page: got Link %q, want a prev link", link)
+	}
+}
+
+func TestAPIConcurrentUpdate(t *testing.T) {
+	id, err := bookshelf.DB.AddBook(&bookshelf.Book{Title: "book mcbook"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bookshelf.DB.DeleteBook(id)
+	bookPath := fmt.Sprintf("/api/v1/books/%d", id)
+
+	resp := apiDo(t, "GET", bookPath, "", nil)
+	etag := resp.Header.Get("ETag")
+	if etag != `"1"` {
+		t.Fatalf("GET ETag: got %q, want %q", etag, `"1"`)
+	}
+
+	// Someone else updates the book.
+	resp = apiDo(t, "PATCH", bookPath, `{"author": "marge"}`, nil)
+	if got, want := resp.Header.Get("ETag"), `"2"`; got != want {
+		t.Errorf("PATCH ETag: got %q, want %q", got, want)
+	}
+
+	// Updates and deletes based on the stale ETag or version are rejected.
+	patch := wt.NewRequest("PATCH", bookPath, strings.NewReader(`{"author": "homer"}`))
+	del := wt.NewRequest("DELETE", bookPath, nil)
+	for _, req := range []*http.Request{patch, del} {
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("If-Match", etag)
+		resp, err := wt.Client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got, want := resp.StatusCode, http.StatusConflict; got != want {
+			t.Errorf("%s with stale If-Match: got status %d, want %d", req.Method, got, want)
+		}
+	}
+	resp = apiDo(t, "PUT", bookPath, `{"title": "t", "version": 1}`, nil)
+	if got, want := resp.StatusCode, http.StatusConflict; got != want {
+		t.Errorf("PUT with stale version: got status %d, want %d", got, want)
+	}
+
+	book, err := bookshelf.DB.GetBook(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := book.Author, "marge"; got != want {
+		t.Errorf("author: got %q, want %q", got, want)
+	}
+}
+
+// racingDB is a BookDatabase in which change is made to a book right after
+// it is first read, as if by another request.
+type racingDB struct {
+	bookshelf.BookDatabase
+	change func(b *bookshelf.Book)
+}
+
+func (db *racingDB) GetBook(id int64) (*bookshelf.Book, error) {
+	b, err := db.BookDatabase.GetBook(id)
+	if err != nil || db.change == nil {
+		return b, err
+	}
+	changed := *b
+	db.change(&changed)
+	db.change = nil
+	return b, db.BookDatabase.UpdateBook(&changed)
+}
+
+// raceChange makes change to the next book read from bookshelf.DB right after
+// reading it. It returns a function restoring bookshelf.DB.
+func raceChange(change func(b *bookshelf.Book)) func() {
+	old := bookshelf.DB
+	bookshelf.DB = &racingDB{BookDatabase: old, change: change}
+	return func() { bookshelf.DB = old }
+}
+
+func TestAPIDeleteChangedBook(t *testing.T) {
+	id, err := bookshelf.DB.AddBook(&bookshelf.Book{Title: "book mcbook"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bookshelf.DB.DeleteBook(id)
+	bookPath := fmt.Sprintf("/api/v1/books/%d", id)
+
+	// The book changes after the handler checks If-Match against it, but
+	// before it is deleted.
+	restore := raceChange(func(b *bookshelf.Book) { b.Author = "marge" })
+	req := wt.NewRequest("DELETE", bookPath, nil)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("If-Match", `"1"`)
+	resp, err := wt.Client.Do(req)
+	restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusConflict; got != want {
+		t.Errorf("DELETE of a book changed meanwhile: got status %d, want %d", got, want)
+	}
+	if book, err := bookshelf.DB.GetBook(id); err != nil || book.Author != "marge" {
+		t.Errorf("book after DELETE = %+v, %v; want the changed book", book, err)
+	}
+}
+
+func TestAPIForgedRequests(t *testing.T) {
+	tests := []struct {
+		name, contentType, token string
+		want                     int
+	}{
+		{"form", "application/x-www-form-urlencoded", "", http.StatusUnsupportedMediaType},
+		{"text", "text/plain", "", http.StatusUnsupportedMediaType},
+		{"no content type", "", "", http.StatusUnsupportedMediaType},
+		{"wrong token", "text/plain", "forged", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := wt.NewRequest("POST", "/api/v1/books", strings.NewReader(`{"title": "forged mcbook"}`))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		if tt.token != "" {
+			req.Header.Set(csrfHeader, tt.token)
+		}
+		resp, err := wt.Client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+
+	books, err := bookshelf.DB.ListBooks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range books {
+		if b.Title == "forged mcbook" {
+			t.Errorf("forged request added book %d", b.ID)
+		}
+	}
+}
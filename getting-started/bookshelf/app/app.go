@@ -10,21 +10,20 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
-	"path"
 	"strconv"
+	"strings"
 
 	"cloud.google.com/go/pubsub"
-	"cloud.google.com/go/storage"
 
 	"golang.org/x/net/context"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
-	uuid "github.com/satori/go.uuid"
+
+	"go.opencensus.io/stats/view"
 
 	"google.golang.org/appengine"
 
@@ -36,10 +35,18 @@ var (
 	listTmpl   = parseTemplate("list.html")
 	editTmpl   = parseTemplate("edit.html")
 	detailTmpl = parseTemplate("detail.html")
+	searchTmpl = parseTemplate("search.html")
 )
 
+// maxSearchResults is the number of books shown on the search results page.
+const maxSearchResults = 50
+
 func main() {
+	if bookshelf.SchemaErr != nil {
+		log.Fatal(bookshelf.SchemaErr)
+	}
 	registerHandlers()
+	go purgeCovers(coverPurgeInterval)
 	appengine.Main()
 }
 
@@ -60,6 +67,8 @@ func registerHandlers() {
 		Handler(appHandler(addFormHandler))
 	r.Methods("GET").Path("/books/{id:[0-9]+}/edit").
 		Handler(appHandler(editFormHandler))
+	r.Methods("GET").Path("/search").
+		Handler(appHandler(searchHandler))
 
 	r.Methods("POST").Path("/books").
 		Handler(appHandler(createHandler))
@@ -68,6 +77,22 @@ func registerHandlers() {
 	r.Methods("POST").Path("/books/{id:[0-9]+}:delete").
 		Handler(appHandler(deleteHandler)).Name("delete")
 
+	// The JSON API handlers are defined in api.go.
+	registerAPIHandlers(r)
+
+	// The import and export handlers are defined in import.go.
+	registerImportHandlers(r)
+
+	// The history handlers are defined in history.go.
+	registerHistoryHandlers(r)
+
+	// Serve uploaded images when they are kept by the app itself, rather than
+	// in Cloud Storage.
+	if h, ok := bookshelf.Storage.(http.Handler); ok {
+		r.Methods("GET", "HEAD").PathPrefix(bookshelf.LocalBlobPath).
+			Handler(http.StripPrefix(strings.TrimSuffix(bookshelf.LocalBlobPath, "/"), h))
+	}
+
 	// The following handlers are defined in auth.go and used in the
 	// "Authenticating Users" part of the Getting Started guide.
 	r.Methods("GET").Path("/login").
@@ -77,6 +102,15 @@ func registerHandlers() {
 	r.Methods("GET").Path("/oauth2callback").
 		Handler(appHandler(oauthCallbackHandler))
 
+	// Serve the request metrics, and those of the book database, to
+	// Prometheus. They are public unless a metrics token is configured: see
+	// bookshelf.Config. The metrics middleware is defined in metrics.go.
+	if err := view.Register(requestViews...); err != nil {
+		log.Fatal(err)
+	}
+	r.Methods("GET").Path("/metrics").Handler(bookshelf.Metrics)
+	r.Use(routeMetrics)
+
 	// Respond to App Engine and Compute Engine health checks.
 	// Indicate the server is healthy.
 	r.Methods("GET").Path("/_ah/health").HandlerFunc(
@@ -86,22 +120,34 @@ func registerHandlers() {
 
 	// [START request_logging]
 	// Delegate all of the HTTP routing and serving to the gorilla/mux router.
-	// Log all requests using the standard Apache format.
-	http.Handle("/", handlers.CombinedLoggingHandler(os.Stderr, r))
+	// Log all requests using the standard Apache format, followed by their
+	// request ID.
+	http.Handle("/", instrument(handlers.CustomLoggingHandler(os.Stderr, r, writeRequestLog)))
 	// [END request_logging]
 }
 
-// listHandler displays a list with summaries of books in the database.
+// bookList is the data rendered by templates/list.html.
+type bookList struct {
+	Books []*bookshelf.Book
+
+	// NextURL and PrevURL link to the adjacent pages, if any.
+	NextURL, PrevURL string
+
+	// CanUndelete links to the recently deleted books.
+	CanUndelete bool
+}
+
+// listHandler displays a page of summaries of books in the database.
 func listHandler(w http.ResponseWriter, r *http.Request) *appError {
-	books, err := bookshelf.DB.ListBooks()
-	if err != nil {
-		return appErrorf(err, "could not list books: %v", err)
+	page, appErr := listPage(r, "")
+	if appErr != nil {
+		return appErr
 	}
 
-	return listTmpl.Execute(w, r, books)
+	return listTmpl.Execute(w, r, newBookList(r, page))
 }
 
-// listMineHandler displays a list of books created by the currently
+// listMineHandler displays a page of books created by the currently
 // authenticated user.
 func listMineHandler(w http.ResponseWriter, r *http.Request) *appError {
 	user := profileFromSession(r)
@@ -110,12 +156,116 @@ func listMineHandler(w http.ResponseWriter, r *http.Request) *appError {
 		return nil
 	}
 
-	books, err := bookshelf.DB.ListBooksCreatedBy(user.ID)
+	page, appErr := listPage(r, user.ID)
+	if appErr != nil {
+		return appErr
+	}
+
+	return listTmpl.Execute(w, r, newBookList(r, page))
+}
+
+// listPage retrieves the page of books described by the query parameters of
+// the request:
+//
+//	cursor    a cursor from a previous page
+//	pageSize  the number of books per page
+//	sort      title, author or publishedDate
+//	order     asc or desc
+//	author    an author name prefix to filter by
+//
+// If createdByID is set, only books created by that user are listed.
+func listPage(r *http.Request, createdByID string) (*bookshelf.BookPage, *appError) {
+	q := r.URL.Query()
+	opts := bookshelf.ListOptions{
+		Cursor:       q.Get("cursor"),
+		SortBy:       bookshelf.SortField(q.Get("sort")),
+		AuthorPrefix: q.Get("author"),
+		CreatedByID:  createdByID,
+	}
+	switch order := q.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		opts.Descending = true
+	default:
+		err := fmt.Errorf("unknown order %q", order)
+		return nil, appErrorCodef(http.StatusBadRequest, err, "%v", err)
+	}
+	if s := q.Get("pageSize"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, appErrorCodef(http.StatusBadRequest, err, "bad page size: %v", err)
+		}
+		opts.PageSize = n
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, appErrorCodef(http.StatusBadRequest, err, "%v", err)
+	}
+
+	page, err := bookshelf.DB.ListBooksPage(opts)
+	if err == bookshelf.ErrInvalidCursor {
+		return nil, appErrorCodef(http.StatusBadRequest, err, "%v", err)
+	}
 	if err != nil {
-		return appErrorf(err, "could not list books: %v", err)
+		return nil, appErrorf(err, "could not list books: %v", err)
 	}
+	return page, nil
+}
 
-	return listTmpl.Execute(w, r, books)
+// newBookList prepares a page of books for templates/list.html.
+func newBookList(r *http.Request, page *bookshelf.BookPage) *bookList {
+	return &bookList{
+		Books:       page.Books,
+		NextURL:     pageURL(r, page.NextCursor),
+		PrevURL:     pageURL(r, page.PrevCursor),
+		CanUndelete: bookshelf.Audit != nil && bookshelf.Audit.CanUndelete(),
+	}
+}
+
+// pageURL returns the URL of the request with its cursor replaced by the
+// given one, or the empty string if there is no cursor.
+func pageURL(r *http.Request, cursor string) string {
+	if cursor == "" {
+		return ""
+	}
+	q := r.URL.Query()
+	q.Set("cursor", cursor)
+	u := *r.URL
+	u.RawQuery = q.Encode()
+	return u.RequestURI()
+}
+
+// searchResults is the data rendered by templates/search.html.
+type searchResults struct {
+	Query string
+	Books []*bookshelf.Book
+}
+
+// searchHandler displays the books matching the words in the "q" query
+// parameter, best matches first.
+func searchHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if bookshelf.SearchIndex == nil {
+		err := errors.New("search index is missing - check the configuration")
+		return appErrorf(err, "%v", err)
+	}
+
+	results := &searchResults{Query: r.FormValue("q")}
+	matches, err := bookshelf.SearchIndex.Search(results.Query, maxSearchResults)
+	if err != nil {
+		return appErrorf(err, "could not search books: %v", err)
+	}
+	for _, m := range matches {
+		book, err := bookshelf.DB.GetBook(m.ID)
+		if err == bookshelf.ErrNotFound {
+			// The index is out of date; skip the book.
+			continue
+		}
+		if err != nil {
+			return appErrorf(err, "could not get book: %v", err)
+		}
+		results.Books = append(results.Books, book)
+	}
+
+	return searchTmpl.Execute(w, r, results)
 }
 
 // bookFromRequest retrieves a book from the database given a book ID in the
@@ -139,7 +289,17 @@ func detailHandler(w http.ResponseWriter, r *http.Request) *appError {
 		return appErrorf(err, "%v", err)
 	}
 
-	return detailTmpl.Execute(w, r, book)
+	// Only offer the changes the user is allowed to make.
+	user := profileFromSession(r)
+	return detailTmpl.Execute(w, r, struct {
+		*bookshelf.Book
+		CanEdit, CanDelete, HasHistory bool
+	}{
+		Book:       book,
+		CanEdit:    canEdit(user, book),
+		CanDelete:  canDelete(user, book),
+		HasHistory: bookshelf.Audit != nil,
+	})
 }
 
 // addFormHandler displays a form that captures details of a new book to add to
@@ -155,6 +315,9 @@ func editFormHandler(w http.ResponseWriter, r *http.Request) *appError {
 	if err != nil {
 		return appErrorf(err, "%v", err)
 	}
+	if appErr := authorize(r, book, canEdit, "edit"); appErr != nil {
+		return appErr
+	}
 
 	return editTmpl.Execute(w, r, book)
 }
@@ -163,6 +326,9 @@ func editFormHandler(w http.ResponseWriter, r *http.Request) *appError {
 // (see templates/edit.html).
 func bookFromForm(r *http.Request) (*bookshelf.Book, error) {
 	imageURL, err := uploadFileFromForm(r)
+	if _, ok := err.(*bookshelf.InvalidImageError); ok {
+		return nil, err
+	}
 	if err != nil {
 		return nil, fmt.Errorf("could not upload file: %v", err)
 	}
@@ -176,74 +342,68 @@ func bookFromForm(r *http.Request) (*bookshelf.Book, error) {
 		PublishedDate: r.FormValue("publishedDate"),
 		ImageURL:      imageURL,
 		Description:   r.FormValue("description"),
-		CreatedBy:     r.FormValue("createdBy"),
-		CreatedByID:   r.FormValue("createdByID"),
-	}
-
-	// If the form didn't carry the user information for the creator, populate it
-	// from the currently logged in user (or mark as anonymous).
-	if book.CreatedByID == "" {
-		user := profileFromSession(r)
-		if user != nil {
-			// Logged in.
-			book.CreatedBy = user.DisplayName
-			book.CreatedByID = user.ID
-		} else {
-			// Not logged in.
-			book.SetCreatorAnonymous()
-		}
 	}
 
+	// The creator is the currently logged in user (or anonymous). Updates
+	// keep the creator of the existing book instead.
+	setCreatorFromSession(r, book)
+
 	return book, nil
 }
 
-// uploadFileFromForm uploads a file if it's present in the "image" form field.
+// setCreatorFromSession marks the currently logged in user as the creator of
+// the given book, or marks the book as anonymous if nobody is logged in.
+func setCreatorFromSession(r *http.Request, book *bookshelf.Book) {
+	user := profileFromSession(r)
+	if user != nil {
+		// Logged in.
+		book.CreatedBy = user.DisplayName
+		book.CreatedByID = user.ID
+	} else {
+		// Not logged in.
+		book.SetCreatorAnonymous()
+	}
+}
+
+// uploadFileFromForm stores the cover image in the "image" form field, if
+// present, in each of the cover sizes, and returns the URL of the default size.
+// Uploads that are not usable images give a *bookshelf.InvalidImageError.
 func uploadFileFromForm(r *http.Request) (url string, err error) {
-	f, fh, err := r.FormFile("image")
+	f, _, err := r.FormFile("image")
 	if err == http.ErrMissingFile {
 		return "", nil
 	}
 	if err != nil {
 		return "", err
 	}
+	defer f.Close()
 
-	if bookshelf.StorageBucket == nil {
-		return "", errors.New("storage bucket is missing - check config.go")
+	if bookshelf.Storage == nil {
+		return "", errors.New("storage is missing - check the configuration")
 	}
 
-	// random filename, retaining existing extension.
-	name := uuid.Must(uuid.NewV4()).String() + path.Ext(fh.Filename)
-
-	ctx := context.Background()
-	w := bookshelf.StorageBucket.Object(name).NewWriter(ctx)
-	w.ACL = []storage.ACLRule{{Entity: storage.AllUsers, Role: storage.RoleReader}}
-	w.ContentType = fh.Header.Get("Content-Type")
-
-	// Entries are immutable, be aggressive about caching (1 day).
-	w.CacheControl = "public, max-age=86400"
-
-	if _, err := io.Copy(w, f); err != nil {
-		return "", err
-	}
-	if err := w.Close(); err != nil {
+	urls, err := bookshelf.StoreCover(r.Context(), bookshelf.Storage, f)
+	if err != nil {
 		return "", err
 	}
-
-	const publicURL = "https://storage.googleapis.com/%s/%s"
-	return fmt.Sprintf(publicURL, bookshelf.StorageBucketName, name), nil
+	return urls[bookshelf.DefaultCoverSize], nil
 }
 
 // createHandler adds a book to the database.
 func createHandler(w http.ResponseWriter, r *http.Request) *appError {
 	book, err := bookFromForm(r)
+	if _, ok := err.(*bookshelf.InvalidImageError); ok {
+		return appErrorCodef(http.StatusBadRequest, err, "could not use cover: %v", err)
+	}
 	if err != nil {
 		return appErrorf(err, "could not parse book from form: %v", err)
 	}
-	id, err := bookshelf.DB.AddBook(book)
+	id, err := booksAs(r).AddBook(book)
 	if err != nil {
+		deleteUnsavedCover(r, book.ImageURL)
 		return appErrorf(err, "could not save book: %v", err)
 	}
-	go publishUpdate(id)
+	go publishUpdate(requestID(r), id)
 	http.Redirect(w, r, fmt.Sprintf("/books/%d", id), http.StatusFound)
 	return nil
 }
@@ -254,39 +414,145 @@ func updateHandler(w http.ResponseWriter, r *http.Request) *appError {
 	if err != nil {
 		return appErrorf(err, "bad book id: %v", err)
 	}
+	existing, err := bookshelf.DB.GetBook(id)
+	if err != nil {
+		return appErrorf(err, "could not find book: %v", err)
+	}
+	if appErr := authorize(r, existing, canEdit, "edit"); appErr != nil {
+		return appErr
+	}
+
+	// The form carries the version of the book that was edited, so that edits
+	// made by someone else in the meantime are not overwritten. Forms without
+	// a version, such as those posted by scripts, are applied to the current
+	// version, so the last writer wins. Stale edits are rejected before their
+	// cover is stored.
+	version := existing.Version
+	if v := r.FormValue("version"); v != "" {
+		if version, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return appErrorCodef(http.StatusBadRequest, err, "bad book version: %v", err)
+		}
+	}
+	if version != existing.Version {
+		return editConflict(bookshelf.ErrConflict)
+	}
 
 	book, err := bookFromForm(r)
+	if _, ok := err.(*bookshelf.InvalidImageError); ok {
+		return appErrorCodef(http.StatusBadRequest, err, "could not use cover: %v", err)
+	}
 	if err != nil {
 		return appErrorf(err, "could not parse book from form: %v", err)
 	}
 	book.ID = id
-
-	err = bookshelf.DB.UpdateBook(book)
+	book.CreatedBy = existing.CreatedBy
+	book.CreatedByID = existing.CreatedByID
+	book.Version = version
+
+	// The book may still change before it is updated, in which case the
+	// new cover is not used after all.
+	err = booksAs(r).UpdateBook(book)
+	if err != nil && book.ImageURL != existing.ImageURL {
+		deleteUnsavedCover(r, book.ImageURL)
+	}
+	if err == bookshelf.ErrConflict {
+		return editConflict(err)
+	}
 	if err != nil {
 		return appErrorf(err, "could not save book: %v", err)
 	}
-	go publishUpdate(book.ID)
+	if book.ImageURL != existing.ImageURL {
+		deleteOldCover(r, book.ID, existing.ImageURL)
+	}
+	go publishUpdate(requestID(r), book.ID)
 	http.Redirect(w, r, fmt.Sprintf("/books/%d", book.ID), http.StatusFound)
 	return nil
 }
 
+// editConflict reports that a book was changed while it was being edited.
+func editConflict(err error) *appError {
+	return appErrorCodef(http.StatusConflict, err,
+		"this book was changed by someone else while you were editing it. "+
+			"Go back, reload the page and make your changes again.")
+}
+
 // deleteHandler deletes a given book.
 func deleteHandler(w http.ResponseWriter, r *http.Request) *appError {
 	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
 	if err != nil {
 		return appErrorf(err, "bad book id: %v", err)
 	}
-	err = bookshelf.DB.DeleteBook(id)
+	book, err := bookshelf.DB.GetBook(id)
+	if err != nil {
+		return appErrorf(err, "could not find book: %v", err)
+	}
+	if appErr := authorize(r, book, canDelete, "delete"); appErr != nil {
+		return appErr
+	}
+
+	// The form carries the version of the book that was shown, so that a
+	// book changed meanwhile, perhaps by a change of owner that would deny
+	// the deletion, is not deleted. Forms without a version delete the
+	// current version.
+	if v := r.FormValue("version"); v != "" {
+		var version int64
+		if version, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return appErrorCodef(http.StatusBadRequest, err, "bad book version: %v", err)
+		}
+		err = bookshelf.DeleteBookVersion(booksAs(r), id, version)
+	} else {
+		err = booksAs(r).DeleteBook(id)
+	}
+	if err == bookshelf.ErrConflict {
+		return appErrorCodef(http.StatusConflict, err,
+			"this book was changed by someone else since you opened it. "+
+				"Go back, reload the page and delete it again if you still want to.")
+	}
 	if err != nil {
 		return appErrorf(err, "could not delete book: %v", err)
 	}
+
+	deleteCoverOfDeleted(r, book)
 	http.Redirect(w, r, "/books", http.StatusFound)
 	return nil
 }
 
+// deleteCoverOfDeleted deletes the cover of a book that was deleted, unless
+// the book can be undeleted: purgeCovers deletes it once it can't.
+func deleteCoverOfDeleted(r *http.Request, book *bookshelf.Book) {
+	if bookshelf.Audit != nil && bookshelf.Audit.CanUndelete() {
+		return
+	}
+	deleteOldCover(r, book.ID, book.ImageURL)
+}
+
+// deleteOldCover deletes the cover at imageURL, which the book with the given
+// ID no longer uses, as it was deleted or given another image. The cover is
+// kept if another book uses the same image. Failing to delete it only leaves
+// an unused image behind.
+func deleteOldCover(r *http.Request, bookID int64, imageURL string) {
+	if bookshelf.Storage == nil || imageURL == "" {
+		return
+	}
+	if err := bookshelf.DeleteUnusedCover(r.Context(), bookshelf.Storage, bookshelf.DB, imageURL); err != nil {
+		log.Printf("[request %s] could not delete cover of book %d: %v", requestID(r), bookID, err)
+	}
+}
+
+// deleteUnsavedCover deletes the cover at imageURL, uploaded with a book that
+// could not be saved, unless another book uses the same image.
+func deleteUnsavedCover(r *http.Request, imageURL string) {
+	if bookshelf.Storage == nil || imageURL == "" {
+		return
+	}
+	if err := bookshelf.DeleteUnusedCover(r.Context(), bookshelf.Storage, bookshelf.DB, imageURL); err != nil {
+		log.Printf("[request %s] could not delete cover of unsaved book: %v", requestID(r), err)
+	}
+}
+
 // publishUpdate notifies Pub/Sub subscribers that the book identified with
-// the given ID has been added/modified.
-func publishUpdate(bookID int64) {
+// the given ID has been added/modified, by the request with the given ID.
+func publishUpdate(reqID string, bookID int64) {
 	if bookshelf.PubsubClient == nil {
 		return
 	}
@@ -298,8 +564,12 @@ func publishUpdate(bookID int64) {
 		return
 	}
 	topic := bookshelf.PubsubClient.Topic(bookshelf.PubsubTopicID)
-	_, err = topic.Publish(ctx, &pubsub.Message{Data: b}).Get(ctx)
-	log.Printf("Published update to Pub/Sub for Book ID %d: %v", bookID, err)
+	msg := &pubsub.Message{
+		Data:       b,
+		Attributes: map[string]string{bookshelf.RequestIDAttribute: reqID},
+	}
+	_, err = topic.Publish(ctx, msg).Get(ctx)
+	log.Printf("[request %s] Published update to Pub/Sub for Book ID %d: %v", reqID, bookID, err)
 }
 
 // http://blog.golang.org/error-handling-and-go
@@ -312,18 +582,48 @@ type appError struct {
 }
 
 func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if e := fn(w, r); e != nil { // e is *appError, not os.Error.
-		log.Printf("Handler error: status code: %d, message: %s, underlying err: %#v",
-			e.Code, e.Message, e.Error)
+	e := verifyCSRFRequest(w, r)
+	if e == nil {
+		e = fn(w, r)
+	}
+	if e != nil { // e is *appError, not os.Error.
+		log.Printf("[request %s] Handler error: status code: %d, message: %s, underlying err: %#v",
+			requestID(r), e.Code, e.Message, e.Error)
 
 		http.Error(w, e.Message, e.Code)
 	}
 }
 
+// verifyCSRFRequest rejects requests that may change data unless they carry
+// the CSRF token of the browser making them.
+//
+// Forms are read here, before the handler runs, so their size is limited to
+// maxFormSize.
+func verifyCSRFRequest(w http.ResponseWriter, r *http.Request) *appError {
+	if !safeMethod(r.Method) && r.Header.Get(csrfHeader) == "" {
+		r.Body = http.MaxBytesReader(w, r.Body, maxFormSize)
+		err := r.ParseMultipartForm(maxFormMemory)
+		if err != nil && err != http.ErrNotMultipart {
+			return appErrorCodef(http.StatusBadRequest, err, "could not read form: %v", err)
+		}
+	}
+	if err := verifyCSRF(r); err != nil {
+		return appErrorCodef(http.StatusForbidden, err,
+			"%v. Go back, reload the page and try again.", err)
+	}
+	return nil
+}
+
 func appErrorf(err error, format string, v ...interface{}) *appError {
+	return appErrorCodef(http.StatusInternalServerError, err, format, v...)
+}
+
+// appErrorCodef is like appErrorf, but responds with the given HTTP status
+// code instead of 500.
+func appErrorCodef(code int, err error, format string, v ...interface{}) *appError {
 	return &appError{
 		Error:   err,
 		Message: fmt.Sprintf(format, v...),
-		Code:    500,
+		Code:    code,
 	}
 }
@@ -6,10 +6,19 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"image"
+	"image/png"
+	"log"
 	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"regexp"
 	"strings"
 	"testing"
 
@@ -23,11 +32,32 @@ var wt *webtest.W
 func TestMain(m *testing.M) {
 	serv := httptest.NewServer(nil)
 	wt = webtest.New(nil, serv.Listener.Addr().String())
+	// Keep cookies, such as the one holding the CSRF token.
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	wt.Client = &http.Client{Jar: jar}
 	registerHandlers()
 
 	os.Exit(m.Run())
 }
 
+var csrfFieldRE = regexp.MustCompile(`name="` + csrfFormField + `" value="([^"]+)"`)
+
+// formToken returns the CSRF token that forms served to wt carry.
+func formToken(t *testing.T) string {
+	body, _, err := wt.GetBody("/books/add")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := csrfFieldRE.FindStringSubmatch(body)
+	if m == nil {
+		t.Fatalf("no CSRF token in form: %s", body)
+	}
+	return m[1]
+}
+
 func TestMainFunc(t *testing.T) {
 	wt := webtest.New(t, "localhost:8080")
 	m := testutil.BuildMain(t)
@@ -81,6 +111,7 @@ func TestEditBook(t *testing.T) {
 	m := multipart.NewWriter(&body)
 	m.WriteField("title", "simpsons")
 	m.WriteField("author", "homer")
+	m.WriteField(csrfFormField, formToken(t))
 	m.Close()
 
 	resp, err := wt.Post(bookPath, "multipart/form-data; boundary="+m.Boundary(), &body)
@@ -99,6 +130,68 @@ func TestEditBook(t *testing.T) {
 	}
 }
 
+func TestEditConflict(t *testing.T) {
+	id, err := bookshelf.DB.AddBook(&bookshelf.Book{Title: "book mcbook"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bookshelf.DB.DeleteBook(id)
+
+	bookPath := fmt.Sprintf("/books/%d", id)
+	bodyContains(t, wt, bookPath+"/edit", `name="version" value="1"`)
+
+	// Submit two edits of version 1 of the book. The second is rejected.
+	for i, want := range []int{http.StatusOK, http.StatusConflict} {
+		var body bytes.Buffer
+		m := multipart.NewWriter(&body)
+		m.WriteField("title", fmt.Sprintf("edit %d", i))
+		m.WriteField(csrfFormField, formToken(t))
+		m.WriteField("version", "1")
+		m.Close()
+
+		resp, err := wt.Post(bookPath, "multipart/form-data; boundary="+m.Boundary(), &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("edit %d: got status %d, want %d", i, resp.StatusCode, want)
+		}
+	}
+
+	bodyContains(t, wt, bookPath, "edit 0")
+}
+
+func TestDeleteConflict(t *testing.T) {
+	id, err := bookshelf.DB.AddBook(&bookshelf.Book{Title: "book mcbook"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bookshelf.DB.DeleteBook(id)
+
+	bookPath := fmt.Sprintf("/books/%d", id)
+	bodyContains(t, wt, bookPath, `name="version" value="1"`)
+
+	// The book changes after the handler checks who may delete it, but
+	// before it is deleted.
+	restore := raceChange(func(b *bookshelf.Book) { b.CreatedByID = "someone else" })
+	resp, err := wt.PostForm(bookPath+":delete", url.Values{
+		csrfFormField: {formToken(t)},
+		"version":     {"1"},
+	})
+	restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusConflict; got != want {
+		t.Errorf("delete of a book changed meanwhile: got status %d, want %d", got, want)
+	}
+	if _, err := bookshelf.DB.GetBook(id); err != nil {
+		t.Errorf("book after delete: %v; want it kept", err)
+	}
+}
+
 func TestAddAndDelete(t *testing.T) {
 	bodyContains(t, wt, "/books/add", "Add book")
 
@@ -108,6 +201,7 @@ func TestAddAndDelete(t *testing.T) {
 	m := multipart.NewWriter(&body)
 	m.WriteField("title", "simpsons")
 	m.WriteField("author", "homer")
+	m.WriteField(csrfFormField, formToken(t))
 	m.Close()
 
 	resp, err := wt.Post(bookPath, "multipart/form-data; boundary="+m.Boundary(), &body)
@@ -123,10 +217,252 @@ func TestAddAndDelete(t *testing.T) {
 	bodyContains(t, wt, gotPath, "simpsons")
 	bodyContains(t, wt, gotPath, "homer")
 
-	_, err = wt.Post(gotPath+":delete", "", nil)
+	_, err = wt.PostForm(gotPath+":delete", url.Values{csrfFormField: {formToken(t)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListPages(t *testing.T) {
+	for _, title := range []string{"a", "b", "c"} {
+		id, err := bookshelf.DB.AddBook(&bookshelf.Book{Title: title})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bookshelf.DB.DeleteBook(id)
+	}
+
+	body, _, err := wt.GetBody("/books?pageSize=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(body, "Next") || strings.Contains(body, "Previous") {
+		t.Errorf("first page: want only a next link, got %s", body)
+	}
+
+	bodyContains(t, wt, "/books?pageSize=2&sort=colour", "unknown sort field")
+	bodyContains(t, wt, "/books?cursor=bogus", "invalid cursor")
+}
+
+func TestSearch(t *testing.T) {
+	id, err := bookshelf.DB.AddBook(&bookshelf.Book{
+		Title:       "book mcbook",
+		Description: "a searchable description",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bodyContains(t, wt, "/search?q=Searchable", "book mcbook")
+	bodyContains(t, wt, "/search?q=unsearchable", "No books found")
+
+	if err := bookshelf.DB.DeleteBook(id); err != nil {
+		t.Fatal(err)
+	}
+	bodyContains(t, wt, "/search?q=searchable", "No books found")
+}
+
+func TestImportExport(t *testing.T) {
+	var body bytes.Buffer
+	m := multipart.NewWriter(&body)
+	f, err := m.CreateFormFile("file", "books.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(f, "title,author\nimported mcbook,homer\nIMPORTED  McBook,Homer\n,marge\n")
+	m.WriteField(csrfFormField, formToken(t))
+	m.Close()
+
+	resp, err := wt.Post("/books/import", "multipart/form-data; boundary="+m.Boundary(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("import: got status %d, want 200", resp.StatusCode)
+	}
+
+	books, err := bookshelf.DB.ListBooks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(books) != 1 || books[0].Title != "imported mcbook" {
+		t.Fatalf("after import, got books %+v, want only imported mcbook", books)
+	}
+	defer bookshelf.DB.DeleteBook(books[0].ID)
+
+	bodyContains(t, wt, "/books/export", "imported mcbook,homer")
+	bodyContains(t, wt, "/books/export?format=jsonl", `"title":"imported mcbook"`)
+
+	resp, err = wt.Get("/books/export?format=xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("export as xml: got status %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestUploadCover(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 600, 900))
+	var cover bytes.Buffer
+	if err := png.Encode(&cover, img); err != nil {
+		t.Fatal(err)
+	}
+
+	post := func(filename string, data []byte) *http.Response {
+		var body bytes.Buffer
+		m := multipart.NewWriter(&body)
+		m.WriteField("title", "covered mcbook")
+		m.WriteField(csrfFormField, formToken(t))
+		f, err := m.CreateFormFile("image", filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(data)
+		m.Close()
+		resp, err := wt.Post("/books", "multipart/form-data; boundary="+m.Boundary(), &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// Uploads are checked by content, not by name.
+	if resp := post("cover.jpg", []byte("<html>not an image</html>")); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("uploading a non-image: got status %d, want 400", resp.StatusCode)
+	}
+
+	resp := post("cover.png", cover.Bytes())
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("uploading a cover: got status %d, want 200", resp.StatusCode)
+	}
+	bookPath := resp.Request.URL.Path
+	body, _, err := wt.GetBody(bookPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageURL := regexp.MustCompile(`/blobs/covers/[0-9a-f]+/medium\.jpg`).FindString(body)
+	if imageURL == "" {
+		t.Fatalf("book page doesn't show the uploaded cover: %s", body)
+	}
+
+	resp, err = wt.Get(imageURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, format, err := image.DecodeConfig(resp.Body)
+	resp.Body.Close()
+	if err != nil || format != "jpeg" || cfg.Width != 200 || cfg.Height != 300 {
+		t.Errorf("GET %s: got %s %dx%d (%v), want a 200x300 jpeg", imageURL, format, cfg.Width, cfg.Height, err)
+	}
+
+	getCover := func() int {
+		resp, err := wt.Get(imageURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Books that can be undeleted keep their cover.
+	deleteAndGetCover := func() int {
+		if _, err := wt.PostForm(bookPath+":delete", url.Values{csrfFormField: {formToken(t)}}); err != nil {
+			t.Fatal(err)
+		}
+		return getCover()
+	}
+	if code := deleteAndGetCover(); code != http.StatusOK {
+		t.Errorf("GET %s after deleting the book: got status %d, want 200", imageURL, code)
+	}
+	resp, err = wt.PostForm(bookPath+":undelete", url.Values{csrfFormField: {formToken(t)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// Otherwise, deleting the book deletes its cover.
+	defer func(audit *bookshelf.AuditedDB) { bookshelf.Audit = audit }(bookshelf.Audit)
+	bookshelf.Audit = nil
+	if code := deleteAndGetCover(); code != http.StatusNotFound {
+		t.Errorf("GET %s after deleting the book: got status %d, want 404", imageURL, code)
+	}
+
+	// Deleting a book through the API deletes its cover too.
+	resp = post("cover.png", cover.Bytes())
+	apiPath := "/api/v1" + resp.Request.URL.Path
+	if code := getCover(); code != http.StatusOK {
+		t.Fatalf("GET %s after uploading the cover again: got status %d, want 200", imageURL, code)
+	}
+	if resp := apiDo(t, "DELETE", apiPath, "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE %s: got status %d, want 204", apiPath, resp.StatusCode)
+	}
+	if code := getCover(); code != http.StatusNotFound {
+		t.Errorf("GET %s after deleting the book through the API: got status %d, want 404", imageURL, code)
+	}
+
+	// So does replacing the cover of a book.
+	resp = post("cover.png", cover.Bytes())
+	apiPath = "/api/v1" + resp.Request.URL.Path
+	if resp := apiDo(t, "PATCH", apiPath, `{"imageUrl": "https://example.com/cover.jpg"}`, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("PATCH %s: got status %d, want 200", apiPath, resp.StatusCode)
+	}
+	if code := getCover(); code != http.StatusNotFound {
+		t.Errorf("GET %s after replacing the cover: got status %d, want 404", imageURL, code)
+	}
+	apiDo(t, "DELETE", apiPath, "", nil)
+}
+
+func TestEditConflictCover(t *testing.T) {
+	id, err := bookshelf.DB.AddBook(&bookshelf.Book{Title: "book mcbook"})
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer bookshelf.DB.DeleteBook(id)
+
+	var cover bytes.Buffer
+	if err := png.Encode(&cover, image.NewRGBA(image.Rect(0, 0, 400, 600))); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(cover.Bytes())
+	imageURL := "/blobs/covers/" + hex.EncodeToString(sum[:16]) + "/" + bookshelf.DefaultCoverSize + ".jpg"
+
+	var body bytes.Buffer
+	m := multipart.NewWriter(&body)
+	m.WriteField("title", "covered mcbook")
+	m.WriteField(csrfFormField, formToken(t))
+	m.WriteField("version", "1")
+	f, err := m.CreateFormFile("image", "cover.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(cover.Bytes())
+	m.Close()
+
+	// The book changes after the edit is checked against it, but before it
+	// is updated with the new cover.
+	restore := raceChange(func(b *bookshelf.Book) { b.Author = "marge" })
+	resp, err := wt.Post(fmt.Sprintf("/books/%d", id), "multipart/form-data; boundary="+m.Boundary(), &body)
+	restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusConflict; got != want {
+		t.Fatalf("edit of a book changed meanwhile: got status %d, want %d", got, want)
+	}
+
+	resp, err = wt.Get(imageURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET %s after the conflicting edit: got status %d, want 404", imageURL, resp.StatusCode)
+	}
 }
 
 func bodyContains(t *testing.T, wt *webtest.W, path, contains string) (ok bool) {
@@ -5,13 +5,14 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/gob"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
 
-	plus "google.golang.org/api/plus/v1"
-
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
 
@@ -24,35 +25,58 @@ const (
 	// The following keys are used for the default session. For example:
 	//  session, _ := bookshelf.SessionStore.New(r, defaultSessionID)
 	//  session.Values[oauthTokenSessionKey]
-	googleProfileSessionKey = "google_profile"
-	oauthTokenSessionKey    = "oauth_token"
+	profileSessionKey    = "profile"
+	oauthTokenSessionKey = "oauth_token"
 
-	// This key is used in the OAuth flow session to store the URL to redirect the
-	// user to after the OAuth flow is complete.
+	// The following keys are used in the OAuth flow session to store the URL
+	// to redirect the user to after the OAuth flow is complete, the name of
+	// the provider signing the user in, and the nonce the ID token must carry.
 	oauthFlowRedirectKey = "redirect"
+	oauthFlowProviderKey = "provider"
+	oauthFlowNonceKey    = "nonce"
 )
 
+var loginTmpl = parseTemplate("login.html")
+
 func init() {
 	// Gob encoding for gorilla/sessions
 	gob.Register(&oauth2.Token{})
 	gob.Register(&Profile{})
 }
 
-// loginHandler initiates an OAuth flow to authenticate the user.
+// loginHandler initiates an OpenID Connect flow to authenticate the user with
+// the provider named by the "provider" parameter. If several providers are
+// configured and none is named, the user is asked to choose one.
 func loginHandler(w http.ResponseWriter, r *http.Request) *appError {
+	redirectURL, err := validateRedirectURL(r.FormValue("redirect"))
+	if err != nil {
+		return appErrorf(err, "invalid redirect URL: %v", err)
+	}
+
+	name := r.FormValue("provider")
+	if name == "" && len(bookshelf.OIDCProviders) > 1 {
+		return loginTmpl.Execute(w, r, loginChoices(redirectURL))
+	}
+	provider := findProvider(name)
+	if provider == nil {
+		err := fmt.Errorf("unknown sign-in provider %q", name)
+		return appErrorCodef(http.StatusBadRequest, err, "%v", err)
+	}
+
 	sessionID := uuid.Must(uuid.NewV4()).String()
+	nonce, err := randomToken()
+	if err != nil {
+		return appErrorf(err, "could not create nonce: %v", err)
+	}
 
 	oauthFlowSession, err := bookshelf.SessionStore.New(r, sessionID)
 	if err != nil {
 		return appErrorf(err, "could not create oauth session: %v", err)
 	}
 	oauthFlowSession.Options.MaxAge = 10 * 60 // 10 minutes
-
-	redirectURL, err := validateRedirectURL(r.FormValue("redirect"))
-	if err != nil {
-		return appErrorf(err, "invalid redirect URL: %v", err)
-	}
 	oauthFlowSession.Values[oauthFlowRedirectKey] = redirectURL
+	oauthFlowSession.Values[oauthFlowProviderKey] = provider.Name
+	oauthFlowSession.Values[oauthFlowNonceKey] = nonce
 
 	if err := oauthFlowSession.Save(r, w); err != nil {
 		return appErrorf(err, "could not save session: %v", err)
@@ -61,12 +85,50 @@ func loginHandler(w http.ResponseWriter, r *http.Request) *appError {
 	// Use the session ID for the "state" parameter.
 	// This protects against CSRF (cross-site request forgery).
 	// See https://godoc.org/golang.org/x/oauth2#Config.AuthCodeURL for more detail.
-	url := bookshelf.OAuthConfig.AuthCodeURL(sessionID, oauth2.ApprovalForce,
-		oauth2.AccessTypeOnline)
-	http.Redirect(w, r, url, http.StatusFound)
+	// The nonce ties the ID token to this flow, which protects against
+	// replayed tokens.
+	http.Redirect(w, r, provider.AuthCodeURL(sessionID, nonce), http.StatusFound)
+	return nil
+}
+
+// loginChoice is a link to sign in with a provider.
+type loginChoice struct {
+	Name, URL string
+}
+
+// loginChoices returns a link to sign in with each configured provider.
+func loginChoices(redirectURL string) []loginChoice {
+	var choices []loginChoice
+	for _, p := range bookshelf.OIDCProviders {
+		q := url.Values{"provider": {p.Name}, "redirect": {redirectURL}}
+		choices = append(choices, loginChoice{Name: p.Name, URL: "/login?" + q.Encode()})
+	}
+	return choices
+}
+
+// findProvider returns the configured provider with the given name, or the
+// only one if name is empty. It returns nil if there is no such provider.
+func findProvider(name string) *bookshelf.OIDCProvider {
+	if name == "" && len(bookshelf.OIDCProviders) == 1 {
+		return bookshelf.OIDCProviders[0]
+	}
+	for _, p := range bookshelf.OIDCProviders {
+		if p.Name == name {
+			return p
+		}
+	}
 	return nil
 }
 
+// randomToken returns an unguessable string.
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
 // validateRedirectURL checks that the URL provided is valid.
 // If the URL is missing, redirect the user to the application's root.
 // The URL must not be absolute (i.e., the URL must refer to a path within this
@@ -87,8 +149,8 @@ func validateRedirectURL(path string) (string, error) {
 	return path, nil
 }
 
-// oauthCallbackHandler completes the OAuth flow, retreives the user's profile
-// information and stores it in a session.
+// oauthCallbackHandler completes the OpenID Connect flow, validates the ID
+// token and stores the user's profile in a session.
 func oauthCallbackHandler(w http.ResponseWriter, r *http.Request) *appError {
 	oauthFlowSession, err := bookshelf.SessionStore.Get(r, r.FormValue("state"))
 	if err != nil {
@@ -100,27 +162,37 @@ func oauthCallbackHandler(w http.ResponseWriter, r *http.Request) *appError {
 	if !ok {
 		return appErrorf(err, "invalid state parameter. try logging in again.")
 	}
+	name, _ := oauthFlowSession.Values[oauthFlowProviderKey].(string)
+	nonce, _ := oauthFlowSession.Values[oauthFlowNonceKey].(string)
+	provider := findProvider(name)
+	if provider == nil || nonce == "" {
+		return appErrorf(err, "invalid state parameter. try logging in again.")
+	}
 
-	code := r.FormValue("code")
-	tok, err := bookshelf.OAuthConfig.Exchange(context.Background(), code)
-	if err != nil {
-		return appErrorf(err, "could not get auth token: %v", err)
+	// The flow is only used once.
+	oauthFlowSession.Options.MaxAge = -1
+	if err := oauthFlowSession.Save(r, w); err != nil {
+		return appErrorf(err, "could not save session: %v", err)
 	}
 
-	session, err := bookshelf.SessionStore.New(r, defaultSessionID)
-	if err != nil {
-		return appErrorf(err, "could not get default session: %v", err)
+	if e := r.FormValue("error"); e != "" {
+		err := fmt.Errorf("sign-in failed: %s", e)
+		return appErrorCodef(http.StatusUnauthorized, err, "%v", err)
 	}
 
-	ctx := context.Background()
-	profile, err := fetchProfile(ctx, tok)
+	tok, claims, err := provider.Exchange(context.Background(), r.FormValue("code"), nonce)
 	if err != nil {
-		return appErrorf(err, "could not fetch Google profile: %v", err)
+		return appErrorCodef(http.StatusUnauthorized, err, "could not sign in: %v", err)
 	}
 
+	session, err := bookshelf.SessionStore.New(r, defaultSessionID)
+	if err != nil {
+		return appErrorf(err, "could not get default session: %v", err)
+	}
 	session.Values[oauthTokenSessionKey] = tok
-	// Strip the profile to only the fields we need. Otherwise the struct is too big.
-	session.Values[googleProfileSessionKey] = stripProfile(profile)
+	// Keep only the fields of the profile we need. Otherwise the session is
+	// too big.
+	session.Values[profileSessionKey] = profileFromClaims(provider, claims)
 	if err := session.Save(r, w); err != nil {
 		return appErrorf(err, "could not save session: %v", err)
 	}
@@ -129,17 +201,6 @@ func oauthCallbackHandler(w http.ResponseWriter, r *http.Request) *appError {
 	return nil
 }
 
-// fetchProfile retrieves the Google+ profile of the user associated with the
-// provided OAuth token.
-func fetchProfile(ctx context.Context, tok *oauth2.Token) (*plus.Person, error) {
-	client := oauth2.NewClient(ctx, bookshelf.OAuthConfig.TokenSource(ctx, tok))
-	plusService, err := plus.New(client)
-	if err != nil {
-		return nil, err
-	}
-	return plusService.People.Get("me").Do()
-}
-
 // logoutHandler clears the default session.
 func logoutHandler(w http.ResponseWriter, r *http.Request) *appError {
 	session, err := bookshelf.SessionStore.New(r, defaultSessionID)
@@ -158,7 +219,7 @@ func logoutHandler(w http.ResponseWriter, r *http.Request) *appError {
 	return nil
 }
 
-// profileFromSession retreives the Google+ profile from the default session.
+// profileFromSession retreives the user's profile from the default session.
 // Returns nil if the profile cannot be retreived (e.g. user is logged out).
 func profileFromSession(r *http.Request) *Profile {
 	session, err := bookshelf.SessionStore.Get(r, defaultSessionID)
@@ -169,7 +230,7 @@ func profileFromSession(r *http.Request) *Profile {
 	if !ok || !tok.Valid() {
 		return nil
 	}
-	profile, ok := session.Values[googleProfileSessionKey].(*Profile)
+	profile, ok := session.Values[profileSessionKey].(*Profile)
 	if !ok {
 		return nil
 	}
@@ -180,11 +241,19 @@ type Profile struct {
 	ID, DisplayName, ImageURL string
 }
 
-// stripProfile returns a subset of a plus.Person.
-func stripProfile(p *plus.Person) *Profile {
+// profileFromClaims returns the profile described by the standard claims of
+// a validated ID token.
+func profileFromClaims(p *bookshelf.OIDCProvider, claims *bookshelf.IDTokenClaims) *Profile {
+	name := claims.Name
+	if name == "" {
+		name = claims.Email
+	}
+	if name == "" {
+		name = claims.Subject
+	}
 	return &Profile{
-		ID:          p.Id,
-		DisplayName: p.DisplayName,
-		ImageURL:    p.Image.Url,
+		ID:          p.IDPrefix + claims.Subject,
+		DisplayName: name,
+		ImageURL:    claims.Picture,
 	}
 }
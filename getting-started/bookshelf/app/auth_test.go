@@ -0,0 +1,135 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf/internal/oidctest"
+)
+
+// withProviders configures a provider for each fake issuer, named after its
+// index, for the duration of a test.
+func withProviders(t *testing.T, issuers ...*oidctest.Issuer) (restore func()) {
+	old := bookshelf.OIDCProviders
+	bookshelf.OIDCProviders = nil
+	for i, f := range issuers {
+		p, err := bookshelf.NewOIDCProvider(context.Background(), http.DefaultClient, bookshelf.OIDCConfig{
+			Name:     string(rune('a' + i)),
+			Issuer:   f.URL,
+			ClientID: "app",
+		}, "http://localhost/oauth2callback")
+		if err != nil {
+			t.Fatal(err)
+		}
+		bookshelf.OIDCProviders = append(bookshelf.OIDCProviders, p)
+	}
+	return func() { bookshelf.OIDCProviders = old }
+}
+
+// serveWithCookies serves a request carrying the given cookies.
+func serveWithCookies(method, path string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestLogin(t *testing.T) {
+	f := oidctest.NewIssuer(t)
+	defer f.Close()
+	defer withProviders(t, f)()
+
+	rec := serveWithCookies("GET", "/login?redirect=/books/mine", nil)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("GET /login: got status %d, want 302: %s", rec.Code, rec.Body)
+	}
+	authURL, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := authURL.Scheme+"://"+authURL.Host+authURL.Path, f.URL+"/authorize"; got != want {
+		t.Errorf("login redirects to %s, want %s", got, want)
+	}
+	q := authURL.Query()
+	state, nonce := q.Get("state"), q.Get("nonce")
+	if state == "" || nonce == "" || q.Get("client_id") != "app" {
+		t.Fatalf("authorize URL %s is missing the state, nonce or client", authURL)
+	}
+	flowCookies := rec.Result().Cookies()
+
+	callback := "/oauth2callback?" + url.Values{"state": {state}, "code": {"good-code"}}.Encode()
+
+	// The ID token must carry the nonce of the flow.
+	claims := f.Claims()
+	f.SetIDToken(f.Sign(t, claims))
+	if rec := serveWithCookies("GET", callback, flowCookies); rec.Code != http.StatusUnauthorized {
+		t.Errorf("callback with the wrong nonce: got status %d, want 401", rec.Code)
+	}
+
+	claims["nonce"] = nonce
+	f.SetIDToken(f.Sign(t, claims))
+	rec = serveWithCookies("GET", callback, flowCookies)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/books/mine" {
+		t.Fatalf("callback: got status %d to %q, want 302 to /books/mine: %s",
+			rec.Code, rec.Header().Get("Location"), rec.Body)
+	}
+
+	var session []*http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == defaultSessionID {
+			session = append(session, c)
+		}
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	for _, c := range session {
+		req.AddCookie(c)
+	}
+	profile := profileFromSession(req)
+	if profile == nil || profile.ID != "a:1234" || profile.DisplayName != "Homer Simpson" {
+		t.Fatalf("profile = %+v, want a:1234 Homer Simpson", profile)
+	}
+	if body := serveWithCookies("GET", "/books", session).Body.String(); !strings.Contains(body, "Homer Simpson") {
+		t.Errorf("signed-in page doesn't show the user: %s", body)
+	}
+
+	// Codes the provider doesn't accept fail to sign in.
+	bad := "/oauth2callback?" + url.Values{"state": {state}, "code": {"bad-code"}}.Encode()
+	if rec := serveWithCookies("GET", bad, flowCookies); rec.Code != http.StatusUnauthorized {
+		t.Errorf("callback with a bad code: got status %d, want 401", rec.Code)
+	}
+}
+
+func TestLoginChoosesProvider(t *testing.T) {
+	f1, f2 := oidctest.NewIssuer(t), oidctest.NewIssuer(t)
+	defer f1.Close()
+	defer f2.Close()
+	defer withProviders(t, f1, f2)()
+
+	body := serveWithCookies("GET", "/login?redirect=/books", nil).Body.String()
+	for _, name := range []string{"a", "b"} {
+		if !strings.Contains(body, "/login?provider="+name+"&amp;redirect=%2Fbooks") {
+			t.Errorf("login page doesn't offer provider %s: %s", name, body)
+		}
+	}
+
+	rec := serveWithCookies("GET", "/login?provider=b", nil)
+	if loc := rec.Header().Get("Location"); !strings.HasPrefix(loc, f2.URL+"/authorize?") {
+		t.Errorf("login with provider b redirects to %q, want %s/authorize", loc, f2.URL)
+	}
+	if rec := serveWithCookies("GET", "/login?provider=c", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("login with an unknown provider: got status %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+)
+
+const (
+	// csrfSessionID is the session holding the CSRF token of a browser. It is
+	// separate from the default session so that the token survives logging
+	// in and out.
+	csrfSessionID = "csrf"
+	csrfTokenKey  = "token"
+
+	// Forms carry the CSRF token in this field, and scripts in this header.
+	csrfFormField = "csrf_token"
+	csrfHeader    = "X-CSRF-Token"
+
+	// maxFormSize is the largest form accepted, large enough for a cover
+	// image or an import file along with the other fields. Up to
+	// maxFormMemory of it is kept in memory, and the rest in temporary files.
+	maxFormSize   = maxImportSize + 1<<20
+	maxFormMemory = 32 << 20
+)
+
+var errCSRF = errors.New("missing or invalid CSRF token")
+
+// csrfToken returns the CSRF token of the browser making the request,
+// creating one if it has none yet. Pages with forms that change data must
+// include the token in them; see appTemplate.Execute.
+func csrfToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	session, err := bookshelf.SessionStore.Get(r, csrfSessionID)
+	if err != nil {
+		// The session couldn't be decoded, e.g. because its key was
+		// removed. Start a new one.
+		session, err = bookshelf.SessionStore.New(r, csrfSessionID)
+		if session == nil {
+			return "", err
+		}
+	}
+	if token, ok := session.Values[csrfTokenKey].(string); ok && token != "" {
+		return token, nil
+	}
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	session.Values[csrfTokenKey] = token
+	if err := session.Save(r, w); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// verifyCSRF checks that requests that may change data carry the CSRF token
+// of the browser making them, so that they can't be forged by other sites.
+func verifyCSRF(r *http.Request) error {
+	if safeMethod(r.Method) {
+		return nil
+	}
+
+	session, err := bookshelf.SessionStore.Get(r, csrfSessionID)
+	if err != nil {
+		return errCSRF
+	}
+	want, ok := session.Values[csrfTokenKey].(string)
+	if !ok || want == "" {
+		return errCSRF
+	}
+	got := r.Header.Get(csrfHeader)
+	if got == "" {
+		got = r.PostFormValue(csrfFormField)
+	}
+	if subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+		return errCSRF
+	}
+	return nil
+}
+
+// safeMethod reports whether requests with the given method only read data,
+// and so need no CSRF token.
+func safeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+)
+
+// csrfCookie returns a session cookie holding the given CSRF token.
+func csrfCookie(t *testing.T, token string) *http.Cookie {
+	req := httptest.NewRequest("GET", "/", nil)
+	session, err := bookshelf.SessionStore.New(req, csrfSessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Values[csrfTokenKey] = token
+	rec := httptest.NewRecorder()
+	if err := session.Save(req, rec); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Result().Cookies()[0]
+}
+
+func TestCSRF(t *testing.T) {
+	id, err := bookshelf.DB.AddBook(&bookshelf.Book{Title: "csrf mcbook"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bookshelf.DB.DeleteBook(id)
+	deletePath := fmt.Sprintf("/books/%d:delete", id)
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		form   url.Values
+		header string
+		want   int
+	}{
+		{"no token", nil, nil, "", http.StatusForbidden},
+		{"no session", nil, url.Values{csrfFormField: {"token"}}, "", http.StatusForbidden},
+		{"wrong token", csrfCookie(t, "token"), url.Values{csrfFormField: {"other"}}, "", http.StatusForbidden},
+		{"token from header", csrfCookie(t, "token"), nil, "token", http.StatusFound},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", deletePath, strings.NewReader(tt.form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tt.cookie != nil {
+			req.AddCookie(tt.cookie)
+		}
+		if tt.header != "" {
+			req.Header.Set(csrfHeader, tt.header)
+		}
+		rec := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: got status %d, want %d: %s", tt.name, rec.Code, tt.want, rec.Body)
+		}
+	}
+}
+
+func TestCSRFFormField(t *testing.T) {
+	// Pages with forms set the CSRF cookie and include its token, which is
+	// kept across pages.
+	rec := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest("GET", "/books/add", nil))
+	m := csrfFieldRE.FindStringSubmatch(rec.Body.String())
+	if m == nil {
+		t.Fatalf("no CSRF token in form: %s", rec.Body)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != csrfSessionID {
+		t.Fatalf("got cookies %v, want a CSRF session", cookies)
+	}
+
+	req := httptest.NewRequest("GET", "/books/import", nil)
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rec, req)
+	if got := csrfFieldRE.FindStringSubmatch(rec.Body.String()); got == nil || got[1] != m[1] {
+		t.Errorf("second page has token %v, want %s", got, m[1])
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/gorilla/mux"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+)
+
+var (
+	historyTmpl = parseTemplate("history.html")
+	deletedTmpl = parseTemplate("deleted.html")
+)
+
+var errNoHistory = errors.New("the history of books isn't kept")
+
+// registerHistoryHandlers adds the handlers for showing the history of books,
+// restoring old versions and undeleting books to r.
+func registerHistoryHandlers(r *mux.Router) {
+	r.Methods("GET").Path("/books/deleted").
+		Handler(appHandler(deletedHandler))
+	r.Methods("GET").Path("/books/{id:[0-9]+}/history").
+		Handler(appHandler(historyHandler))
+	r.Methods("POST").Path("/books/{id:[0-9]+}:restore").
+		Handler(appHandler(restoreHandler))
+	r.Methods("POST").Path("/books/{id:[0-9]+}:undelete").
+		Handler(appHandler(undeleteHandler))
+}
+
+// coverPurgeInterval is how often purgeCovers deletes the covers of the
+// books that can no longer be undeleted.
+const coverPurgeInterval = time.Hour
+
+// purgeCovers deletes the covers of deleted books once they can no longer be
+// undeleted, every interval.
+func purgeCovers(interval time.Duration) {
+	if bookshelf.Audit == nil || !bookshelf.Audit.CanUndelete() {
+		// The covers are deleted with the books.
+		return
+	}
+	for {
+		if err := bookshelf.Audit.PurgeCovers(context.Background()); err != nil {
+			log.Printf("Could not purge the covers of deleted books: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// booksAs returns the book database, recording the changes made through it
+// as made by the user making the request.
+func booksAs(r *http.Request) bookshelf.BookDatabase {
+	if bookshelf.Audit == nil {
+		return bookshelf.DB
+	}
+	return bookshelf.Audit.As(actorOf(r))
+}
+
+// actorOf returns the user making the request, as recorded in the history of
+// the books they change.
+func actorOf(r *http.Request) bookshelf.Actor {
+	if p := profileFromSession(r); p != nil {
+		return bookshelf.Actor{ID: p.ID, Name: p.DisplayName}
+	}
+	return bookshelf.Actor{ID: "anonymous", Name: "Anonymous"}
+}
+
+// bookHistory is the data rendered by templates/history.html.
+type bookHistory struct {
+	ID int64
+
+	// Book is the current version of the book, or nil if it was deleted.
+	Book *bookshelf.Book
+
+	// Changes are the changes made to the book, newest first.
+	Changes []*bookshelf.Change
+
+	CanRestore, CanUndelete bool
+}
+
+// historyHandler displays the changes made to a given book, including
+// deleted ones, and offers to restore earlier versions or undelete it.
+func historyHandler(w http.ResponseWriter, r *http.Request) *appError {
+	id, history, appErr := historyFromRequest(r)
+	if appErr != nil {
+		return appErr
+	}
+
+	h := &bookHistory{ID: id}
+	for i := len(history) - 1; i >= 0; i-- {
+		h.Changes = append(h.Changes, history[i])
+	}
+	user := profileFromSession(r)
+	book, err := bookshelf.DB.GetBook(id)
+	switch {
+	case err == bookshelf.ErrNotFound:
+		last := h.Changes[0]
+		h.CanUndelete = last.Action == bookshelf.ChangeDelete && undeletable(last) &&
+			canDelete(user, &last.Book)
+	case err != nil:
+		return appErrorf(err, "could not find book: %v", err)
+	default:
+		h.Book = book
+		h.CanRestore = canEdit(user, book)
+	}
+	return historyTmpl.Execute(w, r, h)
+}
+
+// undeletable reports whether the book deleted by c can still be undeleted.
+func undeletable(c *bookshelf.Change) bool {
+	if !bookshelf.Audit.CanUndelete() {
+		return false
+	}
+	deleted, err := bookshelf.Audit.Deleted()
+	if err != nil {
+		return false
+	}
+	for _, d := range deleted {
+		if d.ID == c.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// historyFromRequest returns the ID of the book in the URL's path, and its
+// history.
+func historyFromRequest(r *http.Request) (int64, []*bookshelf.Change, *appError) {
+	if bookshelf.Audit == nil {
+		return 0, nil, appErrorCodef(http.StatusNotFound, errNoHistory, "%v", errNoHistory)
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return 0, nil, appErrorf(err, "bad book id: %v", err)
+	}
+	history, err := bookshelf.Audit.History(id)
+	if err != nil {
+		return 0, nil, appErrorf(err, "could not read history: %v", err)
+	}
+	if len(history) == 0 {
+		err := fmt.Errorf("no history for book %d", id)
+		return 0, nil, appErrorCodef(http.StatusNotFound, err, "%v", err)
+	}
+	return id, history, nil
+}
+
+// restoreHandler sets a given book back to the version in the "version" form
+// field.
+func restoreHandler(w http.ResponseWriter, r *http.Request) *appError {
+	id, _, appErr := historyFromRequest(r)
+	if appErr != nil {
+		return appErr
+	}
+	version, err := strconv.ParseInt(r.FormValue("version"), 10, 64)
+	if err != nil {
+		return appErrorCodef(http.StatusBadRequest, err, "bad book version: %v", err)
+	}
+	book, err := bookshelf.DB.GetBook(id)
+	if err == bookshelf.ErrNotFound {
+		return appErrorCodef(http.StatusNotFound, err, "the book was deleted: undelete it first")
+	}
+	if err != nil {
+		return appErrorf(err, "could not find book: %v", err)
+	}
+	if appErr := authorize(r, book, canEdit, "edit"); appErr != nil {
+		return appErr
+	}
+
+	_, err = bookshelf.Audit.As(actorOf(r)).Restore(id, version)
+	if err == bookshelf.ErrNoSuchVersion {
+		return appErrorCodef(http.StatusNotFound, err, "%v", err)
+	}
+	if err != nil {
+		return appErrorf(err, "could not restore book: %v", err)
+	}
+	http.Redirect(w, r, fmt.Sprintf("/books/%d", id), http.StatusFound)
+	return nil
+}
+
+// undeleteHandler adds back a given deleted book.
+func undeleteHandler(w http.ResponseWriter, r *http.Request) *appError {
+	id, history, appErr := historyFromRequest(r)
+	if appErr != nil {
+		return appErr
+	}
+	// Those who could delete the book may undelete it.
+	if appErr := authorize(r, &history[len(history)-1].Book, canDelete, "undelete"); appErr != nil {
+		return appErr
+	}
+
+	_, err := bookshelf.Audit.As(actorOf(r)).Undelete(id)
+	switch err {
+	case nil:
+	case bookshelf.ErrNotDeleted:
+		return appErrorCodef(http.StatusConflict, err, "%v", err)
+	case bookshelf.ErrUndeleteExpired:
+		return appErrorCodef(http.StatusGone, err, "%v", err)
+	default:
+		return appErrorf(err, "could not undelete book: %v", err)
+	}
+	http.Redirect(w, r, fmt.Sprintf("/books/%d", id), http.StatusFound)
+	return nil
+}
+
+// deletedBook is a book listed by templates/deleted.html.
+type deletedBook struct {
+	*bookshelf.Change
+	CanUndelete bool
+}
+
+// deletedHandler lists the books that were deleted recently enough to be
+// undeleted.
+func deletedHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if bookshelf.Audit == nil || !bookshelf.Audit.CanUndelete() {
+		return appErrorCodef(http.StatusNotFound, errNoHistory, "deleted books can't be undeleted")
+	}
+	deleted, err := bookshelf.Audit.Deleted()
+	if err != nil {
+		return appErrorf(err, "could not list deleted books: %v", err)
+	}
+
+	user := profileFromSession(r)
+	var books []deletedBook
+	for _, c := range deleted {
+		books = append(books, deletedBook{Change: c, CanUndelete: canDelete(user, &c.Book)})
+	}
+	return deletedTmpl.Execute(w, r, books)
+}
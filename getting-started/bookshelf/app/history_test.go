@@ -0,0 +1,103 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+)
+
+func TestHistory(t *testing.T) {
+	defer withRoles()()
+
+	id, err := bookshelf.DB.AddBook(&bookshelf.Book{Title: "first title", CreatedByID: "owner"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bookshelf.DB.DeleteBook(id)
+	bookPath := fmt.Sprintf("/books/%d", id)
+	historyPath := bookPath + "/history"
+
+	var body bytes.Buffer
+	m := multipart.NewWriter(&body)
+	m.WriteField("title", "second title")
+	m.Close()
+	if rec := serveAs(t, "editor", "POST", bookPath, "multipart/form-data; boundary="+m.Boundary(), &body); rec.Code != http.StatusFound {
+		t.Fatalf("update: got status %d, want 302: %s", rec.Code, rec.Body)
+	}
+
+	// The history shows who changed which fields.
+	page := serveAs(t, "owner", "GET", historyPath, "", nil).Body.String()
+	for _, want := range []string{"Updated", "by editor", "first title", "second title", "Restore this version"} {
+		if !strings.Contains(page, want) {
+			t.Errorf("history page doesn't show %q: %s", want, page)
+		}
+	}
+	if page := serveAs(t, "someone", "GET", historyPath, "", nil).Body.String(); strings.Contains(page, "Restore this version") {
+		t.Error("history page offers to restore to a user who may not edit the book")
+	}
+
+	restore := func(user string) int {
+		return serveAs(t, user, "POST", bookPath+":restore", "application/x-www-form-urlencoded", strings.NewReader("version=1")).Code
+	}
+	if code := restore("someone"); code != http.StatusForbidden {
+		t.Errorf("restore as someone: got status %d, want 403", code)
+	}
+	if code := restore("owner"); code != http.StatusFound {
+		t.Errorf("restore as owner: got status %d, want 302", code)
+	}
+	if book, err := bookshelf.DB.GetBook(id); err != nil || book.Title != "first title" || book.Version != 3 {
+		t.Errorf("restored book = %+v, %v; want the first title at version 3", book, err)
+	}
+
+	if rec := serveAs(t, "", "GET", fmt.Sprintf("/books/%d/history", id+1000), "", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("history of an unknown book: got status %d, want 404", rec.Code)
+	}
+}
+
+func TestUndelete(t *testing.T) {
+	defer withRoles()()
+
+	id, err := bookshelf.DB.AddBook(&bookshelf.Book{Title: "deleted mcbook", CreatedByID: "owner"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bookshelf.DB.DeleteBook(id)
+	bookPath := fmt.Sprintf("/books/%d", id)
+
+	undelete := func(user string) int {
+		return serveAs(t, user, "POST", bookPath+":undelete", "", nil).Code
+	}
+	if code := undelete("owner"); code != http.StatusConflict {
+		t.Errorf("undelete of a book that exists: got status %d, want 409", code)
+	}
+
+	if rec := serveAs(t, "owner", "POST", bookPath+":delete", "", nil); rec.Code != http.StatusFound {
+		t.Fatalf("delete: got status %d, want 302: %s", rec.Code, rec.Body)
+	}
+	if page := serveAs(t, "owner", "GET", "/books/deleted", "", nil).Body.String(); !strings.Contains(page, "deleted mcbook") {
+		t.Errorf("recently deleted books don't list the book: %s", page)
+	}
+	if page := serveAs(t, "owner", "GET", bookPath+"/history", "", nil).Body.String(); !strings.Contains(page, "Undelete book") {
+		t.Errorf("history of a deleted book doesn't offer to undelete it: %s", page)
+	}
+
+	// Those who may delete a book may undelete it.
+	if code := undelete("editor"); code != http.StatusForbidden {
+		t.Errorf("undelete as editor: got status %d, want 403", code)
+	}
+	if code := undelete("owner"); code != http.StatusFound {
+		t.Errorf("undelete as owner: got status %d, want 302", code)
+	}
+	if book, err := bookshelf.DB.GetBook(id); err != nil || book.Title != "deleted mcbook" {
+		t.Errorf("undeleted book = %+v, %v", book, err)
+	}
+}
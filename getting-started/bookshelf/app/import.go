@@ -0,0 +1,143 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+)
+
+// maxImportSize is the largest file accepted by importHandler. The form it is
+// uploaded in is limited to maxFormSize.
+const maxImportSize = 10 << 20
+
+var importTmpl = parseTemplate("import.html")
+
+// registerImportHandlers adds the handlers for importing and exporting books
+// to r.
+func registerImportHandlers(r *mux.Router) {
+	r.Methods("GET").Path("/books/export").
+		Handler(appHandler(exportHandler))
+	r.Methods("GET").Path("/books/mine/export").
+		Handler(appHandler(exportMineHandler))
+	r.Methods("GET").Path("/books/import").
+		Handler(appHandler(importFormHandler))
+	r.Methods("POST").Path("/books/import").
+		Handler(appHandler(importHandler))
+}
+
+// exportHandler downloads all books, in the format given by the "format"
+// query parameter: "csv" (the default) or "jsonl".
+func exportHandler(w http.ResponseWriter, r *http.Request) *appError {
+	return exportBooks(w, r, "")
+}
+
+// exportMineHandler downloads the books created by the currently
+// authenticated user.
+func exportMineHandler(w http.ResponseWriter, r *http.Request) *appError {
+	user := profileFromSession(r)
+	if user == nil {
+		http.Redirect(w, r, "/login?redirect="+r.URL.RequestURI(), http.StatusFound)
+		return nil
+	}
+	return exportBooks(w, r, user.ID)
+}
+
+// exportBooks writes the books created by the given user, or all books if
+// userID is empty, as a file download.
+func exportBooks(w http.ResponseWriter, r *http.Request, userID string) *appError {
+	format := r.FormValue("format")
+	if format == "" {
+		format = bookshelf.FormatCSV
+	}
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		return appErrorCodef(http.StatusBadRequest, nil, "unknown export format %q", format)
+	}
+
+	books, err := bookshelf.DB.ListBooksCreatedBy(userID)
+	if err != nil {
+		return appErrorf(err, "could not list books: %v", err)
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="books.%s"`, format))
+	if err := bookshelf.ExportBooks(w, format, books); err != nil {
+		return appErrorf(err, "could not export books: %v", err)
+	}
+	return nil
+}
+
+var exportContentTypes = map[string]string{
+	bookshelf.FormatCSV:   "text/csv; charset=utf-8",
+	bookshelf.FormatJSONL: "application/x-ndjson",
+}
+
+// importPage is the data rendered by templates/import.html.
+type importPage struct {
+	// Result is the outcome of an import, if one was attempted.
+	Result *bookshelf.ImportResult
+
+	// Error explains why the file could not be imported at all.
+	Error string
+}
+
+// importFormHandler displays a form for uploading books to import.
+func importFormHandler(w http.ResponseWriter, r *http.Request) *appError {
+	return importTmpl.Execute(w, r, importPage{})
+}
+
+// importHandler adds the books in an uploaded CSV or JSON Lines file, and
+// reports which rows were added, skipped as duplicates, or invalid.
+//
+// The books are recorded as created by the current user, whatever the file
+// says. If the "enrich" field is set, each added book is published to Pub/Sub
+// for the worker to fill in its details.
+func importHandler(w http.ResponseWriter, r *http.Request) *appError {
+	f, fh, err := r.FormFile("file")
+	if err != nil {
+		return appErrorCodef(http.StatusBadRequest, err, "could not read uploaded file: %v", err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(f, maxImportSize+1))
+	if err != nil {
+		return appErrorf(err, "could not read uploaded file: %v", err)
+	}
+	if len(data) > maxImportSize {
+		return appErrorCodef(http.StatusBadRequest, nil, "file is larger than %d MB", maxImportSize>>20)
+	}
+
+	format := r.FormValue("format")
+	if format == "" {
+		// Guess the format from the file name.
+		format = bookshelf.FormatFromFilename(fh.Filename)
+	}
+
+	opts := bookshelf.ImportOptions{
+		Format: format,
+		Prepare: func(b *bookshelf.Book) {
+			setCreatorFromSession(r, b)
+		},
+	}
+	if r.FormValue("enrich") != "" {
+		opts.Added = func(b *bookshelf.Book) {
+			go publishUpdate(requestID(r), b.ID)
+		}
+	}
+
+	result, err := bookshelf.ImportBooks(booksAs(r), bytes.NewReader(data), opts)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return importTmpl.Execute(w, r, importPage{Error: err.Error()})
+	}
+	return importTmpl.Execute(w, r, importPage{Result: result})
+}
@@ -0,0 +1,183 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/gorilla/handlers"
+	"github.com/gorilla/mux"
+
+	"contrib.go.opencensus.io/exporter/stackdriver/propagation"
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+)
+
+// requestIDHeader carries the ID of a request. IDs given by clients or load
+// balancers are kept, so that requests can be followed across services.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the length of the longest request ID accepted from
+// clients.
+const maxRequestIDLength = 128
+
+var (
+	requestLatency = stats.Float64("bookshelf/http/latency",
+		"Latency of HTTP requests", stats.UnitMilliseconds)
+
+	// keyRoute, keyMethod and keyCode tag the requests with the route they
+	// matched, their method and their status code.
+	keyRoute  = tag.MustNewKey("route")
+	keyMethod = tag.MustNewKey("method")
+	keyCode   = tag.MustNewKey("code")
+)
+
+// requestViews are the views of the requests recorded by routeMetrics, served
+// to Prometheus as bookshelf_http_latency (a histogram) and
+// bookshelf_http_requests.
+var requestViews = []*view.View{
+	{
+		Name:        "bookshelf/http/latency",
+		Description: "Latency of HTTP requests, by route and method",
+		Measure:     requestLatency,
+		TagKeys:     []tag.Key{keyRoute, keyMethod},
+		Aggregation: bookshelf.LatencyDistribution,
+	},
+	{
+		Name:        "bookshelf/http/requests",
+		Description: "HTTP requests, by route, method and status code",
+		Measure:     requestLatency,
+		TagKeys:     []tag.Key{keyRoute, keyMethod, keyCode},
+		Aggregation: view.Count(),
+	},
+}
+
+// instrument gives each request handled by h an ID and, if enabled, traces
+// it.
+func instrument(h http.Handler) http.Handler {
+	h = withRequestID(h)
+	if bookshelf.Tracing {
+		// Continue the traces started by the App Engine load balancer.
+		h = &ochttp.Handler{Handler: h, Propagation: &propagation.HTTPFormat{}}
+	}
+	return h
+}
+
+type requestIDKey struct{}
+
+// withRequestID gives each request an ID, kept in its context and sent back
+// in the X-Request-ID header. The ID is that of the request header if valid,
+// or a new random one.
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		trace.FromContext(r.Context()).AddAttributes(trace.StringAttribute("request_id", id))
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestID returns the ID of the request, or "" if it has none.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// newRequestID returns a random request ID.
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// validRequestID reports whether id is a request ID that is safe to log: one
+// of up to maxRequestIDLength printable ASCII characters, other than spaces
+// and quotes.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if c := id[i]; c <= ' ' || c > '~' || c == '"' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// writeRequestLog writes a line in the Apache Combined Log Format, followed
+// by the ID of the request.
+func writeRequestLog(w io.Writer, p handlers.LogFormatterParams) {
+	host, _, err := net.SplitHostPort(p.Request.RemoteAddr)
+	if err != nil {
+		host = p.Request.RemoteAddr
+	}
+	uri := p.Request.RequestURI
+	if uri == "" {
+		uri = p.URL.RequestURI()
+	}
+	fmt.Fprintf(w, "%s - - [%s] \"%s %s %s\" %d %d %q %q request_id=%s\n",
+		host, p.TimeStamp.Format("02/Jan/2006:15:04:05 -0700"),
+		p.Request.Method, uri, p.Request.Proto, p.StatusCode, p.Size,
+		p.Request.Referer(), p.Request.UserAgent(), requestID(p.Request))
+}
+
+// routeMetrics is a mux middleware that records the latency and status code
+// of requests, labelled with the path template of the route they matched,
+// such as "/books/{id:[0-9]+}". Requests that match no route aren't recorded.
+func routeMetrics(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if cur := mux.CurrentRoute(r); cur != nil {
+			if tmpl, err := cur.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		h.ServeHTTP(sw, r)
+		stats.RecordWithTags(r.Context(),
+			[]tag.Mutator{
+				tag.Upsert(keyRoute, route),
+				tag.Upsert(keyMethod, r.Method),
+				tag.Upsert(keyCode, strconv.Itoa(sw.status)),
+			},
+			requestLatency.M(float64(time.Since(start))/float64(time.Millisecond)))
+	})
+}
+
+// statusWriter records the status code written to a ResponseWriter.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = code, true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
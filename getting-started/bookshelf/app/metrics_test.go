@@ -0,0 +1,89 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/handlers"
+)
+
+func TestRequestID(t *testing.T) {
+	serve := func(id string) string {
+		req := httptest.NewRequest("GET", "/books", nil)
+		if id != "" {
+			req.Header.Set(requestIDHeader, id)
+		}
+		rec := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(rec, req)
+		return rec.Header().Get(requestIDHeader)
+	}
+
+	first, second := serve(""), serve("")
+	if first == "" || first == second {
+		t.Errorf("new request IDs are %q and %q, want distinct IDs", first, second)
+	}
+	if got := serve("abc-123"); got != "abc-123" {
+		t.Errorf("request ID from the client: got %q, want abc-123", got)
+	}
+	for _, bad := range []string{"has space", `quo"te`, strings.Repeat("x", maxRequestIDLength+1)} {
+		if got := serve(bad); got == bad || got == "" {
+			t.Errorf("invalid request ID %q was replaced by %q", bad, got)
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	for _, path := range []string{"/books", "/books/123456789/history"} {
+		http.DefaultServeMux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	body, _, err := wt.GetBody("/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`bookshelf_http_requests{code="200",method="GET",route="/books"}`,
+		`bookshelf_http_requests{code="404",method="GET",route="/books/{id:[0-9]+}/history"}`,
+		`bookshelf_http_latency_count{method="GET",route="/books/{id:[0-9]+}/history"}`,
+		`bookshelf_db_latency_count{backend="memory",method="ListBooksPage"}`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics don't include %s", want)
+		}
+	}
+}
+
+func TestWriteRequestLog(t *testing.T) {
+	req := httptest.NewRequest("GET", "/books?x=1", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("User-Agent", "test")
+	var got bytes.Buffer
+	withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeRequestLog(&got, handlers.LogFormatterParams{
+			Request:    r,
+			URL:        url.URL{Path: "/books"},
+			TimeStamp:  time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC),
+			StatusCode: 200,
+			Size:       42,
+		})
+	})).ServeHTTP(httptest.NewRecorder(), withHeader(req, requestIDHeader, "r1"))
+
+	want := `192.0.2.1 - - [01/Mar/2018:12:00:00 +0000] "GET /books?x=1 HTTP/1.1" 200 42 "" "test" request_id=r1` + "\n"
+	if got.String() != want {
+		t.Errorf("got %q, want %q", got.String(), want)
+	}
+}
+
+func withHeader(r *http.Request, key, value string) *http.Request {
+	r.Header.Set(key, value)
+	return r
+}
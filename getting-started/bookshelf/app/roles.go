@@ -0,0 +1,97 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+)
+
+// role describes what a user may do to books created by other users. Anyone
+// signed in is the owner of the books they create, and may edit and delete
+// them whatever their role.
+type role int
+
+const (
+	// roleUser may only change their own books.
+	roleUser role = iota
+	// roleEditor may edit any book, but only delete their own.
+	roleEditor
+	// roleAdmin may edit and delete any book.
+	roleAdmin
+)
+
+// errForbidden is the error of appErrors for requests the user is not allowed
+// to make.
+var errForbidden = errors.New("forbidden")
+
+// authEnabled reports whether user sign-in is configured. Without it, there
+// are no users to tell apart, so anyone may change any book.
+func authEnabled() bool {
+	return len(bookshelf.OIDCProviders) > 0
+}
+
+// roleOf returns the role of a signed-in user, as configured by the
+// bookshelf.AdminIDs and bookshelf.EditorIDs allowlists.
+func roleOf(user *Profile) role {
+	for _, id := range bookshelf.AdminIDs {
+		if id == user.ID {
+			return roleAdmin
+		}
+	}
+	for _, id := range bookshelf.EditorIDs {
+		if id == user.ID {
+			return roleEditor
+		}
+	}
+	return roleUser
+}
+
+// isOwner reports whether user created book. Nobody owns books created
+// anonymously.
+func isOwner(user *Profile, book *bookshelf.Book) bool {
+	return book.CreatedByID != "" && book.CreatedByID != "anonymous" && book.CreatedByID == user.ID
+}
+
+// canEdit reports whether user, who is nil if not signed in, may edit book.
+func canEdit(user *Profile, book *bookshelf.Book) bool {
+	if !authEnabled() {
+		return true
+	}
+	if user == nil {
+		return false
+	}
+	return isOwner(user, book) || roleOf(user) >= roleEditor
+}
+
+// canDelete reports whether user, who is nil if not signed in, may delete
+// book.
+func canDelete(user *Profile, book *bookshelf.Book) bool {
+	if !authEnabled() {
+		return true
+	}
+	if user == nil {
+		return false
+	}
+	return isOwner(user, book) || roleOf(user) >= roleAdmin
+}
+
+// authorize checks that the user making the request is allowed to act on
+// book, responding with 403 Forbidden if not. action describes what is being
+// done, e.g. "edit".
+func authorize(r *http.Request, book *bookshelf.Book, allowed func(*Profile, *bookshelf.Book) bool, action string) *appError {
+	user := profileFromSession(r)
+	if allowed(user, book) {
+		return nil
+	}
+	if user == nil {
+		return appErrorCodef(http.StatusForbidden, errForbidden,
+			"you must be logged in to %s book %d", action, book.ID)
+	}
+	return appErrorCodef(http.StatusForbidden, errForbidden,
+		"you may not %s book %d: it was added by someone else", action, book.ID)
+}
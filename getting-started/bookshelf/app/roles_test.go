@@ -0,0 +1,213 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+)
+
+// withRoles enables sign-in and configures an admin and an editor for the
+// duration of a test.
+func withRoles() (restore func()) {
+	oldProviders, oldAdmins, oldEditors := bookshelf.OIDCProviders, bookshelf.AdminIDs, bookshelf.EditorIDs
+	bookshelf.OIDCProviders = []*bookshelf.OIDCProvider{{Name: "fake"}}
+	bookshelf.AdminIDs = []string{"admin"}
+	bookshelf.EditorIDs = []string{"editor"}
+	return func() {
+		bookshelf.OIDCProviders, bookshelf.AdminIDs, bookshelf.EditorIDs = oldProviders, oldAdmins, oldEditors
+	}
+}
+
+// fakeSession returns a session cookie signing in the user with the given ID,
+// as if they had completed the OpenID Connect flow.
+func fakeSession(t *testing.T, userID string) *http.Cookie {
+	req := httptest.NewRequest("GET", "/", nil)
+	session, err := bookshelf.SessionStore.New(req, defaultSessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Values[oauthTokenSessionKey] = &oauth2.Token{
+		AccessToken: "token",
+		Expiry:      time.Now().Add(time.Hour),
+	}
+	session.Values[profileSessionKey] = &Profile{ID: userID, DisplayName: userID}
+
+	rec := httptest.NewRecorder()
+	if err := session.Save(req, rec); err != nil {
+		t.Fatal(err)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got %d session cookies, want 1", len(cookies))
+	}
+	return cookies[0]
+}
+
+// serveAs serves a request made by the given user, or by someone not signed
+// in if userID is empty. Requests that may change data carry a CSRF token.
+func serveAs(t *testing.T, userID, method, path, contentType string, body io.Reader) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, body)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if userID != "" {
+		req.AddCookie(fakeSession(t, userID))
+	}
+	if !safeMethod(method) {
+		req.AddCookie(csrfCookie(t, "token"))
+		req.Header.Set(csrfHeader, "token")
+	}
+	rec := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRoles(t *testing.T) {
+	defer withRoles()()
+
+	// Each request is made on a new book added by "owner". body returns the
+	// content type and body of requests that have one.
+	editForm := func() (string, io.Reader) {
+		var body bytes.Buffer
+		m := multipart.NewWriter(&body)
+		m.WriteField("title", "edited")
+		m.Close()
+		return "multipart/form-data; boundary=" + m.Boundary(), &body
+	}
+	editJSON := func() (string, io.Reader) {
+		return "application/json", strings.NewReader(`{"title": "edited"}`)
+	}
+	requests := []struct {
+		name         string
+		method, path string
+		body         func() (string, io.Reader)
+	}{
+		{"edit form", "GET", "/books/%d/edit", nil},
+		{"update", "POST", "/books/%d", editForm},
+		{"delete", "POST", "/books/%d:delete", nil},
+		{"API patch", "PATCH", "/api/v1/books/%d", editJSON},
+		{"API delete", "DELETE", "/api/v1/books/%d", nil},
+	}
+
+	const (
+		ok        = http.StatusOK
+		found     = http.StatusFound
+		noContent = http.StatusNoContent
+		forbidden = http.StatusForbidden
+	)
+	tests := []struct {
+		user string
+		want []int // one status per request.
+	}{
+		{"", []int{forbidden, forbidden, forbidden, forbidden, forbidden}},
+		{"someone", []int{forbidden, forbidden, forbidden, forbidden, forbidden}},
+		{"owner", []int{ok, found, found, ok, noContent}},
+		{"editor", []int{ok, found, forbidden, ok, forbidden}},
+		{"admin", []int{ok, found, found, ok, noContent}},
+	}
+	for _, tt := range tests {
+		for i, req := range requests {
+			id, err := bookshelf.DB.AddBook(&bookshelf.Book{
+				Title:       "owned mcbook",
+				CreatedBy:   "owner",
+				CreatedByID: "owner",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var contentType string
+			var body io.Reader
+			if req.body != nil {
+				contentType, body = req.body()
+			}
+			rec := serveAs(t, tt.user, req.method, fmt.Sprintf(req.path, id), contentType, body)
+			if rec.Code != tt.want[i] {
+				t.Errorf("%s as %q: got status %d, want %d: %s", req.name, tt.user, rec.Code, tt.want[i], rec.Body)
+			}
+
+			book, err := bookshelf.DB.GetBook(id)
+			if err == bookshelf.ErrNotFound {
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if book.CreatedByID != "owner" {
+				t.Errorf("%s as %q: creator changed to %q", req.name, tt.user, book.CreatedByID)
+			}
+			bookshelf.DB.DeleteBook(id)
+		}
+	}
+}
+
+func TestDetailOffersAllowedChanges(t *testing.T) {
+	defer withRoles()()
+
+	id, err := bookshelf.DB.AddBook(&bookshelf.Book{Title: "owned mcbook", CreatedByID: "owner"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bookshelf.DB.DeleteBook(id)
+
+	tests := []struct {
+		user             string
+		edit, deleteBook bool
+	}{
+		{"", false, false},
+		{"someone", false, false},
+		{"owner", true, true},
+		{"editor", true, false},
+		{"admin", true, true},
+	}
+	for _, tt := range tests {
+		body := serveAs(t, tt.user, "GET", fmt.Sprintf("/books/%d", id), "", nil).Body.String()
+		if got := strings.Contains(body, "Edit book"); got != tt.edit {
+			t.Errorf("as %q: offers edit = %v, want %v", tt.user, got, tt.edit)
+		}
+		if got := strings.Contains(body, "Delete book"); got != tt.deleteBook {
+			t.Errorf("as %q: offers delete = %v, want %v", tt.user, got, tt.deleteBook)
+		}
+	}
+}
+
+func TestCreateIgnoresFormCreator(t *testing.T) {
+	defer withRoles()()
+
+	var body bytes.Buffer
+	m := multipart.NewWriter(&body)
+	m.WriteField("title", "spoofed mcbook")
+	m.WriteField("createdByID", "admin")
+	m.Close()
+	rec := serveAs(t, "someone", "POST", "/books", "multipart/form-data; boundary="+m.Boundary(), &body)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("got status %d, want 302: %s", rec.Code, rec.Body)
+	}
+
+	var id int64
+	if _, err := fmt.Sscanf(rec.Header().Get("Location"), "/books/%d", &id); err != nil {
+		t.Fatal(err)
+	}
+	defer bookshelf.DB.DeleteBook(id)
+	book, err := bookshelf.DB.GetBook(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.CreatedByID != "someone" {
+		t.Errorf("CreatedByID = %q, want the signed-in user", book.CreatedByID)
+	}
+}
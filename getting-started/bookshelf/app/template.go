@@ -10,13 +10,19 @@ import (
 	"io/ioutil"
 	"net/http"
 	"path/filepath"
-
-	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
 )
 
+// templateFuncs are the functions available to templates. They are
+// placeholders for functions bound to each request by appTemplate.Execute.
+var templateFuncs = template.FuncMap{
+	// csrfField returns a hidden form field holding the CSRF token, which
+	// must be included in every form that POSTs.
+	"csrfField": func() template.HTML { return "" },
+}
+
 // parseTemplate applies a given file to the body of the base template.
 func parseTemplate(filename string) *appTemplate {
-	tmpl := template.Must(template.ParseFiles("templates/base.html"))
+	tmpl := template.Must(template.New("base.html").Funcs(templateFuncs).ParseFiles("templates/base.html"))
 
 	// Put the named file into a template called "body"
 	path := filepath.Join("templates", filename)
@@ -35,8 +41,23 @@ type appTemplate struct {
 }
 
 // Execute writes the template using the provided data, adding login and user
-// information to the base template.
+// information to the base template, and the CSRF token to forms.
 func (tmpl *appTemplate) Execute(w http.ResponseWriter, r *http.Request, data interface{}) *appError {
+	token, err := csrfToken(w, r)
+	if err != nil {
+		return appErrorf(err, "could not create CSRF token: %v", err)
+	}
+	t, err := tmpl.t.Clone()
+	if err != nil {
+		return appErrorf(err, "could not clone template: %v", err)
+	}
+	t.Funcs(template.FuncMap{
+		"csrfField": func() template.HTML {
+			return template.HTML(`<input type="hidden" name="` + csrfFormField +
+				`" value="` + template.HTMLEscapeString(token) + `">`)
+		},
+	})
+
 	d := struct {
 		Data        interface{}
 		AuthEnabled bool
@@ -45,7 +66,7 @@ func (tmpl *appTemplate) Execute(w http.ResponseWriter, r *http.Request, data in
 		LogoutURL   string
 	}{
 		Data:        data,
-		AuthEnabled: bookshelf.OAuthConfig != nil,
+		AuthEnabled: authEnabled(),
 		LoginURL:    "/login?redirect=" + r.URL.RequestURI(),
 		LogoutURL:   "/logout?redirect=" + r.URL.RequestURI(),
 	}
@@ -55,7 +76,7 @@ func (tmpl *appTemplate) Execute(w http.ResponseWriter, r *http.Request, data in
 		d.Profile = profileFromSession(r)
 	}
 
-	if err := tmpl.t.Execute(w, d); err != nil {
+	if err := t.Execute(w, d); err != nil {
 		return appErrorf(err, "could not write template: %v", err)
 	}
 	return nil
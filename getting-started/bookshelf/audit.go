@@ -0,0 +1,530 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	// ErrNoSuchVersion is returned by AuditedDB.Restore when the history of
+	// a book has no such version.
+	ErrNoSuchVersion = errors.New("bookshelf: no such version of the book")
+
+	// ErrNotDeleted is returned by AuditedDB.Undelete when the book wasn't
+	// deleted.
+	ErrNotDeleted = errors.New("bookshelf: book is not deleted")
+
+	// ErrUndeleteExpired is returned by AuditedDB.Undelete when the book was
+	// deleted longer ago than the undelete window.
+	ErrUndeleteExpired = errors.New("bookshelf: book was deleted too long ago to be undeleted")
+)
+
+// ChangeAction is the kind of change made to a book.
+type ChangeAction string
+
+const (
+	ChangeAdd      ChangeAction = "add"
+	ChangeUpdate   ChangeAction = "update"
+	ChangeDelete   ChangeAction = "delete"
+	ChangeRestore  ChangeAction = "restore"
+	ChangeUndelete ChangeAction = "undelete"
+)
+
+// Actor is the user who made a change.
+type Actor struct {
+	ID   string
+	Name string
+}
+
+// SystemActor is recorded as the actor of changes made without one, such as
+// by the Pub/Sub worker.
+var SystemActor = Actor{ID: "system", Name: "System"}
+
+// FieldChange is a change to one field of a book.
+type FieldChange struct {
+	Field    string
+	Old, New string
+}
+
+// Change is an entry in the history of a book.
+type Change struct {
+	// ID identifies the change in its ChangeLog. It is assigned by Append.
+	ID int64
+
+	BookID int64
+	Action ChangeAction
+	Actor  Actor
+	Time   time.Time
+
+	// Fields lists the fields that changed.
+	Fields []FieldChange
+
+	// Book is the book as it was after the change or, for deletions, as it
+	// was when deleted.
+	Book Book
+
+	// RestoredVersion is the version that a ChangeRestore restored.
+	RestoredVersion int64
+}
+
+// ChangeLog is an append-only, thread-safe log of changes to books.
+type ChangeLog interface {
+	// Append adds a change to the log, assigning its ID.
+	Append(c *Change) error
+
+	// History returns the changes to the book with the given ID, oldest
+	// first.
+	History(bookID int64) ([]*Change, error)
+
+	// Since returns the changes made at or after the given time, newest
+	// first.
+	Since(t time.Time) ([]*Change, error)
+}
+
+// changeLogger is implemented by BookDatabases that can keep a ChangeLog next
+// to the books, so that the history of the books is as durable as the books
+// themselves.
+type changeLogger interface {
+	changeLog() (ChangeLog, error)
+}
+
+// versionedDeleter is implemented by BookDatabases that can delete a book only
+// if it is still at a given version, so that AuditedDB records the book that
+// was deleted.
+type versionedDeleter interface {
+	// deleteBookVersion removes the book with the given ID if its version is
+	// version. Otherwise, ErrConflict is returned, or ErrNotFound if the book
+	// does not exist.
+	deleteBookVersion(id, version int64) error
+}
+
+// DeleteBookVersion removes the book with the given ID from db if it is still
+// at version, so that changes made since the caller read the book are not
+// lost. Otherwise, ErrConflict is returned, or ErrNotFound if the book does
+// not exist. Unless db is a versionedDeleter, a change made between the check
+// and the removal is not noticed.
+func DeleteBookVersion(db BookDatabase, id, version int64) error {
+	if deleter, ok := db.(versionedDeleter); ok {
+		return deleter.deleteBookVersion(id, version)
+	}
+	b, err := db.GetBook(id)
+	if err != nil {
+		return err
+	}
+	if b.Version != version {
+		return ErrConflict
+	}
+	return db.DeleteBook(id)
+}
+
+// maxDeleteAttempts bounds the number of times DeleteBook reads a book again
+// after it changed concurrently.
+const maxDeleteAttempts = 5
+
+// AuditedDB is a BookDatabase that records the books added, updated and
+// deleted through it in a ChangeLog, so that their history can be shown, old
+// versions restored, and deleted books undeleted.
+type AuditedDB struct {
+	BookDatabase
+	log   ChangeLog
+	actor Actor
+
+	// undeleteWindow is how long deleted books can be undeleted for.
+	undeleteWindow time.Duration
+
+	// Covers, if set, is the store of the covers of the books. Deleted
+	// books keep their cover while they can be undeleted, and PurgeCovers
+	// deletes it after. Books restored or undeleted after their cover was
+	// deleted lose their image.
+	Covers BlobStore
+
+	purge *coverPurge
+	now   func() time.Time // for tests.
+}
+
+// coverPurge records the progress of PurgeCovers.
+type coverPurge struct {
+	mu    sync.Mutex
+	until time.Time // the covers of books deleted before until were purged.
+}
+
+// Ensure AuditedDB conforms to the BookDatabase, versionedDeleter and
+// imageFinder interfaces.
+var (
+	_ BookDatabase     = &AuditedDB{}
+	_ versionedDeleter = &AuditedDB{}
+	_ imageFinder      = &AuditedDB{}
+)
+
+// NewAuditedDB wraps db so that changes to its books are recorded in log.
+// Deleted books can be undeleted for undeleteWindow, if db implements
+// BookImporter.
+func NewAuditedDB(db BookDatabase, log ChangeLog, undeleteWindow time.Duration) *AuditedDB {
+	return &AuditedDB{
+		BookDatabase:   db,
+		log:            log,
+		actor:          SystemActor,
+		undeleteWindow: undeleteWindow,
+		purge:          &coverPurge{},
+		now:            time.Now,
+	}
+}
+
+// As returns a view of db whose changes are recorded as made by actor.
+func (db *AuditedDB) As(actor Actor) *AuditedDB {
+	copied := *db
+	copied.actor = actor
+	return &copied
+}
+
+// AddBook saves a given book, assigning it a new ID, and records it as added.
+func (db *AuditedDB) AddBook(b *Book) (id int64, err error) {
+	id, err = db.BookDatabase.AddBook(b)
+	if err != nil {
+		return 0, err
+	}
+	added := *b
+	added.ID, added.Version = id, 1
+	return id, db.record(ChangeAdd, &Book{}, &added, 0)
+}
+
+// UpdateBook updates the entry for a given book, and records the fields that
+// changed.
+func (db *AuditedDB) UpdateBook(b *Book) error {
+	old, err := db.BookDatabase.GetBook(b.ID)
+	if err != nil {
+		return err
+	}
+	// The update is only made if the stored book is still at b.Version, so
+	// the fields are diffed against that version or not at all.
+	if old.Version != b.Version {
+		return ErrConflict
+	}
+	if err := db.BookDatabase.UpdateBook(b); err != nil {
+		return err
+	}
+	return db.record(ChangeUpdate, old, b, 0)
+}
+
+// DeleteBook removes a given book by its ID, and records it as deleted. If the
+// database is a versionedDeleter, the book is only removed if it is unchanged
+// since it was read, and is read again otherwise, so that the book recorded is
+// the one deleted.
+func (db *AuditedDB) DeleteBook(id int64) error {
+	for attempt := 1; ; attempt++ {
+		old, err := db.BookDatabase.GetBook(id)
+		if err != nil {
+			return err
+		}
+		err = db.deleteRead(id, old)
+		if err == ErrConflict && attempt < maxDeleteAttempts {
+			continue
+		}
+		return err
+	}
+}
+
+// deleteBookVersion removes the book with the given ID if it is at version,
+// and records it as deleted.
+func (db *AuditedDB) deleteBookVersion(id, version int64) error {
+	old, err := db.BookDatabase.GetBook(id)
+	if err != nil {
+		return err
+	}
+	if old.Version != version {
+		return ErrConflict
+	}
+	return db.deleteRead(id, old)
+}
+
+// deleteRead removes the book with the given ID, last read as old, and records
+// it as deleted. If the database is a versionedDeleter, ErrConflict is
+// returned if the book changed since it was read.
+func (db *AuditedDB) deleteRead(id int64, old *Book) error {
+	var err error
+	if deleter, ok := db.BookDatabase.(versionedDeleter); ok {
+		err = deleter.deleteBookVersion(id, old.Version)
+	} else {
+		err = db.BookDatabase.DeleteBook(id)
+	}
+	if err != nil {
+		return err
+	}
+	return db.record(ChangeDelete, old, &Book{}, 0)
+}
+
+// usesImage reports whether any book in the underlying database has one of
+// the given image URLs. Deleted books are not counted.
+func (db *AuditedDB) usesImage(imageURLs []string) (bool, error) {
+	return anyBookUses(db.BookDatabase, imageURLs)
+}
+
+// History returns the changes made to the book with the given ID, oldest
+// first. The history of deleted books is kept.
+func (db *AuditedDB) History(id int64) ([]*Change, error) {
+	return db.log.History(id)
+}
+
+// Restore sets the title, author, published date, image and description of
+// the book with the given ID back to those of an earlier version, as a new
+// version. The restored book is returned.
+func (db *AuditedDB) Restore(id, version int64) (*Book, error) {
+	history, err := db.log.History(id)
+	if err != nil {
+		return nil, err
+	}
+	var from *Book
+	for _, c := range history {
+		if c.Action != ChangeDelete && c.Book.Version == version {
+			from = &c.Book
+		}
+	}
+	if from == nil {
+		return nil, ErrNoSuchVersion
+	}
+
+	b, err := db.BookDatabase.GetBook(id)
+	if err != nil {
+		return nil, err
+	}
+	old := *b
+	b.Title = from.Title
+	b.Author = from.Author
+	b.PublishedDate = from.PublishedDate
+	b.ImageURL = db.keepCover(from.ImageURL)
+	b.Description = from.Description
+	if err := db.BookDatabase.UpdateBook(b); err != nil {
+		return nil, err
+	}
+	return b, db.record(ChangeRestore, &old, b, version)
+}
+
+// Undelete adds back the book with the given ID, under the same ID, if it was
+// deleted within the undelete window. The undeleted book is returned.
+func (db *AuditedDB) Undelete(id int64) (*Book, error) {
+	history, err := db.log.History(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(history) == 0 {
+		return nil, ErrNotFound
+	}
+	last := history[len(history)-1]
+	if last.Action != ChangeDelete {
+		return nil, ErrNotDeleted
+	}
+	if db.now().Sub(last.Time) > db.undeleteWindow {
+		return nil, ErrUndeleteExpired
+	}
+	importer, ok := db.BookDatabase.(BookImporter)
+	if !ok {
+		return nil, errors.New("audit: the database can't undelete books")
+	}
+
+	b := last.Book
+	b.Version++
+	b.ImageURL = db.keepCover(b.ImageURL)
+	if err := importer.ImportBook(&b); err != nil {
+		return nil, err
+	}
+	return &b, db.record(ChangeUndelete, &Book{}, &b, 0)
+}
+
+// Deleted returns the deletions of the books that can still be undeleted,
+// newest first.
+func (db *AuditedDB) Deleted() ([]*Change, error) {
+	changes, err := db.log.Since(db.now().Add(-db.undeleteWindow))
+	if err != nil {
+		return nil, err
+	}
+	var deleted []*Change
+	seen := make(map[int64]bool)
+	for _, c := range changes {
+		if seen[c.BookID] {
+			continue
+		}
+		seen[c.BookID] = true
+		if c.Action == ChangeDelete {
+			deleted = append(deleted, c)
+		}
+	}
+	return deleted, nil
+}
+
+// PurgeCovers deletes the covers of the books that can no longer be
+// undeleted, as they were deleted longer ago than the undelete window, unless
+// a book, or a deleted book that can still be undeleted, uses the same image.
+// It only considers the books deleted since the previous call, so it is meant
+// to be called periodically.
+func (db *AuditedDB) PurgeCovers(ctx context.Context) error {
+	if db.Covers == nil {
+		return nil
+	}
+	db.purge.mu.Lock()
+	defer db.purge.mu.Unlock()
+
+	cutoff := db.now().Add(-db.undeleteWindow)
+	changes, err := db.log.Since(db.purge.until)
+	if err != nil {
+		return err
+	}
+	// The changes are newest first, so the first change of each book is its
+	// latest.
+	var expired []*Change
+	keep := make(map[string]bool)
+	seen := make(map[int64]bool)
+	for _, c := range changes {
+		if seen[c.BookID] {
+			continue
+		}
+		seen[c.BookID] = true
+		if c.Action != ChangeDelete || c.Book.ImageURL == "" {
+			continue
+		}
+		if c.Time.Before(cutoff) {
+			expired = append(expired, c)
+		} else {
+			keep[c.Book.ImageURL] = true
+		}
+	}
+	for _, c := range expired {
+		if keep[c.Book.ImageURL] {
+			continue
+		}
+		if err := DeleteUnusedCover(ctx, db.Covers, db.BookDatabase, c.Book.ImageURL); err != nil {
+			return fmt.Errorf("audit: could not delete the cover of book %d: %v", c.BookID, err)
+		}
+	}
+	db.purge.until = cutoff
+	return nil
+}
+
+// keepCover returns imageURL, or "" if it is that of a cover that was
+// deleted.
+func (db *AuditedDB) keepCover(imageURL string) string {
+	if db.Covers == nil || imageURL == "" {
+		return imageURL
+	}
+	name := blobName(db.Covers, imageURL)
+	if coverKey(name) == "" {
+		return imageURL
+	}
+	if _, _, err := db.Covers.Get(context.Background(), name); err == ErrBlobNotFound {
+		return ""
+	}
+	return imageURL
+}
+
+// CanUndelete reports whether deleted books can be undeleted.
+func (db *AuditedDB) CanUndelete() bool {
+	_, ok := db.BookDatabase.(BookImporter)
+	return ok && db.undeleteWindow > 0
+}
+
+// record appends a change from old to b to the log.
+func (db *AuditedDB) record(action ChangeAction, old, b *Book, restoredVersion int64) error {
+	snapshot := *b
+	if action == ChangeDelete {
+		snapshot = *old
+	}
+	c := &Change{
+		BookID:          snapshot.ID,
+		Action:          action,
+		Actor:           db.actor,
+		Time:            db.now(),
+		Fields:          diffBooks(old, b),
+		Book:            snapshot,
+		RestoredVersion: restoredVersion,
+	}
+	if err := db.log.Append(c); err != nil {
+		return fmt.Errorf("audit: could not record change to book %d: %v", snapshot.ID, err)
+	}
+	return nil
+}
+
+// diffBooks returns the fields that differ between old and b, other than ID
+// and Version.
+func diffBooks(old, b *Book) []FieldChange {
+	fields := []struct {
+		name     string
+		old, new string
+	}{
+		{"Title", old.Title, b.Title},
+		{"Author", old.Author, b.Author},
+		{"PublishedDate", old.PublishedDate, b.PublishedDate},
+		{"ImageURL", old.ImageURL, b.ImageURL},
+		{"Description", old.Description, b.Description},
+		{"CreatedBy", old.CreatedBy, b.CreatedBy},
+		{"CreatedByID", old.CreatedByID, b.CreatedByID},
+	}
+	var changes []FieldChange
+	for _, f := range fields {
+		if f.old != f.new {
+			changes = append(changes, FieldChange{Field: f.name, Old: f.old, New: f.new})
+		}
+	}
+	return changes
+}
+
+// storedChange is a Change as stored by the ChangeLogs that keep changes in a
+// database, with the fields that are only read back, not queried, encoded as
+// JSON.
+type storedChange struct {
+	BookID          int64
+	Action          string
+	ActorID         string `datastore:",noindex"`
+	ActorName       string `datastore:",noindex"`
+	Time            time.Time
+	Fields          string `datastore:",noindex"`
+	Book            string `datastore:",noindex"`
+	RestoredVersion int64  `datastore:",noindex"`
+}
+
+func newStoredChange(c *Change) (*storedChange, error) {
+	fields, err := json.Marshal(c.Fields)
+	if err != nil {
+		return nil, err
+	}
+	book, err := json.Marshal(c.Book)
+	if err != nil {
+		return nil, err
+	}
+	return &storedChange{
+		BookID:          c.BookID,
+		Action:          string(c.Action),
+		ActorID:         c.Actor.ID,
+		ActorName:       c.Actor.Name,
+		Time:            c.Time,
+		Fields:          string(fields),
+		Book:            string(book),
+		RestoredVersion: c.RestoredVersion,
+	}, nil
+}
+
+// change decodes s into the Change with the given ID.
+func (s *storedChange) change(id int64) (*Change, error) {
+	c := &Change{
+		ID:              id,
+		BookID:          s.BookID,
+		Action:          ChangeAction(s.Action),
+		Actor:           Actor{ID: s.ActorID, Name: s.ActorName},
+		Time:            s.Time,
+		RestoredVersion: s.RestoredVersion,
+	}
+	if err := json.Unmarshal([]byte(s.Fields), &c.Fields); err != nil {
+		return nil, fmt.Errorf("audit: could not decode change %d: %v", id, err)
+	}
+	if err := json.Unmarshal([]byte(s.Book), &c.Book); err != nil {
+		return nil, fmt.Errorf("audit: could not decode change %d: %v", id, err)
+	}
+	return c, nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"golang.org/x/net/context"
+)
+
+// Ensure datastoreChangeLog conforms to the ChangeLog interface, and that
+// datastoreDB keeps its change log next to the books.
+var (
+	_ ChangeLog    = &datastoreChangeLog{}
+	_ changeLogger = &datastoreDB{}
+)
+
+// datastoreChangeLog is a ChangeLog kept as BookChange entities in Cloud
+// Datastore. Datastore IDs are scattered, so changes are ordered by time.
+type datastoreChangeLog struct {
+	client *datastore.Client
+}
+
+func (db *datastoreDB) changeLog() (ChangeLog, error) {
+	return &datastoreChangeLog{client: db.client}, nil
+}
+
+// Append adds a change to the log, assigning its ID.
+func (l *datastoreChangeLog) Append(c *Change) error {
+	ctx := context.Background()
+	s, err := newStoredChange(c)
+	if err != nil {
+		return fmt.Errorf("datastoredb: could not encode change: %v", err)
+	}
+	k, err := l.client.Put(ctx, datastore.IncompleteKey("BookChange", nil), s)
+	if err != nil {
+		return fmt.Errorf("datastoredb: could not put BookChange: %v", err)
+	}
+	c.ID = k.ID
+	return nil
+}
+
+// History returns the changes to the book with the given ID, oldest first.
+func (l *datastoreChangeLog) History(bookID int64) ([]*Change, error) {
+	return l.getAll(datastore.NewQuery("BookChange").
+		Filter("BookID =", bookID).
+		Order("Time"))
+}
+
+// Since returns the changes made at or after t, newest first.
+func (l *datastoreChangeLog) Since(t time.Time) ([]*Change, error) {
+	q := datastore.NewQuery("BookChange")
+	if !t.IsZero() {
+		q = q.Filter("Time >=", t)
+	}
+	return l.getAll(q.Order("-Time"))
+}
+
+// getAll returns the changes found by q.
+func (l *datastoreChangeLog) getAll(q *datastore.Query) ([]*Change, error) {
+	ctx := context.Background()
+	var stored []*storedChange
+	keys, err := l.client.GetAll(ctx, q, &stored)
+	if err != nil {
+		return nil, fmt.Errorf("datastoredb: could not list changes: %v", err)
+	}
+	changes := make([]*Change, len(stored))
+	for i, s := range stored {
+		if changes[i], err = s.change(keys[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return changes, nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"sync"
+	"time"
+)
+
+// Ensure memoryChangeLog conforms to the ChangeLog interface.
+var _ ChangeLog = &memoryChangeLog{}
+
+// memoryChangeLog is an in-process ChangeLog, for the memory database and
+// tests.
+type memoryChangeLog struct {
+	mu      sync.RWMutex
+	changes []*Change         // in the order they were appended.
+	byBook  map[int64][]int64 // maps from book ID to the indexes of its changes.
+}
+
+func newMemoryChangeLog() *memoryChangeLog {
+	return &memoryChangeLog{byBook: make(map[int64][]int64)}
+}
+
+// Append adds a change to the log, assigning its ID.
+func (l *memoryChangeLog) Append(c *Change) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stored := *c
+	stored.ID = int64(len(l.changes)) + 1
+	c.ID = stored.ID
+	l.byBook[c.BookID] = append(l.byBook[c.BookID], int64(len(l.changes)))
+	l.changes = append(l.changes, &stored)
+	return nil
+}
+
+// History returns the changes to the book with the given ID, oldest first.
+func (l *memoryChangeLog) History(bookID int64) ([]*Change, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var history []*Change
+	for _, i := range l.byBook[bookID] {
+		copied := *l.changes[i]
+		history = append(history, &copied)
+	}
+	return history, nil
+}
+
+// Since returns the changes made at or after t, newest first.
+func (l *memoryChangeLog) Since(t time.Time) ([]*Change, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var changes []*Change
+	for i := len(l.changes) - 1; i >= 0 && !l.changes[i].Time.Before(t); i-- {
+		copied := *l.changes[i]
+		changes = append(changes, &copied)
+	}
+	return changes, nil
+}
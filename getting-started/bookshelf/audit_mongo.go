@@ -0,0 +1,75 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Ensure mongoChangeLog conforms to the ChangeLog interface, and that mongoDB
+// keeps its change log next to the books.
+var (
+	_ ChangeLog    = &mongoChangeLog{}
+	_ changeLogger = &mongoDB{}
+)
+
+// mongoChangeLog is a ChangeLog kept in the changes collection of the
+// bookshelf database. Change IDs are random, like book IDs, so changes are
+// ordered by time.
+type mongoChangeLog struct {
+	c *mgo.Collection
+}
+
+func (db *mongoDB) changeLog() (ChangeLog, error) {
+	c := db.conn.DB("bookshelf").C("changes")
+	if err := c.EnsureIndexKey("bookid", "time"); err != nil {
+		return nil, fmt.Errorf("mongodb: could not index changes: %v", err)
+	}
+	if err := c.EnsureIndexKey("time"); err != nil {
+		return nil, fmt.Errorf("mongodb: could not index changes: %v", err)
+	}
+	return &mongoChangeLog{c: c}, nil
+}
+
+// Append adds a change to the log, assigning its ID.
+func (l *mongoChangeLog) Append(c *Change) error {
+	id, err := randomID()
+	if err != nil {
+		return fmt.Errorf("mongodb: could not assign a new ID: %v", err)
+	}
+	stored := *c
+	stored.ID = id
+	if err := l.c.Insert(&stored); err != nil {
+		return fmt.Errorf("mongodb: could not append change: %v", err)
+	}
+	c.ID = id
+	return nil
+}
+
+// History returns the changes to the book with the given ID, oldest first.
+func (l *mongoChangeLog) History(bookID int64) ([]*Change, error) {
+	var changes []*Change
+	if err := l.c.Find(bson.M{"bookid": bookID}).Sort("time", "id").All(&changes); err != nil {
+		return nil, fmt.Errorf("mongodb: could not read changes: %v", err)
+	}
+	return changes, nil
+}
+
+// Since returns the changes made at or after t, newest first.
+func (l *mongoChangeLog) Since(t time.Time) ([]*Change, error) {
+	var query interface{}
+	if !t.IsZero() {
+		query = bson.M{"time": bson.M{"$gte": t}}
+	}
+	var changes []*Change
+	if err := l.c.Find(query).Sort("-time", "-id").All(&changes); err != nil {
+		return nil, fmt.Errorf("mongodb: could not read changes: %v", err)
+	}
+	return changes, nil
+}
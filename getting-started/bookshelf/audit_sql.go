@@ -0,0 +1,129 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Ensure sqlChangeLog conforms to the ChangeLog interface, and that the SQL
+// databases keep their change log in the book_changes table.
+var (
+	_ ChangeLog    = &sqlChangeLog{}
+	_ changeLogger = &mysqlDB{}
+	_ changeLogger = &postgresDB{}
+)
+
+// sqlChangeLog is a ChangeLog kept in the book_changes table of a MySQL or
+// PostgreSQL database, which is created by their migrations. Times are stored
+// as nanoseconds since the Unix epoch.
+type sqlChangeLog struct {
+	conn *sql.DB
+
+	// postgres selects the PostgreSQL dialect: $1, $2, ... placeholders, and
+	// RETURNING to read the ID assigned to a change.
+	postgres bool
+}
+
+func (db *mysqlDB) changeLog() (ChangeLog, error) {
+	return &sqlChangeLog{conn: db.conn}, nil
+}
+
+func (db *postgresDB) changeLog() (ChangeLog, error) {
+	return &sqlChangeLog{conn: db.conn, postgres: true}, nil
+}
+
+const sqlChangeColumns = `id, book_id, action, actor_id, actor_name, changed_at,
+  fields, book, restored_version`
+
+// bind rewrites the ? placeholders of q for the database.
+func (l *sqlChangeLog) bind(q string) string {
+	if !l.postgres {
+		return q
+	}
+	return bindDollar(q)
+}
+
+// Append adds a change to the log, assigning its ID.
+func (l *sqlChangeLog) Append(c *Change) error {
+	s, err := newStoredChange(c)
+	if err != nil {
+		return fmt.Errorf("sql: could not encode change: %v", err)
+	}
+	q := l.bind(`
+  INSERT INTO book_changes (
+    book_id, action, actor_id, actor_name, changed_at, fields, book,
+    restored_version
+  ) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+	args := []interface{}{s.BookID, s.Action, s.ActorID, s.ActorName,
+		s.Time.UnixNano(), s.Fields, s.Book, s.RestoredVersion}
+
+	var id int64
+	if l.postgres {
+		err = l.conn.QueryRow(q+" RETURNING id", args...).Scan(&id)
+	} else {
+		var r sql.Result
+		if r, err = l.conn.Exec(q, args...); err == nil {
+			id, err = r.LastInsertId()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("sql: could not append change: %v", err)
+	}
+	c.ID = id
+	return nil
+}
+
+// History returns the changes to the book with the given ID, oldest first.
+func (l *sqlChangeLog) History(bookID int64) ([]*Change, error) {
+	return l.query(`SELECT `+sqlChangeColumns+` FROM book_changes
+  WHERE book_id = ? ORDER BY id`, bookID)
+}
+
+// Since returns the changes made at or after t, newest first.
+func (l *sqlChangeLog) Since(t time.Time) ([]*Change, error) {
+	// The zero time is out of the range of UnixNano.
+	since := int64(math.MinInt64)
+	if !t.IsZero() {
+		since = t.UnixNano()
+	}
+	return l.query(`SELECT `+sqlChangeColumns+` FROM book_changes
+  WHERE changed_at >= ? ORDER BY changed_at DESC, id DESC`, since)
+}
+
+// query reads the changes returned by a query.
+func (l *sqlChangeLog) query(q string, args ...interface{}) ([]*Change, error) {
+	rows, err := l.conn.Query(l.bind(q), args...)
+	if err != nil {
+		return nil, fmt.Errorf("sql: could not read changes: %v", err)
+	}
+	defer rows.Close()
+
+	var changes []*Change
+	for rows.Next() {
+		var (
+			id        int64
+			s         storedChange
+			changedAt int64
+		)
+		if err := rows.Scan(&id, &s.BookID, &s.Action, &s.ActorID, &s.ActorName,
+			&changedAt, &s.Fields, &s.Book, &s.RestoredVersion); err != nil {
+			return nil, fmt.Errorf("sql: could not read change: %v", err)
+		}
+		s.Time = time.Unix(0, changedAt)
+		c, err := s.change(id)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("sql: could not read changes: %v", err)
+	}
+	return changes, nil
+}
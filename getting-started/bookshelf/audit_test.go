@@ -0,0 +1,427 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// newTestAuditedDB returns an AuditedDB over an indexed memory database, with
+// a clock that tests can move.
+func newTestAuditedDB(t *testing.T) (*AuditedDB, *time.Time) {
+	db, err := newIndexedDB(newMemoryDB(), newMemoryIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	audited := NewAuditedDB(db, newMemoryChangeLog(), 24*time.Hour)
+	audited.now = func() time.Time { return now }
+	return audited, &now
+}
+
+func TestAuditHistory(t *testing.T) {
+	db, now := newTestAuditedDB(t)
+	homer := db.As(Actor{ID: "homer", Name: "Homer"})
+
+	id, err := homer.AddBook(&Book{Title: "Duff", Author: "Homer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	*now = now.Add(time.Minute)
+	b, err := db.GetBook(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Title, b.Description = "Duff Beer", "Mmm"
+	if err := db.As(Actor{ID: "marge", Name: "Marge"}).UpdateBook(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteBook(id); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := db.History(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 {
+		t.Fatalf("got %d changes, want 3", len(history))
+	}
+	add, update, del := history[0], history[1], history[2]
+
+	if add.Action != ChangeAdd || add.Actor.ID != "homer" || add.Book.Version != 1 || add.BookID != id {
+		t.Errorf("add = %+v", add)
+	}
+	wantFields := []FieldChange{{"Title", "", "Duff"}, {"Author", "", "Homer"}}
+	if !reflect.DeepEqual(add.Fields, wantFields) {
+		t.Errorf("add fields = %+v, want %+v", add.Fields, wantFields)
+	}
+
+	if update.Action != ChangeUpdate || update.Actor.Name != "Marge" || !update.Time.After(add.Time) || update.Book.Version != 2 {
+		t.Errorf("update = %+v", update)
+	}
+	wantFields = []FieldChange{{"Title", "Duff", "Duff Beer"}, {"Description", "", "Mmm"}}
+	if !reflect.DeepEqual(update.Fields, wantFields) {
+		t.Errorf("update fields = %+v, want %+v", update.Fields, wantFields)
+	}
+
+	// Changes made without an actor are made by the system, and deletions
+	// keep the deleted book.
+	if del.Action != ChangeDelete || del.Actor != SystemActor || del.Book.Title != "Duff Beer" {
+		t.Errorf("delete = %+v", del)
+	}
+}
+
+func TestAuditRestore(t *testing.T) {
+	db, _ := newTestAuditedDB(t)
+	id, err := db.AddBook(&Book{Title: "v1", Author: "Homer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := db.GetBook(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Title, b.Author = "v2", "Marge"
+	if err := db.UpdateBook(b); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := db.Restore(id, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Title != "v1" || restored.Author != "Homer" || restored.Version != 3 {
+		t.Errorf("restored = %+v, want v1 by Homer, version 3", restored)
+	}
+	if got, err := db.GetBook(id); err != nil || got.Title != "v1" {
+		t.Errorf("GetBook after restore = %+v, %v", got, err)
+	}
+	history, err := db.History(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := history[len(history)-1]; last.Action != ChangeRestore || last.RestoredVersion != 1 || len(last.Fields) != 2 {
+		t.Errorf("restore change = %+v", last)
+	}
+
+	if _, err := db.Restore(id, 7); err != ErrNoSuchVersion {
+		t.Errorf("Restore of an unknown version: got %v, want ErrNoSuchVersion", err)
+	}
+}
+
+func TestAuditUndelete(t *testing.T) {
+	db, now := newTestAuditedDB(t)
+	id, err := db.AddBook(&Book{Title: "Itchy", Author: "Scratchy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Undelete(id); err != ErrNotDeleted {
+		t.Errorf("Undelete of a book that exists: got %v, want ErrNotDeleted", err)
+	}
+	if _, err := db.Undelete(id + 1); err != ErrNotFound {
+		t.Errorf("Undelete of an unknown book: got %v, want ErrNotFound", err)
+	}
+
+	if err := db.DeleteBook(id); err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := db.Deleted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0].BookID != id {
+		t.Errorf("Deleted = %+v, want book %d", deleted, id)
+	}
+
+	b, err := db.Undelete(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.ID != id || b.Title != "Itchy" || b.Version != 2 {
+		t.Errorf("undeleted book = %+v, want book %d at version 2", b, id)
+	}
+	if got, err := db.GetBook(id); err != nil || got.Title != "Itchy" {
+		t.Errorf("GetBook after undelete = %+v, %v", got, err)
+	}
+	if deleted, _ := db.Deleted(); len(deleted) != 0 {
+		t.Errorf("Deleted after undelete = %+v, want none", deleted)
+	}
+
+	// Books can only be undeleted within the undelete window.
+	if err := db.DeleteBook(id); err != nil {
+		t.Fatal(err)
+	}
+	*now = now.Add(25 * time.Hour)
+	if _, err := db.Undelete(id); err != ErrUndeleteExpired {
+		t.Errorf("Undelete after the window: got %v, want ErrUndeleteExpired", err)
+	}
+	if deleted, _ := db.Deleted(); len(deleted) != 0 {
+		t.Errorf("Deleted after the window = %+v, want none", deleted)
+	}
+}
+
+func TestAuditPurgeCovers(t *testing.T) {
+	ctx := context.Background()
+	db, now := newTestAuditedDB(t)
+	store := newMemoryBlobStore(LocalBlobPath)
+	db.Covers = store
+	coverURL := func(w int) string {
+		urls, err := StoreCover(ctx, store, bytes.NewReader(encodeJPEG(t, testImage(w, 300))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return urls[DefaultCoverSize]
+	}
+	exists := func(imageURL string) bool {
+		_, _, err := store.Get(ctx, blobName(store, imageURL))
+		return err == nil
+	}
+
+	expired, undeleted, recent := coverURL(100), coverURL(200), coverURL(300)
+	var ids []int64
+	for _, u := range []string{expired, undeleted, recent} {
+		id, err := db.AddBook(&Book{Title: "covered", ImageURL: u})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	for _, id := range ids[:2] {
+		if err := db.DeleteBook(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	*now = now.Add(time.Hour)
+	if _, err := db.Undelete(ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	*now = now.Add(23 * time.Hour)
+	if err := db.DeleteBook(ids[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Covers are kept while their books can be undeleted.
+	if err := db.PurgeCovers(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []string{expired, undeleted, recent} {
+		if !exists(u) {
+			t.Errorf("cover %s was purged within the undelete window", u)
+		}
+	}
+
+	// The cover of a book goes away once it can no longer be undeleted.
+	*now = now.Add(time.Hour)
+	if err := db.PurgeCovers(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if exists(expired) {
+		t.Errorf("cover %s was kept after the undelete window", expired)
+	}
+	if !exists(undeleted) || !exists(recent) {
+		t.Error("the covers of an undeleted book, or a book that can still be undeleted, were purged")
+	}
+	*now = now.Add(24 * time.Hour)
+	if err := db.PurgeCovers(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if exists(recent) || !exists(undeleted) {
+		t.Error("the covers of the books deleted since the previous purge weren't the only ones purged")
+	}
+}
+
+func TestAuditRestoreDeletedCover(t *testing.T) {
+	ctx := context.Background()
+	db, _ := newTestAuditedDB(t)
+	store := newMemoryBlobStore(LocalBlobPath)
+	db.Covers = store
+	urls, err := StoreCover(ctx, store, bytes.NewReader(encodeJPEG(t, testImage(200, 300))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := db.AddBook(&Book{Title: "covered", ImageURL: urls[DefaultCoverSize]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := db.GetBook(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.ImageURL = ""
+	if err := db.UpdateBook(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteUnusedCover(ctx, store, db, urls[DefaultCoverSize]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restoring a version whose cover was deleted doesn't bring back a
+	// broken image.
+	restored, err := db.Restore(id, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Title != "covered" || restored.ImageURL != "" {
+		t.Errorf("restored book = %+v, want no image", restored)
+	}
+}
+
+// racingDB updates a book just before the first versioned delete of it, as
+// if another process had changed it since it was read.
+type racingDB struct {
+	*memoryDB
+	raced bool
+}
+
+func (db *racingDB) deleteBookVersion(id, version int64) error {
+	if !db.raced {
+		db.raced = true
+		b, err := db.GetBook(id)
+		if err != nil {
+			return err
+		}
+		b.Title = "Duff Dry"
+		if err := db.UpdateBook(b); err != nil {
+			return err
+		}
+	}
+	return db.memoryDB.deleteBookVersion(id, version)
+}
+
+func TestAuditConcurrentChanges(t *testing.T) {
+	db := NewAuditedDB(&racingDB{memoryDB: newMemoryDB()}, newMemoryChangeLog(), 24*time.Hour)
+	id, err := db.AddBook(&Book{Title: "Duff"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An update of a stale copy is refused without being recorded.
+	stale, err := db.GetBook(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := *stale
+	b.Title = "Duff Beer"
+	if err := db.UpdateBook(&b); err != nil {
+		t.Fatal(err)
+	}
+	stale.Description = "Mmm"
+	if err := db.UpdateBook(stale); err != ErrConflict {
+		t.Errorf("UpdateBook with stale version: got %v, want ErrConflict", err)
+	}
+
+	// The book deleted is recorded, not the one read before it changed.
+	if err := db.DeleteBook(id); err != nil {
+		t.Fatal(err)
+	}
+	history, err := db.History(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []ChangeAction
+	for _, c := range history {
+		actions = append(actions, c.Action)
+	}
+	if want := []ChangeAction{ChangeAdd, ChangeUpdate, ChangeDelete}; !reflect.DeepEqual(actions, want) {
+		t.Fatalf("got changes %v, want %v", actions, want)
+	}
+	if del := history[2]; del.Book.Title != "Duff Dry" || del.Book.Version != 3 {
+		t.Errorf("recorded deleted book %+v, want the concurrently updated one", del.Book)
+	}
+}
+
+func TestMemoryChangeLog(t *testing.T) {
+	testChangeLog(t, newMemoryChangeLog())
+}
+
+func TestStoredChange(t *testing.T) {
+	c := &Change{
+		BookID:          5,
+		Action:          ChangeRestore,
+		Actor:           Actor{ID: "homer", Name: "Homer"},
+		Time:            time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC),
+		Fields:          []FieldChange{{"Title", "Duff Beer", "Duff"}},
+		Book:            Book{ID: 5, Title: "Duff", Version: 3},
+		RestoredVersion: 1,
+	}
+	s, err := newStoredChange(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.change(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := *c
+	want.ID = 7
+	if !reflect.DeepEqual(*got, want) {
+		t.Errorf("got %+v, want %+v", *got, want)
+	}
+}
+
+// testChangeLog checks that changes appended to log are read back, in order.
+// It uses a random book ID, so that it can run against a shared database.
+func testChangeLog(t *testing.T, log ChangeLog) {
+	bookID, err := randomID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	var appended []*Change
+	for i, action := range []ChangeAction{ChangeAdd, ChangeUpdate, ChangeDelete} {
+		c := &Change{
+			BookID: bookID,
+			Action: action,
+			Actor:  Actor{ID: "homer", Name: "Homer"},
+			Time:   start.Add(time.Duration(i) * time.Minute),
+			Fields: []FieldChange{{"Title", "", fmt.Sprint("Duff ", i)}},
+			Book:   Book{ID: bookID, Title: fmt.Sprint("Duff ", i), Version: int64(i + 1)},
+		}
+		if err := log.Append(c); err != nil {
+			t.Fatal(err)
+		}
+		if c.ID == 0 {
+			t.Errorf("Append(%s): ID was not assigned", action)
+		}
+		appended = append(appended, c)
+	}
+
+	// equal compares changes ignoring the time zone, which databases may not
+	// keep.
+	equal := func(got, want *Change) bool {
+		g, w := *got, *want
+		g.Time, w.Time = time.Time{}, time.Time{}
+		return got.Time.Equal(want.Time) && reflect.DeepEqual(g, w)
+	}
+
+	history, err := log.History(bookID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != len(appended) {
+		t.Fatalf("History: got %d changes, want %d", len(history), len(appended))
+	}
+	for i, c := range history {
+		if !equal(c, appended[i]) {
+			t.Errorf("History()[%d] = %+v, want %+v", i, c, appended[i])
+		}
+	}
+
+	since, err := log.Since(appended[1].Time)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(since) != 2 || !equal(since[0], appended[2]) || !equal(since[1], appended[1]) {
+		t.Errorf("Since(second change) = %+v, want the last two changes, newest first", since)
+	}
+}
@@ -0,0 +1,342 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+
+	"golang.org/x/net/context"
+)
+
+// ErrBlobNotFound is returned by BlobStore.Get and BlobStore.Delete when no
+// blob exists with the given name.
+var ErrBlobNotFound = errors.New("bookshelf: blob not found")
+
+// LocalBlobPath is the path at which the app serves blobs kept by the local
+// directory and in-memory blob stores.
+const LocalBlobPath = "/blobs/"
+
+// BlobStore stores publicly readable blobs, such as cover images, by name.
+// Names are slash-separated paths, such as "covers/abc/small.jpg".
+type BlobStore interface {
+	// Put stores data under name, replacing any blob with that name.
+	Put(ctx context.Context, name string, data []byte, contentType string) error
+
+	// Get retrieves a blob and its content type. If no such blob exists,
+	// ErrBlobNotFound is returned.
+	Get(ctx context.Context, name string) (data []byte, contentType string, err error)
+
+	// Delete removes a blob. If no such blob exists, ErrBlobNotFound is
+	// returned.
+	Delete(ctx context.Context, name string) error
+
+	// URL returns the URL at which the blob with the given name is served.
+	URL(name string) string
+}
+
+// blobName returns the name of the blob in store served at rawurl, or "" if
+// rawurl is not the URL of one of its blobs.
+func blobName(store BlobStore, rawurl string) string {
+	prefix := store.URL("")
+	if !strings.HasPrefix(rawurl, prefix) {
+		return ""
+	}
+	name, err := url.PathUnescape(strings.TrimPrefix(rawurl, prefix))
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+// gcsBlobStore stores blobs as objects in a Cloud Storage bucket.
+type gcsBlobStore struct {
+	bucket     *storage.BucketHandle
+	bucketName string
+}
+
+// Ensure gcsBlobStore conforms to the BlobStore interface.
+var _ BlobStore = &gcsBlobStore{}
+
+func newGCSBlobStore(bucket *storage.BucketHandle, bucketName string) *gcsBlobStore {
+	return &gcsBlobStore{bucket: bucket, bucketName: bucketName}
+}
+
+// Put uploads data as a publicly readable object.
+func (s *gcsBlobStore) Put(ctx context.Context, name string, data []byte, contentType string) error {
+	w := s.bucket.Object(name).NewWriter(ctx)
+	w.ACL = []storage.ACLRule{{Entity: storage.AllUsers, Role: storage.RoleReader}}
+	w.ContentType = contentType
+
+	// Entries are immutable, be aggressive about caching (1 day).
+	w.CacheControl = "public, max-age=86400"
+
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return fmt.Errorf("gcs: could not write %s: %v", name, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("gcs: could not write %s: %v", name, err)
+	}
+	return nil
+}
+
+// Get downloads an object.
+func (s *gcsBlobStore) Get(ctx context.Context, name string) ([]byte, string, error) {
+	r, err := s.bucket.Object(name).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, "", ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("gcs: could not read %s: %v", name, err)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, "", fmt.Errorf("gcs: could not read %s: %v", name, err)
+	}
+	return data, r.ContentType(), nil
+}
+
+// Delete deletes an object.
+func (s *gcsBlobStore) Delete(ctx context.Context, name string) error {
+	err := s.bucket.Object(name).Delete(ctx)
+	if err == storage.ErrObjectNotExist {
+		return ErrBlobNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("gcs: could not delete %s: %v", name, err)
+	}
+	return nil
+}
+
+// URL returns the public URL of the object.
+func (s *gcsBlobStore) URL(name string) string {
+	const publicURL = "https://storage.googleapis.com/%s/%s"
+	return fmt.Sprintf(publicURL, s.bucketName, name)
+}
+
+// localBlobStore stores blobs as files in a local directory. It is meant for
+// development and tests; the files are served by ServeHTTP.
+type localBlobStore struct {
+	dir     string
+	baseURL string
+}
+
+// Ensure localBlobStore conforms to the BlobStore and http.Handler
+// interfaces.
+var (
+	_ BlobStore    = &localBlobStore{}
+	_ http.Handler = &localBlobStore{}
+)
+
+// newLocalBlobStore creates a BlobStore keeping blobs under dir, which is
+// created if needed. Blob URLs are baseURL followed by the blob name.
+func newLocalBlobStore(dir, baseURL string) (*localBlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("localblob: could not create directory: %v", err)
+	}
+	return &localBlobStore{dir: dir, baseURL: strings.TrimSuffix(baseURL, "/") + "/"}, nil
+}
+
+// path returns the file name for a blob, rejecting names that would escape
+// the directory.
+func (s *localBlobStore) path(name string) (string, error) {
+	if !validBlobName(name) {
+		return "", fmt.Errorf("localblob: invalid blob name %q", name)
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(name)), nil
+}
+
+// Put writes data to a file. The content type is not stored; it is inferred
+// from the file name by Get.
+func (s *localBlobStore) Put(ctx context.Context, name string, data []byte, contentType string) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return fmt.Errorf("localblob: could not create directory: %v", err)
+	}
+	if err := ioutil.WriteFile(p, data, 0644); err != nil {
+		return fmt.Errorf("localblob: could not write %s: %v", name, err)
+	}
+	return nil
+}
+
+// Get reads a file.
+func (s *localBlobStore) Get(ctx context.Context, name string) ([]byte, string, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, "", ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("localblob: could not read %s: %v", name, err)
+	}
+	return data, contentTypeByName(name), nil
+}
+
+// Delete removes a file. Directories left empty are not removed.
+func (s *localBlobStore) Delete(ctx context.Context, name string) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return ErrBlobNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("localblob: could not delete %s: %v", name, err)
+	}
+	return nil
+}
+
+// URL returns baseURL followed by the escaped blob name.
+func (s *localBlobStore) URL(name string) string {
+	return s.baseURL + (&url.URL{Path: name}).EscapedPath()
+}
+
+// ServeHTTP serves the blob named by the request path, which must have had
+// the base URL's path stripped.
+func (s *localBlobStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	serveBlob(w, r, s)
+}
+
+// memoryBlobStore is a simple in-memory BlobStore. Blobs are copied on the
+// way in and out.
+type memoryBlobStore struct {
+	baseURL string
+
+	mu    sync.Mutex
+	blobs map[string]memoryBlob // maps from blob name to blob.
+}
+
+type memoryBlob struct {
+	data        []byte
+	contentType string
+}
+
+// Ensure memoryBlobStore conforms to the BlobStore and http.Handler
+// interfaces.
+var (
+	_ BlobStore    = &memoryBlobStore{}
+	_ http.Handler = &memoryBlobStore{}
+)
+
+// newMemoryBlobStore creates an empty BlobStore. Blob URLs are baseURL
+// followed by the blob name.
+func newMemoryBlobStore(baseURL string) *memoryBlobStore {
+	return &memoryBlobStore{
+		baseURL: strings.TrimSuffix(baseURL, "/") + "/",
+		blobs:   make(map[string]memoryBlob),
+	}
+}
+
+// Put saves a copy of data.
+func (s *memoryBlobStore) Put(ctx context.Context, name string, data []byte, contentType string) error {
+	if !validBlobName(name) {
+		return fmt.Errorf("memoryblob: invalid blob name %q", name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.blobs[name] = memoryBlob{
+		data:        append([]byte(nil), data...),
+		contentType: contentType,
+	}
+	return nil
+}
+
+// Get returns a copy of a blob.
+func (s *memoryBlobStore) Get(ctx context.Context, name string) ([]byte, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.blobs[name]
+	if !ok {
+		return nil, "", ErrBlobNotFound
+	}
+	return append([]byte(nil), b.data...), b.contentType, nil
+}
+
+// Delete removes a blob.
+func (s *memoryBlobStore) Delete(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.blobs[name]; !ok {
+		return ErrBlobNotFound
+	}
+	delete(s.blobs, name)
+	return nil
+}
+
+// URL returns baseURL followed by the escaped blob name.
+func (s *memoryBlobStore) URL(name string) string {
+	return s.baseURL + (&url.URL{Path: name}).EscapedPath()
+}
+
+// ServeHTTP serves the blob named by the request path, which must have had
+// the base URL's path stripped.
+func (s *memoryBlobStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	serveBlob(w, r, s)
+}
+
+// serveBlob serves the blob in store named by the request path.
+func serveBlob(w http.ResponseWriter, r *http.Request, store BlobStore) {
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	if !validBlobName(name) {
+		http.NotFound(w, r)
+		return
+	}
+	data, contentType, err := store.Get(r.Context(), name)
+	if err == ErrBlobNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(data))
+}
+
+// validBlobName reports whether name is a clean, relative, slash-separated
+// path.
+func validBlobName(name string) bool {
+	return name != "" && path.Clean(name) == name && !path.IsAbs(name) &&
+		name != ".." && !strings.HasPrefix(name, "../") && !strings.Contains(name, "\\")
+}
+
+// contentTypeByName returns the content type for a blob name's extension.
+func contentTypeByName(name string) string {
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
@@ -0,0 +1,151 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func testBlobStore(t *testing.T, store BlobStore) {
+	ctx := context.Background()
+
+	if err := store.Put(ctx, "a/b.txt", []byte("hello"), "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	data, contentType, err := store.Get(ctx, "a/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" || contentType != "text/plain; charset=utf-8" && contentType != "text/plain" {
+		t.Errorf("Get = %q, %q; want hello, text/plain", data, contentType)
+	}
+
+	if err := store.Put(ctx, "a/b.txt", []byte("bye"), "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	if data, _, _ := store.Get(ctx, "a/b.txt"); string(data) != "bye" {
+		t.Errorf("after overwriting, got %q, want bye", data)
+	}
+
+	if got, want := blobName(store, store.URL("a/b c.txt")), "a/b c.txt"; got != want {
+		t.Errorf("blobName(URL(%q)) = %q", want, got)
+	}
+	if got := blobName(store, "http://elsewhere.example.com/a/b.txt"); got != "" {
+		t.Errorf("blobName of another site's URL = %q, want empty", got)
+	}
+
+	if err := store.Delete(ctx, "a/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.Get(ctx, "a/b.txt"); err != ErrBlobNotFound {
+		t.Errorf("Get after Delete: got %v, want ErrBlobNotFound", err)
+	}
+	if err := store.Delete(ctx, "a/b.txt"); err != ErrBlobNotFound {
+		t.Errorf("Delete twice: got %v, want ErrBlobNotFound", err)
+	}
+
+	for _, name := range []string{"", "/abs", "../up", "a/../../up", "a//b"} {
+		if err := store.Put(ctx, name, nil, "text/plain"); err == nil {
+			t.Errorf("Put(%q): got nil error", name)
+		}
+	}
+}
+
+func TestMemoryBlobStore(t *testing.T) {
+	testBlobStore(t, newMemoryBlobStore(LocalBlobPath))
+}
+
+func TestLocalBlobStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookshelf-blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := newLocalBlobStore(dir, LocalBlobPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlobStore(t, store)
+}
+
+func TestServeBlob(t *testing.T) {
+	store := newMemoryBlobStore(LocalBlobPath)
+	if err := store.Put(context.Background(), "covers/x/small.jpg", []byte("jpeg data"), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	h := http.StripPrefix("/blobs", store)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", store.URL("covers/x/small.jpg"), nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "jpeg data" || rec.Header().Get("Content-Type") != "image/jpeg" {
+		t.Errorf("got %d %q %q, want 200 image/jpeg", rec.Code, rec.Header().Get("Content-Type"), rec.Body.String())
+	}
+
+	for _, path := range []string{"/blobs/covers/x/large.jpg", "/blobs/", "/blobs/covers/../covers/x/small.jpg"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s: got status %d, want 404", path, rec.Code)
+		}
+	}
+}
+
+func TestDeleteUnusedCover(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryBlobStore(LocalBlobPath)
+	db := newMemoryDB()
+
+	urls, err := StoreCover(ctx, store, bytes.NewReader(encodeJPEG(t, testImage(300, 300))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageURL := urls[DefaultCoverSize]
+
+	// Two books share the cover; it is kept until neither uses it.
+	id1, err := db.AddBook(&Book{Title: "one", ImageURL: imageURL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.AddBook(&Book{Title: "two", ImageURL: urls["small"]}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteBook(id1); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteUnusedCover(ctx, store, db, imageURL); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.blobs) != len(CoverSizes) {
+		t.Fatalf("got %d blobs with the cover still used, want %d", len(store.blobs), len(CoverSizes))
+	}
+
+	db = newMemoryDB()
+	if err := DeleteUnusedCover(ctx, store, db, imageURL); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.blobs) != 0 {
+		t.Errorf("got %d blobs after deleting the unused cover, want 0", len(store.blobs))
+	}
+
+	// Images stored elsewhere are left alone.
+	if err := store.Put(ctx, "other.jpg", nil, "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []string{store.URL("other.jpg"), "https://books.example.com/covers/x/medium.jpg"} {
+		if err := DeleteUnusedCover(ctx, store, db, u); err != nil {
+			t.Errorf("DeleteUnusedCover(%q): %v", u, err)
+		}
+	}
+	if len(store.blobs) != 1 {
+		t.Error("DeleteUnusedCover deleted an image that is not a cover")
+	}
+}
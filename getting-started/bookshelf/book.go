@@ -4,16 +4,32 @@
 
 package bookshelf
 
+import "errors"
+
+var (
+	// ErrNotFound is returned by BookDatabase.GetBook when no book exists with
+	// the given ID.
+	ErrNotFound = errors.New("bookshelf: book not found")
+
+	// ErrConflict is returned by BookDatabase.UpdateBook when the book has
+	// been modified since the version being updated was read.
+	ErrConflict = errors.New("bookshelf: book was modified concurrently")
+)
+
 // Book holds metadata about a book.
 type Book struct {
-	ID            int64
-	Title         string
-	Author        string
-	PublishedDate string
-	ImageURL      string
-	Description   string
-	CreatedBy     string
-	CreatedByID   string
+	ID            int64  `json:"id"`
+	Title         string `json:"title"`
+	Author        string `json:"author"`
+	PublishedDate string `json:"publishedDate"`
+	ImageURL      string `json:"imageUrl"`
+	Description   string `json:"description"`
+	CreatedBy     string `json:"createdBy"`
+	CreatedByID   string `json:"createdById"`
+
+	// Version is incremented each time the book is updated. It is used to
+	// detect concurrent modifications: see BookDatabase.UpdateBook.
+	Version int64 `json:"version"`
 }
 
 // CreatedByDisplayName returns a string appropriate for displaying the name of
@@ -40,16 +56,27 @@ type BookDatabase interface {
 	// the user who created the book entry.
 	ListBooksCreatedBy(userID string) ([]*Book, error)
 
-	// GetBook retrieves a book by its ID.
+	// ListBooksPage returns a page of books, ordered and filtered according
+	// to opts. Pages are retrieved one after another by passing the
+	// NextCursor or PrevCursor of a page as opts.Cursor.
+	ListBooksPage(opts ListOptions) (*BookPage, error)
+
+	// GetBook retrieves a book by its ID. If no such book exists, ErrNotFound
+	// is returned.
 	GetBook(id int64) (*Book, error)
 
-	// AddBook saves a given book, assigning it a new ID.
+	// AddBook saves a given book, assigning it a new ID. The book's Version
+	// is set to 1.
 	AddBook(b *Book) (id int64, err error)
 
 	// DeleteBook removes a given book by its ID.
 	DeleteBook(id int64) error
 
-	// UpdateBook updates the entry for a given book.
+	// UpdateBook updates the entry for a given book. The update is only made if
+	// b.Version matches the version of the stored book, in which case
+	// b.Version is incremented. Otherwise, ErrConflict is returned and the
+	// caller should re-read the book before trying again. If the book does not
+	// exist, ErrNotFound is returned.
 	UpdateBook(b *Book) error
 
 	// Close closes the database, freeing up any available resources.
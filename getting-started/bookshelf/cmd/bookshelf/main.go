@@ -0,0 +1,274 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Command bookshelf performs administrative tasks for the bookshelf app.
+//
+// Each subcommand acts on the database given by the -db URL (see
+// bookshelf.OpenBookDatabase).
+//
+// The migrate subcommand manages the schema of a MySQL or PostgreSQL
+// database:
+//
+//	bookshelf -db mysql://root@localhost migrate status
+//	bookshelf -db mysql://root@localhost migrate up [version]
+//	bookshelf -db mysql://root@localhost migrate down [version]
+//
+// "up" applies pending migrations, up to the latest or the given version.
+// "down" reverts the latest migration, or all migrations after the given
+// version. The app and the worker refuse to start while migrations are
+// pending, so apply them before deploying a new version. Only one process
+// migrates a database at a time.
+//
+// The export and import subcommands copy books to and from CSV or JSON Lines
+// files:
+//
+//	bookshelf -db mysql://root@localhost export csv > books.csv
+//	bookshelf -db mysql://root@localhost import books.csv
+//
+// Imports skip invalid rows and books that already exist, reporting each one.
+// With -enrich, each imported book is published to Pub/Sub for the worker to
+// fill in its details.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"cloud.google.com/go/pubsub"
+	"golang.org/x/net/context"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+)
+
+func main() {
+	var (
+		dbURL   = flag.String("db", "", "URL of the database to act on")
+		project = flag.String("enrich", "", "project ID of the Pub/Sub topic to publish imported books to, for the worker to fill in their details")
+		dryRun  = flag.Bool("dry-run", false, "validate imported books without adding them")
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage:
+bookshelf -db <url> migrate <action> [version]
+bookshelf -db <url> export [csv|jsonl]
+bookshelf -db <url> [-enrich <project>] [-dry-run] import <file>
+
+Migrate actions:
+* status: list migrations and whether they have been applied.
+* up [version]: apply pending migrations, up to the latest or given version.
+* down [version]: revert the latest migration, or those after the given version.
+
+Export writes all books to stdout. Import reads a .csv or .jsonl file.
+
+Flags:
+`)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	switch flag.Arg(0) {
+	case "migrate", "export", "import":
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid command: %q\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *dbURL == "" {
+		fmt.Fprintf(os.Stderr, "The %s command needs -db.\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if flag.Arg(0) != "migrate" {
+		db, err := bookshelf.OpenBookDatabase(*dbURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer db.Close()
+		if flag.Arg(0) == "export" {
+			err = export(os.Stdout, db, flag.Arg(1))
+		} else {
+			err = importFile(os.Stdout, db, flag.Arg(1), *project, *dryRun)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	m, err := bookshelf.OpenMigrator(*dbURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer m.Close()
+
+	if err := migrate(os.Stdout, m, flag.Arg(1), flag.Arg(2)); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// migrate runs a migrate action, then prints the resulting status.
+func migrate(w io.Writer, m *bookshelf.Migrator, action, versionArg string) error {
+	var version int64 = -1
+	if versionArg != "" {
+		v, err := strconv.ParseInt(versionArg, 10, 64)
+		if err != nil || v < 0 {
+			return fmt.Errorf("invalid version %q", versionArg)
+		}
+		version = v
+	}
+
+	switch action {
+	case "status":
+	case "up":
+		if version < 0 {
+			version = m.Latest()
+		}
+		if err := m.MigrateTo(version); err != nil {
+			return err
+		}
+	case "down":
+		if version < 0 {
+			v, err := previousVersion(m)
+			if err != nil {
+				return err
+			}
+			version = v
+		}
+		if err := m.MigrateTo(version); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid migrate action: %q", action)
+	}
+
+	return printStatus(w, m)
+}
+
+// previousVersion returns the version of the migration applied before the
+// latest applied one, or 0 if at most one migration has been applied.
+func previousVersion(m *bookshelf.Migrator) (int64, error) {
+	status, err := m.Status()
+	if err != nil {
+		return 0, err
+	}
+	var applied []int64
+	for _, s := range status {
+		if s.Applied {
+			applied = append(applied, s.Version)
+		}
+	}
+	if len(applied) < 2 {
+		return 0, nil
+	}
+	return applied[len(applied)-2], nil
+}
+
+// printStatus prints a table of the migrations and whether they are applied.
+func printStatus(w io.Writer, m *bookshelf.Migrator) error {
+	status, err := m.Status()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tSTATUS\tAPPLIED AT\tNAME")
+	pending := 0
+	for _, s := range status {
+		state := "pending"
+		if s.Applied {
+			state = "applied"
+		} else {
+			pending++
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", s.Version, state, s.AppliedAt, s.Name)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%d of %d migrations pending.\n", pending, len(status))
+	return nil
+}
+
+// export writes all books in db to w, in the given format.
+func export(w io.Writer, db bookshelf.BookDatabase, format string) error {
+	if format == "" {
+		format = bookshelf.FormatCSV
+	}
+	books, err := db.ListBooks()
+	if err != nil {
+		return err
+	}
+	return bookshelf.ExportBooks(w, format, books)
+}
+
+// importFile adds the books in the named file to db, and reports the rows that
+// were skipped. If project is set, each added book is published to the Pub/Sub
+// topic of the worker in that project.
+func importFile(w io.Writer, db bookshelf.BookDatabase, name, project string, dryRun bool) error {
+	if name == "" {
+		return fmt.Errorf("missing file to import")
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	opts := bookshelf.ImportOptions{
+		Format: bookshelf.FormatFromFilename(name),
+		DryRun: dryRun,
+	}
+
+	var results []*pubsub.PublishResult
+	if project != "" && !dryRun {
+		ctx := context.Background()
+		client, err := pubsub.NewClient(ctx, project)
+		if err != nil {
+			return fmt.Errorf("could not create Pub/Sub client: %v", err)
+		}
+		topic := client.Topic(bookshelf.PubsubTopicID)
+		defer topic.Stop()
+		opts.Added = func(b *bookshelf.Book) {
+			data, _ := json.Marshal(b.ID)
+			results = append(results, topic.Publish(ctx, &pubsub.Message{Data: data}))
+		}
+	}
+
+	r, err := bookshelf.ImportBooks(db, f, opts)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range r.Duplicates {
+		fmt.Fprintf(w, "Skipped %v\n", e)
+	}
+	for _, e := range r.Errors {
+		fmt.Fprintf(w, "Invalid %v\n", e)
+	}
+	verb := "Added"
+	if dryRun {
+		verb = "Would add"
+	}
+	fmt.Fprintf(w, "%s %d of %d books: %d duplicates, %d invalid.\n",
+		verb, len(r.Added), r.Rows, len(r.Duplicates), len(r.Errors))
+
+	published := 0
+	for _, res := range results {
+		if _, err := res.Get(context.Background()); err != nil {
+			log.Printf("Could not publish book for enrichment: %v", err)
+			continue
+		}
+		published++
+	}
+	if len(results) > 0 {
+		fmt.Fprintf(w, "Published %d books for enrichment.\n", published)
+	}
+	return nil
+}
@@ -0,0 +1,377 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// BookImporter is implemented by BookDatabases that can store a book under an
+// ID chosen by the caller, such as when copying books from another database.
+type BookImporter interface {
+	// ImportBook saves b under b.ID, keeping b.Version. Any book already
+	// stored with that ID is replaced.
+	ImportBook(b *Book) error
+}
+
+// importFinisher is implemented by BookImporters that need to catch up once a
+// batch of books has been imported, such as by moving an ID sequence past the
+// imported IDs. CopyBooks calls finishImport when it returns.
+type importFinisher interface {
+	finishImport() error
+}
+
+// CopyOptions configures CopyBooks.
+type CopyOptions struct {
+	// DryRun reads the source database without writing to the destination
+	// or the checkpoint.
+	DryRun bool
+
+	// Checkpoint is the path of a file recording which books have been
+	// copied. If the file exists, the copy resumes from where it left off,
+	// skipping books that were already copied. Optional.
+	Checkpoint string
+
+	// Source and Destination identify the databases, such as by their URLs,
+	// in the checkpoint. A checkpoint saved by a copy between other databases
+	// is refused. Passwords in URLs are not saved.
+	Source, Destination string
+
+	// PageSize is the number of books read from the source at a time.
+	// Defaults to MaxPageSize.
+	PageSize int
+
+	// Progress, if set, is called after each page of books is copied.
+	Progress func(CopyResult)
+}
+
+// CopyResult summarizes a run of CopyBooks.
+type CopyResult struct {
+	// Read is the number of books read from the source in this run.
+	Read int
+
+	// Copied is the number of books written to the destination in this run,
+	// or that would have been written in a dry run.
+	Copied int
+
+	// Skipped is the number of books read that had been copied before,
+	// according to the checkpoint.
+	Skipped int
+
+	// PreservedIDs reports whether the destination keeps the source IDs.
+	PreservedIDs bool
+}
+
+// copyCheckpoint is the content of a checkpoint file.
+type copyCheckpoint struct {
+	// Source and Destination are the databases being copied between.
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+
+	// Cursor is the cursor of the first source page not yet fully copied.
+	Cursor string `json:"cursor"`
+
+	// IDs maps from the source ID of each copied book to its destination ID.
+	// It is only kept for destinations that aren't BookImporters: books
+	// imported again just replace their earlier copy.
+	IDs map[int64]int64 `json:"ids,omitempty"`
+}
+
+// CopyBooks copies all books from src to dst, one page at a time.
+//
+// If dst implements BookImporter, books keep their IDs and versions.
+// Otherwise they are added with AddBook, and so get new IDs and start again
+// at version 1.
+//
+// Progress is saved to the checkpoint file after each page, and when a book
+// fails to copy. If dst is a BookImporter, the checkpoint only records the
+// page to resume from, and the books of that page are imported again.
+// Otherwise it also records the books copied, and once a copy completes, the
+// checkpoint is kept, so running the copy again only copies the books added
+// to src since. If the process dies mid-page, books copied since the last
+// save may be copied again, creating duplicates.
+func CopyBooks(dst, src BookDatabase, opts CopyOptions) (result *CopyResult, err error) {
+	importer, preserveIDs := dst.(BookImporter)
+	result = &CopyResult{PreservedIDs: preserveIDs}
+	if finisher, ok := dst.(importFinisher); ok && preserveIDs {
+		defer func() {
+			if result.Copied == 0 || opts.DryRun {
+				return
+			}
+			if finishErr := finisher.finishImport(); finishErr != nil && err == nil {
+				err = fmt.Errorf("copy: %v", finishErr)
+			}
+		}()
+	}
+
+	source, destination := redactURL(opts.Source), redactURL(opts.Destination)
+	cp, err := loadCopyCheckpoint(opts.Checkpoint, source, destination)
+	if err != nil {
+		return result, err
+	}
+	cp.Source, cp.Destination = source, destination
+	if preserveIDs {
+		cp.IDs = nil
+	}
+	save := func() error {
+		if opts.DryRun || opts.Checkpoint == "" {
+			return nil
+		}
+		return cp.save(opts.Checkpoint)
+	}
+
+	pageSize := opts.PageSize
+	if pageSize == 0 {
+		pageSize = MaxPageSize
+	}
+	for {
+		page, err := src.ListBooksPage(ListOptions{PageSize: pageSize, Cursor: cp.Cursor})
+		if err != nil {
+			return result, fmt.Errorf("copy: could not list source books: %v", err)
+		}
+
+		for _, b := range page.Books {
+			result.Read++
+			if _, ok := cp.IDs[b.ID]; ok {
+				result.Skipped++
+				continue
+			}
+			if !opts.DryRun {
+				id, err := copyBook(dst, importer, b)
+				if err != nil {
+					if saveErr := save(); saveErr != nil {
+						return result, fmt.Errorf("copy: could not copy book %d: %v (and %v)", b.ID, err, saveErr)
+					}
+					return result, fmt.Errorf("copy: could not copy book %d: %v", b.ID, err)
+				}
+				if !preserveIDs {
+					cp.IDs[b.ID] = id
+				}
+			}
+			result.Copied++
+		}
+
+		cp.Cursor = page.NextCursor
+		if err := save(); err != nil {
+			return result, err
+		}
+		if opts.Progress != nil {
+			opts.Progress(*result)
+		}
+		if page.NextCursor == "" {
+			return result, nil
+		}
+	}
+}
+
+// copyBook writes a copy of b to dst, returning its ID in dst. If importer is
+// non-nil, it is used to keep the ID of b.
+func copyBook(dst BookDatabase, importer BookImporter, b *Book) (int64, error) {
+	copied := *b
+	if importer != nil {
+		return b.ID, importer.ImportBook(&copied)
+	}
+	copied.ID = 0
+	return dst.AddBook(&copied)
+}
+
+// loadCopyCheckpoint reads a checkpoint file, checking that it was saved by a
+// copy from source to destination. A missing file, or an empty path, yields
+// an empty checkpoint.
+func loadCopyCheckpoint(path, source, destination string) (*copyCheckpoint, error) {
+	cp := &copyCheckpoint{IDs: make(map[int64]int64)}
+	if path == "" {
+		return cp, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("copy: could not read checkpoint: %v", err)
+	}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, fmt.Errorf("copy: could not parse checkpoint %s: %v", path, err)
+	}
+	if cp.Source != source || cp.Destination != destination {
+		return nil, fmt.Errorf("copy: checkpoint %s is for a copy from %q to %q; remove it or use another checkpoint file",
+			path, cp.Source, cp.Destination)
+	}
+	if cp.IDs == nil {
+		cp.IDs = make(map[int64]int64)
+	}
+	return cp, nil
+}
+
+// redactURL removes the password from a database URL, if any.
+func redactURL(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.User == nil {
+		return rawurl
+	}
+	if _, ok := u.User.Password(); !ok {
+		return rawurl
+	}
+	u.User = url.User(u.User.Username())
+	return u.String()
+}
+
+// save writes the checkpoint to path. The file is replaced atomically, so an
+// interrupted save leaves the previous checkpoint intact.
+func (cp *copyCheckpoint) save(path string) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return fmt.Errorf("copy: could not encode checkpoint: %v", err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("copy: could not save checkpoint: %v", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("copy: could not save checkpoint: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("copy: could not save checkpoint: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("copy: could not save checkpoint: %v", err)
+	}
+	return nil
+}
+
+// Verification compares the books in a source and destination database.
+type Verification struct {
+	SourceCount, DestCount int
+
+	// SourceChecksum and DestChecksum are hex-encoded digests of the books in
+	// each database. They are independent of the order the books are listed
+	// in.
+	SourceChecksum, DestChecksum string
+
+	// Missing lists the IDs of source books with no identical book in the
+	// destination. Extra lists the IDs of destination books with no identical
+	// book in the source.
+	Missing, Extra []int64
+}
+
+// OK reports whether the source and destination hold the same books.
+func (v *Verification) OK() bool {
+	return v.SourceCount == v.DestCount && v.SourceChecksum == v.DestChecksum
+}
+
+// VerifyCopy compares the books in src and dst. Books are compared by their
+// fields other than the version, and also by ID if compareIDs is set.
+func VerifyCopy(dst, src BookDatabase, compareIDs bool) (*Verification, error) {
+	srcSums, err := bookChecksums(src, compareIDs)
+	if err != nil {
+		return nil, fmt.Errorf("verify: could not list source books: %v", err)
+	}
+	dstSums, err := bookChecksums(dst, compareIDs)
+	if err != nil {
+		return nil, fmt.Errorf("verify: could not list destination books: %v", err)
+	}
+
+	v := &Verification{
+		SourceCount:    srcSums.count,
+		DestCount:      dstSums.count,
+		SourceChecksum: srcSums.digest(),
+		DestChecksum:   dstSums.digest(),
+	}
+	for sum, ids := range srcSums.ids {
+		if n := len(ids) - len(dstSums.ids[sum]); n > 0 {
+			v.Missing = append(v.Missing, ids[len(ids)-n:]...)
+		}
+	}
+	for sum, ids := range dstSums.ids {
+		if n := len(ids) - len(srcSums.ids[sum]); n > 0 {
+			v.Extra = append(v.Extra, ids[len(ids)-n:]...)
+		}
+	}
+	sortIDs(v.Missing)
+	sortIDs(v.Extra)
+	return v, nil
+}
+
+// checksums holds the checksums of all the books in a database.
+type checksums struct {
+	count int
+	ids   map[string][]int64 // maps from book checksum to the IDs of the books.
+}
+
+// bookChecksums lists all the books in db and computes their checksums.
+func bookChecksums(db BookDatabase, includeID bool) (*checksums, error) {
+	sums := &checksums{ids: make(map[string][]int64)}
+	opts := ListOptions{PageSize: MaxPageSize}
+	for {
+		page, err := db.ListBooksPage(opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range page.Books {
+			sum := bookChecksum(b, includeID)
+			sums.ids[sum] = append(sums.ids[sum], b.ID)
+			sums.count++
+		}
+		if page.NextCursor == "" {
+			return sums, nil
+		}
+		opts.Cursor = page.NextCursor
+	}
+}
+
+// digest combines the book checksums into a single checksum, independent of
+// the order of the books.
+func (c *checksums) digest() string {
+	var sums []string
+	for sum, ids := range c.ids {
+		for range ids {
+			sums = append(sums, sum)
+		}
+	}
+	sort.Strings(sums)
+
+	h := sha256.New()
+	for _, sum := range sums {
+		h.Write([]byte(sum))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// bookChecksum returns a hex-encoded digest of the fields of b, other than
+// its version. Its ID is included if includeID is set.
+func bookChecksum(b *Book, includeID bool) string {
+	var id int64
+	if includeID {
+		id = b.ID
+	}
+	// Encoding the fields as JSON keeps them unambiguously separated.
+	data, _ := json.Marshal([]interface{}{id, b.Title, b.Author, b.PublishedDate,
+		b.ImageURL, b.Description, b.CreatedBy, b.CreatedByID})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func sortIDs(ids []int64) {
+	sort.Sort(int64s(ids))
+}
+
+// int64s implements sort.Interface, ordering IDs in increasing order.
+type int64s []int64
+
+func (s int64s) Len() int           { return len(s) }
+func (s int64s) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,366 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// MaxCoverBytes is the largest cover image upload accepted.
+	MaxCoverBytes = 10 << 20
+
+	// maxCoverPixels limits the dimensions of cover images, so that small
+	// files can't decode into huge images.
+	maxCoverPixels = 40 * 1000 * 1000
+
+	// coverQuality is the JPEG quality covers are re-encoded with.
+	coverQuality = 85
+)
+
+// CoverSize is a size covers are resized to. Covers are scaled down to fit
+// within Width x Height, keeping their aspect ratio; they are never scaled up.
+type CoverSize struct {
+	Name          string
+	Width, Height int
+}
+
+// CoverSizes are the sizes every uploaded cover is stored in.
+var CoverSizes = []CoverSize{
+	{Name: "small", Width: 100, Height: 150},
+	{Name: "medium", Width: 200, Height: 300},
+	{Name: "large", Width: 400, Height: 600},
+}
+
+// DefaultCoverSize is the name of the size used as a book's ImageURL.
+const DefaultCoverSize = "medium"
+
+// InvalidImageError is returned when an uploaded cover is not an image that
+// can be used, e.g. because it is too large or not in a supported format.
+type InvalidImageError struct {
+	Reason string
+}
+
+func (e *InvalidImageError) Error() string {
+	return "invalid image: " + e.Reason
+}
+
+// Cover is one size of a processed cover image.
+type Cover struct {
+	Size CoverSize
+
+	// Name is the blob name the cover is stored under. It is derived from
+	// the content of the upload, so uploading the same image twice gives the
+	// same names.
+	Name string
+
+	// Data is the cover, encoded as a JPEG.
+	Data []byte
+}
+
+// StoreCover processes the cover image read from r and stores each size in
+// store. It returns the URL of each size, keyed by the size name.
+func StoreCover(ctx context.Context, store BlobStore, r io.Reader) (map[string]string, error) {
+	covers, err := ProcessCover(r)
+	if err != nil {
+		return nil, err
+	}
+	urls := make(map[string]string)
+	for _, c := range covers {
+		if err := store.Put(ctx, c.Name, c.Data, "image/jpeg"); err != nil {
+			return nil, err
+		}
+		urls[c.Size.Name] = store.URL(c.Name)
+	}
+	return urls, nil
+}
+
+// ProcessCover validates the image read from r and resizes it to each of
+// CoverSizes. JPEG, PNG, GIF and WebP images are accepted; the format is
+// determined from the content, not the file name or the declared content
+// type.
+//
+// The covers are re-encoded as JPEGs, so metadata such as EXIF is not kept.
+// The EXIF orientation of JPEGs is applied first, so that photos taken with a
+// rotated camera appear the right way up.
+func ProcessCover(r io.Reader) ([]Cover, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, MaxCoverBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxCoverBytes {
+		return nil, &InvalidImageError{fmt.Sprintf("larger than %d MB", MaxCoverBytes>>20)}
+	}
+	format := sniffImageFormat(data)
+	if format == "" {
+		return nil, &InvalidImageError{"not a JPEG, PNG, GIF or WebP image"}
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, &InvalidImageError{fmt.Sprintf("could not read %s: %v", format, err)}
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxCoverPixels {
+		return nil, &InvalidImageError{fmt.Sprintf("bad dimensions %dx%d", cfg.Width, cfg.Height)}
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, &InvalidImageError{fmt.Sprintf("could not decode %s: %v", format, err)}
+	}
+	if format == "jpeg" {
+		img = orient(img, exifOrientation(data))
+	}
+
+	sum := sha256.Sum256(data)
+	key := hex.EncodeToString(sum[:16])
+
+	var covers []Cover
+	for _, size := range CoverSizes {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, resize(img, size), &jpeg.Options{Quality: coverQuality}); err != nil {
+			return nil, fmt.Errorf("could not encode cover: %v", err)
+		}
+		covers = append(covers, Cover{
+			Size: size,
+			Name: coverName(key, size.Name),
+			Data: buf.Bytes(),
+		})
+	}
+	return covers, nil
+}
+
+// DeleteUnusedCover deletes every size of the cover at imageURL from store,
+// unless a book in db still uses it. Since covers are named after their
+// content, books given the same image share a cover. Images that are not
+// covers in store, such as those found by the Pub/Sub worker, are ignored.
+func DeleteUnusedCover(ctx context.Context, store BlobStore, db BookDatabase, imageURL string) error {
+	key := coverKey(blobName(store, imageURL))
+	if key == "" {
+		return nil
+	}
+	var urls []string
+	for _, size := range CoverSizes {
+		urls = append(urls, store.URL(coverName(key, size.Name)))
+	}
+	if used, err := anyBookUses(db, urls); err != nil || used {
+		return err
+	}
+
+	for _, size := range CoverSizes {
+		err := store.Delete(ctx, coverName(key, size.Name))
+		if err != nil && err != ErrBlobNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// imageFinder is implemented by BookDatabases that can find the books with an
+// image without listing all the books.
+type imageFinder interface {
+	// usesImage reports whether any book has one of the given image URLs.
+	usesImage(imageURLs []string) (bool, error)
+}
+
+// anyBookUses reports whether any book in db has one of the given image URLs.
+// Unless db is an imageFinder, all the books are read.
+func anyBookUses(db BookDatabase, imageURLs []string) (bool, error) {
+	if len(imageURLs) == 0 {
+		return false, nil
+	}
+	if f, ok := db.(imageFinder); ok {
+		return f.usesImage(imageURLs)
+	}
+	return listBooksUsing(db, imageURLs)
+}
+
+// listBooksUsing reports whether any book in db has one of the given image
+// URLs by reading all the books.
+func listBooksUsing(db BookDatabase, imageURLs []string) (bool, error) {
+	books, err := db.ListBooks()
+	if err != nil {
+		return false, err
+	}
+	for _, b := range books {
+		for _, u := range imageURLs {
+			if b.ImageURL == u {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// coverKey returns the key of the cover with the given blob name, or "" if
+// name is not that of a cover.
+func coverKey(name string) string {
+	parts := strings.Split(name, "/")
+	if len(parts) != 3 || parts[0] != "covers" || parts[1] == "" || !strings.HasSuffix(parts[2], ".jpg") {
+		return ""
+	}
+	for _, size := range CoverSizes {
+		if parts[2] == size.Name+".jpg" {
+			return parts[1]
+		}
+	}
+	return ""
+}
+
+// coverName returns the blob name of a size of the cover with the given key.
+func coverName(key, size string) string {
+	return "covers/" + key + "/" + size + ".jpg"
+}
+
+// sniffImageFormat returns the format of the image in data, as named by the
+// image package, or "" if it is not a supported format.
+func sniffImageFormat(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("\xff\xd8\xff")):
+		return "jpeg"
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return "png"
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return "gif"
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return "webp"
+	}
+	return ""
+}
+
+// resize scales img down to fit within size, flattening any transparency
+// onto a white background.
+func resize(img image.Image, size CoverSize) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > size.Width {
+		w, h = size.Width, h*size.Width/w
+	}
+	if h > size.Height {
+		w, h = w*size.Height/h, size.Height
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.ZP, draw.Src)
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, b, xdraw.Over, nil)
+	return dst
+}
+
+// exifOrientation returns the EXIF orientation tag of a JPEG, from 1 to 8, or
+// 1 (upright) if it has none.
+func exifOrientation(data []byte) int {
+	// Walk the JPEG segments up to the start of the image data, looking for
+	// an APP1 segment holding EXIF.
+	for i := 2; i+4 <= len(data) && data[i] == 0xff; {
+		marker := data[i+1]
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		if marker == 0xda || n < 2 || i+2+n > len(data) {
+			break
+		}
+		seg := data[i+4 : i+2+n]
+		if marker == 0xe1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return tiffOrientation(seg[6:])
+		}
+		i += 2 + n
+	}
+	return 1
+}
+
+// tiffOrientation returns the orientation tag in the first IFD of the TIFF
+// structure holding EXIF data, or 1 if there is none.
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		e := ifd + 2 + 12*i
+		if e+12 > len(tiff) {
+			break
+		}
+		// Orientation is tag 0x0112, a single SHORT.
+		if order.Uint16(tiff[e:]) == 0x0112 && order.Uint16(tiff[e+2:]) == 3 {
+			if o := int(order.Uint16(tiff[e+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+		}
+	}
+	return 1
+}
+
+// orient transforms img so that it appears upright, given its EXIF
+// orientation.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	// Orientations 5 to 8 swap the width and height.
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // flipped horizontally.
+				dx, dy = w-1-x, y
+			case 3: // rotated 180°.
+				dx, dy = w-1-x, h-1-y
+			case 4: // flipped vertically.
+				dx, dy = x, h-1-y
+			case 5: // transposed.
+				dx, dy = y, x
+			case 6: // rotated 90° counterclockwise; turn it clockwise.
+				dx, dy = h-1-y, x
+			case 7: // transversed.
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90° clockwise; turn it counterclockwise.
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
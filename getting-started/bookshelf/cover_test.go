@@ -0,0 +1,258 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// testImage returns a w x h image, red on the left half and blue on the
+// right.
+func testImage(w, h int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{0, 0, 255, 255}
+			if x < w/2 {
+				c = color.RGBA{255, 0, 0, 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func encodeJPEG(t *testing.T, img image.Image) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// withOrientation inserts an EXIF segment with the given orientation into a
+// JPEG.
+func withOrientation(data []byte, orientation uint16) []byte {
+	var tiff bytes.Buffer
+	tiff.WriteString("MM\x00\x2a")
+	binary.Write(&tiff, binary.BigEndian, uint32(8))
+	binary.Write(&tiff, binary.BigEndian, uint16(1))                      // entries
+	binary.Write(&tiff, binary.BigEndian, []uint16{0x0112, 3, 0, 1})      // tag, type, count
+	binary.Write(&tiff, binary.BigEndian, []uint16{orientation, 0, 0, 0}) // value, next IFD
+
+	seg := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	var out bytes.Buffer
+	out.Write(data[:2])
+	out.Write([]byte{0xff, 0xe1})
+	binary.Write(&out, binary.BigEndian, uint16(len(seg)+2))
+	out.Write(seg)
+	out.Write(data[2:])
+	return out.Bytes()
+}
+
+func TestProcessCoverFormats(t *testing.T) {
+	img := testImage(800, 600)
+	var pngData, gifData bytes.Buffer
+	if err := png.Encode(&pngData, img); err != nil {
+		t.Fatal(err)
+	}
+	if err := gif.Encode(&gifData, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	webpData, err := ioutil.ReadFile("testdata/cover.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		format string
+		data   []byte
+	}{
+		{"jpeg", encodeJPEG(t, img)},
+		{"png", pngData.Bytes()},
+		{"gif", gifData.Bytes()},
+		{"webp", webpData},
+	}
+	for _, tt := range tests {
+		if got := sniffImageFormat(tt.data); got != tt.format {
+			t.Errorf("sniffImageFormat(%s) = %q", tt.format, got)
+		}
+		covers, err := ProcessCover(bytes.NewReader(tt.data))
+		if err != nil {
+			t.Errorf("ProcessCover(%s): %v", tt.format, err)
+			continue
+		}
+		if len(covers) != len(CoverSizes) {
+			t.Errorf("ProcessCover(%s) gave %d covers, want %d", tt.format, len(covers), len(CoverSizes))
+			continue
+		}
+		for _, c := range covers {
+			got, format, err := image.Decode(bytes.NewReader(c.Data))
+			if err != nil || format != "jpeg" {
+				t.Errorf("%s %s cover: format %q, %v; want a JPEG", tt.format, c.Size.Name, format, err)
+				continue
+			}
+			b := got.Bounds()
+			if b.Dx() > c.Size.Width || b.Dy() > c.Size.Height {
+				t.Errorf("%s %s cover is %dx%d, want at most %dx%d", tt.format, c.Size.Name,
+					b.Dx(), b.Dy(), c.Size.Width, c.Size.Height)
+			}
+		}
+	}
+}
+
+func TestProcessCoverResize(t *testing.T) {
+	covers, err := ProcessCover(bytes.NewReader(encodeJPEG(t, testImage(800, 600))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Landscape images are limited by the width, keeping the aspect ratio.
+	want := map[string]image.Point{
+		"small":  {100, 75},
+		"medium": {200, 150},
+		"large":  {400, 300},
+	}
+	for _, c := range covers {
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(c.Data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := (image.Point{cfg.Width, cfg.Height}); got != want[c.Size.Name] {
+			t.Errorf("%s cover is %v, want %v", c.Size.Name, got, want[c.Size.Name])
+		}
+	}
+
+	// Small images are not scaled up.
+	covers, err = ProcessCover(bytes.NewReader(encodeJPEG(t, testImage(50, 60))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range covers {
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(c.Data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Width != 50 || cfg.Height != 60 {
+			t.Errorf("%s cover of a 50x60 image is %dx%d, want 50x60", c.Size.Name, cfg.Width, cfg.Height)
+		}
+	}
+}
+
+func TestProcessCoverOrientation(t *testing.T) {
+	data := withOrientation(encodeJPEG(t, testImage(400, 200)), 6)
+	if o := exifOrientation(data); o != 6 {
+		t.Fatalf("exifOrientation = %d, want 6", o)
+	}
+
+	covers, err := ProcessCover(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := covers[len(covers)-1]
+	if bytes.Contains(large.Data, []byte("Exif")) {
+		t.Error("cover still has EXIF data")
+	}
+	img, err := jpeg.Decode(bytes.NewReader(large.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rotated clockwise, the 400x200 image becomes 200x400 with the red half
+	// on top.
+	b := img.Bounds()
+	if b.Dx() != 200 || b.Dy() != 400 {
+		t.Fatalf("cover is %dx%d, want 200x400", b.Dx(), b.Dy())
+	}
+	if r, _, bl, _ := img.At(100, 50).RGBA(); r < bl {
+		t.Error("top of rotated cover is not red")
+	}
+	if r, _, bl, _ := img.At(100, 350).RGBA(); r > bl {
+		t.Error("bottom of rotated cover is not blue")
+	}
+}
+
+func TestProcessCoverInvalid(t *testing.T) {
+	huge := make([]byte, MaxCoverBytes+1)
+	copy(huge, "\x89PNG\r\n\x1a\n")
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"text", []byte("hello, world")},
+		{"html named as an image", []byte("<html><img src=x></html>")},
+		{"truncated jpeg", encodeJPEG(t, testImage(10, 10))[:20]},
+		{"too large", huge},
+	}
+	for _, tt := range tests {
+		_, err := ProcessCover(bytes.NewReader(tt.data))
+		if _, ok := err.(*InvalidImageError); !ok {
+			t.Errorf("%s: got error %v, want an InvalidImageError", tt.name, err)
+		}
+	}
+}
+
+func TestStoreCover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookshelf-covers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := newLocalBlobStore(dir, "http://localhost/blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := encodeJPEG(t, testImage(300, 300))
+	ctx := context.Background()
+	urls, err := StoreCover(ctx, store, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The same image is stored under the same names.
+	again, err := StoreCover(ctx, store, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range CoverSizes {
+		u := urls[size.Name]
+		if !strings.HasPrefix(u, "http://localhost/blobs/covers/") || !strings.HasSuffix(u, "/"+size.Name+".jpg") {
+			t.Errorf("%s URL = %q, want http://localhost/blobs/covers/<key>/%s.jpg", size.Name, u, size.Name)
+		}
+		if again[size.Name] != u {
+			t.Errorf("%s URL changed from %q to %q on second upload", size.Name, u, again[size.Name])
+		}
+		name := strings.TrimPrefix(u, "http://localhost/blobs/")
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+			t.Errorf("%s cover not stored: %v", size.Name, err)
+		}
+	}
+
+	other, err := StoreCover(ctx, store, bytes.NewReader(encodeJPEG(t, testImage(300, 200))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other[DefaultCoverSize] == urls[DefaultCoverSize] {
+		t.Error("different images stored under the same name")
+	}
+
+	if err := store.Put(ctx, "../escape", nil, "text/plain"); err == nil {
+		t.Error("Put(../escape): got nil error")
+	}
+}
@@ -18,8 +18,14 @@ type datastoreDB struct {
 	client *datastore.Client
 }
 
-// Ensure datastoreDB conforms to the BookDatabase interface.
-var _ BookDatabase = &datastoreDB{}
+// Ensure datastoreDB conforms to the BookDatabase, BookImporter,
+// versionedDeleter and imageFinder interfaces.
+var (
+	_ BookDatabase     = &datastoreDB{}
+	_ BookImporter     = &datastoreDB{}
+	_ versionedDeleter = &datastoreDB{}
+	_ imageFinder      = &datastoreDB{}
+)
 
 // newDatastoreDB creates a new BookDatabase backed by Cloud Datastore.
 // See the datastore and google packages for details on creating a suitable Client:
@@ -53,17 +59,20 @@ func (db *datastoreDB) GetBook(id int64) (*Book, error) {
 	ctx := context.Background()
 	k := db.datastoreKey(id)
 	book := &Book{}
-	if err := db.client.Get(ctx, k, book); err != nil {
+	if err := db.client.Get(ctx, k, book); err == datastore.ErrNoSuchEntity {
+		return nil, ErrNotFound
+	} else if err != nil {
 		return nil, fmt.Errorf("datastoredb: could not get Book: %v", err)
 	}
 	book.ID = id
 	return book, nil
 }
 
-// AddBook saves a given book, assigning it a new ID.
+// AddBook saves a given book, assigning it a new ID and its first version.
 func (db *datastoreDB) AddBook(b *Book) (id int64, err error) {
 	ctx := context.Background()
 	k := datastore.IncompleteKey("Book", nil)
+	b.Version = 1
 	k, err = db.client.Put(ctx, k, b)
 	if err != nil {
 		return 0, fmt.Errorf("datastoredb: could not put Book: %v", err)
@@ -71,6 +80,21 @@ func (db *datastoreDB) AddBook(b *Book) (id int64, err error) {
 	return k.ID, nil
 }
 
+// ImportBook saves a given book under its ID, replacing any book with that ID.
+//
+// Datastore allocates IDs for new books from a scattered range of large
+// numbers, so imported books are unlikely to collide with books added later.
+func (db *datastoreDB) ImportBook(b *Book) error {
+	if b.ID <= 0 {
+		return fmt.Errorf("datastoredb: invalid book ID %d passed into importBook", b.ID)
+	}
+	ctx := context.Background()
+	if _, err := db.client.Put(ctx, db.datastoreKey(b.ID), b); err != nil {
+		return fmt.Errorf("datastoredb: could not put Book: %v", err)
+	}
+	return nil
+}
+
 // DeleteBook removes a given book by its ID.
 func (db *datastoreDB) DeleteBook(id int64) error {
 	ctx := context.Background()
@@ -81,13 +105,79 @@ func (db *datastoreDB) DeleteBook(id int64) error {
 	return nil
 }
 
-// UpdateBook updates the entry for a given book.
+// deleteBookVersion removes a given book by its ID, if its version matches
+// the stored version. The version is checked in a transaction.
+func (db *datastoreDB) deleteBookVersion(id, version int64) error {
+	ctx := context.Background()
+	k := db.datastoreKey(id)
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var stored Book
+		if err := tx.Get(k, &stored); err == datastore.ErrNoSuchEntity {
+			return ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		if stored.Version != version {
+			return ErrConflict
+		}
+		return tx.Delete(k)
+	})
+	if err == ErrNotFound || err == ErrConflict {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("datastoredb: could not delete Book: %v", err)
+	}
+	return nil
+}
+
+// usesImage reports whether any book has one of the given image URLs. Since
+// Datastore has no IN filter, each URL is looked for by its own query.
+func (db *datastoreDB) usesImage(imageURLs []string) (bool, error) {
+	ctx := context.Background()
+	for _, u := range imageURLs {
+		q := datastore.NewQuery("Book").
+			Filter("ImageURL =", u).
+			KeysOnly().
+			Limit(1)
+		keys, err := db.client.GetAll(ctx, q, nil)
+		if err != nil {
+			return false, fmt.Errorf("datastoredb: could not find books by image: %v", err)
+		}
+		if len(keys) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// UpdateBook updates the entry for a given book, if its version matches the
+// stored version. The version is checked and updated in a transaction.
 func (db *datastoreDB) UpdateBook(b *Book) error {
 	ctx := context.Background()
 	k := db.datastoreKey(b.ID)
-	if _, err := db.client.Put(ctx, k, b); err != nil {
+	updated := *b
+	updated.Version++
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var stored Book
+		if err := tx.Get(k, &stored); err == datastore.ErrNoSuchEntity {
+			return ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		if stored.Version != b.Version {
+			return ErrConflict
+		}
+		_, err := tx.Put(k, &updated)
+		return err
+	})
+	if err == ErrNotFound || err == ErrConflict {
+		return err
+	}
+	if err != nil {
 		return fmt.Errorf("datastoredb: could not update Book: %v", err)
 	}
+	b.Version = updated.Version
 	return nil
 }
 
@@ -136,3 +226,97 @@ func (db *datastoreDB) ListBooksCreatedBy(userID string) ([]*Book, error) {
 
 	return books, nil
 }
+
+// datastoreSortProperties maps sort fields to properties of Book entities.
+var datastoreSortProperties = map[SortField]string{
+	SortByTitle:         "Title",
+	SortByAuthor:        "Author",
+	SortByPublishedDate: "PublishedDate",
+}
+
+// ListBooksPage returns a page of books, ordered and filtered according to
+// opts. Pages are found by keyset pagination on the sort field and the key,
+// as Datastore query cursors can't be used to page backwards.
+//
+// Datastore only allows inequality filters on the first sort order, so a
+// cursor's position is found with two queries: one for the books with the
+// same sort value as the cursor, ordered by key, and one for the books with
+// greater (or lesser) sort values. Likewise, books with an author prefix can
+// only be found with a range of authors when sorting by author. Otherwise,
+// all the books in that range are read and sorted here.
+func (db *datastoreDB) ListBooksPage(opts ListOptions) (*BookPage, error) {
+	ctx := context.Background()
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	cur, err := decodeKeysetCursor(opts.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	field := opts.sortField()
+	q := datastore.NewQuery("Book")
+	if opts.CreatedByID != "" {
+		q = q.Filter("CreatedByID =", opts.CreatedByID)
+	}
+	if opts.AuthorPrefix != "" {
+		q = q.Filter("Author >=", opts.AuthorPrefix).
+			Filter("Author <", opts.AuthorPrefix+authorPrefixEnd)
+		if field != SortByAuthor {
+			books, err := db.getAll(ctx, q.Order("Author"))
+			if err != nil {
+				return nil, err
+			}
+			return sortedKeysetPage(opts, cur, books), nil
+		}
+	}
+
+	prop := datastoreSortProperties[field]
+	order, keyOrder, op := prop, "__key__", ">"
+	if !cur.scanAscending(opts) {
+		order, keyOrder, op = "-"+prop, "-__key__", "<"
+	}
+	limit := opts.pageSize() + 1
+	var books []*Book
+	if cur != nil {
+		// The cursor's sort value is within any author prefix range, so the
+		// range filters can be left out, leaving a single inequality filter.
+		tied := datastore.NewQuery("Book")
+		if opts.CreatedByID != "" {
+			tied = tied.Filter("CreatedByID =", opts.CreatedByID)
+		}
+		tied = tied.Filter(prop+" =", cur.Value).
+			Filter("__key__ "+op, db.datastoreKey(cur.ID)).
+			Order(keyOrder).
+			Limit(limit)
+		if books, err = db.getAll(ctx, tied); err != nil {
+			return nil, err
+		}
+		q = q.Filter(prop+" "+op, cur.Value)
+	}
+	if len(books) < limit {
+		rest, err := db.getAll(ctx, q.Order(order).Order(keyOrder).Limit(limit-len(books)))
+		if err != nil {
+			return nil, err
+		}
+		books = append(books, rest...)
+	}
+	return keysetPage(opts, cur, books), nil
+}
+
+// authorPrefixEnd is appended to an author prefix to find the end of the
+// range of authors starting with it: it is the greatest character.
+const authorPrefixEnd = "\U0010FFFF"
+
+// getAll returns the books found by q.
+func (db *datastoreDB) getAll(ctx context.Context, q *datastore.Query) ([]*Book, error) {
+	var books []*Book
+	keys, err := db.client.GetAll(ctx, q, &books)
+	if err != nil {
+		return nil, fmt.Errorf("datastoredb: could not list books: %v", err)
+	}
+	for i, k := range keys {
+		books[i].ID = k.ID
+	}
+	return books, nil
+}
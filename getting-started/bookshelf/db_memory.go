@@ -11,10 +11,18 @@ import (
 	"sync"
 )
 
-// Ensure memoryDB conforms to the BookDatabase interface.
-var _ BookDatabase = &memoryDB{}
+// Ensure memoryDB conforms to the BookDatabase, BookImporter,
+// versionedDeleter and imageFinder interfaces.
+var (
+	_ BookDatabase     = &memoryDB{}
+	_ BookImporter     = &memoryDB{}
+	_ versionedDeleter = &memoryDB{}
+	_ imageFinder      = &memoryDB{}
+)
 
-// memoryDB is a simple in-memory persistence layer for books.
+// memoryDB is a simple in-memory persistence layer for books. Books are
+// copied on the way in and out, so that callers can't modify stored books
+// without going through UpdateBook.
 type memoryDB struct {
 	mu     sync.Mutex
 	nextID int64           // next ID to assign to a book.
@@ -43,24 +51,44 @@ func (db *memoryDB) GetBook(id int64) (*Book, error) {
 
 	book, ok := db.books[id]
 	if !ok {
-		return nil, fmt.Errorf("memorydb: book not found with ID %d", id)
+		return nil, ErrNotFound
 	}
-	return book, nil
+	copied := *book
+	return &copied, nil
 }
 
-// AddBook saves a given book, assigning it a new ID.
+// AddBook saves a given book, assigning it a new ID and its first version.
 func (db *memoryDB) AddBook(b *Book) (id int64, err error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
 	b.ID = db.nextID
-	db.books[b.ID] = b
+	b.Version = 1
+	stored := *b
+	db.books[b.ID] = &stored
 
 	db.nextID++
 
 	return b.ID, nil
 }
 
+// ImportBook saves a given book under its ID, replacing any book with that ID.
+func (db *memoryDB) ImportBook(b *Book) error {
+	if b.ID <= 0 {
+		return fmt.Errorf("memorydb: invalid book ID %d passed into importBook", b.ID)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	stored := *b
+	db.books[b.ID] = &stored
+	if b.ID >= db.nextID {
+		db.nextID = b.ID + 1
+	}
+	return nil
+}
+
 // DeleteBook removes a given book by its ID.
 func (db *memoryDB) DeleteBook(id int64) error {
 	if id == 0 {
@@ -77,7 +105,40 @@ func (db *memoryDB) DeleteBook(id int64) error {
 	return nil
 }
 
-// UpdateBook updates the entry for a given book.
+// deleteBookVersion removes a given book by its ID, if its version matches
+// the stored version.
+func (db *memoryDB) deleteBookVersion(id, version int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	b, ok := db.books[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if b.Version != version {
+		return ErrConflict
+	}
+	delete(db.books, id)
+	return nil
+}
+
+// usesImage reports whether any book has one of the given image URLs.
+func (db *memoryDB) usesImage(imageURLs []string) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, b := range db.books {
+		for _, u := range imageURLs {
+			if b.ImageURL == u {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// UpdateBook updates the entry for a given book, if its version matches the
+// stored version.
 func (db *memoryDB) UpdateBook(b *Book) error {
 	if b.ID == 0 {
 		return errors.New("memorydb: book with unassigned ID passed into updateBook")
@@ -86,7 +147,16 @@ func (db *memoryDB) UpdateBook(b *Book) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	db.books[b.ID] = b
+	old, ok := db.books[b.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if old.Version != b.Version {
+		return ErrConflict
+	}
+	b.Version++
+	stored := *b
+	db.books[b.ID] = &stored
 	return nil
 }
 
@@ -105,7 +175,8 @@ func (db *memoryDB) ListBooks() ([]*Book, error) {
 
 	var books []*Book
 	for _, b := range db.books {
-		books = append(books, b)
+		copied := *b
+		books = append(books, &copied)
 	}
 
 	sort.Sort(booksByTitle(books))
@@ -125,10 +196,35 @@ func (db *memoryDB) ListBooksCreatedBy(userID string) ([]*Book, error) {
 	var books []*Book
 	for _, b := range db.books {
 		if b.CreatedByID == userID {
-			books = append(books, b)
+			copied := *b
+			books = append(books, &copied)
 		}
 	}
 
 	sort.Sort(booksByTitle(books))
 	return books, nil
 }
+
+// ListBooksPage returns a page of books, ordered and filtered according to
+// opts.
+func (db *memoryDB) ListBooksPage(opts ListOptions) (*BookPage, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	cur, err := decodeKeysetCursor(opts.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	db.mu.Lock()
+	var books []*Book
+	for _, b := range db.books {
+		if opts.matches(b) {
+			copied := *b
+			books = append(books, &copied)
+		}
+	}
+	db.mu.Unlock()
+
+	return sortedKeysetPage(opts, cur, books), nil
+}
@@ -0,0 +1,162 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	dbCallLatency = stats.Float64("bookshelf/db/latency",
+		"Latency of BookDatabase calls", stats.UnitMilliseconds)
+	dbCallErrors = stats.Int64("bookshelf/db/errors",
+		"BookDatabase calls that failed. ErrNotFound and ErrConflict aren't failures", stats.UnitDimensionless)
+
+	// keyBackend and keyMethod tag the BookDatabase calls with the name of
+	// the backend, such as "mysql", and of the method called.
+	keyBackend = tag.MustNewKey("backend")
+	keyMethod  = tag.MustNewKey("method")
+)
+
+// dbViews are the views of the BookDatabase calls, served to Prometheus as
+// bookshelf_db_latency (a histogram) and bookshelf_db_errors.
+var dbViews = []*view.View{
+	{
+		Name:        "bookshelf/db/latency",
+		Description: "Latency of BookDatabase calls, by backend and method",
+		Measure:     dbCallLatency,
+		TagKeys:     []tag.Key{keyBackend, keyMethod},
+		Aggregation: LatencyDistribution,
+	},
+	{
+		Name:        "bookshelf/db/errors",
+		Description: "BookDatabase calls that failed, by backend and method. ErrNotFound and ErrConflict aren't failures",
+		Measure:     dbCallErrors,
+		TagKeys:     []tag.Key{keyBackend, keyMethod},
+		Aggregation: view.Count(),
+	},
+}
+
+// instrumentedDB is a BookDatabase that records the latency and failures of
+// the calls made to the underlying database, as seen in dbViews.
+type instrumentedDB struct {
+	BookDatabase
+	backend string
+}
+
+// Ensure instrumentedDB conforms to the BookDatabase, versionedDeleter and
+// imageFinder interfaces.
+var (
+	_ BookDatabase     = &instrumentedDB{}
+	_ versionedDeleter = &instrumentedDB{}
+	_ imageFinder      = &instrumentedDB{}
+)
+
+// newInstrumentedDB wraps db, labelling its metrics with the name of its
+// backend, such as "mysql".
+func newInstrumentedDB(db BookDatabase, backend string) *instrumentedDB {
+	return &instrumentedDB{BookDatabase: db, backend: backend}
+}
+
+// databaseBackend returns the name of the backend of the database at rawurl,
+// as used to label its metrics.
+func databaseBackend(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "unknown"
+	}
+	if u.Scheme == "postgresql" {
+		return "postgres"
+	}
+	return u.Scheme
+}
+
+// observe records a call to method that started at start and returned err.
+func (db *instrumentedDB) observe(method string, start time.Time, err error) {
+	ms := []stats.Measurement{dbCallLatency.M(float64(time.Since(start)) / float64(time.Millisecond))}
+	if err != nil && err != ErrNotFound && err != ErrConflict {
+		ms = append(ms, dbCallErrors.M(1))
+	}
+	stats.RecordWithTags(context.Background(),
+		[]tag.Mutator{tag.Upsert(keyBackend, db.backend), tag.Upsert(keyMethod, method)}, ms...)
+}
+
+func (db *instrumentedDB) ListBooks() (books []*Book, err error) {
+	defer func(start time.Time) { db.observe("ListBooks", start, err) }(time.Now())
+	return db.BookDatabase.ListBooks()
+}
+
+func (db *instrumentedDB) ListBooksCreatedBy(userID string) (books []*Book, err error) {
+	defer func(start time.Time) { db.observe("ListBooksCreatedBy", start, err) }(time.Now())
+	return db.BookDatabase.ListBooksCreatedBy(userID)
+}
+
+func (db *instrumentedDB) ListBooksPage(opts ListOptions) (page *BookPage, err error) {
+	defer func(start time.Time) { db.observe("ListBooksPage", start, err) }(time.Now())
+	return db.BookDatabase.ListBooksPage(opts)
+}
+
+func (db *instrumentedDB) GetBook(id int64) (b *Book, err error) {
+	defer func(start time.Time) { db.observe("GetBook", start, err) }(time.Now())
+	return db.BookDatabase.GetBook(id)
+}
+
+func (db *instrumentedDB) AddBook(b *Book) (id int64, err error) {
+	defer func(start time.Time) { db.observe("AddBook", start, err) }(time.Now())
+	return db.BookDatabase.AddBook(b)
+}
+
+func (db *instrumentedDB) DeleteBook(id int64) (err error) {
+	defer func(start time.Time) { db.observe("DeleteBook", start, err) }(time.Now())
+	return db.BookDatabase.DeleteBook(id)
+}
+
+func (db *instrumentedDB) UpdateBook(b *Book) (err error) {
+	defer func(start time.Time) { db.observe("UpdateBook", start, err) }(time.Now())
+	return db.BookDatabase.UpdateBook(b)
+}
+
+// deleteBookVersion removes a given book if it is at version, if the
+// underlying database is a versionedDeleter. It is recorded as a DeleteBook
+// call.
+func (db *instrumentedDB) deleteBookVersion(id, version int64) (err error) {
+	deleter, ok := db.BookDatabase.(versionedDeleter)
+	if !ok {
+		return fmt.Errorf("bookshelf: %T can't delete versions of books", db.BookDatabase)
+	}
+	defer func(start time.Time) { db.observe("DeleteBook", start, err) }(time.Now())
+	return deleter.deleteBookVersion(id, version)
+}
+
+// usesImage reports whether any book has one of the given image URLs, asking
+// the underlying database if it is an imageFinder. Otherwise, it is recorded
+// as a ListBooks call.
+func (db *instrumentedDB) usesImage(imageURLs []string) (used bool, err error) {
+	f, ok := db.BookDatabase.(imageFinder)
+	if !ok {
+		return listBooksUsing(db, imageURLs)
+	}
+	defer func(start time.Time) { db.observe("usesImage", start, err) }(time.Now())
+	return f.usesImage(imageURLs)
+}
+
+// ImportBook saves b under b.ID, if the underlying database is a
+// BookImporter.
+func (db *instrumentedDB) ImportBook(b *Book) (err error) {
+	importer, ok := db.BookDatabase.(BookImporter)
+	if !ok {
+		return fmt.Errorf("bookshelf: %T can't import books", db.BookDatabase)
+	}
+	defer func(start time.Time) { db.observe("ImportBook", start, err) }(time.Now())
+	return importer.ImportBook(b)
+}
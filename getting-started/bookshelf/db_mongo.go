@@ -8,6 +8,7 @@ import (
 	"crypto/rand"
 	"fmt"
 	"math/big"
+	"regexp"
 
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
@@ -18,8 +19,14 @@ type mongoDB struct {
 	c    *mgo.Collection
 }
 
-// Ensure mongoDB conforms to the BookDatabase interface.
-var _ BookDatabase = &mongoDB{}
+// Ensure mongoDB conforms to the BookDatabase, BookImporter,
+// versionedDeleter and imageFinder interfaces.
+var (
+	_ BookDatabase     = &mongoDB{}
+	_ BookImporter     = &mongoDB{}
+	_ versionedDeleter = &mongoDB{}
+	_ imageFinder      = &mongoDB{}
+)
 
 // newMongoDB creates a new BookDatabase backed by a given Mongo server,
 // authenticated with given credentials.
@@ -35,9 +42,14 @@ func newMongoDB(addr string, cred *mgo.Credential) (BookDatabase, error) {
 		}
 	}
 
+	c := conn.DB("bookshelf").C("books")
+	if err := c.EnsureIndexKey("imageurl"); err != nil {
+		return nil, fmt.Errorf("mongodb: could not index books: %v", err)
+	}
+
 	return &mongoDB{
 		conn: conn,
-		c:    conn.DB("bookshelf").C("books"),
+		c:    c,
 	}, nil
 }
 
@@ -49,7 +61,9 @@ func (db *mongoDB) Close() {
 // GetBook retrieves a book by its ID.
 func (db *mongoDB) GetBook(id int64) (*Book, error) {
 	b := &Book{}
-	if err := db.c.Find(bson.D{{Name: "id", Value: id}}).One(b); err != nil {
+	if err := db.c.Find(bson.D{{Name: "id", Value: id}}).One(b); err == mgo.ErrNotFound {
+		return nil, ErrNotFound
+	} else if err != nil {
 		return nil, err
 	}
 	return b, nil
@@ -68,7 +82,7 @@ func randomID() (int64, error) {
 	return n.Int64() + 1, nil
 }
 
-// AddBook saves a given book, assigning it a new ID.
+// AddBook saves a given book, assigning it a new ID and its first version.
 func (db *mongoDB) AddBook(b *Book) (id int64, err error) {
 	id, err = randomID()
 	if err != nil {
@@ -76,20 +90,88 @@ func (db *mongoDB) AddBook(b *Book) (id int64, err error) {
 	}
 
 	b.ID = id
+	b.Version = 1
 	if err := db.c.Insert(b); err != nil {
 		return 0, fmt.Errorf("mongodb: could not add book: %v", err)
 	}
 	return id, nil
 }
 
+// ImportBook saves a given book under its ID, replacing any book with that ID.
+func (db *mongoDB) ImportBook(b *Book) error {
+	if b.ID <= 0 {
+		return fmt.Errorf("mongodb: invalid book ID %d passed into importBook", b.ID)
+	}
+	if _, err := db.c.Upsert(bson.D{{Name: "id", Value: b.ID}}, b); err != nil {
+		return fmt.Errorf("mongodb: could not import book: %v", err)
+	}
+	return nil
+}
+
 // DeleteBook removes a given book by its ID.
 func (db *mongoDB) DeleteBook(id int64) error {
 	return db.c.Remove(bson.D{{Name: "id", Value: id}})
 }
 
-// UpdateBook updates the entry for a given book.
+// deleteBookVersion removes a given book by its ID, if its version matches
+// the stored version.
+func (db *mongoDB) deleteBookVersion(id, version int64) error {
+	err := db.c.Remove(bson.D{
+		{Name: "id", Value: id},
+		{Name: "version", Value: mongoVersion(version)},
+	})
+	if err == mgo.ErrNotFound {
+		// Either the book doesn't exist, or it has a different version.
+		if _, err := db.GetBook(id); err != nil {
+			return err
+		}
+		return ErrConflict
+	}
+	if err != nil {
+		return fmt.Errorf("mongodb: could not delete book: %v", err)
+	}
+	return nil
+}
+
+// usesImage reports whether any book has one of the given image URLs.
+func (db *mongoDB) usesImage(imageURLs []string) (bool, error) {
+	n, err := db.c.Find(bson.M{"imageurl": bson.M{"$in": imageURLs}}).Limit(1).Count()
+	if err != nil {
+		return false, fmt.Errorf("mongodb: could not find books by image: %v", err)
+	}
+	return n > 0, nil
+}
+
+// mongoVersion returns a query value matching books at version.
+func mongoVersion(version int64) interface{} {
+	if version == 0 {
+		// Books added before versioning have no version field.
+		return bson.M{"$in": []interface{}{0, nil}}
+	}
+	return version
+}
+
+// UpdateBook updates the entry for a given book, if its version matches the
+// stored version.
 func (db *mongoDB) UpdateBook(b *Book) error {
-	return db.c.Update(bson.D{{Name: "id", Value: b.ID}}, b)
+	updated := *b
+	updated.Version++
+	err := db.c.Update(bson.D{
+		{Name: "id", Value: b.ID},
+		{Name: "version", Value: mongoVersion(b.Version)},
+	}, &updated)
+	if err == mgo.ErrNotFound {
+		// Either the book doesn't exist, or it has a different version.
+		if _, err := db.GetBook(b.ID); err != nil {
+			return err
+		}
+		return ErrConflict
+	}
+	if err != nil {
+		return fmt.Errorf("mongodb: could not update book: %v", err)
+	}
+	b.Version = updated.Version
+	return nil
 }
 
 // ListBooks returns a list of books, ordered by title.
@@ -110,3 +192,58 @@ func (db *mongoDB) ListBooksCreatedBy(userID string) ([]*Book, error) {
 	}
 	return result, nil
 }
+
+// mongoSortFields maps sort fields to the fields of stored book documents.
+var mongoSortFields = map[SortField]string{
+	SortByTitle:         "title",
+	SortByAuthor:        "author",
+	SortByPublishedDate: "publisheddate",
+}
+
+// ListBooksPage returns a page of books, ordered and filtered according to
+// opts. Pages are found by keyset pagination on the sort field and the ID.
+func (db *mongoDB) ListBooksPage(opts ListOptions) (*BookPage, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	cur, err := decodeKeysetCursor(opts.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	var filters []bson.M
+	if opts.CreatedByID != "" {
+		filters = append(filters, bson.M{"createdbyid": opts.CreatedByID})
+	}
+	if opts.AuthorPrefix != "" {
+		prefix := bson.RegEx{Pattern: "^" + regexp.QuoteMeta(opts.AuthorPrefix)}
+		filters = append(filters, bson.M{"author": prefix})
+	}
+
+	field := mongoSortFields[opts.sortField()]
+	op, order := "$gt", ""
+	if !cur.scanAscending(opts) {
+		op, order = "$lt", "-"
+	}
+	if cur != nil {
+		filters = append(filters, bson.M{"$or": []bson.M{
+			{field: bson.M{op: cur.Value}},
+			{field: cur.Value, "id": bson.M{op: cur.ID}},
+		}})
+	}
+
+	var query interface{}
+	if len(filters) > 0 {
+		query = bson.M{"$and": filters}
+	}
+
+	var result []*Book
+	err = db.c.Find(query).
+		Sort(order+field, order+"id").
+		Limit(opts.pageSize() + 1).
+		All(&result)
+	if err != nil {
+		return nil, fmt.Errorf("mongodb: could not list books: %v", err)
+	}
+	return keysetPage(opts, cur, result), nil
+}
@@ -9,24 +9,97 @@ import (
 	"database/sql/driver"
 	"errors"
 	"fmt"
+	"strings"
 
-	"github.com/go-sql-driver/mysql"
+	"golang.org/x/net/context"
+
+	// Register the MySQL driver for database/sql.
+	_ "github.com/go-sql-driver/mysql"
 )
 
-var createTableStatements = []string{
-	`CREATE DATABASE IF NOT EXISTS library DEFAULT CHARACTER SET = 'utf8' DEFAULT COLLATE 'utf8_general_ci';`,
-	`USE library;`,
-	`CREATE TABLE IF NOT EXISTS books (
-		id INT UNSIGNED NOT NULL AUTO_INCREMENT,
-		title VARCHAR(255) NULL,
-		author VARCHAR(255) NULL,
-		publishedDate VARCHAR(255) NULL,
-		imageUrl VARCHAR(255) NULL,
-		description TEXT NULL,
-		createdBy VARCHAR(255) NULL,
-		createdById VARCHAR(255) NULL,
-		PRIMARY KEY (id)
-	)`,
+const createDatabaseStatement = `CREATE DATABASE IF NOT EXISTS library DEFAULT CHARACTER SET = 'utf8' DEFAULT COLLATE 'utf8_general_ci'`
+
+// mysqlMigrations evolve the schema of the library database. They are
+// applied, inspected and reverted with the bookshelf migrate command; opening
+// the database fails while any of them is pending.
+//
+// To change the schema, append a new migration; never edit one that may
+// already have been applied.
+var mysqlMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create books table",
+		Up: []string{`CREATE TABLE IF NOT EXISTS books (
+			id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+			title VARCHAR(255) NULL,
+			author VARCHAR(255) NULL,
+			publishedDate VARCHAR(255) NULL,
+			imageUrl VARCHAR(255) NULL,
+			description TEXT NULL,
+			createdBy VARCHAR(255) NULL,
+			createdById VARCHAR(255) NULL,
+			PRIMARY KEY (id)
+		)`},
+		Down:    []string{`DROP TABLE books`},
+		present: mysqlTableExists("books"),
+	},
+	{
+		Version: 2,
+		Name:    "add books.version",
+		Up:      []string{`ALTER TABLE books ADD COLUMN version BIGINT NOT NULL DEFAULT 0`},
+		Down:    []string{`ALTER TABLE books DROP COLUMN version`},
+		present: mysqlColumnExists("books", "version"),
+	},
+	{
+		Version: 3,
+		Name:    "create book_changes table",
+		Up: []string{`CREATE TABLE book_changes (
+			id BIGINT NOT NULL AUTO_INCREMENT,
+			book_id BIGINT NOT NULL,
+			action VARCHAR(16) NOT NULL,
+			actor_id VARCHAR(255) NOT NULL,
+			actor_name VARCHAR(255) NOT NULL,
+			changed_at BIGINT NOT NULL,
+			fields TEXT NOT NULL,
+			book TEXT NOT NULL,
+			restored_version BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (id),
+			INDEX (book_id, id),
+			INDEX (changed_at)
+		)`},
+		Down: []string{`DROP TABLE book_changes`},
+	},
+	{
+		Version: 4,
+		Name:    "index books.imageUrl",
+		// A prefix of 191 characters fits the index key limit of older
+		// MySQL versions with 4-byte characters.
+		Up:   []string{`CREATE INDEX books_image_url ON books (imageUrl(191))`},
+		Down: []string{`DROP INDEX books_image_url ON books`},
+	},
+}
+
+// mysqlTableExists reports whether a table exists in the current database.
+// It is used to recognize changes made before migrations were tracked.
+func mysqlTableExists(table string) func(*sql.Conn) (bool, error) {
+	return func(conn *sql.Conn) (bool, error) {
+		var n int
+		err := conn.QueryRowContext(context.Background(), `SELECT COUNT(*) FROM information_schema.tables
+			WHERE table_schema = DATABASE() AND table_name = ?`, table).Scan(&n)
+		return n > 0, err
+	}
+}
+
+// mysqlColumnExists reports whether a column exists in a table of the current
+// database.
+func mysqlColumnExists(table, column string) func(*sql.Conn) (bool, error) {
+	return func(conn *sql.Conn) (bool, error) {
+		var n int
+		err := conn.QueryRowContext(context.Background(), `SELECT COUNT(*) FROM information_schema.columns
+			WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ?`,
+			table, column).Scan(&n)
+		return n > 0, err
+	}
 }
 
 // mysqlDB persists books to a MySQL instance.
@@ -36,13 +109,22 @@ type mysqlDB struct {
 	list   *sql.Stmt
 	listBy *sql.Stmt
 	insert *sql.Stmt
+	put    *sql.Stmt
 	get    *sql.Stmt
 	update *sql.Stmt
 	delete *sql.Stmt
+
+	deleteVersion *sql.Stmt
 }
 
-// Ensure mysqlDB conforms to the BookDatabase interface.
-var _ BookDatabase = &mysqlDB{}
+// Ensure mysqlDB conforms to the BookDatabase, BookImporter,
+// versionedDeleter and imageFinder interfaces.
+var (
+	_ BookDatabase     = &mysqlDB{}
+	_ BookImporter     = &mysqlDB{}
+	_ versionedDeleter = &mysqlDB{}
+	_ imageFinder      = &mysqlDB{}
+)
 
 type MySQLConfig struct {
 	// Optional.
@@ -82,22 +164,21 @@ func (c MySQLConfig) dataStoreName(databaseName string) string {
 	return fmt.Sprintf("%stcp([%s]:%d)/%s", cred, c.Host, c.Port, databaseName)
 }
 
-// newMySQLDB creates a new BookDatabase backed by a given MySQL server.
+// newMySQLDB creates a new BookDatabase backed by a given MySQL server. It
+// returns a *SchemaError if any migration has not been applied.
 func newMySQLDB(config MySQLConfig) (BookDatabase, error) {
-	// Check database and table exists. If not, create it.
-	if err := config.ensureTableExists(); err != nil {
-		return nil, err
-	}
-
-	conn, err := sql.Open("mysql", config.dataStoreName("library"))
+	// Create the database and the schema_migrations table if they don't
+	// exist, and check that the schema is up to date.
+	m, err := newMySQLMigrator(config)
 	if err != nil {
-		return nil, fmt.Errorf("mysql: could not get a connection: %v", err)
+		return nil, err
 	}
-	if err := conn.Ping(); err != nil {
-		conn.Close()
-		return nil, fmt.Errorf("mysql: could not establish a good connection: %v", err)
+	if err := m.checkSchema(); err != nil {
+		m.Close()
+		return nil, err
 	}
 
+	conn := m.db
 	db := &mysqlDB{
 		conn: conn,
 	}
@@ -116,12 +197,18 @@ func newMySQLDB(config MySQLConfig) (BookDatabase, error) {
 	if db.insert, err = conn.Prepare(insertStatement); err != nil {
 		return nil, fmt.Errorf("mysql: prepare insert: %v", err)
 	}
+	if db.put, err = conn.Prepare(putStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare put: %v", err)
+	}
 	if db.update, err = conn.Prepare(updateStatement); err != nil {
 		return nil, fmt.Errorf("mysql: prepare update: %v", err)
 	}
 	if db.delete, err = conn.Prepare(deleteStatement); err != nil {
 		return nil, fmt.Errorf("mysql: prepare delete: %v", err)
 	}
+	if db.deleteVersion, err = conn.Prepare(deleteVersionStatement); err != nil {
+		return nil, fmt.Errorf("mysql: prepare deleteVersion: %v", err)
+	}
 
 	return db, nil
 }
@@ -147,9 +234,10 @@ func scanBook(s rowScanner) (*Book, error) {
 		description   sql.NullString
 		createdBy     sql.NullString
 		createdByID   sql.NullString
+		version       int64
 	)
 	if err := s.Scan(&id, &title, &author, &publishedDate, &imageURL,
-		&description, &createdBy, &createdByID); err != nil {
+		&description, &createdBy, &createdByID, &version); err != nil {
 		return nil, err
 	}
 
@@ -162,6 +250,7 @@ func scanBook(s rowScanner) (*Book, error) {
 		Description:   description.String,
 		CreatedBy:     createdBy.String,
 		CreatedByID:   createdByID.String,
+		Version:       version,
 	}
 	return book, nil
 }
@@ -219,13 +308,89 @@ func (db *mysqlDB) ListBooksCreatedBy(userID string) ([]*Book, error) {
 	return books, nil
 }
 
+// mysqlSortColumns maps sort fields to columns of the books table.
+var mysqlSortColumns = map[SortField]string{
+	SortByTitle:         "title",
+	SortByAuthor:        "author",
+	SortByPublishedDate: "publishedDate",
+}
+
+// likeEscaper escapes the LIKE wildcards in a string, so that it matches
+// literally.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// ListBooksPage returns a page of books, ordered and filtered according to
+// opts. Pages are found by keyset pagination on the sort column and the ID,
+// so that the cost of a page does not grow with its position in the list.
+func (db *mysqlDB) ListBooksPage(opts ListOptions) (*BookPage, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	cur, err := decodeKeysetCursor(opts.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		where []string
+		args  []interface{}
+	)
+	if opts.CreatedByID != "" {
+		where = append(where, "createdById = ?")
+		args = append(args, opts.CreatedByID)
+	}
+	if opts.AuthorPrefix != "" {
+		where = append(where, "author LIKE ?")
+		args = append(args, likeEscaper.Replace(opts.AuthorPrefix)+"%")
+	}
+
+	col := mysqlSortColumns[opts.sortField()]
+	op, dir := ">", "ASC"
+	if !cur.scanAscending(opts) {
+		op, dir = "<", "DESC"
+	}
+	if cur != nil {
+		where = append(where, fmt.Sprintf("(%[1]s %[2]s ? OR (%[1]s = ? AND id %[2]s ?))", col, op))
+		args = append(args, cur.Value, cur.Value, cur.ID)
+	}
+
+	// The column names and directions come from fixed strings above; only
+	// the values are passed as arguments.
+	q := "SELECT * FROM books"
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	q += fmt.Sprintf(" ORDER BY %[1]s %[2]s, id %[2]s LIMIT %[3]d", col, dir, opts.pageSize()+1)
+
+	rows, err := db.conn.Query(q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("mysql: could not list books: %v", err)
+	}
+	defer rows.Close()
+
+	var books []*Book
+	for rows.Next() {
+		book, err := scanBook(rows)
+		if err != nil {
+			return nil, fmt.Errorf("mysql: could not read row: %v", err)
+		}
+
+		books = append(books, book)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("mysql: could not list books: %v", err)
+	}
+
+	return keysetPage(opts, cur, books), nil
+}
+
 const getStatement = "SELECT * FROM books WHERE id = ?"
 
 // GetBook retrieves a book by its ID.
 func (db *mysqlDB) GetBook(id int64) (*Book, error) {
 	book, err := scanBook(db.get.QueryRow(id))
 	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("mysql: could not find book with id %d", id)
+		return nil, ErrNotFound
 	}
 	if err != nil {
 		return nil, fmt.Errorf("mysql: could not get book: %v", err)
@@ -235,10 +400,11 @@ func (db *mysqlDB) GetBook(id int64) (*Book, error) {
 
 const insertStatement = `
   INSERT INTO books (
-    title, author, publishedDate, imageUrl, description, createdBy, createdById
-  ) VALUES (?, ?, ?, ?, ?, ?, ?)`
+    title, author, publishedDate, imageUrl, description, createdBy, createdById,
+    version
+  ) VALUES (?, ?, ?, ?, ?, ?, ?, 1)`
 
-// AddBook saves a given book, assigning it a new ID.
+// AddBook saves a given book, assigning it a new ID and its first version.
 func (db *mysqlDB) AddBook(b *Book) (id int64, err error) {
 	r, err := execAffectingOneRow(db.insert, b.Title, b.Author, b.PublishedDate,
 		b.ImageURL, b.Description, b.CreatedBy, b.CreatedByID)
@@ -250,9 +416,35 @@ func (db *mysqlDB) AddBook(b *Book) (id int64, err error) {
 	if err != nil {
 		return 0, fmt.Errorf("mysql: could not get last insert ID: %v", err)
 	}
+	b.Version = 1
 	return lastInsertID, nil
 }
 
+const putStatement = `
+  INSERT INTO books (
+    id, title, author, publishedDate, imageUrl, description, createdBy,
+    createdById, version
+  ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+  ON DUPLICATE KEY UPDATE
+    title=VALUES(title), author=VALUES(author),
+    publishedDate=VALUES(publishedDate), imageUrl=VALUES(imageUrl),
+    description=VALUES(description), createdBy=VALUES(createdBy),
+    createdById=VALUES(createdById), version=VALUES(version)`
+
+// ImportBook saves a given book under its ID, replacing any book with that ID.
+// MySQL moves the AUTO_INCREMENT counter past explicitly inserted IDs, so
+// books added later don't collide with imported ones.
+func (db *mysqlDB) ImportBook(b *Book) error {
+	if b.ID <= 0 {
+		return fmt.Errorf("mysql: invalid book ID %d passed into importBook", b.ID)
+	}
+	if _, err := db.put.Exec(b.ID, b.Title, b.Author, b.PublishedDate,
+		b.ImageURL, b.Description, b.CreatedBy, b.CreatedByID, b.Version); err != nil {
+		return fmt.Errorf("mysql: could not import book: %v", err)
+	}
+	return nil
+}
+
 const deleteStatement = `DELETE FROM books WHERE id = ?`
 
 // DeleteBook removes a given book by its ID.
@@ -264,64 +456,148 @@ func (db *mysqlDB) DeleteBook(id int64) error {
 	return err
 }
 
+const deleteVersionStatement = `DELETE FROM books WHERE id = ? AND version = ?`
+
+// deleteBookVersion removes a given book by its ID, if its version matches
+// the stored version.
+func (db *mysqlDB) deleteBookVersion(id, version int64) error {
+	r, err := db.deleteVersion.Exec(id, version)
+	if err != nil {
+		return fmt.Errorf("mysql: could not delete book: %v", err)
+	}
+	return checkVersionedDelete(r, db, id)
+}
+
+// usesImage reports whether any book has one of the given image URLs.
+func (db *mysqlDB) usesImage(imageURLs []string) (bool, error) {
+	return sqlUsesImage(db.conn, imageQuery(len(imageURLs)), imageURLs)
+}
+
+// imageQuery returns a query selecting a row if any book has one of n image
+// URLs, given as arguments.
+func imageQuery(n int) string {
+	return "SELECT 1 FROM books WHERE imageUrl IN (?" + strings.Repeat(", ?", n-1) + ") LIMIT 1"
+}
+
+// sqlUsesImage runs q, a query from imageQuery, with imageURLs as arguments,
+// and reports whether it selected a row.
+func sqlUsesImage(conn *sql.DB, q string, imageURLs []string) (bool, error) {
+	args := make([]interface{}, len(imageURLs))
+	for i, u := range imageURLs {
+		args[i] = u
+	}
+	var one int
+	err := conn.QueryRow(q, args...).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("sql: could not find books by image: %v", err)
+	}
+	return true, nil
+}
+
+// checkVersionedDelete returns ErrNotFound or ErrConflict if a versioned
+// delete removed no row.
+func checkVersionedDelete(r sql.Result, db BookDatabase, id int64) error {
+	n, err := r.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("sql: could not get rows affected: %v", err)
+	}
+	if n == 0 {
+		// Either the book doesn't exist, or it has a different version.
+		if _, err := db.GetBook(id); err != nil {
+			return err
+		}
+		return ErrConflict
+	}
+	return nil
+}
+
 const updateStatement = `
   UPDATE books
   SET title=?, author=?, publishedDate=?, imageUrl=?, description=?,
-      createdBy=?, createdById=?
-  WHERE id = ?`
+      createdBy=?, createdById=?, version=version+1
+  WHERE id = ? AND version = ?`
 
-// UpdateBook updates the entry for a given book.
+// UpdateBook updates the entry for a given book, if its version matches the
+// stored version.
 func (db *mysqlDB) UpdateBook(b *Book) error {
 	if b.ID == 0 {
 		return errors.New("mysql: book with unassigned ID passed into updateBook")
 	}
 
-	_, err := execAffectingOneRow(db.update, b.Title, b.Author, b.PublishedDate,
-		b.ImageURL, b.Description, b.CreatedBy, b.CreatedByID, b.ID)
-	return err
+	r, err := db.update.Exec(b.Title, b.Author, b.PublishedDate,
+		b.ImageURL, b.Description, b.CreatedBy, b.CreatedByID, b.ID, b.Version)
+	if err != nil {
+		return fmt.Errorf("mysql: could not execute statement: %v", err)
+	}
+	rowsAffected, err := r.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("mysql: could not get rows affected: %v", err)
+	}
+	if rowsAffected == 0 {
+		// Either the book doesn't exist, or it has a different version.
+		if _, err := db.GetBook(b.ID); err != nil {
+			return err
+		}
+		return ErrConflict
+	}
+	b.Version++
+	return nil
 }
 
-// ensureTableExists checks the table exists. If not, it creates it.
-func (config MySQLConfig) ensureTableExists() error {
+// mysqlLockName names the lock held while migrating the library database.
+const mysqlLockName = "bookshelf.schema_migrations"
+
+// newMySQLMigrator returns a Migrator for the library database on the given
+// MySQL server, creating the database if it doesn't exist.
+func newMySQLMigrator(config MySQLConfig) (*Migrator, error) {
 	conn, err := sql.Open("mysql", config.dataStoreName(""))
 	if err != nil {
-		return fmt.Errorf("mysql: could not get a connection: %v", err)
+		return nil, fmt.Errorf("mysql: could not get a connection: %v", err)
 	}
 	defer conn.Close()
 
 	// Check the connection.
 	if conn.Ping() == driver.ErrBadConn {
-		return fmt.Errorf("mysql: could not connect to the database. " +
+		return nil, fmt.Errorf("mysql: could not connect to the database. " +
 			"could be bad address, or this address is not whitelisted for access.")
 	}
 
-	if _, err := conn.Exec("USE library"); err != nil {
-		// MySQL error 1049 is "database does not exist"
-		if mErr, ok := err.(*mysql.MySQLError); ok && mErr.Number == 1049 {
-			return createTable(conn)
-		}
+	if _, err := conn.Exec(createDatabaseStatement); err != nil {
+		return nil, fmt.Errorf("mysql: could not create database: %v", err)
 	}
 
-	if _, err := conn.Exec("DESCRIBE books"); err != nil {
-		// MySQL error 1146 is "table does not exist"
-		if mErr, ok := err.(*mysql.MySQLError); ok && mErr.Number == 1146 {
-			return createTable(conn)
-		}
-		// Unknown error.
-		return fmt.Errorf("mysql: could not connect to the database: %v", err)
+	libraryConn, err := sql.Open("mysql", config.dataStoreName("library"))
+	if err != nil {
+		return nil, fmt.Errorf("mysql: could not get a connection: %v", err)
 	}
-	return nil
+	m, err := newMigrator(libraryConn, mysqlMigrations)
+	if err != nil {
+		libraryConn.Close()
+		return nil, err
+	}
+	m.lock = mysqlLock
+	return m, nil
 }
 
-// createTable creates the table, and if necessary, the database.
-func createTable(conn *sql.DB) error {
-	for _, stmt := range createTableStatements {
-		_, err := conn.Exec(stmt)
-		if err != nil {
-			return err
-		}
+// mysqlLock takes the migration lock with GET_LOCK, waiting up to a minute
+// for another process to release it. MySQL locks belong to the session, so
+// the lock is released explicitly before conn goes back to the pool.
+func mysqlLock(conn *sql.Conn) (func() error, error) {
+	ctx := context.Background()
+	var got sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 60)", mysqlLockName).Scan(&got); err != nil {
+		return nil, err
 	}
-	return nil
+	if got.Int64 != 1 {
+		return nil, errors.New("timed out waiting for another migration to finish")
+	}
+	return func() error {
+		_, err := conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", mysqlLockName)
+		return err
+	}, nil
 }
 
 // execAffectingOneRow executes a given statement, expecting one row to be affected.
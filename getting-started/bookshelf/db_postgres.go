@@ -0,0 +1,567 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	// Register the PostgreSQL driver for database/sql.
+	_ "github.com/lib/pq"
+)
+
+// postgresMigrations evolve the schema of the books database, like
+// mysqlMigrations.
+var postgresMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create books table",
+		Up: []string{`CREATE TABLE IF NOT EXISTS books (
+			id BIGSERIAL PRIMARY KEY,
+			title VARCHAR(255) NULL,
+			author VARCHAR(255) NULL,
+			publishedDate VARCHAR(255) NULL,
+			imageUrl VARCHAR(255) NULL,
+			description TEXT NULL,
+			createdBy VARCHAR(255) NULL,
+			createdById VARCHAR(255) NULL,
+			version BIGINT NOT NULL DEFAULT 0
+		)`},
+		Down:    []string{`DROP TABLE books`},
+		present: postgresTableExists("books"),
+	},
+	{
+		Version: 2,
+		Name:    "create book_changes table",
+		Up: []string{
+			`CREATE TABLE book_changes (
+				id BIGSERIAL PRIMARY KEY,
+				book_id BIGINT NOT NULL,
+				action VARCHAR(16) NOT NULL,
+				actor_id VARCHAR(255) NOT NULL,
+				actor_name VARCHAR(255) NOT NULL,
+				changed_at BIGINT NOT NULL,
+				fields TEXT NOT NULL,
+				book TEXT NOT NULL,
+				restored_version BIGINT NOT NULL DEFAULT 0
+			)`,
+			`CREATE INDEX book_changes_book_id ON book_changes (book_id, id)`,
+			`CREATE INDEX book_changes_changed_at ON book_changes (changed_at)`,
+		},
+		Down: []string{`DROP TABLE book_changes`},
+	},
+	{
+		Version: 3,
+		Name:    "index books.imageUrl",
+		Up:      []string{`CREATE INDEX books_image_url ON books (imageUrl)`},
+		Down:    []string{`DROP INDEX books_image_url`},
+	},
+}
+
+// postgresTableExists reports whether a table exists in the current schema.
+// It is used to recognize changes made before migrations were tracked.
+func postgresTableExists(table string) func(*sql.Conn) (bool, error) {
+	return func(conn *sql.Conn) (bool, error) {
+		var exists bool
+		err := conn.QueryRowContext(context.Background(), `SELECT to_regclass($1) IS NOT NULL`, table).Scan(&exists)
+		return exists, err
+	}
+}
+
+// postgresColumns lists the columns of the books table in the order expected
+// by scanBook.
+const postgresColumns = `id, title, author, publishedDate, imageUrl, description,
+  createdBy, createdById, version`
+
+// postgresDB persists books to a PostgreSQL instance.
+type postgresDB struct {
+	conn *sql.DB
+
+	list   *sql.Stmt
+	listBy *sql.Stmt
+	insert *sql.Stmt
+	put    *sql.Stmt
+	get    *sql.Stmt
+	update *sql.Stmt
+	delete *sql.Stmt
+
+	deleteVersion *sql.Stmt
+}
+
+// Ensure postgresDB conforms to the BookDatabase, BookImporter,
+// importFinisher, versionedDeleter and imageFinder interfaces.
+var (
+	_ BookDatabase     = &postgresDB{}
+	_ BookImporter     = &postgresDB{}
+	_ importFinisher   = &postgresDB{}
+	_ versionedDeleter = &postgresDB{}
+	_ imageFinder      = &postgresDB{}
+)
+
+type PostgresConfig struct {
+	// Optional.
+	Username, Password string
+
+	// Host of the PostgreSQL instance.
+	//
+	// If set, UnixSocket should be unset.
+	Host string
+
+	// Port of the PostgreSQL instance.
+	//
+	// If set, UnixSocket should be unset.
+	Port int
+
+	// UnixSocket is the path to the directory holding the server's unix
+	// socket, e.g. "/cloudsql/project:region:instance".
+	//
+	// If set, Host and Port should be unset.
+	UnixSocket string
+
+	// Database is the name of the database holding the books table. It is
+	// created if it doesn't exist. Defaults to "library".
+	Database string
+
+	// SSLMode is passed to the driver as the "sslmode" parameter. Defaults to
+	// "disable", which is suitable for local servers and the Cloud SQL unix
+	// socket, which is encrypted by the Cloud SQL proxy.
+	SSLMode string
+
+	// Connection pool settings. Zero values select the defaults below.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// Default connection pool settings. Cloud SQL instances limit the number of
+// concurrent connections, so the pool is bounded.
+const (
+	defaultPostgresMaxOpenConns    = 10
+	defaultPostgresMaxIdleConns    = 5
+	defaultPostgresConnMaxLifetime = 30 * time.Minute
+)
+
+// dsnQuoter quotes a value for a key/value connection string.
+var dsnQuoter = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+// dataSourceName returns a connection string suitable for sql.Open.
+func (c PostgresConfig) dataSourceName(databaseName string) string {
+	params := []string{"dbname", databaseName, "sslmode", c.SSLMode}
+	if c.SSLMode == "" {
+		params[3] = "disable"
+	}
+	if c.Username != "" {
+		params = append(params, "user", c.Username)
+	}
+	if c.Password != "" {
+		params = append(params, "password", c.Password)
+	}
+	if c.UnixSocket != "" {
+		params = append(params, "host", c.UnixSocket)
+	} else {
+		params = append(params, "host", c.Host, "port", fmt.Sprint(c.Port))
+	}
+
+	var dsn []string
+	for i := 0; i < len(params); i += 2 {
+		dsn = append(dsn, fmt.Sprintf("%s='%s'", params[i], dsnQuoter.Replace(params[i+1])))
+	}
+	return strings.Join(dsn, " ")
+}
+
+func (c PostgresConfig) database() string {
+	if c.Database == "" {
+		return "library"
+	}
+	return c.Database
+}
+
+// newPostgresDB creates a new BookDatabase backed by a given PostgreSQL
+// server. It returns a *SchemaError if any migration has not been applied.
+func newPostgresDB(config PostgresConfig) (BookDatabase, error) {
+	// Create the database and the schema_migrations table if they don't
+	// exist, and check that the schema is up to date.
+	m, err := newPostgresMigrator(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.checkSchema(); err != nil {
+		m.Close()
+		return nil, err
+	}
+
+	conn := m.db
+	config.configurePool(conn)
+
+	db := &postgresDB{
+		conn: conn,
+	}
+
+	// Prepared statements. The actual SQL queries are in the code near the
+	// relevant method (e.g. addBook).
+	if db.list, err = conn.Prepare(postgresListStatement); err != nil {
+		return nil, fmt.Errorf("postgres: prepare list: %v", err)
+	}
+	if db.listBy, err = conn.Prepare(postgresListByStatement); err != nil {
+		return nil, fmt.Errorf("postgres: prepare listBy: %v", err)
+	}
+	if db.get, err = conn.Prepare(postgresGetStatement); err != nil {
+		return nil, fmt.Errorf("postgres: prepare get: %v", err)
+	}
+	if db.insert, err = conn.Prepare(postgresInsertStatement); err != nil {
+		return nil, fmt.Errorf("postgres: prepare insert: %v", err)
+	}
+	if db.put, err = conn.Prepare(postgresPutStatement); err != nil {
+		return nil, fmt.Errorf("postgres: prepare put: %v", err)
+	}
+	if db.update, err = conn.Prepare(postgresUpdateStatement); err != nil {
+		return nil, fmt.Errorf("postgres: prepare update: %v", err)
+	}
+	if db.delete, err = conn.Prepare(postgresDeleteStatement); err != nil {
+		return nil, fmt.Errorf("postgres: prepare delete: %v", err)
+	}
+	if db.deleteVersion, err = conn.Prepare(postgresDeleteVersionStatement); err != nil {
+		return nil, fmt.Errorf("postgres: prepare deleteVersion: %v", err)
+	}
+
+	return db, nil
+}
+
+// postgresLockKey identifies the advisory lock held while migrating.
+const postgresLockKey = 0x626f6f6b73 // "books"
+
+// newPostgresMigrator returns a Migrator for the books database on the given
+// PostgreSQL server, creating the database if it doesn't exist.
+func newPostgresMigrator(config PostgresConfig) (*Migrator, error) {
+	if err := config.ensureDatabaseExists(); err != nil {
+		return nil, err
+	}
+
+	conn, err := sql.Open("postgres", config.dataSourceName(config.database()))
+	if err != nil {
+		return nil, fmt.Errorf("postgres: could not get a connection: %v", err)
+	}
+	if err := conn.Ping(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("postgres: could not establish a good connection: %v", err)
+	}
+	m, err := newMigrator(conn, postgresMigrations)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	m.dollarPlaceholders = true
+	m.lock = postgresLock
+	return m, nil
+}
+
+// postgresLock takes the migration lock, waiting for another process to
+// release it. Advisory locks taken outside a transaction belong to the
+// session, so the lock is released explicitly before conn goes back to the
+// pool.
+func postgresLock(conn *sql.Conn) (func() error, error) {
+	ctx := context.Background()
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", postgresLockKey); err != nil {
+		return nil, err
+	}
+	return func() error {
+		_, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", postgresLockKey)
+		return err
+	}, nil
+}
+
+// configurePool applies the connection pool settings to conn.
+func (c PostgresConfig) configurePool(conn *sql.DB) {
+	maxOpen, maxIdle, maxLifetime := c.MaxOpenConns, c.MaxIdleConns, c.ConnMaxLifetime
+	if maxOpen == 0 {
+		maxOpen = defaultPostgresMaxOpenConns
+	}
+	if maxIdle == 0 {
+		maxIdle = defaultPostgresMaxIdleConns
+	}
+	if maxLifetime == 0 {
+		maxLifetime = defaultPostgresConnMaxLifetime
+	}
+	conn.SetMaxOpenConns(maxOpen)
+	conn.SetMaxIdleConns(maxIdle)
+	conn.SetConnMaxLifetime(maxLifetime)
+}
+
+// ensureDatabaseExists checks the database exists. If not, it creates it.
+func (c PostgresConfig) ensureDatabaseExists() error {
+	// Every server has a "postgres" database to connect to for maintenance.
+	conn, err := sql.Open("postgres", c.dataSourceName("postgres"))
+	if err != nil {
+		return fmt.Errorf("postgres: could not get a connection: %v", err)
+	}
+	defer conn.Close()
+
+	var exists bool
+	err = conn.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)",
+		c.database()).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("postgres: could not connect to the database: %v", err)
+	}
+	if exists {
+		return nil
+	}
+
+	// CREATE DATABASE doesn't accept parameters, so quote the name by hand.
+	name := `"` + strings.Replace(c.database(), `"`, `""`, -1) + `"`
+	if _, err := conn.Exec("CREATE DATABASE " + name); err != nil {
+		return fmt.Errorf("postgres: could not create database: %v", err)
+	}
+	return nil
+}
+
+// Close closes the database, freeing up any resources.
+func (db *postgresDB) Close() {
+	db.conn.Close()
+}
+
+// queryBooks reads all the books returned by a query.
+func queryBooks(rows *sql.Rows, err error) ([]*Book, error) {
+	if err != nil {
+		return nil, fmt.Errorf("postgres: could not list books: %v", err)
+	}
+	defer rows.Close()
+
+	var books []*Book
+	for rows.Next() {
+		book, err := scanBook(rows)
+		if err != nil {
+			return nil, fmt.Errorf("postgres: could not read row: %v", err)
+		}
+
+		books = append(books, book)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("postgres: could not list books: %v", err)
+	}
+	return books, nil
+}
+
+const postgresListStatement = `SELECT ` + postgresColumns + ` FROM books ORDER BY title, id`
+
+// ListBooks returns a list of books, ordered by title.
+func (db *postgresDB) ListBooks() ([]*Book, error) {
+	return queryBooks(db.list.Query())
+}
+
+const postgresListByStatement = `
+  SELECT ` + postgresColumns + ` FROM books
+  WHERE createdById = $1 ORDER BY title, id`
+
+// ListBooksCreatedBy returns a list of books, ordered by title, filtered by
+// the user who created the book entry.
+func (db *postgresDB) ListBooksCreatedBy(userID string) ([]*Book, error) {
+	if userID == "" {
+		return db.ListBooks()
+	}
+	return queryBooks(db.listBy.Query(userID))
+}
+
+// postgresSortColumns maps sort fields to columns of the books table.
+var postgresSortColumns = map[SortField]string{
+	SortByTitle:         "title",
+	SortByAuthor:        "author",
+	SortByPublishedDate: "publishedDate",
+}
+
+// ListBooksPage returns a page of books, ordered and filtered according to
+// opts. Pages are found by keyset pagination on the sort column and the ID.
+func (db *postgresDB) ListBooksPage(opts ListOptions) (*BookPage, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	cur, err := decodeKeysetCursor(opts.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		where []string
+		args  []interface{}
+	)
+	// arg adds an argument to the query, returning its placeholder.
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if opts.CreatedByID != "" {
+		where = append(where, "createdById = "+arg(opts.CreatedByID))
+	}
+	if opts.AuthorPrefix != "" {
+		where = append(where, "author LIKE "+arg(likeEscaper.Replace(opts.AuthorPrefix)+"%"))
+	}
+
+	col := postgresSortColumns[opts.sortField()]
+	op, dir := ">", "ASC"
+	if !cur.scanAscending(opts) {
+		op, dir = "<", "DESC"
+	}
+	if cur != nil {
+		// Row comparison orders by the sort column, then by ID.
+		where = append(where, fmt.Sprintf("(%s, id) %s (%s, %s)", col, op, arg(cur.Value), arg(cur.ID)))
+	}
+
+	// The column names and directions come from fixed strings above; only
+	// the values are passed as arguments.
+	q := "SELECT " + postgresColumns + " FROM books"
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	q += fmt.Sprintf(" ORDER BY %[1]s %[2]s, id %[2]s LIMIT %[3]d", col, dir, opts.pageSize()+1)
+
+	books, err := queryBooks(db.conn.Query(q, args...))
+	if err != nil {
+		return nil, err
+	}
+	return keysetPage(opts, cur, books), nil
+}
+
+const postgresGetStatement = `SELECT ` + postgresColumns + ` FROM books WHERE id = $1`
+
+// GetBook retrieves a book by its ID.
+func (db *postgresDB) GetBook(id int64) (*Book, error) {
+	book, err := scanBook(db.get.QueryRow(id))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("postgres: could not get book: %v", err)
+	}
+	return book, nil
+}
+
+const postgresInsertStatement = `
+  INSERT INTO books (
+    title, author, publishedDate, imageUrl, description, createdBy, createdById,
+    version
+  ) VALUES ($1, $2, $3, $4, $5, $6, $7, 1)
+  RETURNING id`
+
+// AddBook saves a given book, assigning it a new ID and its first version.
+func (db *postgresDB) AddBook(b *Book) (id int64, err error) {
+	err = db.insert.QueryRow(b.Title, b.Author, b.PublishedDate,
+		b.ImageURL, b.Description, b.CreatedBy, b.CreatedByID).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("postgres: could not add book: %v", err)
+	}
+	b.Version = 1
+	return id, nil
+}
+
+const postgresPutStatement = `
+  INSERT INTO books (
+    id, title, author, publishedDate, imageUrl, description, createdBy,
+    createdById, version
+  ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+  ON CONFLICT (id) DO UPDATE SET
+    title=EXCLUDED.title, author=EXCLUDED.author,
+    publishedDate=EXCLUDED.publishedDate, imageUrl=EXCLUDED.imageUrl,
+    description=EXCLUDED.description, createdBy=EXCLUDED.createdBy,
+    createdById=EXCLUDED.createdById, version=EXCLUDED.version`
+
+// postgresResetSequenceStatement moves the ID sequence past the largest ID,
+// so that books added after an import don't collide with imported ones.
+const postgresResetSequenceStatement = `
+  SELECT setval(pg_get_serial_sequence('books', 'id'), GREATEST(MAX(id), 1))
+  FROM books`
+
+// ImportBook saves a given book under its ID, replacing any book with that ID.
+// The ID sequence is left alone until finishImport is called.
+func (db *postgresDB) ImportBook(b *Book) error {
+	if b.ID <= 0 {
+		return fmt.Errorf("postgres: invalid book ID %d passed into importBook", b.ID)
+	}
+	if _, err := db.put.Exec(b.ID, b.Title, b.Author, b.PublishedDate,
+		b.ImageURL, b.Description, b.CreatedBy, b.CreatedByID, b.Version); err != nil {
+		return fmt.Errorf("postgres: could not import book: %v", err)
+	}
+	return nil
+}
+
+// finishImport moves the ID sequence past the imported books.
+func (db *postgresDB) finishImport() error {
+	if _, err := db.conn.Exec(postgresResetSequenceStatement); err != nil {
+		return fmt.Errorf("postgres: could not update ID sequence: %v", err)
+	}
+	return nil
+}
+
+const postgresDeleteStatement = `DELETE FROM books WHERE id = $1`
+
+// DeleteBook removes a given book by its ID.
+func (db *postgresDB) DeleteBook(id int64) error {
+	if id == 0 {
+		return errors.New("postgres: book with unassigned ID passed into deleteBook")
+	}
+	r, err := db.delete.Exec(id)
+	if err != nil {
+		return fmt.Errorf("postgres: could not delete book: %v", err)
+	}
+	if n, err := r.RowsAffected(); err != nil {
+		return fmt.Errorf("postgres: could not get rows affected: %v", err)
+	} else if n != 1 {
+		return fmt.Errorf("postgres: could not delete book with ID %d, does not exist", id)
+	}
+	return nil
+}
+
+const postgresDeleteVersionStatement = `DELETE FROM books WHERE id = $1 AND version = $2`
+
+// deleteBookVersion removes a given book by its ID, if its version matches
+// the stored version.
+func (db *postgresDB) deleteBookVersion(id, version int64) error {
+	r, err := db.deleteVersion.Exec(id, version)
+	if err != nil {
+		return fmt.Errorf("postgres: could not delete book: %v", err)
+	}
+	return checkVersionedDelete(r, db, id)
+}
+
+// usesImage reports whether any book has one of the given image URLs.
+func (db *postgresDB) usesImage(imageURLs []string) (bool, error) {
+	return sqlUsesImage(db.conn, bindDollar(imageQuery(len(imageURLs))), imageURLs)
+}
+
+const postgresUpdateStatement = `
+  UPDATE books
+  SET title=$1, author=$2, publishedDate=$3, imageUrl=$4, description=$5,
+      createdBy=$6, createdById=$7, version=version+1
+  WHERE id = $8 AND version = $9`
+
+// UpdateBook updates the entry for a given book, if its version matches the
+// stored version.
+func (db *postgresDB) UpdateBook(b *Book) error {
+	if b.ID == 0 {
+		return errors.New("postgres: book with unassigned ID passed into updateBook")
+	}
+
+	r, err := db.update.Exec(b.Title, b.Author, b.PublishedDate,
+		b.ImageURL, b.Description, b.CreatedBy, b.CreatedByID, b.ID, b.Version)
+	if err != nil {
+		return fmt.Errorf("postgres: could not update book: %v", err)
+	}
+	rowsAffected, err := r.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("postgres: could not get rows affected: %v", err)
+	}
+	if rowsAffected == 0 {
+		// Either the book doesn't exist, or it has a different version.
+		if _, err := db.GetBook(b.ID); err != nil {
+			return err
+		}
+		return ErrConflict
+	}
+	b.Version++
+	return nil
+}
@@ -7,7 +7,9 @@ package bookshelf
 import (
 	"fmt"
 	"os"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -26,6 +28,8 @@ func testDB(t *testing.T, db BookDatabase) {
 		Title:       fmt.Sprintf("t-%d", time.Now().Unix()),
 		Description: "desc",
 	}
+	b.ImageURL = "https://example.com/" + b.Title + ".jpg"
+	imageURLs := []string{"https://example.com/other.jpg", b.ImageURL}
 
 	id, err := db.AddBook(b)
 	if err != nil {
@@ -45,13 +49,174 @@ func testDB(t *testing.T, db BookDatabase) {
 	if got, want := gotBook.Description, b.Description; got != want {
 		t.Errorf("Update description: got %q, want %q", got, want)
 	}
+	if got, want := gotBook.Version, int64(2); got != want {
+		t.Errorf("Update version: got %d, want %d", got, want)
+	}
+
+	stale := *b
+	stale.Version = 1
+	stale.Description = "staledesc"
+	if err := db.UpdateBook(&stale); err != ErrConflict {
+		t.Errorf("UpdateBook with stale version: got err %v, want ErrConflict", err)
+	}
+	if gotBook, err := db.GetBook(id); err != nil {
+		t.Error(err)
+	} else if got, want := gotBook.Description, b.Description; got != want {
+		t.Errorf("Description after stale update: got %q, want %q", got, want)
+	}
+
+	if used, err := anyBookUses(db, imageURLs); err != nil || !used {
+		t.Errorf("anyBookUses(%q) = %v, %v; want true", imageURLs, used, err)
+	}
 
-	if err := db.DeleteBook(id); err != nil {
+	deleter, versioned := db.(versionedDeleter)
+	if versioned {
+		if err := deleter.deleteBookVersion(id, 1); err != ErrConflict {
+			t.Errorf("deleteBookVersion with stale version: got err %v, want ErrConflict", err)
+		}
+		if err := deleter.deleteBookVersion(id, 2); err != nil {
+			t.Error(err)
+		}
+	} else if err := db.DeleteBook(id); err != nil {
 		t.Error(err)
 	}
 
-	if _, err := db.GetBook(id); err == nil {
-		t.Error("want non-nil err")
+	if _, err := db.GetBook(id); err != ErrNotFound {
+		t.Errorf("GetBook after delete: got err %v, want ErrNotFound", err)
+	}
+	if used, err := anyBookUses(db, imageURLs); err != nil || used {
+		t.Errorf("anyBookUses(%q) after delete = %v, %v; want false", imageURLs, used, err)
+	}
+	if versioned {
+		if err := deleter.deleteBookVersion(id, 2); err != ErrNotFound {
+			t.Errorf("deleteBookVersion after delete: got err %v, want ErrNotFound", err)
+		}
+	}
+	if err := db.UpdateBook(b); err != ErrNotFound {
+		t.Errorf("UpdateBook after delete: got err %v, want ErrNotFound", err)
+	}
+
+	testListBooksPage(t, db)
+	if importer, ok := db.(BookImporter); ok {
+		testImportBook(t, db, importer)
+	}
+}
+
+func testImportBook(t *testing.T, db BookDatabase, importer BookImporter) {
+	added := &Book{Title: "import-added"}
+	addedID, err := db.AddBook(added)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.DeleteBook(addedID)
+
+	imported := &Book{ID: addedID + 1000, Title: "import-imported", Author: "a", Version: 7}
+	if err := importer.ImportBook(imported); err != nil {
+		t.Fatalf("ImportBook: %v", err)
+	}
+	defer db.DeleteBook(imported.ID)
+
+	// Importing again replaces the book.
+	imported.Title = "import-replaced"
+	if err := importer.ImportBook(imported); err != nil {
+		t.Fatalf("ImportBook again: %v", err)
+	}
+	got, err := db.GetBook(imported.ID)
+	if err != nil {
+		t.Fatalf("GetBook(%d): %v", imported.ID, err)
+	}
+	if !reflect.DeepEqual(got, imported) {
+		t.Errorf("GetBook(%d) = %+v, want %+v", imported.ID, got, imported)
+	}
+
+	// New books don't collide with imported ones.
+	laterID, err := db.AddBook(&Book{Title: "import-later"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.DeleteBook(laterID)
+	if laterID == imported.ID {
+		t.Errorf("AddBook after ImportBook reused ID %d", laterID)
+	}
+}
+
+func testListBooksPage(t *testing.T, db BookDatabase) {
+	// Use a unique author prefix, so that other books in the database are
+	// filtered out.
+	prefix := fmt.Sprintf("pager-%d-", time.Now().UnixNano())
+	for _, a := range []string{"c", "a", "e", "b", "d"} {
+		id, err := db.AddBook(&Book{Title: "t-" + a, Author: prefix + a})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.DeleteBook(id)
+	}
+
+	// authors lists the author suffixes of the books on a page.
+	authors := func(p *BookPage) string {
+		var s string
+		for _, b := range p.Books {
+			s += strings.TrimPrefix(b.Author, prefix)
+		}
+		return s
+	}
+
+	opts := ListOptions{PageSize: 2, SortBy: SortByAuthor, AuthorPrefix: prefix}
+	var (
+		got  []string
+		page *BookPage
+		err  error
+	)
+	for {
+		if page, err = db.ListBooksPage(opts); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, authors(page))
+		if page.NextCursor == "" {
+			break
+		}
+		opts.Cursor = page.NextCursor
+	}
+	if want := []string{"ab", "cd", "e"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ListBooksPage forwards: got %q, want %q", got, want)
+	}
+
+	got = nil
+	for page.PrevCursor != "" {
+		opts.Cursor = page.PrevCursor
+		if page, err = db.ListBooksPage(opts); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, authors(page))
+	}
+	if want := []string{"cd", "ab"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ListBooksPage backwards: got %q, want %q", got, want)
+	}
+
+	opts = ListOptions{PageSize: 3, SortBy: SortByAuthor, Descending: true, AuthorPrefix: prefix}
+	if page, err = db.ListBooksPage(opts); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := authors(page), "edc"; got != want {
+		t.Errorf("ListBooksPage descending: got %q, want %q", got, want)
+	}
+
+	// Sorting by another field than the author prefix.
+	opts = ListOptions{PageSize: 3, SortBy: SortByTitle, AuthorPrefix: prefix}
+	if page, err = db.ListBooksPage(opts); err != nil {
+		t.Fatal(err)
+	}
+	opts.Cursor = page.NextCursor
+	if page, err = db.ListBooksPage(opts); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := authors(page), "de"; got != want {
+		t.Errorf("ListBooksPage by title: got second page %q, want %q", got, want)
+	}
+
+	opts.Cursor = "not a cursor"
+	if _, err := db.ListBooksPage(opts); err != ErrInvalidCursor {
+		t.Errorf("ListBooksPage with bad cursor: got err %v, want ErrInvalidCursor", err)
 	}
 }
 
@@ -73,6 +238,11 @@ func TestDatastoreDB(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	log, err := db.(changeLogger).changeLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testChangeLog(t, log)
 	testDB(t, db)
 }
 
@@ -94,13 +264,75 @@ func TestMySQLDB(t *testing.T) {
 		t.Fatalf("Could not parse port: %v", err)
 	}
 
-	db, err := newMySQLDB(MySQLConfig{
+	config := MySQLConfig{
 		Username: "root",
 		Host:     host,
 		Port:     p,
-	})
+	}
+	m, err := newMySQLMigrator(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.MigrateTo(m.Latest())
+	m.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := newMySQLDB(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log, err := db.(changeLogger).changeLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testChangeLog(t, log)
+	testDB(t, db)
+}
+
+func TestPostgresDB(t *testing.T) {
+	t.Parallel()
+
+	host := os.Getenv("GOLANG_SAMPLES_POSTGRES_HOST")
+	port := os.Getenv("GOLANG_SAMPLES_POSTGRES_PORT")
+
+	if host == "" {
+		t.Skip("GOLANG_SAMPLES_POSTGRES_HOST not set.")
+	}
+	if port == "" {
+		port = "5432"
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatalf("Could not parse port: %v", err)
+	}
+
+	config := PostgresConfig{
+		Username: "postgres",
+		Password: os.Getenv("GOLANG_SAMPLES_POSTGRES_PASSWORD"),
+		Host:     host,
+		Port:     p,
+	}
+	m, err := newPostgresMigrator(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.MigrateTo(m.Latest())
+	m.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := newPostgresDB(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log, err := db.(changeLogger).changeLog()
 	if err != nil {
 		t.Fatal(err)
 	}
+	testChangeLog(t, log)
 	testDB(t, db)
 }
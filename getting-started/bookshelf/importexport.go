@@ -0,0 +1,355 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// File formats for importing and exporting books.
+const (
+	// FormatCSV is comma-separated values, with a header row naming the
+	// columns. The column names are those of the JSON fields of Book.
+	FormatCSV = "csv"
+
+	// FormatJSONL is JSON Lines: one JSON-encoded Book per line.
+	FormatJSONL = "jsonl"
+)
+
+// FormatFromFilename returns the format of a file named name, given by its
+// extension, whatever its case: ".csv" is FormatCSV, and ".jsonl" and
+// ".ndjson" are FormatJSONL. Other extensions are returned without the dot,
+// in lower case, as the name of an unknown format.
+func FormatFromFilename(name string) string {
+	format := strings.TrimPrefix(strings.ToLower(filepath.Ext(name)), ".")
+	if format == "ndjson" {
+		return FormatJSONL
+	}
+	return format
+}
+
+// csvColumns are the columns written when exporting books as CSV.
+var csvColumns = []string{
+	"id", "title", "author", "publishedDate", "imageUrl", "description",
+	"createdBy", "createdById",
+}
+
+// maxFieldLength is the maximum length of the short text fields of a book,
+// matching the size of the SQL columns that store them.
+const maxFieldLength = 255
+
+// ExportBooks writes books to w in the given format.
+func ExportBooks(w io.Writer, format string, books []*Book) error {
+	switch format {
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(csvColumns); err != nil {
+			return err
+		}
+		for _, b := range books {
+			if err := cw.Write(bookCSVRecord(b)); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	case FormatJSONL:
+		enc := json.NewEncoder(w)
+		for _, b := range books {
+			if err := enc.Encode(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("bookshelf: unknown format %q", format)
+}
+
+func bookCSVRecord(b *Book) []string {
+	return []string{
+		strconv.FormatInt(b.ID, 10), b.Title, b.Author, b.PublishedDate,
+		b.ImageURL, b.Description, b.CreatedBy, b.CreatedByID,
+	}
+}
+
+// ImportOptions configures ImportBooks.
+type ImportOptions struct {
+	// Format is FormatCSV or FormatJSONL.
+	Format string
+
+	// DryRun validates the books without adding them.
+	DryRun bool
+
+	// Prepare, if set, is called on each valid book before it is added, e.g.
+	// to record who imported it.
+	Prepare func(b *Book)
+
+	// Added, if set, is called with each book after it is added, e.g. to
+	// enqueue it for metadata enrichment.
+	Added func(b *Book)
+}
+
+// RowError describes a row of an import file that was not imported.
+type RowError struct {
+	// Row is the number of the row in the file, counting from 1. In CSV
+	// files, the header is row 1; in JSON Lines files, rows are lines.
+	Row int
+	Err error
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("row %d: %v", e.Row, e.Err)
+}
+
+// ImportResult reports the outcome of ImportBooks.
+type ImportResult struct {
+	// Rows is the number of rows read, not counting the CSV header or blank
+	// lines.
+	Rows int
+
+	// Added lists the books added, with their new IDs.
+	Added []*Book
+
+	// Duplicates lists the rows skipped because a book with the same title
+	// and author already exists, or appeared earlier in the file.
+	Duplicates []*RowError
+
+	// Errors lists the rows that were invalid or could not be added.
+	Errors []*RowError
+}
+
+// ImportBooks reads books from r and adds them to db.
+//
+// Each row is validated on its own: invalid rows are reported in the result
+// and don't stop the import. Books are deduplicated by title and author,
+// ignoring case and extra whitespace, against the books in db and earlier rows
+// of the file. IDs and versions in the file are ignored; books get new ones.
+//
+// An error is returned only if the file as a whole can't be read, such as a
+// CSV file without a title column.
+func ImportBooks(db BookDatabase, r io.Reader, opts ImportOptions) (*ImportResult, error) {
+	rows, err := readImportRows(r, opts.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := db.ListBooks()
+	if err != nil {
+		return nil, fmt.Errorf("bookshelf: could not list books: %v", err)
+	}
+	seen := make(map[string]string)
+	for _, b := range existing {
+		seen[dedupKey(b)] = fmt.Sprintf("book %d", b.ID)
+	}
+
+	result := &ImportResult{Rows: len(rows)}
+	for _, row := range rows {
+		if row.err != nil {
+			result.Errors = append(result.Errors, &RowError{Row: row.line, Err: row.err})
+			continue
+		}
+		b := row.book
+		if err := validateImportedBook(b); err != nil {
+			result.Errors = append(result.Errors, &RowError{Row: row.line, Err: err})
+			continue
+		}
+		key := dedupKey(b)
+		if dup, ok := seen[key]; ok {
+			result.Duplicates = append(result.Duplicates, &RowError{
+				Row: row.line,
+				Err: fmt.Errorf("duplicate of %s", dup),
+			})
+			continue
+		}
+		seen[key] = fmt.Sprintf("row %d", row.line)
+
+		b.ID, b.Version = 0, 0
+		if opts.Prepare != nil {
+			opts.Prepare(b)
+		}
+		if !opts.DryRun {
+			id, err := db.AddBook(b)
+			if err != nil {
+				result.Errors = append(result.Errors, &RowError{Row: row.line, Err: err})
+				continue
+			}
+			b.ID = id
+			if opts.Added != nil {
+				opts.Added(b)
+			}
+		}
+		result.Added = append(result.Added, b)
+	}
+	return result, nil
+}
+
+// dedupKey returns the key by which books are deduplicated on import.
+func dedupKey(b *Book) string {
+	normalize := func(s string) string {
+		return strings.ToLower(strings.Join(strings.Fields(s), " "))
+	}
+	return normalize(b.Title) + "\x00" + normalize(b.Author)
+}
+
+// validateImportedBook checks that a book read from an import file can be
+// stored.
+func validateImportedBook(b *Book) error {
+	if strings.TrimSpace(b.Title) == "" {
+		return errors.New("title is required")
+	}
+	fields := []struct {
+		name, value string
+	}{
+		{"title", b.Title},
+		{"author", b.Author},
+		{"publishedDate", b.PublishedDate},
+		{"imageUrl", b.ImageURL},
+		{"createdBy", b.CreatedBy},
+		{"createdById", b.CreatedByID},
+	}
+	for _, f := range fields {
+		if n := utf8.RuneCountInString(f.value); n > maxFieldLength {
+			return fmt.Errorf("%s is too long (%d characters, maximum %d)", f.name, n, maxFieldLength)
+		}
+	}
+	if b.ImageURL != "" {
+		u, err := url.Parse(b.ImageURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("imageUrl %q is not an http or https URL", b.ImageURL)
+		}
+	}
+	return nil
+}
+
+// importRow is a row read from an import file: either a book, or the reason
+// the row couldn't be read.
+type importRow struct {
+	line int
+	book *Book
+	err  error
+}
+
+func readImportRows(r io.Reader, format string) ([]importRow, error) {
+	switch format {
+	case FormatCSV:
+		return readCSVRows(r)
+	case FormatJSONL:
+		return readJSONLRows(r)
+	}
+	return nil, fmt.Errorf("bookshelf: unknown format %q", format)
+}
+
+func readCSVRows(r io.Reader) ([]importRow, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1 // Rows with the wrong number of fields are reported per row.
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, errors.New("bookshelf: CSV file is empty")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("bookshelf: could not read CSV header: %v", err)
+	}
+
+	// Map from column index to the field of the book it sets.
+	setters := make([]func(b *Book, v string), len(header))
+	hasTitle := false
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		if i == 0 {
+			name = strings.TrimPrefix(name, "\ufeff") // Byte order mark.
+		}
+		set, ok := csvSetters[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("bookshelf: unknown CSV column %q", name)
+		}
+		setters[i] = set
+		hasTitle = hasTitle || strings.EqualFold(name, "title")
+	}
+	if !hasTitle {
+		return nil, errors.New("bookshelf: CSV file has no title column")
+	}
+
+	var rows []importRow
+	// Rows are numbered as in a spreadsheet, with the header as row 1.
+	for row := 2; ; row++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if pe, ok := err.(*csv.ParseError); ok {
+			// The rest of the file can still be read.
+			rows = append(rows, importRow{line: row, err: pe.Err})
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bookshelf: could not read CSV: %v", err)
+		}
+		if len(record) != len(header) {
+			rows = append(rows, importRow{
+				line: row,
+				err:  fmt.Errorf("got %d fields, want %d", len(record), len(header)),
+			})
+			continue
+		}
+		b := &Book{}
+		for i, v := range record {
+			setters[i](b, v)
+		}
+		rows = append(rows, importRow{line: row, book: b})
+	}
+}
+
+// csvSetters maps from lowercase CSV column name to a function setting the
+// corresponding field of a book. The ID and version are accepted so that
+// exported files can be imported, but are ignored.
+var csvSetters = map[string]func(b *Book, v string){
+	"id":            func(b *Book, v string) {},
+	"version":       func(b *Book, v string) {},
+	"title":         func(b *Book, v string) { b.Title = v },
+	"author":        func(b *Book, v string) { b.Author = v },
+	"publisheddate": func(b *Book, v string) { b.PublishedDate = v },
+	"imageurl":      func(b *Book, v string) { b.ImageURL = v },
+	"description":   func(b *Book, v string) { b.Description = v },
+	"createdby":     func(b *Book, v string) { b.CreatedBy = v },
+	"createdbyid":   func(b *Book, v string) { b.CreatedByID = v },
+}
+
+// maxJSONLLine is the longest line accepted in a JSON Lines file.
+const maxJSONLLine = 1 << 20
+
+func readJSONLRows(r io.Reader) ([]importRow, error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), maxJSONLLine)
+
+	var rows []importRow
+	for line := 1; s.Scan(); line++ {
+		data := bytes.TrimSpace(s.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		b := &Book{}
+		if err := UnmarshalStrictJSON(data, b); err != nil {
+			rows = append(rows, importRow{line: line, err: fmt.Errorf("invalid JSON: %v", err)})
+			continue
+		}
+		rows = append(rows, importRow{line: line, book: b})
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("bookshelf: could not read JSON Lines: %v", err)
+	}
+	return rows, nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExportImportRoundTrip(t *testing.T) {
+	books := []*Book{
+		{ID: 3, Title: "Moby Dick", Author: "Herman Melville", PublishedDate: "1851",
+			ImageURL: "https://example.com/moby.jpg", Description: "A whale, \"Moby\",\nmeets a man.",
+			CreatedBy: "Ishmael", CreatedByID: "ishmael", Version: 4},
+		{ID: 7, Title: "Emma", Author: "Jane Austen"},
+	}
+
+	for _, format := range []string{FormatCSV, FormatJSONL} {
+		var buf bytes.Buffer
+		if err := ExportBooks(&buf, format, books); err != nil {
+			t.Fatalf("ExportBooks(%s): %v", format, err)
+		}
+
+		db := newMemoryDB()
+		r, err := ImportBooks(db, &buf, ImportOptions{Format: format})
+		if err != nil {
+			t.Fatalf("ImportBooks(%s): %v", format, err)
+		}
+		if r.Rows != 2 || len(r.Added) != 2 || len(r.Errors) != 0 || len(r.Duplicates) != 0 {
+			t.Errorf("ImportBooks(%s) = %+v, want 2 books added", format, r)
+		}
+
+		got, _ := db.ListBooks()
+		for i, b := range got {
+			// Imported books get new IDs and versions.
+			want := *books[len(books)-1-i] // ListBooks orders by title.
+			want.ID, want.Version = b.ID, 1
+			if !reflect.DeepEqual(*b, want) {
+				t.Errorf("%s: imported book = %+v, want %+v", format, *b, want)
+			}
+		}
+	}
+}
+
+func TestImportBooksRowErrors(t *testing.T) {
+	db := newMemoryDB()
+	if _, err := db.AddBook(&Book{Title: "Emma", Author: "Jane Austen"}); err != nil {
+		t.Fatal(err)
+	}
+
+	csv := `Title,Author,imageUrl
+Persuasion,Jane Austen,
+,No Title,
+  emma , JANE   austen,
+Persuasion,Jane Austen,
+Too,Many,Fields,Here
+Sanditon,Jane Austen,ftp://example.com/cover.jpg
+` + strings.Repeat("x", 256) + `,Long Title,
+`
+	var added []string
+	r, err := ImportBooks(db, strings.NewReader(csv), ImportOptions{
+		Format:  FormatCSV,
+		Prepare: func(b *Book) { b.CreatedByID = "importer" },
+		Added:   func(b *Book) { added = append(added, b.Title) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Rows != 7 {
+		t.Errorf("Rows = %d, want 7", r.Rows)
+	}
+	if want := []string{"Persuasion"}; !reflect.DeepEqual(added, want) {
+		t.Errorf("Added callback got %v, want %v", added, want)
+	}
+	if len(r.Added) != 1 || r.Added[0].CreatedByID != "importer" || r.Added[0].ID == 0 {
+		t.Errorf("Added = %+v, want Persuasion with an ID, created by importer", r.Added)
+	}
+	if got, want := rowNumbers(r.Duplicates), []int{4, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Duplicates rows = %v, want %v (%v)", got, want, r.Duplicates)
+	}
+	if got, want := rowNumbers(r.Errors), []int{3, 6, 7, 8}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Errors rows = %v, want %v (%v)", got, want, r.Errors)
+	}
+	if got := r.Duplicates[1].Error(); got != "row 5: duplicate of row 2" {
+		t.Errorf("Duplicates[1] = %q, want %q", got, "row 5: duplicate of row 2")
+	}
+}
+
+func TestImportBooksJSONLErrors(t *testing.T) {
+	jsonl := `{"title": "Emma", "author": "Jane Austen"}
+
+{"title": "Persuasion", "colour": "blue"}
+not json
+{"title": "Sanditon"} {"title": "Another"}
+{"title": "Mansfield Park", "id": 12, "version": 3}
+`
+	db := newMemoryDB()
+	r, err := ImportBooks(db, strings.NewReader(jsonl), ImportOptions{Format: FormatJSONL, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rowNumbers(r.Errors), []int{3, 4, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Errors rows = %v, want %v (%v)", got, want, r.Errors)
+	}
+	if len(r.Added) != 2 {
+		t.Errorf("dry run: got %d books to add, want 2", len(r.Added))
+	}
+	if books, _ := db.ListBooks(); len(books) != 0 {
+		t.Errorf("dry run added %d books", len(books))
+	}
+}
+
+func TestImportBooksInvalidFile(t *testing.T) {
+	tests := []struct {
+		format, data string
+	}{
+		{FormatCSV, ""},
+		{FormatCSV, "author,description\nhomer,d\n"},
+		{FormatCSV, "title,colour\nt,blue\n"},
+		{"xml", "<books/>"},
+	}
+	for _, tt := range tests {
+		if _, err := ImportBooks(newMemoryDB(), strings.NewReader(tt.data), ImportOptions{Format: tt.format}); err == nil {
+			t.Errorf("ImportBooks(%s, %q): got nil error", tt.format, tt.data)
+		}
+	}
+}
+
+func TestFormatFromFilename(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"books.csv", FormatCSV},
+		{"Books.CSV", FormatCSV},
+		{"books.jsonl", FormatJSONL},
+		{"books.ndjson", FormatJSONL},
+		{"/tmp/books.NDJSON", FormatJSONL},
+		{"books.xml", "xml"},
+		{"books", ""},
+	}
+	for _, tt := range tests {
+		if got := FormatFromFilename(tt.name); got != tt.want {
+			t.Errorf("FormatFromFilename(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func rowNumbers(errs []*RowError) []int {
+	var rows []int
+	for _, e := range errs {
+		rows = append(rows, e.Row)
+	}
+	return rows
+}
@@ -0,0 +1,154 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// SearchResult is a book matching a search query.
+type SearchResult struct {
+	ID    int64
+	Score float64
+}
+
+// BookIndex provides thread-safe full-text search over books.
+type BookIndex interface {
+	// Index adds a book to the index, replacing any previous entry for the
+	// same book ID.
+	Index(b *Book) error
+
+	// Remove removes the book with the given ID from the index.
+	Remove(id int64) error
+
+	// Search returns up to limit books containing all the words in query,
+	// best matches first.
+	Search(query string, limit int) ([]SearchResult, error)
+}
+
+// tokenize splits text into lowercase words, treating any run of characters
+// other than letters and digits as a separator.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// bookTokens returns the words of a book that are searchable: those in its
+// title, author and description.
+func bookTokens(b *Book) []string {
+	var tokens []string
+	for _, text := range []string{b.Title, b.Author, b.Description} {
+		tokens = append(tokens, tokenize(text)...)
+	}
+	return tokens
+}
+
+// indexedDB is a BookDatabase that keeps a BookIndex up to date with the
+// books added, updated and deleted through it. Reads are passed straight to
+// the underlying database.
+type indexedDB struct {
+	BookDatabase
+	index BookIndex
+}
+
+// Ensure indexedDB conforms to the BookDatabase, versionedDeleter and
+// imageFinder interfaces.
+var (
+	_ BookDatabase     = &indexedDB{}
+	_ versionedDeleter = &indexedDB{}
+	_ imageFinder      = &indexedDB{}
+)
+
+// newIndexedDB wraps db so that changes to its books are reflected in index.
+// All books currently in db are added to the index.
+func newIndexedDB(db BookDatabase, index BookIndex) (BookDatabase, error) {
+	books, err := db.ListBooks()
+	if err != nil {
+		return nil, fmt.Errorf("index: could not list books: %v", err)
+	}
+	for _, b := range books {
+		if err := index.Index(b); err != nil {
+			return nil, fmt.Errorf("index: could not index book %d: %v", b.ID, err)
+		}
+	}
+	return &indexedDB{BookDatabase: db, index: index}, nil
+}
+
+// AddBook saves a given book, assigning it a new ID, and indexes it.
+func (db *indexedDB) AddBook(b *Book) (id int64, err error) {
+	id, err = db.BookDatabase.AddBook(b)
+	if err != nil {
+		return 0, err
+	}
+	indexed := *b
+	indexed.ID = id
+	if err := db.index.Index(&indexed); err != nil {
+		return id, fmt.Errorf("index: could not index book %d: %v", id, err)
+	}
+	return id, nil
+}
+
+// UpdateBook updates the entry for a given book and re-indexes it.
+func (db *indexedDB) UpdateBook(b *Book) error {
+	if err := db.BookDatabase.UpdateBook(b); err != nil {
+		return err
+	}
+	if err := db.index.Index(b); err != nil {
+		return fmt.Errorf("index: could not index book %d: %v", b.ID, err)
+	}
+	return nil
+}
+
+// DeleteBook removes a given book by its ID, and removes it from the index.
+func (db *indexedDB) DeleteBook(id int64) error {
+	if err := db.BookDatabase.DeleteBook(id); err != nil {
+		return err
+	}
+	if err := db.index.Remove(id); err != nil {
+		return fmt.Errorf("index: could not remove book %d: %v", id, err)
+	}
+	return nil
+}
+
+// deleteBookVersion removes a given book if it is at version, if the
+// underlying database is a versionedDeleter, and removes it from the index.
+func (db *indexedDB) deleteBookVersion(id, version int64) error {
+	deleter, ok := db.BookDatabase.(versionedDeleter)
+	if !ok {
+		return fmt.Errorf("index: %T can't delete versions of books", db.BookDatabase)
+	}
+	if err := deleter.deleteBookVersion(id, version); err != nil {
+		return err
+	}
+	if err := db.index.Remove(id); err != nil {
+		return fmt.Errorf("index: could not remove book %d: %v", id, err)
+	}
+	return nil
+}
+
+// usesImage reports whether any book in the underlying database has one of
+// the given image URLs.
+func (db *indexedDB) usesImage(imageURLs []string) (bool, error) {
+	return anyBookUses(db.BookDatabase, imageURLs)
+}
+
+// ImportBook saves b under b.ID, if the underlying database is a
+// BookImporter, and indexes it.
+func (db *indexedDB) ImportBook(b *Book) error {
+	importer, ok := db.BookDatabase.(BookImporter)
+	if !ok {
+		return fmt.Errorf("index: %T can't import books", db.BookDatabase)
+	}
+	if err := importer.ImportBook(b); err != nil {
+		return err
+	}
+	if err := db.index.Index(b); err != nil {
+		return fmt.Errorf("index: could not index book %d: %v", b.ID, err)
+	}
+	return nil
+}
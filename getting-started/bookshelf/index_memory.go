@@ -0,0 +1,135 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"sort"
+	"sync"
+)
+
+// Ensure memoryIndex conforms to the BookIndex interface.
+var _ BookIndex = &memoryIndex{}
+
+// memoryIndex is an in-process inverted index of books. Matches are ranked
+// by how often the query words occur in each book.
+type memoryIndex struct {
+	mu       sync.RWMutex
+	postings map[string]map[int64]int // maps from word to book ID to word count.
+	words    map[int64][]string       // maps from book ID to its distinct words.
+}
+
+func newMemoryIndex() *memoryIndex {
+	return &memoryIndex{
+		postings: make(map[string]map[int64]int),
+		words:    make(map[int64][]string),
+	}
+}
+
+// Index adds a book to the index, replacing any previous entry for the same
+// book ID.
+func (idx *memoryIndex) Index(b *Book) error {
+	counts := make(map[string]int)
+	for _, w := range bookTokens(b) {
+		counts[w]++
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.remove(b.ID)
+	words := make([]string, 0, len(counts))
+	for w, n := range counts {
+		p, ok := idx.postings[w]
+		if !ok {
+			p = make(map[int64]int)
+			idx.postings[w] = p
+		}
+		p[b.ID] = n
+		words = append(words, w)
+	}
+	idx.words[b.ID] = words
+	return nil
+}
+
+// Remove removes the book with the given ID from the index.
+func (idx *memoryIndex) Remove(id int64) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.remove(id)
+	return nil
+}
+
+// remove removes a book from the index. idx.mu must be held.
+func (idx *memoryIndex) remove(id int64) {
+	for _, w := range idx.words[id] {
+		p := idx.postings[w]
+		delete(p, id)
+		if len(p) == 0 {
+			delete(idx.postings, w)
+		}
+	}
+	delete(idx.words, id)
+}
+
+// Search returns up to limit books containing all the words in query, ordered
+// by the total number of occurrences of the query words. Books with equal
+// scores are ordered by ID. Repeated query words are only counted once.
+func (idx *memoryIndex) Search(query string, limit int) ([]SearchResult, error) {
+	var terms []string
+	seen := make(map[string]bool)
+	for _, t := range tokenize(query) {
+		if !seen[t] {
+			seen[t] = true
+			terms = append(terms, t)
+		}
+	}
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	// Start from the books containing the first word, and narrow down by each
+	// of the remaining words.
+	scores := make(map[int64]int)
+	for id, n := range idx.postings[terms[0]] {
+		scores[id] = n
+	}
+	for _, t := range terms[1:] {
+		p := idx.postings[t]
+		for id := range scores {
+			if n, ok := p[id]; ok {
+				scores[id] += n
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+
+	results := make([]SearchResult, 0, len(scores))
+	for id, score := range scores {
+		results = append(results, SearchResult{ID: id, Score: float64(score)})
+	}
+	sort.Sort(byScore(results))
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// byScore implements sort.Interface, ordering results by descending score,
+// then by ID.
+type byScore []SearchResult
+
+func (s byScore) Len() int      { return len(s) }
+func (s byScore) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byScore) Less(i, j int) bool {
+	if s[i].Score != s[j].Score {
+		return s[i].Score > s[j].Score
+	}
+	return s[i].ID < s[j].ID
+}
@@ -0,0 +1,131 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	got := tokenize("The Hitchhiker's Guide, vol. 42 — Ærø!")
+	want := []string{"the", "hitchhiker", "s", "guide", "vol", "42", "ærø"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func searchIDs(t *testing.T, idx BookIndex, query string) []int64 {
+	results, err := idx.Search(query, 0)
+	if err != nil {
+		t.Fatalf("Search(%q): %v", query, err)
+	}
+	var ids []int64
+	for _, r := range results {
+		ids = append(ids, r.ID)
+	}
+	return ids
+}
+
+func TestMemoryIndex(t *testing.T) {
+	idx := newMemoryIndex()
+	books := []*Book{
+		{ID: 1, Title: "Go Programming", Author: "Alan Donovan", Description: "Go go go."},
+		{ID: 2, Title: "Programming Pearls", Author: "Jon Bentley"},
+		{ID: 3, Title: "The Go Way", Description: "Programming in Go."},
+	}
+	for _, b := range books {
+		if err := idx.Index(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		query string
+		want  []int64
+	}{
+		{"go", []int64{1, 3}},
+		{"GO programming", []int64{1, 3}},
+		{"programming", []int64{1, 2, 3}},
+		{"bentley pearls", []int64{2}},
+		{"go pearls", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		if got := searchIDs(t, idx, tt.query); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Search(%q): got %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	// Repeating a query word doesn't change the scores.
+	once, _ := idx.Search("go programming", 0)
+	twice, _ := idx.Search("go Go programming", 0)
+	if !reflect.DeepEqual(once, twice) {
+		t.Errorf("Search with a repeated word: got %v, want %v", twice, once)
+	}
+
+	if results, _ := idx.Search("programming", 2); len(results) != 2 {
+		t.Errorf("Search with limit 2: got %d results", len(results))
+	}
+
+	// Re-indexing a book replaces its old words.
+	if err := idx.Index(&Book{ID: 1, Title: "Rust Programming"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := searchIDs(t, idx, "go"), []int64{3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Search after re-index: got %v, want %v", got, want)
+	}
+
+	if err := idx.Remove(3); err != nil {
+		t.Fatal(err)
+	}
+	if got := searchIDs(t, idx, "go"); got != nil {
+		t.Errorf("Search after remove: got %v, want none", got)
+	}
+}
+
+func TestIndexedDB(t *testing.T) {
+	mem := newMemoryDB()
+	existing, err := mem.AddBook(&Book{Title: "Existing Book"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx := newMemoryIndex()
+	db, err := newIndexedDB(mem, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if got, want := searchIDs(t, idx, "existing"), []int64{existing}; !reflect.DeepEqual(got, want) {
+		t.Errorf("books present at startup: got %v, want %v", got, want)
+	}
+
+	id, err := db.AddBook(&Book{Title: "Added Book"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := searchIDs(t, idx, "added"), []int64{id}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after AddBook: got %v, want %v", got, want)
+	}
+
+	if err := db.UpdateBook(&Book{ID: id, Title: "Updated Book", Version: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if got := searchIDs(t, idx, "added"); got != nil {
+		t.Errorf("after UpdateBook: got %v for old title, want none", got)
+	}
+	if got, want := searchIDs(t, idx, "updated"), []int64{id}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after UpdateBook: got %v, want %v", got, want)
+	}
+
+	if err := db.DeleteBook(id); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := searchIDs(t, idx, "book"), []int64{existing}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after DeleteBook: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package oidctest provides a fake OpenID Connect provider for tests.
+package oidctest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Issuer is an OpenID Connect provider serving discovery, its signing key
+// and a token endpoint. The token endpoint accepts the code "good-code" and
+// returns the ID token given to SetIDToken.
+type Issuer struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	key         *rsa.PrivateKey
+	kid         string
+	keys        int // generated so far
+	idToken     string
+	jwksFetches int
+}
+
+// NewIssuer starts an Issuer. The caller should call Close when finished.
+func NewIssuer(t *testing.T) *Issuer {
+	f := &Issuer{}
+	f.RotateKey(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 f.URL,
+			"authorization_endpoint": f.URL + "/authorize",
+			"token_endpoint":         f.URL + "/token",
+			"jwks_uri":               f.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.jwksFetches++
+		key, kid := f.key, f.kid
+		f.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": kid,
+				"use": "sig",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "good-code" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": "invalid_grant"}`)
+			return
+		}
+		f.mu.Lock()
+		idToken := f.idToken
+		f.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idToken,
+		})
+	})
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+// Claims returns valid claims for a token meant for client "app", with
+// subject "1234" and nonce "nonce".
+func (f *Issuer) Claims() map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":     f.URL,
+		"sub":     "1234",
+		"aud":     "app",
+		"exp":     now.Add(time.Hour).Unix(),
+		"iat":     now.Unix(),
+		"nonce":   "nonce",
+		"name":    "Homer Simpson",
+		"email":   "homer@example.com",
+		"picture": "https://example.com/homer.jpg",
+	}
+}
+
+// Key returns the current signing key of the issuer and its ID.
+func (f *Issuer) Key() (key *rsa.PrivateKey, kid string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.key, f.kid
+}
+
+// RotateKey replaces the signing key of the issuer with a new one.
+func (f *Issuer) RotateKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.keys++
+	f.key, f.kid = key, fmt.Sprintf("key%d", f.keys)
+}
+
+// Sign returns a JWT with the given claims, signed with the current key of
+// the issuer.
+func (f *Issuer) Sign(t *testing.T, claims map[string]interface{}) string {
+	key, kid := f.Key()
+	return Sign(t, key, kid, "RS256", claims)
+}
+
+// SetIDToken sets the ID token returned by the token endpoint.
+func (f *Issuer) SetIDToken(idToken string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.idToken = idToken
+}
+
+// JWKSFetches returns the number of times the signing keys were fetched.
+func (f *Issuer) JWKSFetches() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.jwksFetches
+}
+
+// Sign returns a JWT with the given claims and header fields, signed with
+// key using RS256 whatever alg says.
+func Sign(t *testing.T, key *rsa.PrivateKey, kid, alg string, claims map[string]interface{}) string {
+	enc := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := enc(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + enc(claims)
+	hash := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
@@ -0,0 +1,287 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrInvalidCursor is returned by BookDatabase.ListBooksPage when
+// ListOptions.Cursor was not returned by a previous call.
+var ErrInvalidCursor = errors.New("bookshelf: invalid cursor")
+
+// SortField identifies the field by which a list of books is ordered.
+type SortField string
+
+// Fields that books can be sorted by.
+const (
+	SortByTitle         SortField = "title"
+	SortByAuthor        SortField = "author"
+	SortByPublishedDate SortField = "publishedDate"
+)
+
+const (
+	// DefaultPageSize is used when ListOptions.PageSize is zero.
+	DefaultPageSize = 10
+
+	// MaxPageSize is the largest page that ListBooksPage will return.
+	MaxPageSize = 100
+)
+
+// ListOptions configures a call to BookDatabase.ListBooksPage.
+type ListOptions struct {
+	// PageSize is the maximum number of books to return. If zero,
+	// DefaultPageSize is used. Values above MaxPageSize are capped.
+	PageSize int
+
+	// Cursor is the NextCursor or PrevCursor of a previously returned page.
+	// If empty, the first page is returned.
+	//
+	// A cursor must only be used with the same SortBy, Descending,
+	// AuthorPrefix and CreatedByID options as the call that returned it.
+	Cursor string
+
+	// SortBy is the field by which books are ordered. If empty, books are
+	// ordered by title.
+	SortBy SortField
+
+	// Descending reverses the sort order.
+	Descending bool
+
+	// AuthorPrefix, if set, restricts the list to books whose author starts
+	// with the given string.
+	AuthorPrefix string
+
+	// CreatedByID, if set, restricts the list to books created by the given
+	// user.
+	CreatedByID string
+}
+
+// BookPage is a single page of a list of books.
+type BookPage struct {
+	Books []*Book
+
+	// NextCursor can be passed as ListOptions.Cursor to retrieve the following
+	// page. It is empty if this is the last page.
+	NextCursor string
+
+	// PrevCursor can be passed as ListOptions.Cursor to retrieve the preceding
+	// page. It is empty if this is the first page.
+	PrevCursor string
+}
+
+// Validate reports whether the options are well-formed.
+func (o ListOptions) Validate() error {
+	switch o.SortBy {
+	case "", SortByTitle, SortByAuthor, SortByPublishedDate:
+	default:
+		return fmt.Errorf("bookshelf: unknown sort field %q", o.SortBy)
+	}
+	if o.PageSize < 0 {
+		return fmt.Errorf("bookshelf: negative page size %d", o.PageSize)
+	}
+	return nil
+}
+
+// pageSize returns the number of books to put on a page.
+func (o ListOptions) pageSize() int {
+	switch {
+	case o.PageSize == 0:
+		return DefaultPageSize
+	case o.PageSize > MaxPageSize:
+		return MaxPageSize
+	}
+	return o.PageSize
+}
+
+// sortField returns the field to sort by, applying the default.
+func (o ListOptions) sortField() SortField {
+	if o.SortBy == "" {
+		return SortByTitle
+	}
+	return o.SortBy
+}
+
+// matches reports whether b passes the filters in o.
+func (o ListOptions) matches(b *Book) bool {
+	if o.CreatedByID != "" && b.CreatedByID != o.CreatedByID {
+		return false
+	}
+	return strings.HasPrefix(b.Author, o.AuthorPrefix)
+}
+
+// sortValue returns the value of the field of b that f refers to.
+func (f SortField) sortValue(b *Book) string {
+	switch f {
+	case SortByAuthor:
+		return b.Author
+	case SortByPublishedDate:
+		return b.PublishedDate
+	}
+	return b.Title
+}
+
+// keysetCursor is the decoded form of the cursors returned by backends that
+// use keyset pagination. It identifies the book at the edge of a page by its
+// sort value, with the ID breaking ties between equal sort values.
+type keysetCursor struct {
+	Value string `json:"v"`
+	ID    int64  `json:"id"`
+
+	// Before is set for cursors that point to the page preceding the book
+	// (i.e. PrevCursor), and unset for cursors that point to the page
+	// following it (i.e. NextCursor).
+	Before bool `json:"b,omitempty"`
+}
+
+// decodeKeysetCursor parses a cursor returned by encode. It returns nil for
+// the empty cursor.
+func decodeKeysetCursor(s string) (*keysetCursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	c := &keysetCursor{}
+	if err := decodeCursor(s, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *keysetCursor) encode() string {
+	return encodeCursor(c)
+}
+
+// encodeCursor serializes a backend-specific cursor struct into the opaque
+// form returned in BookPage.
+func encodeCursor(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		// Cursors only hold strings and numbers, so this can't fail.
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor parses a cursor produced by encodeCursor into v.
+func decodeCursor(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return ErrInvalidCursor
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return ErrInvalidCursor
+	}
+	return nil
+}
+
+// scanAscending reports whether a backend should read books in ascending
+// order of the sort field to fill the page requested by opts and cur. Pages
+// before a cursor are read backwards, starting at the cursor.
+func (c *keysetCursor) scanAscending(opts ListOptions) bool {
+	before := c != nil && c.Before
+	return opts.Descending == before
+}
+
+// keysetPage builds a page from books read by a keyset-paginating backend.
+// books must hold up to pageSize+1 books, read in the order given by
+// scanAscending, starting strictly after (or before) cur.
+func keysetPage(opts ListOptions, cur *keysetCursor, books []*Book) *BookPage {
+	n := opts.pageSize()
+	more := len(books) > n
+	if more {
+		books = books[:n]
+	}
+
+	before := cur != nil && cur.Before
+	if before {
+		// Books were read backwards from the cursor; restore display order.
+		for i, j := 0, len(books)-1; i < j; i, j = i+1, j-1 {
+			books[i], books[j] = books[j], books[i]
+		}
+	}
+
+	page := &BookPage{Books: books}
+	if len(books) == 0 {
+		return page
+	}
+
+	field := opts.sortField()
+	first, last := books[0], books[len(books)-1]
+	// There are books after this page if we saw an extra one while reading
+	// forwards, or if we paged backwards from a cursor. Likewise for books
+	// before this page.
+	if more || before {
+		page.NextCursor = (&keysetCursor{Value: field.sortValue(last), ID: last.ID}).encode()
+	}
+	if (before && more) || (!before && cur != nil) {
+		page.PrevCursor = (&keysetCursor{Value: field.sortValue(first), ID: first.ID, Before: true}).encode()
+	}
+	return page
+}
+
+// compareKeyset orders b relative to the position (value, id), returning -1,
+// 0 or +1 as b sorts before, at or after it in ascending order.
+func compareKeyset(field SortField, b *Book, value string, id int64) int {
+	v := field.sortValue(b)
+	switch {
+	case v < value:
+		return -1
+	case v > value:
+		return 1
+	case b.ID < id:
+		return -1
+	case b.ID > id:
+		return 1
+	}
+	return 0
+}
+
+// sortedKeysetPage builds a page from all the books matching opts, in any
+// order, for backends that can't sort and paginate them themselves.
+func sortedKeysetPage(opts ListOptions, cur *keysetCursor, books []*Book) *BookPage {
+	field := opts.sortField()
+	asc := cur.scanAscending(opts)
+	sort.Sort(keysetOrder{field: field, asc: asc, books: books})
+
+	// Skip the books up to and including the cursor, then read one more book
+	// than fits on the page to find out whether there is another page.
+	var page []*Book
+	for _, b := range books {
+		if cur != nil {
+			c := compareKeyset(field, b, cur.Value, cur.ID)
+			if (asc && c <= 0) || (!asc && c >= 0) {
+				continue
+			}
+		}
+		page = append(page, b)
+		if len(page) > opts.pageSize() {
+			break
+		}
+	}
+	return keysetPage(opts, cur, page)
+}
+
+// keysetOrder sorts books by a field and their ID, in the order in which
+// keyset-paginating backends read them.
+type keysetOrder struct {
+	field SortField
+	asc   bool
+	books []*Book
+}
+
+func (o keysetOrder) Len() int      { return len(o.books) }
+func (o keysetOrder) Swap(i, j int) { o.books[i], o.books[j] = o.books[j], o.books[i] }
+func (o keysetOrder) Less(i, j int) bool {
+	c := compareKeyset(o.field, o.books[i], o.field.sortValue(o.books[j]), o.books[j].ID)
+	if o.asc {
+		return c < 0
+	}
+	return c > 0
+}
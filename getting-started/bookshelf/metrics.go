@@ -0,0 +1,52 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+
+	"contrib.go.opencensus.io/exporter/prometheus"
+	"go.opencensus.io/stats/view"
+)
+
+// LatencyDistribution buckets latencies recorded in milliseconds, such as
+// those of requests.
+var LatencyDistribution = view.Distribution(5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000)
+
+// configureMetrics registers the views of the metrics recorded by this
+// package, and returns a handler serving all the registered views to
+// Prometheus. If token isn't empty, requests must carry it as a bearer token.
+func configureMetrics(token string) (http.Handler, error) {
+	if err := view.Register(dbViews...); err != nil {
+		return nil, fmt.Errorf("bookshelf: could not register metrics: %v", err)
+	}
+	exporter, err := prometheus.NewExporter(prometheus.Options{})
+	if err != nil {
+		return nil, fmt.Errorf("bookshelf: could not export metrics: %v", err)
+	}
+	if token == "" {
+		return exporter, nil
+	}
+	return &tokenHandler{h: exporter, token: token}, nil
+}
+
+// tokenHandler serves the requests with an "Authorization: Bearer <token>"
+// header with h, and rejects the others.
+type tokenHandler struct {
+	h     http.Handler
+	token string
+}
+
+func (th *tokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	want := "Bearer " + th.token
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(want)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	th.h.ServeHTTP(w, r)
+}
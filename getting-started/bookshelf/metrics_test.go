@@ -0,0 +1,92 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// scrape returns the metrics served by h to Prometheus.
+func scrape(h http.Handler, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestMetricsToken(t *testing.T) {
+	h, err := configureMetrics("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"", "wrong"} {
+		if rec := scrape(h, token); rec.Code != http.StatusUnauthorized {
+			t.Errorf("token %q: got status %d, want %d", token, rec.Code, http.StatusUnauthorized)
+		}
+	}
+	if rec := scrape(h, "s3cret"); rec.Code != http.StatusOK {
+		t.Errorf("valid token: got status %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+// failingDB is a BookDatabase whose updates fail.
+type failingDB struct {
+	BookDatabase
+}
+
+func (failingDB) UpdateBook(b *Book) error { return errors.New("disk full") }
+
+func TestInstrumentedDB(t *testing.T) {
+	db := newInstrumentedDB(failingDB{newMemoryDB()}, "test")
+	id, err := db.AddBook(&Book{Title: "Counted"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetBook(id + 1); err != ErrNotFound {
+		t.Fatalf("GetBook of an unknown book: got %v, want ErrNotFound", err)
+	}
+	if err := db.UpdateBook(&Book{ID: id}); err == nil {
+		t.Fatal("UpdateBook: got nil error")
+	}
+
+	h, err := configureMetrics("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := scrape(h, "").Body.String()
+	for _, want := range []string{
+		`bookshelf_db_latency_count{backend="test",method="AddBook"} 1`,
+		`bookshelf_db_latency_count{backend="test",method="GetBook"} 1`,
+		`bookshelf_db_errors{backend="test",method="UpdateBook"} 1`,
+	} {
+		if !strings.Contains(metrics, want+"\n") {
+			t.Errorf("metrics don't include %s", want)
+		}
+	}
+	// Books that aren't found aren't failures.
+	if strings.Contains(metrics, `bookshelf_db_errors{backend="test",method="GetBook"}`) {
+		t.Error("ErrNotFound was counted as an error")
+	}
+}
+
+func TestDatabaseBackend(t *testing.T) {
+	for rawurl, want := range map[string]string{
+		"memory:":                   "memory",
+		"mysql://root@localhost":    "mysql",
+		"postgresql://u@localhost/": "postgres",
+		"datastore://project":       "datastore",
+	} {
+		if got := databaseBackend(rawurl); got != want {
+			t.Errorf("databaseBackend(%q) = %q, want %q", rawurl, got, want)
+		}
+	}
+}
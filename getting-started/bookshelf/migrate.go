@@ -0,0 +1,291 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build go1.9
+
+package bookshelf
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+// Migration is a versioned change to the schema of a SQL database.
+type Migration struct {
+	// Version orders the migrations. Versions must be positive and unique.
+	Version int64
+
+	// Name is a short description of the change.
+	Name string
+
+	// Up holds the statements that apply the change, and Down the statements
+	// that revert it.
+	Up, Down []string
+
+	// present, if set, reports whether the change made by Up is already in a
+	// database that predates the schema_migrations table. If so, the migration
+	// is recorded as applied without running Up.
+	present func(*sql.Conn) (bool, error)
+}
+
+// MigrationStatus reports whether a migration has been applied to a database.
+type MigrationStatus struct {
+	Migration
+	Applied bool
+
+	// AppliedAt is the time the migration was applied, as reported by the
+	// database.
+	AppliedAt string
+}
+
+// Migrator applies and reverts migrations, keeping track of the applied
+// migrations in the schema_migrations table.
+//
+// Each migration runs in a transaction along with its bookkeeping. Note that
+// some databases, including MySQL, commit schema changes immediately, so a
+// failed migration may need to be cleaned up by hand. Migrations run on a
+// single connection, which holds the migration lock, so they also work on
+// databases limited to one open connection.
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+
+	// lock, if set, takes a lock on conn that keeps other processes from
+	// migrating the database at the same time, until the returned function
+	// releases it. The migrations run on conn meanwhile.
+	lock func(conn *sql.Conn) (unlock func() error, err error)
+
+	// dollarPlaceholders selects the $1, $2, ... placeholders of PostgreSQL
+	// for the bookkeeping statements, instead of ?.
+	dollarPlaceholders bool
+}
+
+const createMigrationsTableStatement = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version BIGINT NOT NULL PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`
+
+// newMigrator creates a Migrator for db. migrations must be sorted by
+// version.
+func newMigrator(db *sql.DB, migrations []Migration) (*Migrator, error) {
+	var last int64
+	for _, m := range migrations {
+		if m.Version <= last {
+			return nil, fmt.Errorf("migrate: migration %d (%s) is out of order", m.Version, m.Name)
+		}
+		last = m.Version
+	}
+	if _, err := db.Exec(createMigrationsTableStatement); err != nil {
+		return nil, fmt.Errorf("migrate: could not create schema_migrations table: %v", err)
+	}
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+// Close closes the underlying database.
+func (m *Migrator) Close() error {
+	return m.db.Close()
+}
+
+// Latest returns the version of the last known migration, or 0 if there are
+// none.
+func (m *Migrator) Latest() int64 {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Status lists the known migrations in order, reporting which have been
+// applied.
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	ctx := context.Background()
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("migrate: could not get a connection: %v", err)
+	}
+	defer conn.Close()
+	return m.status(conn)
+}
+
+// status is like Status, using conn.
+func (m *Migrator) status(conn *sql.Conn) ([]MigrationStatus, error) {
+	rows, err := conn.QueryContext(context.Background(), "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("migrate: could not read schema_migrations: %v", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]string)
+	for rows.Next() {
+		var (
+			version   int64
+			appliedAt string
+		)
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("migrate: could not read schema_migrations: %v", err)
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("migrate: could not read schema_migrations: %v", err)
+	}
+
+	status := make([]MigrationStatus, len(m.migrations))
+	for i, mig := range m.migrations {
+		appliedAt, ok := applied[mig.Version]
+		status[i] = MigrationStatus{Migration: mig, Applied: ok, AppliedAt: appliedAt}
+	}
+	return status, nil
+}
+
+// SchemaError is returned when a database is opened whose schema is behind
+// the migrations known to this version of the bookshelf. The pending
+// migrations are applied with the migrate command of cmd/bookshelf.
+type SchemaError struct {
+	// Pending lists the migrations that have not been applied.
+	Pending []Migration
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("bookshelf: %d schema migrations are pending, up to version %d; apply them with: bookshelf -db <url> migrate up",
+		len(e.Pending), e.Pending[len(e.Pending)-1].Version)
+}
+
+// checkSchema returns a *SchemaError if any migration has not been applied.
+func (m *Migrator) checkSchema() error {
+	status, err := m.Status()
+	if err != nil {
+		return err
+	}
+	var pending []Migration
+	for _, s := range status {
+		if !s.Applied {
+			pending = append(pending, s.Migration)
+		}
+	}
+	if len(pending) > 0 {
+		return &SchemaError{Pending: pending}
+	}
+	return nil
+}
+
+// MigrateTo applies all pending migrations up to and including version, and
+// reverts all applied migrations after version, latest first. MigrateTo(0)
+// reverts every migration.
+func (m *Migrator) MigrateTo(version int64) error {
+	conn, err := m.db.Conn(context.Background())
+	if err != nil {
+		return fmt.Errorf("migrate: could not get a connection: %v", err)
+	}
+	defer conn.Close()
+	if m.lock != nil {
+		unlock, err := m.lock(conn)
+		if err != nil {
+			return fmt.Errorf("migrate: could not lock the database: %v", err)
+		}
+		defer unlock()
+	}
+
+	status, err := m.status(conn)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range status {
+		if s.Version > version || s.Applied {
+			continue
+		}
+		if err := m.up(conn, s.Migration); err != nil {
+			return err
+		}
+	}
+
+	for i := len(status) - 1; i >= 0; i-- {
+		s := status[i]
+		if s.Version <= version || !s.Applied {
+			continue
+		}
+		if err := m.down(conn, s.Migration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// up applies a migration on conn and records it as applied.
+func (m *Migrator) up(conn *sql.Conn, mig Migration) error {
+	run := true
+	if mig.present != nil {
+		present, err := mig.present(conn)
+		if err != nil {
+			return fmt.Errorf("migrate: %d (%s): could not inspect schema: %v", mig.Version, mig.Name, err)
+		}
+		run = !present
+	}
+
+	var stmts []string
+	if run {
+		stmts = mig.Up
+	}
+	return m.exec(conn, mig, stmts,
+		m.bind("INSERT INTO schema_migrations (version, name) VALUES (?, ?)"), mig.Version, mig.Name)
+}
+
+// down reverts a migration on conn and removes its record.
+func (m *Migrator) down(conn *sql.Conn, mig Migration) error {
+	return m.exec(conn, mig, mig.Down,
+		m.bind("DELETE FROM schema_migrations WHERE version = ?"), mig.Version)
+}
+
+// bind rewrites the ? placeholders of a bookkeeping statement for the
+// database.
+func (m *Migrator) bind(q string) string {
+	if !m.dollarPlaceholders {
+		return q
+	}
+	return bindDollar(q)
+}
+
+// bindDollar replaces the ? placeholders of q with $1, $2, ..., for
+// PostgreSQL.
+func bindDollar(q string) string {
+	var b bytes.Buffer
+	n := 0
+	for _, r := range q {
+		if r != '?' {
+			b.WriteRune(r)
+			continue
+		}
+		n++
+		fmt.Fprintf(&b, "$%d", n)
+	}
+	return b.String()
+}
+
+// exec runs stmts followed by the given bookkeeping statement in a
+// transaction on conn.
+func (m *Migrator) exec(conn *sql.Conn, mig Migration, stmts []string, bookkeeping string, args ...interface{}) error {
+	tx, err := conn.BeginTx(context.Background(), nil)
+	if err != nil {
+		return fmt.Errorf("migrate: could not begin transaction: %v", err)
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migrate: %d (%s): %v", mig.Version, mig.Name, err)
+		}
+	}
+	if _, err := tx.Exec(bookkeeping, args...); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("migrate: %d (%s): could not update schema_migrations: %v", mig.Version, mig.Name, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("migrate: %d (%s): could not commit: %v", mig.Version, mig.Name, err)
+	}
+	return nil
+}
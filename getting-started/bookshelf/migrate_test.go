@@ -0,0 +1,246 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build go1.9
+
+package bookshelf
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	// SQLite stands in for MySQL, to test the migration bookkeeping without
+	// a database server.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var testMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create a",
+		Up:      []string{`CREATE TABLE a (id INTEGER)`},
+		Down:    []string{`DROP TABLE a`},
+	},
+	{
+		Version: 2,
+		Name:    "add a.b",
+		Up:      []string{`ALTER TABLE a ADD COLUMN b TEXT`},
+		Down:    []string{`ALTER TABLE a DROP COLUMN b`},
+	},
+	{
+		Version: 3,
+		Name:    "create c, which already exists",
+		Up:      []string{`CREATE TABLE c (id INTEGER)`},
+		Down:    []string{`DROP TABLE IF EXISTS c`},
+		present: func(*sql.Conn) (bool, error) { return true, nil },
+	},
+}
+
+func openTestMigrator(t *testing.T, migrations []Migration) *Migrator {
+	conn, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each connection to :memory: is a separate database.
+	conn.SetMaxOpenConns(1)
+
+	m, err := newMigrator(conn, migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// appliedVersions lists the versions reported as applied by m.Status.
+func appliedVersions(t *testing.T, m *Migrator) []int64 {
+	status, err := m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var applied []int64
+	for _, s := range status {
+		if s.Applied {
+			if s.AppliedAt == "" {
+				t.Errorf("migration %d: want AppliedAt to be set", s.Version)
+			}
+			applied = append(applied, s.Version)
+		}
+	}
+	return applied
+}
+
+func tableExists(t *testing.T, m *Migrator, table string) bool {
+	var n int
+	err := m.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, table).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n > 0
+}
+
+func TestMigrator(t *testing.T) {
+	m := openTestMigrator(t, testMigrations)
+	defer m.Close()
+
+	if got := appliedVersions(t, m); len(got) != 0 {
+		t.Fatalf("new database: got applied %v, want none", got)
+	}
+	if got, want := m.Latest(), int64(3); got != want {
+		t.Errorf("Latest: got %d, want %d", got, want)
+	}
+	if err, ok := m.checkSchema().(*SchemaError); !ok || len(err.Pending) != 3 {
+		t.Errorf("new database: checkSchema got %v, want 3 pending migrations", err)
+	}
+
+	if err := m.MigrateTo(2); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := appliedVersions(t, m), []int64{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("MigrateTo(2): got applied %v, want %v", got, want)
+	}
+	if _, err := m.db.Exec(`INSERT INTO a (id, b) VALUES (1, 'x')`); err != nil {
+		t.Errorf("MigrateTo(2): could not use new column: %v", err)
+	}
+
+	if err := m.MigrateTo(m.Latest()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := appliedVersions(t, m), []int64{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("MigrateTo(3): got applied %v, want %v", got, want)
+	}
+	if tableExists(t, m, "c") {
+		t.Error("MigrateTo(3): ran migration whose changes were already present")
+	}
+	if err := m.checkSchema(); err != nil {
+		t.Errorf("MigrateTo(3): checkSchema got %v, want nil", err)
+	}
+
+	// Migrating to the current version is a no-op.
+	if err := m.MigrateTo(3); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.MigrateTo(1); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := appliedVersions(t, m), []int64{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("MigrateTo(1): got applied %v, want %v", got, want)
+	}
+	if _, err := m.db.Exec(`INSERT INTO a (id, b) VALUES (1, 'x')`); err == nil {
+		t.Error("MigrateTo(1): column b was not removed")
+	}
+
+	if err := m.MigrateTo(0); err != nil {
+		t.Fatal(err)
+	}
+	if got := appliedVersions(t, m); len(got) != 0 {
+		t.Errorf("MigrateTo(0): got applied %v, want none", got)
+	}
+	if tableExists(t, m, "a") {
+		t.Error("MigrateTo(0): table a was not dropped")
+	}
+}
+
+func TestMigratorFailure(t *testing.T) {
+	migrations := append(testMigrations[:1:1], Migration{
+		Version: 2,
+		Name:    "broken",
+		Up:      []string{`CREATE TABLE d (id INTEGER)`, `NOT SQL`},
+	})
+	m := openTestMigrator(t, migrations)
+	defer m.Close()
+
+	if err := m.MigrateTo(m.Latest()); err == nil {
+		t.Fatal("MigrateTo: want error from broken migration")
+	}
+	if got, want := appliedVersions(t, m), []int64{1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got applied %v, want %v", got, want)
+	}
+	if tableExists(t, m, "d") {
+		t.Error("broken migration was not rolled back")
+	}
+}
+
+func TestMigratorLock(t *testing.T) {
+	// The test database allows only one open connection, so migrating hangs
+	// unless it runs on the connection holding the lock.
+	m := openTestMigrator(t, testMigrations)
+	defer m.Close()
+
+	var locked, unlocked bool
+	m.lock = func(conn *sql.Conn) (func() error, error) {
+		if _, err := conn.ExecContext(context.Background(), "SELECT 1"); err != nil {
+			return nil, err
+		}
+		locked = true
+		return func() error {
+			unlocked = true
+			return nil
+		}, nil
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- m.MigrateTo(m.Latest()) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("MigrateTo with a lock: timed out")
+	}
+	if !locked || !unlocked {
+		t.Errorf("got locked %v, unlocked %v; want both", locked, unlocked)
+	}
+	if got, want := appliedVersions(t, m), []int64{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got applied %v, want %v", got, want)
+	}
+}
+
+func TestMigratorOrder(t *testing.T) {
+	conn, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	migrations := []Migration{testMigrations[1], testMigrations[0]}
+	if _, err := newMigrator(conn, migrations); err == nil {
+		t.Error("newMigrator with unordered migrations: want error")
+	}
+}
+
+func TestSQLMigrationsOrdered(t *testing.T) {
+	for name, migrations := range map[string][]Migration{
+		"mysql":    mysqlMigrations,
+		"postgres": postgresMigrations,
+	} {
+		var last int64
+		for _, m := range migrations {
+			if m.Version != last+1 {
+				t.Errorf("%s migration %q: got version %d, want %d", name, m.Name, m.Version, last+1)
+			}
+			if len(m.Up) == 0 || len(m.Down) == 0 {
+				t.Errorf("%s migration %d: want both up and down statements", name, m.Version)
+			}
+			last = m.Version
+		}
+	}
+}
+
+func TestMigratorBind(t *testing.T) {
+	const q = "INSERT INTO schema_migrations (version, name) VALUES (?, ?)"
+	m := &Migrator{}
+	if got := m.bind(q); got != q {
+		t.Errorf("bind: got %q, want %q", got, q)
+	}
+	m.dollarPlaceholders = true
+	if got, want := m.bind(q), "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)"; got != want {
+		t.Errorf("bind with dollar placeholders: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,300 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build go1.9
+
+package bookshelf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+	"gopkg.in/square/go-jose.v2"
+
+	"golang.org/x/net/context"
+)
+
+// googleIssuer is the issuer URL of Google's OpenID Connect provider.
+const googleIssuer = "https://accounts.google.com"
+
+// oidcClockSkew is how far the clocks of the app and providers may differ
+// when checking the times in ID tokens.
+const oidcClockSkew = time.Minute
+
+// minJWKSRefresh is how long the signing keys of a provider are kept before
+// a token signed with an unknown key makes the app fetch them again, so that
+// forged tokens can't make the app flood the provider with requests.
+const minJWKSRefresh = time.Minute
+
+// OIDCProvider signs users in with OpenID Connect. See
+// https://openid.net/specs/openid-connect-core-1_0.html
+type OIDCProvider struct {
+	// Name identifies the provider in login URLs, e.g. "google".
+	Name string
+
+	// Issuer is the provider's issuer URL, which ID tokens must be issued
+	// by.
+	Issuer string
+
+	// Config is the OAuth 2.0 configuration of the app with the provider,
+	// with endpoints found by discovery.
+	Config *oauth2.Config
+
+	// IDPrefix is prepended to the subjects of ID tokens to give user IDs,
+	// so that users of different providers can't share an ID.
+	IDPrefix string
+
+	client   *http.Client
+	keys     *jwks
+	verifier *oidc.IDTokenVerifier
+}
+
+// OIDCConfig configures an OpenID Connect provider.
+type OIDCConfig struct {
+	// Name identifies the provider in login URLs. It must be unique.
+	Name string `json:"name" yaml:"name"`
+
+	// Issuer is the provider's issuer URL, e.g. "https://accounts.google.com".
+	Issuer string `json:"issuer" yaml:"issuer"`
+
+	// ClientID and ClientSecret are given by the provider when registering
+	// the app.
+	ClientID     string `json:"clientID" yaml:"clientID"`
+	ClientSecret string `json:"clientSecret" yaml:"clientSecret"`
+}
+
+// NewOIDCProvider discovers the endpoints of the provider at cfg.Issuer,
+// using client for all requests to the provider. Users are sent back to the
+// app at redirectURL after signing in.
+func NewOIDCProvider(ctx context.Context, client *http.Client, cfg OIDCConfig, redirectURL string) (*OIDCProvider, error) {
+	provider, err := oidc.NewProvider(oidc.ClientContext(ctx, client), cfg.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: could not discover %s: %v", cfg.Name, err)
+	}
+	var d struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := provider.Claims(&d); err != nil || d.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc: %s: configuration has no signing keys", cfg.Name)
+	}
+
+	keys := &jwks{client: client, url: d.JWKSURI}
+	p := &OIDCProvider{
+		Name:   cfg.Name,
+		Issuer: cfg.Issuer,
+		Config: &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  redirectURL,
+			Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+			Endpoint:     provider.Endpoint(),
+		},
+		IDPrefix: cfg.Name + ":",
+		client:   client,
+		keys:     keys,
+		verifier: oidc.NewVerifier(cfg.Issuer, keys, &oidc.Config{
+			ClientID: cfg.ClientID,
+			// Tokens are accepted until oidcClockSkew after they expire.
+			Now: func() time.Time { return time.Now().Add(-oidcClockSkew) },
+		}),
+	}
+	// Google subjects are the user IDs the app used before it supported
+	// other providers, so they are kept as they are.
+	if cfg.Issuer == googleIssuer {
+		p.IDPrefix = ""
+	}
+	return p, nil
+}
+
+// AuthCodeURL returns the URL of the provider's sign-in page. state and nonce
+// must be unguessable; the ID token must carry the same nonce.
+func (p *OIDCProvider) AuthCodeURL(state, nonce string) string {
+	return p.Config.AuthCodeURL(state, oidc.Nonce(nonce))
+}
+
+// Exchange exchanges an authorization code for an OAuth 2.0 token, and
+// returns the token and the claims of the ID token that comes with it. The ID
+// token must carry the nonce given to AuthCodeURL.
+func (p *OIDCProvider) Exchange(ctx context.Context, code, nonce string) (*oauth2.Token, *IDTokenClaims, error) {
+	tok, err := p.Config.Exchange(context.WithValue(ctx, oauth2.HTTPClient, p.client), code)
+	if err != nil {
+		return nil, nil, fmt.Errorf("oidc: could not exchange code: %v", err)
+	}
+	rawIDToken, ok := tok.Extra("id_token").(string)
+	if !ok {
+		return nil, nil, errors.New("oidc: token response has no ID token")
+	}
+	claims, err := p.VerifyIDToken(ctx, rawIDToken, nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tok, claims, nil
+}
+
+// IDTokenClaims holds the claims of an ID token used by the app.
+type IDTokenClaims struct {
+	Issuer  string `json:"iss"`
+	Subject string `json:"sub"`
+	// AuthorizedParty is the client the token was issued to, if the token has
+	// several audiences.
+	AuthorizedParty string `json:"azp"`
+	Nonce           string `json:"nonce"`
+
+	Name    string `json:"name"`
+	Email   string `json:"email"`
+	Picture string `json:"picture"`
+}
+
+// VerifyIDToken checks that rawIDToken was signed by the provider, is meant
+// for the app, has not expired and carries the nonce given to AuthCodeURL,
+// and returns its claims. Only RS256 signatures are accepted, as required
+// by the specification.
+func (p *OIDCProvider) VerifyIDToken(ctx context.Context, rawIDToken, nonce string) (*IDTokenClaims, error) {
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	var claims IDTokenClaims
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("oidc: malformed ID token claims: %v", err)
+	}
+	// The library leaves the checks below to the app.
+	if len(idToken.Audience) > 1 && claims.AuthorizedParty != p.Config.ClientID {
+		return nil, errors.New("oidc: ID token was issued to another party")
+	}
+	if idToken.IssuedAt.Add(-oidcClockSkew).After(time.Now()) {
+		return nil, errors.New("oidc: ID token is issued in the future")
+	}
+	if nonce == "" || idToken.Nonce != nonce {
+		return nil, errors.New("oidc: ID token nonce does not match")
+	}
+	if idToken.Subject == "" {
+		return nil, errors.New("oidc: ID token has no subject")
+	}
+	return &claims, nil
+}
+
+// Ensure jwks conforms to the oidc.KeySet interface.
+var _ oidc.KeySet = &jwks{}
+
+// jwks is the JSON Web Key Set (RFC 7517) a provider signs ID tokens with.
+// The keys are fetched again when a token is signed with a key not in the
+// set, since providers rotate their keys, but no more than once every
+// minJWKSRefresh.
+type jwks struct {
+	client *http.Client
+	url    string
+
+	mu      sync.Mutex
+	keys    []jose.JSONWebKey
+	err     error     // of the last fetch
+	fetched time.Time // when the last fetch finished
+
+	// fetching is closed when the fetch in progress, if any, finishes.
+	fetching chan struct{}
+}
+
+// VerifySignature verifies the signature of a JWS and returns its payload.
+func (s *jwks) VerifySignature(ctx context.Context, raw string) ([]byte, error) {
+	jws, err := jose.ParseSigned(raw)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: malformed ID token: %v", err)
+	}
+	s.mu.Lock()
+	keys := s.keys
+	s.mu.Unlock()
+	if payload, ok := verifyJWS(jws, keys); ok {
+		return payload, nil
+	}
+
+	keys, err = s.refresh(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if payload, ok := verifyJWS(jws, keys); ok {
+		return payload, nil
+	}
+	return nil, errors.New("oidc: invalid ID token signature")
+}
+
+// verifyJWS verifies jws with the key it names, or with any of the keys if
+// it names none.
+func verifyJWS(jws *jose.JSONWebSignature, keys []jose.JSONWebKey) ([]byte, bool) {
+	kid := jws.Signatures[0].Header.KeyID
+	for i := range keys {
+		k := &keys[i]
+		if kid != "" && k.KeyID != kid || k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if payload, err := jws.Verify(k); err == nil {
+			return payload, true
+		}
+	}
+	return nil, false
+}
+
+// refresh fetches the keys again and returns them, unless they were fetched
+// less than minJWKSRefresh ago. Callers arriving during a fetch wait for it
+// rather than starting another. The lock is not held while fetching.
+func (s *jwks) refresh(ctx context.Context) ([]jose.JSONWebKey, error) {
+	s.mu.Lock()
+	if done := s.fetching; done != nil {
+		s.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.keys, s.err
+	}
+	if !s.fetched.IsZero() && time.Since(s.fetched) < minJWKSRefresh {
+		defer s.mu.Unlock()
+		return s.keys, s.err
+	}
+	done := make(chan struct{})
+	s.fetching = done
+	s.mu.Unlock()
+
+	var set jose.JSONWebKeySet
+	err := getOIDCJSON(ctx, s.client, s.url, &set)
+	if err != nil {
+		err = fmt.Errorf("oidc: could not fetch signing keys: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		s.keys = set.Keys
+	}
+	s.err = err
+	s.fetched = time.Now()
+	s.fetching = nil
+	close(done)
+	return s.keys, err
+}
+
+// getOIDCJSON fetches url and decodes the JSON response into v.
+func getOIDCJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
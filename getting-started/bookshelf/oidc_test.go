@@ -0,0 +1,174 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build go1.9
+
+package bookshelf
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf/internal/oidctest"
+)
+
+func newTestProvider(t *testing.T, f *oidctest.Issuer) *OIDCProvider {
+	p, err := NewOIDCProvider(context.Background(), http.DefaultClient, OIDCConfig{
+		Name:     "fake",
+		Issuer:   f.URL,
+		ClientID: "app",
+	}, "http://localhost/oauth2callback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	f := oidctest.NewIssuer(t)
+	defer f.Close()
+
+	p := newTestProvider(t, f)
+	if p.Config.Endpoint.TokenURL != f.URL+"/token" || p.IDPrefix != "fake:" {
+		t.Errorf("got provider %+v, want the discovered endpoints", p)
+	}
+	authURL := p.AuthCodeURL("state", "nonce")
+	if !strings.HasPrefix(authURL, f.URL+"/authorize?") || !strings.Contains(authURL, "nonce=nonce") ||
+		!strings.Contains(authURL, "scope=openid") {
+		t.Errorf("AuthCodeURL = %q, want the authorize endpoint with a nonce and the openid scope", authURL)
+	}
+
+	// The issuer in the configuration must be the one asked for.
+	_, err := NewOIDCProvider(context.Background(), http.DefaultClient, OIDCConfig{
+		Name:   "other",
+		Issuer: f.URL + "/other",
+	}, "")
+	if err == nil {
+		t.Error("discovering a provider at the wrong issuer: got nil error")
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	f := oidctest.NewIssuer(t)
+	defer f.Close()
+	p := newTestProvider(t, f)
+	key, kid := f.Key()
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := func(change func(map[string]interface{})) string {
+		c := f.Claims()
+		if change != nil {
+			change(c)
+		}
+		return f.Sign(t, c)
+	}
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", valid(nil), true},
+		{"several audiences", valid(func(c map[string]interface{}) {
+			c["aud"], c["azp"] = []string{"app", "other"}, "app"
+		}), true},
+		{"slightly expired", valid(func(c map[string]interface{}) {
+			c["exp"] = time.Now().Add(-oidcClockSkew / 2).Unix()
+		}), true},
+		{"expired", valid(func(c map[string]interface{}) {
+			c["exp"] = time.Now().Add(-2 * oidcClockSkew).Unix()
+		}), false},
+		{"issued in the future", valid(func(c map[string]interface{}) {
+			c["iat"] = time.Now().Add(time.Hour).Unix()
+		}), false},
+		{"other audience", valid(func(c map[string]interface{}) { c["aud"] = "other" }), false},
+		{"issued to another party", valid(func(c map[string]interface{}) {
+			c["aud"], c["azp"] = []string{"app", "other"}, "other"
+		}), false},
+		{"other issuer", valid(func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }), false},
+		{"wrong nonce", valid(func(c map[string]interface{}) { c["nonce"] = "replayed" }), false},
+		{"no subject", valid(func(c map[string]interface{}) { delete(c, "sub") }), false},
+		{"signed by another key", oidctest.Sign(t, otherKey, kid, "RS256", f.Claims()), false},
+		{"unknown key", oidctest.Sign(t, key, "other", "RS256", f.Claims()), false},
+		{"unsigned", strings.Join(strings.Split(oidctest.Sign(t, key, kid, "none", f.Claims()), ".")[:2], ".") + ".", false},
+		{"HMAC", oidctest.Sign(t, key, kid, "HS256", f.Claims()), false},
+		{"tampered", func() string {
+			parts := strings.Split(valid(nil), ".")
+			c := f.Claims()
+			c["sub"] = "admin"
+			b, _ := json.Marshal(c)
+			parts[1] = base64.RawURLEncoding.EncodeToString(b)
+			return strings.Join(parts, ".")
+		}(), false},
+		{"malformed", "not.a-token", false},
+	}
+	for _, tt := range tests {
+		claims, err := p.VerifyIDToken(context.Background(), tt.token, "nonce")
+		if tt.ok && (err != nil || claims.Subject != "1234") {
+			t.Errorf("%s: got %+v, %v; want subject 1234", tt.name, claims, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: got nil error", tt.name)
+		}
+	}
+	// Tokens signed with unknown keys don't make the app fetch the keys
+	// again every time.
+	if got := f.JWKSFetches(); got != 1 {
+		t.Errorf("got %d key fetches, want 1", got)
+	}
+}
+
+func TestOIDCExchange(t *testing.T) {
+	f := oidctest.NewIssuer(t)
+	defer f.Close()
+	p := newTestProvider(t, f)
+	ctx := context.Background()
+
+	f.SetIDToken(f.Sign(t, f.Claims()))
+	tok, claims, err := p.Exchange(ctx, "good-code", "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "access" || claims.Name != "Homer Simpson" || claims.Picture == "" {
+		t.Errorf("Exchange = %+v, %+v", tok, claims)
+	}
+	if _, _, err := p.Exchange(ctx, "good-code", "other nonce"); err == nil {
+		t.Error("Exchange with the wrong nonce: got nil error")
+	}
+	if _, _, err := p.Exchange(ctx, "bad-code", "nonce"); err == nil {
+		t.Error("Exchange with a bad code: got nil error")
+	}
+
+	// Keys are cached until the provider signs with a new one, and then
+	// fetched again once minJWKSRefresh has passed.
+	f.RotateKey(t)
+	f.SetIDToken(f.Sign(t, f.Claims()))
+	if _, _, err := p.Exchange(ctx, "good-code", "nonce"); err == nil {
+		t.Error("Exchange right after key rotation: got nil error")
+	}
+	p.keys.mu.Lock()
+	p.keys.fetched = p.keys.fetched.Add(-minJWKSRefresh)
+	p.keys.mu.Unlock()
+	if _, _, err := p.Exchange(ctx, "good-code", "nonce"); err != nil {
+		t.Fatalf("Exchange after key rotation: %v", err)
+	}
+	if got := f.JWKSFetches(); got != 2 {
+		t.Errorf("got %d key fetches, want 2", got)
+	}
+
+	f.SetIDToken("")
+	if _, _, err := p.Exchange(ctx, "good-code", "nonce"); err == nil {
+		t.Error("Exchange without an ID token: got nil error")
+	}
+}
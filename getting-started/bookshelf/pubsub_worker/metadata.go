@@ -0,0 +1,155 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/context"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+)
+
+// Metadata describes a book, as found by a MetadataProvider.
+type Metadata struct {
+	Title         string
+	Author        string
+	PublishedDate string
+	Description   string
+	ImageURL      string
+
+	// Confidence is how likely the metadata is to describe the book that was
+	// looked up, from 0 (unrelated) to 1 (certain, e.g. matched by ISBN).
+	Confidence float64
+}
+
+// MetadataProvider looks up the details of books.
+type MetadataProvider interface {
+	// Name identifies the provider in logs.
+	Name() string
+
+	// Lookup returns the metadata best matching b, or nil if there is no
+	// match.
+	Lookup(ctx context.Context, b *bookshelf.Book) (*Metadata, error)
+}
+
+const (
+	// minConfidence is the confidence needed for metadata to fill in the
+	// empty fields of a book.
+	minConfidence = 0.5
+
+	// overwriteConfidence is the confidence needed for metadata to replace
+	// the title, author and published date the user entered.
+	overwriteConfidence = 0.85
+)
+
+// lookup asks each provider for metadata about b, and returns the most
+// confident match. Providers that fail are skipped; an error is returned only
+// if all of them fail.
+func lookup(ctx context.Context, providers []MetadataProvider, b *bookshelf.Book) (*Metadata, error) {
+	var (
+		best    *Metadata
+		lastErr error
+		failed  int
+	)
+	for _, p := range providers {
+		md, err := p.Lookup(ctx, b)
+		if err != nil {
+			log.Printf("[ID %d] %s lookup failed: %v", b.ID, p.Name(), err)
+			lastErr = err
+			failed++
+			continue
+		}
+		if md == nil {
+			continue
+		}
+		log.Printf("[ID %d] %s found %q with confidence %.2f.", b.ID, p.Name(), md.Title, md.Confidence)
+		if best == nil || md.Confidence > best.Confidence {
+			best = md
+		}
+		if best.Confidence >= 1 {
+			break
+		}
+	}
+	if failed > 0 && failed == len(providers) {
+		return nil, lastErr
+	}
+	return best, nil
+}
+
+// applyMetadata updates b with md, and reports whether b changed.
+//
+// Empty fields of b are filled in if md is at least minConfidence. The title,
+// author and published date are only replaced if md is at least
+// overwriteConfidence, so that a doubtful match doesn't undo what the user
+// entered.
+func applyMetadata(b *bookshelf.Book, md *Metadata) bool {
+	if md == nil || md.Confidence < minConfidence {
+		return false
+	}
+	overwrite := md.Confidence >= overwriteConfidence
+
+	changed := false
+	set := func(field *string, value string, replace bool) {
+		if value == "" || *field == value || (*field != "" && !replace) {
+			return
+		}
+		*field = value
+		changed = true
+	}
+	set(&b.Title, md.Title, overwrite)
+	set(&b.Author, md.Author, overwrite)
+	set(&b.PublishedDate, md.PublishedDate, overwrite)
+	set(&b.Description, md.Description, false)
+	// Replace http with https to prevent Content Security errors on the page.
+	set(&b.ImageURL, strings.Replace(md.ImageURL, "http://", "https://", 1), false)
+	return changed
+}
+
+// matchConfidence scores how well a found title and authors match a book.
+// The title counts for most of the score; the author counts only if the book
+// has one.
+func matchConfidence(b *bookshelf.Book, title string, authors []string) float64 {
+	t := similarity(b.Title, title)
+	if b.Author == "" {
+		return t
+	}
+	a := similarity(b.Author, strings.Join(authors, " "))
+	return 0.75*t + 0.25*a
+}
+
+// similarity compares the words of what the user entered with those of a
+// candidate, from 0 (no words in common) to 1 (the same words). Missing words
+// count more than extra words, since providers' titles often include a
+// subtitle the user left out.
+func similarity(entered, candidate string) float64 {
+	want, got := wordSet(entered), wordSet(candidate)
+	if len(want) == 0 || len(got) == 0 {
+		return 0
+	}
+	common := 0
+	for w := range want {
+		if got[w] {
+			common++
+		}
+	}
+	recall := float64(common) / float64(len(want))
+	precision := float64(common) / float64(len(got))
+	return recall * (0.5 + 0.5*precision)
+}
+
+// wordSet returns the set of lowercase words in s.
+func wordSet(s string) map[string]bool {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	set := make(map[string]bool, len(words))
+	for _, w := range words {
+		set[w] = true
+	}
+	return set
+}
@@ -0,0 +1,310 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	books "google.golang.org/api/books/v1"
+
+	"golang.org/x/net/context"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+)
+
+// fakeProvider serves canned responses for the Google Books and Open Library
+// APIs, recording the queries it receives.
+type fakeProvider struct {
+	*httptest.Server
+	queries []string
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	f := &fakeProvider{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/books/v1/volumes", func(w http.ResponseWriter, r *http.Request) {
+		f.queries = append(f.queries, r.FormValue("q"))
+		writeJSON(t, w, map[string]interface{}{
+			"items": []interface{}{
+				map[string]interface{}{"volumeInfo": map[string]interface{}{
+					"title":   "Moby Dick Coloring Book",
+					"authors": []string{"Someone Else"},
+				}},
+				map[string]interface{}{"volumeInfo": map[string]interface{}{
+					"title":         "Moby-Dick",
+					"authors":       []string{"Herman Melville"},
+					"publishedDate": "1851",
+					"description":   "A whale of a tale.",
+					"imageLinks":    map[string]string{"thumbnail": "http://books.example.com/moby.jpg"},
+					"industryIdentifiers": []interface{}{
+						map[string]string{"type": "ISBN_13", "identifier": "9780142437247"},
+					},
+				}},
+			},
+		})
+	})
+	mux.HandleFunc("/search.json", func(w http.ResponseWriter, r *http.Request) {
+		f.queries = append(f.queries, r.FormValue("title")+"|"+r.FormValue("author"))
+		writeJSON(t, w, map[string]interface{}{
+			"docs": []interface{}{
+				map[string]interface{}{
+					"title":              "Emma",
+					"author_name":        []string{"Jane Austen"},
+					"first_publish_year": 1815,
+					"cover_i":            42,
+				},
+			},
+		})
+	})
+	mux.HandleFunc("/api/books", func(w http.ResponseWriter, r *http.Request) {
+		f.queries = append(f.queries, r.FormValue("bibkeys"))
+		if r.FormValue("bibkeys") != "ISBN:9780142437247" {
+			writeJSON(t, w, map[string]interface{}{})
+			return
+		}
+		writeJSON(t, w, map[string]interface{}{
+			"ISBN:9780142437247": map[string]interface{}{
+				"title":        "Moby Dick, or, The Whale",
+				"publish_date": "2003",
+				"authors":      []interface{}{map[string]string{"name": "Herman Melville"}},
+				"cover":        map[string]string{"medium": "https://covers.example.com/moby-M.jpg"},
+			},
+		})
+	})
+	mux.HandleFunc("/broken/", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	})
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+func writeJSON(t *testing.T, w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBooksAPIProvider(t *testing.T) {
+	f := newFakeProvider(t)
+	defer f.Close()
+
+	service, err := books.New(http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.BasePath = f.URL + "/books/v1/"
+	p := &booksAPIProvider{service: service}
+
+	md, err := p.Lookup(context.Background(), &bookshelf.Book{Title: "moby dick", Author: "melville"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md == nil || md.Title != "Moby-Dick" || md.Author != "Herman Melville" || md.PublishedDate != "1851" {
+		t.Fatalf("Lookup = %+v, want Moby-Dick by Herman Melville", md)
+	}
+	if md.Confidence < overwriteConfidence || md.Confidence >= 1 {
+		t.Errorf("Confidence = %.2f, want in [%.2f, 1)", md.Confidence, overwriteConfidence)
+	}
+
+	// Books mentioning an ISBN are searched for by ISBN, and matched with
+	// certainty.
+	md, err = p.Lookup(context.Background(), &bookshelf.Book{Title: "978-0-14-243724-7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md == nil || md.Confidence != 1 {
+		t.Errorf("Lookup by ISBN = %+v, want confidence 1", md)
+	}
+	if got, want := f.queries[len(f.queries)-1], "isbn:9780142437247"; got != want {
+		t.Errorf("query = %q, want %q", got, want)
+	}
+}
+
+func TestOpenLibraryProvider(t *testing.T) {
+	f := newFakeProvider(t)
+	defer f.Close()
+
+	p := &openLibraryProvider{client: http.DefaultClient, baseURL: f.URL, coversURL: "https://covers.example.com"}
+	md, err := p.Lookup(context.Background(), &bookshelf.Book{Title: "Emma", Author: "Austen"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Metadata{
+		Title:         "Emma",
+		Author:        "Jane Austen",
+		PublishedDate: "1815",
+		ImageURL:      "https://covers.example.com/b/id/42-M.jpg",
+	}
+	if md == nil {
+		t.Fatal("Lookup = nil, want a match")
+	}
+	got := *md
+	got.Confidence = 0
+	if got != want {
+		t.Errorf("Lookup = %+v, want %+v", got, want)
+	}
+	if got, want := f.queries[0], "Emma|Austen"; got != want {
+		t.Errorf("query = %q, want %q", got, want)
+	}
+
+	p.baseURL = f.URL + "/broken"
+	if _, err := p.Lookup(context.Background(), &bookshelf.Book{Title: "Emma"}); err == nil {
+		t.Error("Lookup with failing server: got nil error")
+	}
+}
+
+func TestISBNProvider(t *testing.T) {
+	f := newFakeProvider(t)
+	defer f.Close()
+	p := &isbnProvider{client: http.DefaultClient, baseURL: f.URL}
+
+	md, err := p.Lookup(context.Background(), &bookshelf.Book{
+		Title:       "my whale book",
+		Description: "ISBN 978-0-14-243724-7, paperback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md == nil || md.Title != "Moby Dick, or, The Whale" || md.Confidence != 1 {
+		t.Errorf("Lookup = %+v, want Moby Dick with confidence 1", md)
+	}
+
+	// Unknown ISBNs, and books without one, have no match.
+	for _, b := range []*bookshelf.Book{{Title: "0-306-40615-2"}, {Title: "Emma"}} {
+		if md, err := p.Lookup(context.Background(), b); md != nil || err != nil {
+			t.Errorf("Lookup(%q) = %+v, %v; want nil, nil", b.Title, md, err)
+		}
+	}
+	if len(f.queries) != 2 {
+		t.Errorf("got %d queries, want 2 (none for a book without an ISBN)", len(f.queries))
+	}
+}
+
+func TestNormalizeISBN(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"978-0-14-243724-7", "9780142437247"},
+		{"978 0 14 243724 8", ""},
+		{"0-306-40615-2", "0306406152"},
+		{"0-8044-2957-x", "080442957X"},
+		{"0-8044-2957-1", ""},
+		{"12345", ""},
+		{"X-306-40615-2", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeISBN(tt.in); got != tt.want {
+			t.Errorf("normalizeISBN(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// stubProvider returns fixed metadata or an error.
+type stubProvider struct {
+	md  *Metadata
+	err error
+}
+
+func (p *stubProvider) Name() string { return "stub" }
+
+func (p *stubProvider) Lookup(ctx context.Context, b *bookshelf.Book) (*Metadata, error) {
+	return p.md, p.err
+}
+
+func TestLookupPicksMostConfident(t *testing.T) {
+	ctx := context.Background()
+	b := &bookshelf.Book{Title: "t"}
+	failing := &stubProvider{err: errors.New("down")}
+	low := &stubProvider{md: &Metadata{Title: "low", Confidence: 0.3}}
+	high := &stubProvider{md: &Metadata{Title: "high", Confidence: 0.9}}
+
+	md, err := lookup(ctx, []MetadataProvider{failing, low, high, &stubProvider{}}, b)
+	if err != nil || md == nil || md.Title != "high" {
+		t.Errorf("lookup = %+v, %v; want high", md, err)
+	}
+	if _, err := lookup(ctx, []MetadataProvider{failing, failing}, b); err == nil {
+		t.Error("lookup with all providers failing: got nil error")
+	}
+	if md, err := lookup(ctx, []MetadataProvider{&stubProvider{}}, b); md != nil || err != nil {
+		t.Errorf("lookup with no matches = %+v, %v; want nil, nil", md, err)
+	}
+}
+
+func TestApplyMetadata(t *testing.T) {
+	entered := bookshelf.Book{Title: "moby dick", Author: "melville"}
+	md := Metadata{
+		Title:         "Moby-Dick",
+		Author:        "Herman Melville",
+		PublishedDate: "1851",
+		Description:   "A whale.",
+		ImageURL:      "http://example.com/moby.jpg",
+	}
+
+	tests := []struct {
+		confidence float64
+		want       bookshelf.Book
+	}{
+		{0.2, entered},
+		{0.6, bookshelf.Book{Title: "moby dick", Author: "melville", PublishedDate: "1851",
+			Description: "A whale.", ImageURL: "https://example.com/moby.jpg"}},
+		{0.9, bookshelf.Book{Title: "Moby-Dick", Author: "Herman Melville", PublishedDate: "1851",
+			Description: "A whale.", ImageURL: "https://example.com/moby.jpg"}},
+	}
+	for _, tt := range tests {
+		b := entered
+		md.Confidence = tt.confidence
+		changed := applyMetadata(&b, &md)
+		if b != tt.want {
+			t.Errorf("confidence %.1f: got %+v, want %+v", tt.confidence, b, tt.want)
+		}
+		if want := b != entered; changed != want {
+			t.Errorf("confidence %.1f: changed = %v, want %v", tt.confidence, changed, want)
+		}
+	}
+}
+
+func TestMatchConfidence(t *testing.T) {
+	b := &bookshelf.Book{Title: "Moby Dick", Author: "Melville"}
+	exact := matchConfidence(b, "Moby Dick", []string{"Herman Melville"})
+	subtitle := matchConfidence(b, "Moby Dick; or, The Whale", []string{"Herman Melville"})
+	wrong := matchConfidence(b, "Dick Tracy", []string{"Chester Gould"})
+	if !(exact > subtitle && subtitle > wrong) {
+		t.Errorf("got exact %.2f, subtitle %.2f, wrong %.2f; want decreasing", exact, subtitle, wrong)
+	}
+	if wrong >= minConfidence {
+		t.Errorf("wrong match confidence %.2f, want below %.2f", wrong, minConfidence)
+	}
+}
+
+func TestUpdateOnce(t *testing.T) {
+	defer func(p []MetadataProvider) { providers = p }(providers)
+	providers = []MetadataProvider{&stubProvider{md: &Metadata{
+		Title:       "Moby-Dick",
+		Description: "A whale.",
+		Confidence:  0.7,
+	}}}
+
+	id, err := bookshelf.DB.AddBook(&bookshelf.Book{Title: "moby dick"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bookshelf.DB.DeleteBook(id)
+
+	if err := update(id); err != nil {
+		t.Fatal(err)
+	}
+	got, err := bookshelf.DB.GetBook(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "moby dick" || got.Description != "A whale." || got.Version != 2 {
+		t.Errorf("after update, got %+v; want the title kept, the description filled in, version 2", got)
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	books "google.golang.org/api/books/v1"
+
+	"golang.org/x/net/context"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+)
+
+// maxCandidates is the number of search results providers consider.
+const maxCandidates = 5
+
+// booksAPIProvider looks up books with the Google Books API.
+type booksAPIProvider struct {
+	service *books.Service
+}
+
+// Ensure booksAPIProvider conforms to the MetadataProvider interface.
+var _ MetadataProvider = &booksAPIProvider{}
+
+func (p *booksAPIProvider) Name() string { return "Google Books" }
+
+// Lookup searches for volumes by ISBN if the book mentions one, or else by
+// title, and returns the best match.
+func (p *booksAPIProvider) Lookup(ctx context.Context, b *bookshelf.Book) (*Metadata, error) {
+	isbn := findISBN(b)
+	query := b.Title
+	if isbn != "" {
+		query = "isbn:" + isbn
+	}
+	vols, err := p.service.Volumes.List(query).MaxResults(maxCandidates).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+
+	var best *Metadata
+	for _, v := range vols.Items {
+		info := v.VolumeInfo
+		if info == nil {
+			continue
+		}
+		md := &Metadata{
+			Title:         info.Title,
+			Author:        strings.Join(info.Authors, ", "),
+			PublishedDate: info.PublishedDate,
+			Description:   info.Description,
+			Confidence:    matchConfidence(b, info.Title, info.Authors),
+		}
+		if info.ImageLinks != nil {
+			md.ImageURL = info.ImageLinks.Thumbnail
+		}
+		for _, id := range info.IndustryIdentifiers {
+			if isbn != "" && normalizeISBN(id.Identifier) == isbn {
+				md.Confidence = 1
+			}
+		}
+		if best == nil || md.Confidence > best.Confidence {
+			best = md
+		}
+	}
+	return best, nil
+}
+
+// openLibraryProvider looks up books with a search API in the style of Open
+// Library's: https://openlibrary.org/dev/docs/api/search
+type openLibraryProvider struct {
+	client *http.Client
+
+	// baseURL is the root of the API, e.g. "https://openlibrary.org".
+	baseURL string
+
+	// coversURL is the root of the cover image service, e.g.
+	// "https://covers.openlibrary.org".
+	coversURL string
+}
+
+// Ensure openLibraryProvider conforms to the MetadataProvider interface.
+var _ MetadataProvider = &openLibraryProvider{}
+
+func (p *openLibraryProvider) Name() string { return "Open Library" }
+
+// openLibrarySearch is the response of the search API.
+type openLibrarySearch struct {
+	Docs []struct {
+		Title            string   `json:"title"`
+		AuthorName       []string `json:"author_name"`
+		FirstPublishYear int      `json:"first_publish_year"`
+		CoverID          int64    `json:"cover_i"`
+	} `json:"docs"`
+}
+
+// Lookup searches by title, and author if the book has one, and returns the
+// best match.
+func (p *openLibraryProvider) Lookup(ctx context.Context, b *bookshelf.Book) (*Metadata, error) {
+	q := url.Values{
+		"title": {b.Title},
+		"limit": {strconv.Itoa(maxCandidates)},
+	}
+	if b.Author != "" {
+		q.Set("author", b.Author)
+	}
+	var resp openLibrarySearch
+	if err := getJSON(ctx, p.client, p.baseURL+"/search.json?"+q.Encode(), &resp); err != nil {
+		return nil, err
+	}
+
+	var best *Metadata
+	for _, doc := range resp.Docs {
+		md := &Metadata{
+			Title:      doc.Title,
+			Author:     strings.Join(doc.AuthorName, ", "),
+			Confidence: matchConfidence(b, doc.Title, doc.AuthorName),
+		}
+		if doc.FirstPublishYear != 0 {
+			md.PublishedDate = strconv.Itoa(doc.FirstPublishYear)
+		}
+		if doc.CoverID != 0 {
+			md.ImageURL = fmt.Sprintf("%s/b/id/%d-M.jpg", p.coversURL, doc.CoverID)
+		}
+		if best == nil || md.Confidence > best.Confidence {
+			best = md
+		}
+	}
+	return best, nil
+}
+
+// isbnProvider looks up books that mention an ISBN in their title or
+// description, with a books API in the style of Open Library's:
+// https://openlibrary.org/dev/docs/api/books
+//
+// Matches by ISBN are certain, so they replace whatever the user entered.
+type isbnProvider struct {
+	client *http.Client
+
+	// baseURL is the root of the API, e.g. "https://openlibrary.org".
+	baseURL string
+}
+
+// Ensure isbnProvider conforms to the MetadataProvider interface.
+var _ MetadataProvider = &isbnProvider{}
+
+func (p *isbnProvider) Name() string { return "ISBN" }
+
+// isbnBook is an entry in the response of the books API.
+type isbnBook struct {
+	Title       string `json:"title"`
+	PublishDate string `json:"publish_date"`
+	Authors     []struct {
+		Name string `json:"name"`
+	} `json:"authors"`
+	Cover struct {
+		Medium string `json:"medium"`
+	} `json:"cover"`
+}
+
+// Lookup returns the book with the ISBN mentioned by b, or nil if b mentions
+// no ISBN or the ISBN is unknown.
+func (p *isbnProvider) Lookup(ctx context.Context, b *bookshelf.Book) (*Metadata, error) {
+	isbn := findISBN(b)
+	if isbn == "" {
+		return nil, nil
+	}
+	key := "ISBN:" + isbn
+	q := url.Values{
+		"bibkeys": {key},
+		"format":  {"json"},
+		"jscmd":   {"data"},
+	}
+	var resp map[string]isbnBook
+	if err := getJSON(ctx, p.client, p.baseURL+"/api/books?"+q.Encode(), &resp); err != nil {
+		return nil, err
+	}
+	found, ok := resp[key]
+	if !ok {
+		return nil, nil
+	}
+
+	var authors []string
+	for _, a := range found.Authors {
+		authors = append(authors, a.Name)
+	}
+	return &Metadata{
+		Title:         found.Title,
+		Author:        strings.Join(authors, ", "),
+		PublishedDate: found.PublishDate,
+		ImageURL:      found.Cover.Medium,
+		Confidence:    1,
+	}, nil
+}
+
+// getJSON fetches rawurl and decodes the JSON response into v.
+func getJSON(ctx context.Context, client *http.Client, rawurl string, v interface{}) error {
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", rawurl, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("GET %s: could not decode response: %v", rawurl, err)
+	}
+	return nil
+}
+
+// isbnCandidate matches runs of digits, hyphens and spaces that may be an
+// ISBN-10 or ISBN-13.
+var isbnCandidate = regexp.MustCompile(`\b[0-9][0-9 -]{8,15}[0-9Xx]\b`)
+
+// findISBN returns the first valid ISBN in the title or description of b,
+// without separators, or "" if there is none.
+func findISBN(b *bookshelf.Book) string {
+	for _, text := range []string{b.Title, b.Description} {
+		for _, c := range isbnCandidate.FindAllString(text, -1) {
+			if isbn := normalizeISBN(c); isbn != "" {
+				return isbn
+			}
+		}
+	}
+	return ""
+}
+
+// normalizeISBN removes hyphens and spaces from s and returns it if it is a
+// valid ISBN-10 or ISBN-13, or "" otherwise.
+func normalizeISBN(s string) string {
+	s = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(s))
+	switch len(s) {
+	case 10:
+		sum := 0
+		for i, r := range s {
+			d := int(r - '0')
+			if r == 'X' && i == 9 {
+				d = 10
+			} else if r < '0' || r > '9' {
+				return ""
+			}
+			sum += (10 - i) * d
+		}
+		if sum%11 == 0 {
+			return s
+		}
+	case 13:
+		sum := 0
+		for i, r := range s {
+			if r < '0' || r > '9' {
+				return ""
+			}
+			d := int(r - '0')
+			if i%2 == 1 {
+				d *= 3
+			}
+			sum += d
+		}
+		if sum%10 == 0 {
+			return s
+		}
+	}
+	return ""
+}
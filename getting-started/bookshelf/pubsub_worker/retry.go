@@ -0,0 +1,126 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// maxRecentFailures is the number of failures kept for the status page.
+const maxRecentFailures = 50
+
+// failure records a failed attempt to process a message.
+type failure struct {
+	Time      time.Time
+	MessageID string
+	BookID    int64
+	Attempt   int
+	Err       string
+
+	// DeadLettered is set if the message was given up on and sent to the
+	// dead-letter topic.
+	DeadLettered bool
+}
+
+// retryTracker counts the attempts made to process each message, and decides
+// how long to wait before retrying and when to give up.
+//
+// Pub/Sub redelivers a message with the same ID after it is nacked, so
+// attempts are counted by message ID. The counts are kept in memory, so they
+// start again if the worker restarts, or if another worker instance receives
+// the message.
+type retryTracker struct {
+	maxAttempts int
+	baseBackoff time.Duration // wait after the first failed attempt.
+	maxBackoff  time.Duration // longest wait between attempts.
+
+	mu       sync.Mutex
+	attempts map[string]int // maps from message ID to failed attempts.
+	recent   []failure      // most recent first.
+}
+
+func newRetryTracker(maxAttempts int, baseBackoff, maxBackoff time.Duration) *retryTracker {
+	return &retryTracker{
+		maxAttempts: maxAttempts,
+		baseBackoff: baseBackoff,
+		maxBackoff:  maxBackoff,
+		attempts:    make(map[string]int),
+	}
+}
+
+// fail records a failed attempt to process a message. It returns the number
+// of failed attempts so far, and whether the message should be given up on.
+func (t *retryTracker) fail(msgID string, bookID int64, err error) (attempt int, giveUp bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.attempts[msgID]++
+	attempt = t.attempts[msgID]
+	giveUp = attempt >= t.maxAttempts
+	t.record(failure{
+		Time:         time.Now(),
+		MessageID:    msgID,
+		BookID:       bookID,
+		Attempt:      attempt,
+		Err:          err.Error(),
+		DeadLettered: giveUp,
+	})
+	return attempt, giveUp
+}
+
+// giveUp records that a message is being dead-lettered without retrying,
+// because it can never be processed.
+func (t *retryTracker) giveUp(msgID string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.attempts[msgID]++
+	t.record(failure{
+		Time:         time.Now(),
+		MessageID:    msgID,
+		Attempt:      t.attempts[msgID],
+		Err:          err.Error(),
+		DeadLettered: true,
+	})
+}
+
+// record adds f to the recent failures. t.mu must be held.
+func (t *retryTracker) record(f failure) {
+	t.recent = append([]failure{f}, t.recent...)
+	if len(t.recent) > maxRecentFailures {
+		t.recent = t.recent[:maxRecentFailures]
+	}
+}
+
+// done forgets a message that was processed or dead-lettered.
+func (t *retryTracker) done(msgID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.attempts, msgID)
+}
+
+// backoff returns how long to wait before retrying a message that has failed
+// the given number of times. The wait doubles with each attempt, up to
+// maxBackoff.
+func (t *retryTracker) backoff(attempt int) time.Duration {
+	d := t.baseBackoff
+	for i := 1; i < attempt && d < t.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > t.maxBackoff {
+		d = t.maxBackoff
+	}
+	return d
+}
+
+// recentFailures returns the most recent failures, most recent first.
+func (t *retryTracker) recentFailures() []failure {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]failure(nil), t.recent...)
+}
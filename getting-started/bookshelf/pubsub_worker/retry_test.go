@@ -0,0 +1,157 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+
+	"golang.org/x/net/context"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	r := newRetryTracker(10, time.Second, 10*time.Second)
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, w := range want {
+		if got := r.backoff(i + 1); got != w {
+			t.Errorf("backoff(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+}
+
+func TestRetryTracker(t *testing.T) {
+	r := newRetryTracker(3, 0, 0)
+	errFailed := errors.New("failed")
+	for i := 1; i <= 3; i++ {
+		attempt, giveUp := r.fail("m1", 7, errFailed)
+		if attempt != i || giveUp != (i == 3) {
+			t.Errorf("fail #%d = %d, %v; want %d, %v", i, attempt, giveUp, i, i == 3)
+		}
+	}
+
+	// Other messages are counted separately, and counts restart once a
+	// message is done.
+	if attempt, _ := r.fail("m2", 8, errFailed); attempt != 1 {
+		t.Errorf("fail(m2) attempt = %d, want 1", attempt)
+	}
+	r.done("m1")
+	if attempt, _ := r.fail("m1", 7, errFailed); attempt != 1 {
+		t.Errorf("fail(m1) after done: attempt = %d, want 1", attempt)
+	}
+
+	recent := r.recentFailures()
+	if len(recent) != 5 || recent[0].MessageID != "m1" || recent[1].MessageID != "m2" || !recent[2].DeadLettered {
+		t.Errorf("recentFailures = %+v, want 5 failures, most recent first", recent)
+	}
+
+	for i := 0; i < maxRecentFailures; i++ {
+		r.fail("m3", 9, errFailed)
+	}
+	if n := len(r.recentFailures()); n != maxRecentFailures {
+		t.Errorf("got %d recent failures, want %d", n, maxRecentFailures)
+	}
+}
+
+// withTestRetries replaces the retry settings and dead-letter publisher for a
+// test, returning the messages dead-lettered.
+func withTestRetries(maxAttempts int, publishErr error) (dead *[]*pubsub.Message, restore func()) {
+	oldRetries, oldPublish, oldProviders := retries, publishDeadLetter, providers
+	dead = &[]*pubsub.Message{}
+	retries = newRetryTracker(maxAttempts, time.Millisecond, time.Millisecond)
+	publishDeadLetter = func(ctx context.Context, msg *pubsub.Message) error {
+		if publishErr != nil {
+			return publishErr
+		}
+		*dead = append(*dead, msg)
+		return nil
+	}
+	return dead, func() {
+		retries, publishDeadLetter, providers = oldRetries, oldPublish, oldProviders
+	}
+}
+
+func TestProcessMessageDeadLetters(t *testing.T) {
+	dead, restore := withTestRetries(3, nil)
+	defer restore()
+	providers = []MetadataProvider{&stubProvider{err: errors.New("provider down")}}
+
+	id, err := bookshelf.DB.AddBook(&bookshelf.Book{Title: "poison"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bookshelf.DB.DeleteBook(id)
+
+	ctx := context.Background()
+	msg := &pubsub.Message{
+		ID:         "m1",
+		Data:       []byte(strconv.FormatInt(id, 10)),
+		Attributes: map[string]string{"requestId": "r1"},
+	}
+	for i := 1; i < 3; i++ {
+		if processMessage(ctx, msg) {
+			t.Fatalf("attempt %d: got ack, want nack", i)
+		}
+	}
+	if !processMessage(ctx, msg) {
+		t.Fatal("last attempt: got nack, want ack after dead-lettering")
+	}
+
+	if len(*dead) != 1 {
+		t.Fatalf("got %d dead letters, want 1", len(*dead))
+	}
+	d := (*dead)[0]
+	if string(d.Data) != string(msg.Data) || d.Attributes["error"] != "provider down" ||
+		d.Attributes["originalMessageId"] != "m1" || d.Attributes["requestId"] != "r1" {
+		t.Errorf("dead letter = %+v, want the original data, reason and attributes", d)
+	}
+
+	rec := httptest.NewRecorder()
+	statusHandler(rec, httptest.NewRequest("GET", "/", nil))
+	body := rec.Body.String()
+	if !strings.Contains(body, "provider down") || !strings.Contains(body, "dead-lettered") {
+		t.Errorf("status page = %s, want it to list the failures", body)
+	}
+}
+
+func TestProcessMessageUndecodable(t *testing.T) {
+	dead, restore := withTestRetries(3, nil)
+	defer restore()
+
+	if !processMessage(context.Background(), &pubsub.Message{ID: "m1", Data: []byte("not json")}) {
+		t.Error("got nack, want ack after dead-lettering")
+	}
+	if len(*dead) != 1 || !strings.Contains((*dead)[0].Attributes["error"], "could not decode") {
+		t.Errorf("dead letters = %+v, want one with a decoding error", *dead)
+	}
+}
+
+func TestProcessMessageDeadLetterFails(t *testing.T) {
+	_, restore := withTestRetries(1, errors.New("publish failed"))
+	defer restore()
+
+	if processMessage(context.Background(), &pubsub.Message{ID: "m1", Data: []byte("not json")}) {
+		t.Error("got ack, want nack when the dead letter can't be published")
+	}
+}
+
+func TestProcessMessageDeletedBook(t *testing.T) {
+	dead, restore := withTestRetries(3, nil)
+	defer restore()
+
+	if !processMessage(context.Background(), &pubsub.Message{ID: "m1", Data: []byte("123456789")}) {
+		t.Error("got nack for a deleted book, want ack")
+	}
+	if len(*dead) != 0 {
+		t.Errorf("got %d dead letters for a deleted book, want 0", len(*dead))
+	}
+}
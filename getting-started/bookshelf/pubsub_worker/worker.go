@@ -9,11 +9,14 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"html/template"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	books "google.golang.org/api/books/v1"
 
@@ -26,25 +29,55 @@ import (
 
 const subName = "book-worker-sub"
 
+// deadLetterTopicID is the topic that messages are published to when they
+// can't be processed. Each message carries the reason in its "error"
+// attribute.
+const deadLetterTopicID = bookshelf.PubsubTopicID + "-dead-letter"
+
+// Retry settings. The maximum number of attempts can be set with the
+// MAX_ATTEMPTS environment variable.
+const (
+	defaultMaxAttempts = 5
+	baseRetryBackoff   = time.Second
+	maxRetryBackoff    = time.Minute
+)
+
 var (
 	countMu sync.Mutex
 	count   int
 
-	booksClient  *books.Service
+	// providers are asked for the details of each book, in order.
+	providers    []MetadataProvider
 	subscription *pubsub.Subscription
+
+	retries = newRetryTracker(defaultMaxAttempts, baseRetryBackoff, maxRetryBackoff)
+
+	// publishDeadLetter publishes a message to the dead-letter topic.
+	publishDeadLetter func(ctx context.Context, msg *pubsub.Message) error
 )
 
 func main() {
 	ctx := context.Background()
 
+	if bookshelf.SchemaErr != nil {
+		log.Fatal(bookshelf.SchemaErr)
+	}
 	if bookshelf.PubsubClient == nil {
-		log.Fatal("You must configure the Pub/Sub client in config.go before running pubsub_worker.")
+		log.Fatal("You must set BOOKSHELF_PUBSUB_PROJECT, and a database other than memory:, before running pubsub_worker.")
 	}
 
 	var err error
-	booksClient, err = books.New(http.DefaultClient)
+	providers, err = configureProviders()
 	if err != nil {
-		log.Fatalf("could not access Google Books API: %v", err)
+		log.Fatal(err)
+	}
+
+	if v := os.Getenv("MAX_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("Invalid MAX_ATTEMPTS %q: must be a positive number.", v)
+		}
+		retries.maxAttempts = n
 	}
 
 	// [START pubsub_create_topic]
@@ -73,16 +106,29 @@ func main() {
 	}
 	// [END pubsub_create_topic]
 
+	// Create the dead-letter topic if it does not yet exist.
+	deadLetterTopic := bookshelf.PubsubClient.Topic(deadLetterTopicID)
+	exists, err = deadLetterTopic.Exists(ctx)
+	if err != nil {
+		log.Fatalf("Error checking for dead-letter topic: %v", err)
+	}
+	if !exists {
+		if _, err := bookshelf.PubsubClient.CreateTopic(ctx, deadLetterTopicID); err != nil {
+			log.Fatalf("Failed to create dead-letter topic: %v", err)
+		}
+	}
+	publishDeadLetter = func(ctx context.Context, msg *pubsub.Message) error {
+		_, err := deadLetterTopic.Publish(ctx, msg).Get(ctx)
+		return err
+	}
+
 	// Start worker goroutine.
 	go subscribe()
 
 	// [START http]
-	// Publish a count of processed requests to the server homepage.
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		countMu.Lock()
-		defer countMu.Unlock()
-		fmt.Fprintf(w, "This worker has processed %d books.", count)
-	})
+	// Publish a count of processed requests and the recent failures to the
+	// server homepage.
+	http.HandleFunc("/", statusHandler)
 
 	port := "8080"
 	if p := os.Getenv("PORT"); p != "" {
@@ -92,63 +138,203 @@ func main() {
 	// [END http]
 }
 
+// configureProviders returns the metadata providers: the Google Books API,
+// and the ISBN and search APIs of Open Library, or of the server at
+// OPENLIBRARY_URL if set.
+func configureProviders() ([]MetadataProvider, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	booksService, err := books.New(client)
+	if err != nil {
+		return nil, fmt.Errorf("could not access Google Books API: %v", err)
+	}
+
+	openLibraryURL := "https://openlibrary.org"
+	if u := os.Getenv("OPENLIBRARY_URL"); u != "" {
+		openLibraryURL = strings.TrimSuffix(u, "/")
+	}
+
+	return []MetadataProvider{
+		&isbnProvider{client: client, baseURL: openLibraryURL},
+		&booksAPIProvider{service: booksService},
+		&openLibraryProvider{
+			client:    client,
+			baseURL:   openLibraryURL,
+			coversURL: "https://covers.openlibrary.org",
+		},
+	}, nil
+}
+
 func subscribe() {
 	ctx := context.Background()
 	err := subscription.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
-		var id int64
-		if err := json.Unmarshal(msg.Data, &id); err != nil {
-			log.Printf("could not decode message data: %#v", msg)
+		if processMessage(ctx, msg) {
 			msg.Ack()
-			return
+		} else {
+			msg.Nack()
 		}
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// processMessage updates the book identified by msg, and reports whether msg
+// should be acknowledged.
+//
+// Failed updates are retried with exponential backoff: processMessage waits
+// before returning false, so that the message is redelivered after the wait.
+// Messages that fail too many times, or can't be decoded, are published to
+// the dead-letter topic and acknowledged.
+func processMessage(ctx context.Context, msg *pubsub.Message) bool {
+	var id int64
+	if err := json.Unmarshal(msg.Data, &id); err != nil {
+		err = fmt.Errorf("could not decode message data %q: %v", msg.Data, err)
+		log.Printf("[message %s] %v", msg.ID, err)
+		retries.giveUp(msg.ID, err)
+		return deadLetter(ctx, msg, err)
+	}
 
+	// Messages published by the app carry the ID of the request that
+	// changed the book, to match the worker's logs with the app's.
+	if reqID := msg.Attributes[bookshelf.RequestIDAttribute]; reqID != "" {
+		log.Printf("[ID %d] Processing update from request %s.", id, reqID)
+	} else {
 		log.Printf("[ID %d] Processing.", id)
-		if err := update(id); err != nil {
-			log.Printf("[ID %d] could not update: %v", id, err)
-			msg.Nack()
-			return
+	}
+	err := update(id)
+	if err == bookshelf.ErrNotFound {
+		// The book was deleted since the message was published.
+		log.Printf("[ID %d] Book no longer exists, ACK", id)
+		retries.done(msg.ID)
+		return true
+	}
+	if err != nil {
+		attempt, giveUp := retries.fail(msg.ID, id, err)
+		log.Printf("[ID %d] could not update (attempt %d): %v", id, attempt, err)
+		if giveUp {
+			return deadLetter(ctx, msg, err)
 		}
+		select {
+		case <-time.After(retries.backoff(attempt)):
+		case <-ctx.Done():
+		}
+		return false
+	}
 
-		countMu.Lock()
-		count++
-		countMu.Unlock()
+	retries.done(msg.ID)
+	countMu.Lock()
+	count++
+	countMu.Unlock()
 
-		msg.Ack()
-		log.Printf("[ID %d] ACK", id)
-	})
+	log.Printf("[ID %d] ACK", id)
+	return true
+}
+
+// deadLetter publishes msg to the dead-letter topic with the reason it
+// failed, and reports whether it was published. Messages that could not be
+// published are retried.
+func deadLetter(ctx context.Context, msg *pubsub.Message, reason error) bool {
+	attrs := map[string]string{
+		"error":             reason.Error(),
+		"originalMessageId": msg.ID,
+	}
+	for k, v := range msg.Attributes {
+		if _, ok := attrs[k]; !ok {
+			attrs[k] = v
+		}
+	}
+	err := publishDeadLetter(ctx, &pubsub.Message{Data: msg.Data, Attributes: attrs})
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("[message %s] could not publish to dead-letter topic: %v", msg.ID, err)
+		return false
+	}
+	log.Printf("[message %s] Published to dead-letter topic %s.", msg.ID, deadLetterTopicID)
+	retries.done(msg.ID)
+	return true
+}
+
+// statusTmpl renders the worker's status page.
+var statusTmpl = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Bookshelf worker</title></head>
+<body>
+<p>This worker has processed {{.Count}} books.</p>
+<h3>Recent failures</h3>
+{{if .Failures}}
+<table border="1" cellpadding="4">
+<tr><th>Time</th><th>Message</th><th>Book</th><th>Attempt</th><th>Outcome</th><th>Error</th></tr>
+{{range .Failures}}
+<tr>
+<td>{{.Time.Format "2006-01-02 15:04:05"}}</td>
+<td>{{.MessageID}}</td>
+<td>{{if .BookID}}{{.BookID}}{{end}}</td>
+<td>{{.Attempt}}</td>
+<td>{{if .DeadLettered}}dead-lettered{{else}}retrying{{end}}</td>
+<td>{{.Err}}</td>
+</tr>
+{{end}}
+</table>
+{{else}}
+<p>None.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// statusHandler shows the number of books processed and the recent failures.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	countMu.Lock()
+	n := count
+	countMu.Unlock()
+
+	data := struct {
+		Count    int
+		Failures []failure
+	}{n, retries.recentFailures()}
+	if err := statusTmpl.Execute(w, data); err != nil {
+		log.Printf("could not render status page: %v", err)
 	}
 }
 
-// update retrieves the book with the given ID, finds metata from the Books
-// server and updates the database with the book's details.
+// maxUpdateAttempts is the number of times update tries to save a book that
+// is being modified by someone else at the same time.
+const maxUpdateAttempts = 5
+
+// update finds metadata for the book with the given ID and updates the
+// database with the book's details. If the book is changed while the metadata
+// is being looked up, the lookup is retried with the latest version of the
+// book, so that the change isn't overwritten.
 func update(bookID int64) error {
+	for attempt := 1; ; attempt++ {
+		err := updateOnce(bookID)
+		if err != bookshelf.ErrConflict || attempt == maxUpdateAttempts {
+			return err
+		}
+		log.Printf("[ID %d] modified concurrently, retrying (attempt %d).", bookID, attempt)
+		time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+	}
+}
+
+// updateOnce retrieves the book with the given ID, looks up its metadata and
+// updates the database with the book's details.
+func updateOnce(bookID int64) error {
 	book, err := bookshelf.DB.GetBook(bookID)
 	if err != nil {
 		return err
 	}
 
-	vols, err := booksClient.Volumes.List(book.Title).Do()
+	md, err := lookup(context.Background(), providers, book)
 	if err != nil {
 		return err
 	}
-
-	if len(vols.Items) == 0 {
+	if md == nil {
+		log.Printf("[ID %d] No metadata found.", bookID)
 		return nil
 	}
-
-	info := vols.Items[0].VolumeInfo
-	book.Title = info.Title
-	book.Author = strings.Join(info.Authors, ", ")
-	book.PublishedDate = info.PublishedDate
-	if book.Description == "" {
-		book.Description = info.Description
-	}
-	if book.ImageURL == "" && info.ImageLinks != nil {
-		url := info.ImageLinks.Thumbnail
-		// Replace http with https to prevent Content Security errors on the page.
-		book.ImageURL = strings.Replace(url, "http://", "https://", 1)
+	if !applyMetadata(book, md) {
+		log.Printf("[ID %d] Nothing to update (best match %q, confidence %.2f).", bookID, md.Title, md.Confidence)
+		return nil
 	}
 
 	return bookshelf.DB.UpdateBook(book)
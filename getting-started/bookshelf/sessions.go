@@ -0,0 +1,110 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// sessionKeyLength is the length of a session key: 32 bytes to sign session
+// cookies, followed by 32 bytes to encrypt them.
+const sessionKeyLength = 64
+
+// sessionMaxAge is how long sessions last, in seconds.
+const sessionMaxAge = 7 * 24 * 60 * 60 // 1 week
+
+// SessionConfig configures how sessions are stored.
+type SessionConfig struct {
+	// Keys are base64-encoded session keys, newest first. Sessions are
+	// saved with the first key, and can be read with any of them, so keys
+	// can be rotated by adding a new key at the front and removing the last
+	// one once the sessions it saved have expired.
+	//
+	// Each key is 64 random bytes, e.g. from:
+	//   head -c 64 /dev/urandom | base64 -w 0
+	//
+	// If there are no keys, a random key is used, so sessions don't survive
+	// restarts and aren't shared between instances.
+	Keys []string `json:"keys" yaml:"keys"`
+
+	// Secure restricts session cookies to HTTPS. It should be set whenever
+	// the app is served over HTTPS.
+	Secure bool `json:"secure" yaml:"secure"`
+
+	// Dir, if set, is a directory to store sessions in on the server, rather
+	// than in cookies. Only the session ID is then kept in cookies, and
+	// sessions can be larger.
+	Dir string `json:"dir" yaml:"dir"`
+}
+
+// configureSessions creates a session store. Session cookies are signed and
+// encrypted, inaccessible to scripts, and, from Go 1.11, not sent with
+// cross-site requests other than top-level navigations.
+func configureSessions(cfg SessionConfig) (sessions.Store, error) {
+	keyPairs, err := sessionKeyPairs(cfg.Keys)
+	if err != nil {
+		return nil, err
+	}
+	options := &sessions.Options{
+		Path:     "/",
+		MaxAge:   sessionMaxAge,
+		HttpOnly: true,
+		Secure:   cfg.Secure,
+	}
+	setSameSiteLax(options)
+
+	if cfg.Dir != "" {
+		if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+			return nil, fmt.Errorf("sessions: could not create directory: %v", err)
+		}
+		store := sessions.NewFilesystemStore(cfg.Dir, keyPairs...)
+		store.Options = options
+		store.MaxLength(0) // Sessions on disk may be of any size.
+		return store, nil
+	}
+
+	store := sessions.NewCookieStore(keyPairs...)
+	store.Options = options
+	return store, nil
+}
+
+// sessionKeyPairs decodes session keys into the authentication and
+// encryption key pairs used by gorilla/sessions.
+func sessionKeyPairs(keys []string) ([][]byte, error) {
+	if len(keys) == 0 {
+		log.Print("sessions: no session keys configured, using a random key")
+		return [][]byte{
+			securecookie.GenerateRandomKey(32),
+			securecookie.GenerateRandomKey(32),
+		}, nil
+	}
+	var pairs [][]byte
+	for i, k := range keys {
+		b, err := decodeSessionKey(k)
+		if err != nil {
+			return nil, fmt.Errorf("sessions: key %d %v", i+1, err)
+		}
+		pairs = append(pairs, b[:32], b[32:])
+	}
+	return pairs, nil
+}
+
+// decodeSessionKey decodes a base64-encoded session key.
+func decodeSessionKey(key string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("is not base64: %v", err)
+	}
+	if len(b) != sessionKeyLength {
+		return nil, fmt.Errorf("is %d bytes, want %d", len(b), sessionKeyLength)
+	}
+	return b, nil
+}
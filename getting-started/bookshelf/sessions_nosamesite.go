@@ -0,0 +1,13 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build !go1.11
+
+package bookshelf
+
+import "github.com/gorilla/sessions"
+
+// setSameSiteLax does nothing: the SameSite cookie attribute needs Go 1.11.
+// Forms are still protected by their CSRF tokens.
+func setSameSiteLax(options *sessions.Options) {}
@@ -0,0 +1,19 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build go1.11
+
+package bookshelf
+
+import (
+	"net/http"
+
+	"github.com/gorilla/sessions"
+)
+
+// setSameSiteLax keeps session cookies from being sent with cross-site
+// requests other than top-level navigations.
+func setSameSiteLax(options *sessions.Options) {
+	options.SameSite = http.SameSiteLaxMode
+}
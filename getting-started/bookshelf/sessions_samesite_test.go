@@ -0,0 +1,22 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build go1.11
+
+package bookshelf
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSessionCookieSameSite(t *testing.T) {
+	store, err := configureSessions(SessionConfig{Keys: []string{newSessionKey()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := saveSession(t, store, "homer"); c.SameSite != http.SameSiteLaxMode {
+		t.Errorf("got SameSite %v, want Lax", c.SameSite)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+func newSessionKey() string {
+	return base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(sessionKeyLength))
+}
+
+// saveSession saves a session holding value in store, and returns its cookie.
+func saveSession(t *testing.T, store sessions.Store, value string) *http.Cookie {
+	req := httptest.NewRequest("GET", "/", nil)
+	session, err := store.New(req, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Values["value"] = value
+	rec := httptest.NewRecorder()
+	if err := session.Save(req, rec); err != nil {
+		t.Fatal(err)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got %d cookies, want 1", len(cookies))
+	}
+	return cookies[0]
+}
+
+// loadSession returns the value held by the session in cookie.
+func loadSession(store sessions.Store, cookie *http.Cookie) (string, error) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	session, err := store.Get(req, "test")
+	if err != nil {
+		return "", err
+	}
+	value, _ := session.Values["value"].(string)
+	return value, nil
+}
+
+func TestSessionKeyRotation(t *testing.T) {
+	oldKey, newKey := newSessionKey(), newSessionKey()
+	oldStore, err := configureSessions(SessionConfig{Keys: []string{oldKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := saveSession(t, oldStore, "homer")
+
+	// Sessions saved with the old key can still be read once a new key is
+	// added in front of it, but not once it is removed.
+	rotated, err := configureSessions(SessionConfig{Keys: []string{newKey, oldKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := loadSession(rotated, cookie); err != nil || got != "homer" {
+		t.Errorf("after rotation: got %q, %v; want homer", got, err)
+	}
+	if _, err := loadSession(oldStore, saveSession(t, rotated, "marge")); err == nil {
+		t.Error("session saved after rotation could be read with the old key only")
+	}
+	removed, err := configureSessions(SessionConfig{Keys: []string{newKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadSession(removed, cookie); err == nil {
+		t.Error("session saved with a removed key: got nil error")
+	}
+}
+
+func TestSessionKeyErrors(t *testing.T) {
+	for _, keys := range [][]string{
+		{"not base64!"},
+		{base64.StdEncoding.EncodeToString([]byte("too short"))},
+		{newSessionKey(), "not base64!"},
+	} {
+		if _, err := configureSessions(SessionConfig{Keys: keys}); err == nil {
+			t.Errorf("configureSessions(%q): got nil error", keys)
+		}
+	}
+}
+
+func TestSessionCookieOptions(t *testing.T) {
+	for _, secure := range []bool{false, true} {
+		store, err := configureSessions(SessionConfig{Keys: []string{newSessionKey()}, Secure: secure})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := saveSession(t, store, "homer")
+		if !c.HttpOnly || c.Secure != secure || c.MaxAge != sessionMaxAge {
+			t.Errorf("Secure %v: got cookie %+v, want HttpOnly and a week long", secure, c)
+		}
+	}
+}
+
+func TestFilesystemSessions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := configureSessions(SessionConfig{Keys: []string{newSessionKey()}, Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.(*sessions.FilesystemStore); !ok {
+		t.Fatalf("got %T, want a FilesystemStore", store)
+	}
+	cookie := saveSession(t, store, "homer")
+	if got, err := loadSession(store, cookie); err != nil || got != "homer" {
+		t.Errorf("got %q, %v; want homer", got, err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil || len(files) != 1 {
+		t.Errorf("got %d session files, %v; want 1", len(files), err)
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config configures the bookshelf app and worker: which backends they use,
+// and how users sign in.
+//
+// It is read from an optional YAML or JSON file named by the BOOKSHELF_CONFIG
+// environment variable, then from the environment variables listed below,
+// which override the file. With no configuration at all, books and images are
+// kept in memory, and sign-in is disabled.
+type Config struct {
+	// Database is the URL of the book database, as accepted by
+	// OpenBookDatabase, e.g. "mysql://root@localhost". Defaults to
+	// "memory:". Set by BOOKSHELF_DATABASE.
+	Database string `json:"database" yaml:"database"`
+
+	Storage StorageConfig `json:"storage" yaml:"storage"`
+	Auth    AuthConfig    `json:"auth" yaml:"auth"`
+
+	// Sessions are set by SESSION_KEYS (space-separated), SESSION_SECURE
+	// and SESSION_DIR. Session cookies are secure by default on App Engine.
+	Sessions SessionConfig `json:"sessions" yaml:"sessions"`
+
+	// PubsubProject is the project ID of the Pub/Sub topic that added books
+	// are published to, for the worker to fill in their details. The worker
+	// is disabled if it is empty. Set by BOOKSHELF_PUBSUB_PROJECT.
+	PubsubProject string `json:"pubsubProject" yaml:"pubsubProject"`
+
+	// UndeleteWindow is how long deleted books can be undeleted for, as a
+	// duration such as "72h". Defaults to a week; "0" disables undeleting.
+	// Set by BOOKSHELF_UNDELETE_WINDOW.
+	UndeleteWindow string `json:"undeleteWindow" yaml:"undeleteWindow"`
+
+	// TraceProject is the project ID that OpenCensus trace spans of
+	// requests are exported to, in Stackdriver Trace. Tracing is disabled if
+	// it is empty. Set by BOOKSHELF_TRACE_PROJECT.
+	TraceProject string `json:"traceProject" yaml:"traceProject"`
+
+	// MetricsToken is the bearer token that Prometheus must send to scrape
+	// the app's /metrics. The metrics are public if it is empty. Set by
+	// BOOKSHELF_METRICS_TOKEN.
+	MetricsToken string `json:"metricsToken" yaml:"metricsToken"`
+}
+
+// StorageConfig configures where uploaded images are kept. Images are kept in
+// memory if neither field is set.
+type StorageConfig struct {
+	// Bucket is the Cloud Storage bucket to keep images in. Set by
+	// BOOKSHELF_BUCKET.
+	Bucket string `json:"bucket" yaml:"bucket"`
+
+	// Dir is a local directory to keep images in, served by the app. Set by
+	// BOOKSHELF_BLOB_DIR.
+	Dir string `json:"dir" yaml:"dir"`
+}
+
+// AuthConfig configures user sign-in. Sign-in is disabled if there are no
+// providers.
+type AuthConfig struct {
+	// Providers are the OpenID Connect providers users can sign in with.
+	//
+	// A single provider can be set by OAUTH2_CLIENT_ID, OAUTH2_CLIENT_SECRET,
+	// OAUTH2_ISSUER (defaults to Google) and OAUTH2_PROVIDER (its name,
+	// defaults to "google"), replacing those in the file.
+	Providers []OIDCConfig `json:"providers" yaml:"providers"`
+
+	// RedirectURL is the URL of the app's /oauth2callback handler. Defaults
+	// to "http://localhost:8080/oauth2callback". Set by OAUTH2_CALLBACK.
+	RedirectURL string `json:"redirectURL" yaml:"redirectURL"`
+
+	// Admins and Editors list the user IDs of admins, who may edit and
+	// delete any book, and editors, who may edit any book. Set by
+	// BOOKSHELF_ADMINS and BOOKSHELF_EDITORS, separated by spaces.
+	Admins  []string `json:"admins" yaml:"admins"`
+	Editors []string `json:"editors" yaml:"editors"`
+}
+
+const (
+	defaultDatabase    = "memory:"
+	defaultRedirectURL = "http://localhost:8080/oauth2callback"
+	defaultUndelete    = "168h" // 1 week
+)
+
+// LoadConfig reads the configuration from the named file, if any, and from
+// the environment. Files ending in ".json" are read as JSON, and others as
+// YAML. Unknown fields are errors, to catch typos.
+//
+// The configuration isn't validated: see Config.Validate.
+func LoadConfig(path string) (*Config, error) {
+	return loadConfig(path, os.Getenv)
+}
+
+func loadConfig(path string, getenv func(string) string) (*Config, error) {
+	c := &Config{}
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("bookshelf: could not read config file: %v", err)
+		}
+		if strings.ToLower(filepath.Ext(path)) == ".json" {
+			err = UnmarshalStrictJSON(b, c)
+		} else {
+			err = yaml.UnmarshalStrict(b, c)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bookshelf: invalid config file %s: %v", path, err)
+		}
+	}
+
+	if err := c.loadEnv(getenv); err != nil {
+		return nil, err
+	}
+	if c.Database == "" {
+		c.Database = defaultDatabase
+	}
+	if c.Auth.RedirectURL == "" {
+		c.Auth.RedirectURL = defaultRedirectURL
+	}
+	if c.UndeleteWindow == "" {
+		c.UndeleteWindow = defaultUndelete
+	}
+	return c, nil
+}
+
+// loadEnv overrides c with the environment variables that are set.
+func (c *Config) loadEnv(getenv func(string) string) error {
+	setString := func(dst *string, name string) {
+		if v := getenv(name); v != "" {
+			*dst = v
+		}
+	}
+	setList := func(dst *[]string, name string) {
+		if v := getenv(name); v != "" {
+			*dst = strings.Fields(v)
+		}
+	}
+
+	setString(&c.Database, "BOOKSHELF_DATABASE")
+	setString(&c.Storage.Bucket, "BOOKSHELF_BUCKET")
+	setString(&c.Storage.Dir, "BOOKSHELF_BLOB_DIR")
+	setString(&c.PubsubProject, "BOOKSHELF_PUBSUB_PROJECT")
+	setString(&c.UndeleteWindow, "BOOKSHELF_UNDELETE_WINDOW")
+	setString(&c.TraceProject, "BOOKSHELF_TRACE_PROJECT")
+	setString(&c.MetricsToken, "BOOKSHELF_METRICS_TOKEN")
+
+	if id := getenv("OAUTH2_CLIENT_ID"); id != "" {
+		p := OIDCConfig{
+			Name:         "google",
+			Issuer:       googleIssuer,
+			ClientID:     id,
+			ClientSecret: getenv("OAUTH2_CLIENT_SECRET"),
+		}
+		setString(&p.Name, "OAUTH2_PROVIDER")
+		setString(&p.Issuer, "OAUTH2_ISSUER")
+		c.Auth.Providers = []OIDCConfig{p}
+	}
+	setString(&c.Auth.RedirectURL, "OAUTH2_CALLBACK")
+	setList(&c.Auth.Admins, "BOOKSHELF_ADMINS")
+	setList(&c.Auth.Editors, "BOOKSHELF_EDITORS")
+
+	setList(&c.Sessions.Keys, "SESSION_KEYS")
+	setString(&c.Sessions.Dir, "SESSION_DIR")
+	if getenv("GAE_INSTANCE") != "" {
+		// Running in production, which is served over HTTPS.
+		c.Sessions.Secure = true
+	}
+	if v := getenv("SESSION_SECURE"); v != "" {
+		secure, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("bookshelf: SESSION_SECURE is %q, want true or false", v)
+		}
+		c.Sessions.Secure = secure
+	}
+	return nil
+}
+
+// Validate checks the configuration without connecting to any backend, and
+// reports all the problems found.
+func (c *Config) Validate() error {
+	var problems []string
+	addf := func(format string, v ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, v...))
+	}
+
+	if err := checkDatabaseURL(c.Database); err != nil {
+		addf("database: %s", strings.TrimPrefix(err.Error(), "bookshelf: "))
+	}
+	if c.Storage.Bucket != "" && c.Storage.Dir != "" {
+		addf("storage: set either a bucket or a directory, not both")
+	}
+
+	names := make(map[string]bool)
+	for i, p := range c.Auth.Providers {
+		if p.Name == "" {
+			addf("auth: provider %d has no name", i+1)
+		} else if names[p.Name] {
+			addf("auth: provider name %q is used more than once", p.Name)
+		}
+		names[p.Name] = true
+		if u, err := url.Parse(p.Issuer); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			addf("auth: provider %q has invalid issuer URL %q", p.Name, p.Issuer)
+		}
+		if p.ClientID == "" {
+			addf("auth: provider %q has no client ID", p.Name)
+		}
+	}
+	if len(c.Auth.Providers) > 0 {
+		if u, err := url.Parse(c.Auth.RedirectURL); err != nil || !u.IsAbs() || u.Host == "" {
+			addf("auth: invalid redirect URL %q", c.Auth.RedirectURL)
+		}
+	} else if len(c.Auth.Admins) > 0 || len(c.Auth.Editors) > 0 {
+		addf("auth: admins and editors are listed, but no sign-in provider is configured")
+	}
+
+	for i, k := range c.Sessions.Keys {
+		if _, err := decodeSessionKey(k); err != nil {
+			addf("sessions: key %d %v", i+1, err)
+		}
+	}
+
+	if c.PubsubProject != "" && strings.HasPrefix(c.Database, "memory:") {
+		addf("pubsubProject: the worker doesn't share the memory of the app, " +
+			"so it needs another database")
+	}
+
+	if d, err := time.ParseDuration(c.UndeleteWindow); err != nil || d < 0 {
+		addf("undeleteWindow: %q is not a duration such as 72h", c.UndeleteWindow)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("bookshelf: invalid configuration:\n\t%s", strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// env returns a getenv function for the given variables.
+func env(vars map[string]string) func(string) string {
+	return func(name string) string { return vars[name] }
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	c, err := loadConfig("", env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Config{Database: "memory:", Auth: AuthConfig{RedirectURL: defaultRedirectURL}, UndeleteWindow: "168h"}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("got %+v, want %+v", c, want)
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("default configuration: %v", err)
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The placeholders in the example are commented out, so it can be used
+	// as it is.
+	want := &Config{
+		Database: "mysql://root@localhost:3306",
+		Auth: AuthConfig{
+			RedirectURL: "http://localhost:8080/oauth2callback",
+			Editors:     []string{},
+		},
+		Sessions:       SessionConfig{Keys: []string{}},
+		UndeleteWindow: "72h",
+	}
+
+	jsonFile := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(jsonFile, []byte(`{
+		"database": "mysql://root@localhost:3306",
+		"auth": {
+			"redirectURL": "http://localhost:8080/oauth2callback",
+			"editors": []
+		},
+		"sessions": {"keys": [], "secure": false},
+		"undeleteWindow": "72h"
+	}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"config.example.yaml", jsonFile} {
+		c, err := loadConfig(path, env(nil))
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		if !reflect.DeepEqual(c, want) {
+			t.Errorf("%s: got %+v, want %+v", path, c, want)
+		}
+		if err := c.Validate(); err != nil {
+			t.Errorf("%s: %v", path, err)
+		}
+	}
+
+	// Typos are caught, in nested objects too.
+	for name, content := range map[string]string{
+		"typo.yaml":   "databse: memory:\n",
+		"typo.json":   `{"databse": "memory:"}`,
+		"nested.json": `{"auth": {"providers": [{"name": "google", "clientId": "client", "secret": "s"}]}}`,
+	} {
+		typo := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(typo, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadConfig(typo, env(nil)); err == nil {
+			t.Errorf("%s: config file with an unknown field: got nil error", name)
+		}
+	}
+	if _, err := loadConfig(filepath.Join(dir, "missing.yaml"), env(nil)); err == nil {
+		t.Error("missing config file: got nil error")
+	}
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	c, err := loadConfig("config.example.yaml", env(map[string]string{
+		"BOOKSHELF_DATABASE":       "datastore://project",
+		"BOOKSHELF_BUCKET":         "bucket",
+		"BOOKSHELF_PUBSUB_PROJECT": "project",
+		"BOOKSHELF_TRACE_PROJECT":  "trace-project",
+		"BOOKSHELF_METRICS_TOKEN":  "token",
+		"OAUTH2_CLIENT_ID":         "client",
+		"OAUTH2_CLIENT_SECRET":     "secret",
+		"OAUTH2_CALLBACK":          "https://example.com/oauth2callback",
+		"BOOKSHELF_ADMINS":         "a1 a2",
+		"SESSION_KEYS":             "k1  k2",
+		"GAE_INSTANCE":             "instance",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Config{
+		Database: "datastore://project",
+		Storage:  StorageConfig{Bucket: "bucket"},
+		Auth: AuthConfig{
+			Providers:   []OIDCConfig{{Name: "google", Issuer: googleIssuer, ClientID: "client", ClientSecret: "secret"}},
+			RedirectURL: "https://example.com/oauth2callback",
+			Admins:      []string{"a1", "a2"},
+			Editors:     []string{},
+		},
+		Sessions:       SessionConfig{Keys: []string{"k1", "k2"}, Secure: true},
+		PubsubProject:  "project",
+		UndeleteWindow: "72h",
+		TraceProject:   "trace-project",
+		MetricsToken:   "token",
+	}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("got %+v, want %+v", c, want)
+	}
+
+	if _, err := loadConfig("", env(map[string]string{"SESSION_SECURE": "yes please"})); err == nil {
+		t.Error("invalid SESSION_SECURE: got nil error")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	provider := OIDCConfig{Name: "google", Issuer: googleIssuer, ClientID: "client"}
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		errs   []string
+	}{
+		{"valid", func(c *Config) {
+			c.Database = "postgres://user@localhost/books"
+			c.Storage.Dir = "blobs"
+			c.Auth.Providers = []OIDCConfig{provider}
+			c.Auth.Editors = []string{"editor"}
+			c.Sessions.Keys = []string{newSessionKey()}
+			c.PubsubProject = "project"
+		}, nil},
+		{"database", func(c *Config) { c.Database = "sqlite://books.db" }, []string{"database: unknown database type"}},
+		{"database port", func(c *Config) { c.Database = "mysql://root@localhost:port" }, []string{"database: invalid database URL"}},
+		{"storage", func(c *Config) {
+			c.Storage = StorageConfig{Bucket: "bucket", Dir: "blobs"}
+		}, []string{"storage: set either"}},
+		{"providers", func(c *Config) {
+			c.Auth.Providers = []OIDCConfig{provider, provider, {Issuer: "accounts.google.com"}}
+			c.Auth.RedirectURL = "/oauth2callback"
+		}, []string{
+			`auth: provider name "google" is used more than once`,
+			"auth: provider 3 has no name",
+			`auth: provider "" has invalid issuer URL`,
+			`auth: provider "" has no client ID`,
+			"auth: invalid redirect URL",
+		}},
+		{"admins without sign-in", func(c *Config) { c.Auth.Admins = []string{"admin"} }, []string{"no sign-in provider"}},
+		{"session keys", func(c *Config) {
+			c.Sessions.Keys = []string{newSessionKey(), "short"}
+		}, []string{"sessions: key 2 is"}},
+		{"pubsub with memory", func(c *Config) { c.PubsubProject = "project" }, []string{"pubsubProject:"}},
+		{"undelete window", func(c *Config) { c.UndeleteWindow = "a week" }, []string{"undeleteWindow:"}},
+	}
+	for _, tt := range tests {
+		c, err := loadConfig("", env(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tt.change(c)
+		err = c.Validate()
+		if len(tt.errs) == 0 {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: got nil error", tt.name)
+			continue
+		}
+		for _, want := range tt.errs {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: error %q doesn't mention %q", tt.name, err, want)
+			}
+		}
+		if n := strings.Count(err.Error(), "\n\t"); n != len(tt.errs) {
+			t.Errorf("%s: got %d problems, want %d: %v", tt.name, n, len(tt.errs), err)
+		}
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	oldDB, oldAudit, oldStorage, oldSessions, oldIndex := DB, Audit, Storage, SessionStore, SearchIndex
+	defer func() {
+		DB, Audit, Storage, SessionStore, SearchIndex = oldDB, oldAudit, oldStorage, oldSessions, oldIndex
+	}()
+
+	dir, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := loadConfig("", env(map[string]string{"BOOKSHELF_BLOB_DIR": dir}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Configure(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := Storage.(*localBlobStore); !ok {
+		t.Errorf("Storage is %T, want *localBlobStore", Storage)
+	}
+	if _, ok := Audit.BookDatabase.(*indexedDB); !ok || DB != Audit || SearchIndex == nil || SessionStore == nil || len(OIDCProviders) != 0 {
+		t.Errorf("got DB %T, index %v, sessions %v, providers %v", DB, SearchIndex, SessionStore, OIDCProviders)
+	}
+
+	c.Storage.Bucket = "bucket"
+	if err := Configure(c); err == nil || !strings.Contains(err.Error(), "storage:") {
+		t.Errorf("Configure with an invalid configuration: got %v, want a storage error", err)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// UnmarshalStrictJSON is like json.Unmarshal, but object keys that match no
+// field of v are errors, to catch typos. It works like
+// json.Decoder.DisallowUnknownFields, which needs Go 1.10.
+func UnmarshalStrictJSON(data []byte, v interface{}) error {
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	return checkJSONFields(raw, reflect.TypeOf(v), "")
+}
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// checkJSONFields returns an error if an object in raw, a decoded JSON
+// value, has a key that matches no field of the struct it is decoded into.
+// t is the type raw is decoded into, and path is where raw is in the
+// outermost value, for errors.
+func checkJSONFields(raw interface{}, t reflect.Type, path string) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	// Types that decode themselves may accept any keys.
+	if reflect.PtrTo(t).Implements(jsonUnmarshalerType) {
+		return nil
+	}
+
+	switch raw := raw.(type) {
+	case map[string]interface{}:
+		switch t.Kind() {
+		case reflect.Map:
+			for key, v := range raw {
+				if err := checkJSONFields(v, t.Elem(), path+key+"."); err != nil {
+					return err
+				}
+			}
+		case reflect.Struct:
+			for key, v := range raw {
+				f, ok := jsonField(t, key)
+				if !ok {
+					return fmt.Errorf("json: unknown field %q", path+key)
+				}
+				if err := checkJSONFields(v, f.Type, path+key+"."); err != nil {
+					return err
+				}
+			}
+		}
+	case []interface{}:
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			for i, v := range raw {
+				if err := checkJSONFields(v, t.Elem(), fmt.Sprintf("%s%d.", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// jsonField returns the field of struct type t that encoding/json decodes
+// key into, looking into embedded structs. Like encoding/json, it prefers
+// an exact match of the name, but accepts any case.
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	var fold reflect.StructField
+	folded := false
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := tag
+		if comma := strings.Index(tag, ","); comma >= 0 {
+			name = tag[:comma]
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			if ef, ok := jsonField(ft, key); ok {
+				return ef, true
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if name == key {
+			return f, true
+		}
+		if !folded && strings.EqualFold(name, key) {
+			fold, folded = f, true
+		}
+	}
+	return fold, folded
+}
@@ -0,0 +1,63 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnmarshalStrictJSON(t *testing.T) {
+	type inner struct {
+		Name string `json:"name"`
+	}
+	type embedded struct {
+		Extra string `json:"extra"`
+	}
+	type outer struct {
+		embedded
+		ID      int64            `json:"id,omitempty"`
+		Title   string           // matched by the field name
+		Skipped string           `json:"-"`
+		Inner   *inner           `json:"inner"`
+		List    []inner          `json:"list"`
+		Map     map[string]inner `json:"map"`
+		Time    time.Time        `json:"time"`
+		Any     interface{}      `json:"any"`
+	}
+	tests := []struct {
+		data    string
+		unknown string // the unknown field, if any
+	}{
+		{`{"id": 1, "title": "t", "extra": "e", "inner": {"name": "n"}, "list": [{"name": "n"}],
+		  "map": {"k": {"name": "n"}}, "time": "2018-01-02T03:04:05Z", "any": {"x": 1}}`, ""},
+		{`{"ID": 1, "TITLE": "t"}`, ""},
+		{`{"inner": null, "list": null}`, ""},
+		{`{"titel": "t"}`, `"titel"`},
+		{`{"Skipped": "s"}`, `"Skipped"`},
+		{`{"inner": {"nmae": "n"}}`, `"inner.nmae"`},
+		{`{"list": [{"name": "n"}, {"nmae": "n"}]}`, `"list.1.nmae"`},
+		{`{"map": {"k": {"nmae": "n"}}}`, `"map.k.nmae"`},
+	}
+	for _, tt := range tests {
+		var v outer
+		err := UnmarshalStrictJSON([]byte(tt.data), &v)
+		if tt.unknown == "" && err != nil {
+			t.Errorf("%s: %v", tt.data, err)
+		}
+		if tt.unknown != "" && (err == nil || !strings.Contains(err.Error(), "unknown field "+tt.unknown)) {
+			t.Errorf("%s: got error %v, want unknown field %s", tt.data, err, tt.unknown)
+		}
+	}
+
+	var v outer
+	if err := UnmarshalStrictJSON([]byte(`{"id": "one"}`), &v); err == nil {
+		t.Error("invalid JSON value: got nil error")
+	}
+	if err := UnmarshalStrictJSON([]byte(`{"id": 1} {"id": 2}`), &v); err == nil {
+		t.Error("two JSON values: got nil error")
+	}
+}
@@ -5,7 +5,13 @@
 package testutil
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -14,23 +20,32 @@ import (
 	"time"
 )
 
+// DefaultTimeout is the default of Cmd.Timeout.
+const DefaultTimeout = 2 * time.Minute
+
 // BuildMain builds the main package in the current working directory.
 // If it doesn't build, t.Fatal is called.
 // Test methods calling BuildMain should run Runner.Cleanup.
 func BuildMain(t *testing.T) *Runner {
-	wd, err := os.Getwd()
+	return buildMain(t, ".")
+}
+
+// buildMain builds the main package in dir.
+func buildMain(t *testing.T, dir string) *Runner {
+	abs, err := filepath.Abs(dir)
 	if err != nil {
 		t.Fatal(err)
 	}
-	tmp, err := ioutil.TempDir("", "runmain-"+filepath.Base(wd)+"-")
+	tmp, err := ioutil.TempDir("", "runmain-"+filepath.Base(abs)+"-")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	r := &Runner{t: t, tmp: tmp}
+	r := &Runner{t: t, tmp: tmp, name: filepath.Base(abs)}
 
 	bin := filepath.Join(tmp, "a.out")
 	cmd := exec.Command("go", "build", "-o", bin)
+	cmd.Dir = abs
 	if out, err := cmd.CombinedOutput(); err != nil {
 		t.Errorf("go build: %v\n%s", err, out)
 		return r
@@ -42,9 +57,61 @@ func BuildMain(t *testing.T) *Runner {
 
 // Runner holds the result of `go build`
 type Runner struct {
-	t   *testing.T
-	tmp string
-	bin string
+	t    testing.TB
+	tmp  string
+	bin  string
+	name string // the name of the directory of the main package.
+}
+
+// Cmd describes a run of the built binary.
+type Cmd struct {
+	Args  []string          // the command-line arguments, not including the command.
+	Env   map[string]string // added to the environment of the test.
+	Stdin io.Reader         // if nil, the standard input is empty.
+
+	// Timeout limits the run of Exec, or the wait for the server of Serve
+	// to be ready. It defaults to DefaultTimeout.
+	Timeout time.Duration
+
+	// ReadyPath, if set, is polled by Serve with GET requests until it
+	// responds with a 2xx status. Otherwise, Serve waits for the server to
+	// accept connections.
+	ReadyPath string
+}
+
+func (c *Cmd) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return DefaultTimeout
+	}
+	return c.Timeout
+}
+
+// Result is the outcome of a run of the built binary.
+type Result struct {
+	Stdout, Stderr bytes.Buffer
+
+	// ExitCode is the exit status of the process, or -1 if it was
+	// killed by a signal or didn't start.
+	ExitCode int
+
+	// Err is the error starting or waiting for the process, such as an
+	// *exec.ExitError if it didn't exit successfully.
+	Err error
+
+	// TimedOut reports whether the run took longer than its timeout.
+	TimedOut bool
+
+	process *os.Process
+}
+
+// Success reports whether the process exited with status 0.
+func (res *Result) Success() bool {
+	return res.Err == nil && res.ExitCode == 0
+}
+
+// String describes the result, with the output of the process.
+func (res *Result) String() string {
+	return fmt.Sprintf("exit status %d\nstdout:\n%s\nstderr:\n%s", res.ExitCode, res.Stdout.Bytes(), res.Stderr.Bytes())
 }
 
 // Built reports whether the build was successful.
@@ -61,44 +128,206 @@ func (r *Runner) Cleanup() {
 
 // Run runs the built binary with the given environment.
 // After f returns, the running process is shut down.
-func (r *Runner) Run(env map[string]string, f func()) {
+func (r *Runner) Run(env map[string]string, f func()) *Result {
+	res, done := r.start(Cmd{Env: env})
+	if done == nil {
+		return res
+	}
+
+	// Run the user's tests.
+	f()
+
+	r.stop(res, done)
+	return res
+}
+
+// Exec runs the built binary until it exits, and returns its output and exit
+// status. The process is killed after the timeout of c.
+func (r *Runner) Exec(c Cmd) *Result {
+	res, done := r.start(c)
+	if done == nil {
+		return res
+	}
+	select {
+	case <-done:
+	case <-time.After(c.timeout()):
+		res.TimedOut = true
+		r.t.Errorf("%s timed out after %v, killing it.", r.describe(c), c.timeout())
+		r.kill(res, done)
+	}
+	return res
+}
+
+// Serve runs the built binary as a server, listening on a free port given by
+// the PORT environment variable. Once the server is ready, it calls f with
+// the address of the server, such as "localhost:51234". After f returns, the
+// server is shut down. If the server isn't ready in time, or exits before,
+// Serve reports an error, and doesn't call f.
+func (r *Runner) Serve(c Cmd, f func(addr string)) *Result {
+	port, err := freePort()
+	if err != nil {
+		r.t.Error(err)
+		return &Result{ExitCode: -1, Err: err}
+	}
+	env := map[string]string{"PORT": port}
+	for k, v := range c.Env {
+		env[k] = v
+	}
+	c.Env = env
+	addr := net.JoinHostPort("localhost", port)
+
+	res, done := r.start(c)
+	if done == nil {
+		return res
+	}
+
+	if err := r.waitReady(c, addr, done); err != nil {
+		if err == errExited {
+			r.t.Errorf("%s exited before it was ready:\n%v", r.describe(c), res)
+			return res
+		}
+		res.TimedOut = true
+		r.kill(res, done)
+		r.t.Errorf("%s wasn't ready after %v: %v\n%v", r.describe(c), c.timeout(), err, res)
+		return res
+	}
+
+	// Run the user's tests.
+	f(addr)
+
+	r.stop(res, done)
+	return res
+}
+
+// start starts the built binary. It returns a channel closed once the
+// process exits and res is complete, or nil if the process didn't start.
+func (r *Runner) start(c Cmd) (res *Result, done chan struct{}) {
+	res = &Result{ExitCode: -1}
 	if !r.Built() {
 		r.t.Error("Tried to run when binary not built.")
-		return
+		return res, nil
 	}
 	environ := os.Environ()
-	for k, v := range env {
+	for k, v := range c.Env {
 		environ = append(environ, k+"="+v)
 	}
 
-	cmd := exec.Command(r.bin)
+	cmd := exec.Command(r.bin, c.Args...)
 	cmd.Env = environ
+	cmd.Stdin = c.Stdin
+	cmd.Stdout = &res.Stdout
+	cmd.Stderr = &res.Stderr
 
 	if err := cmd.Start(); err != nil {
 		r.t.Error(err)
-		return
+		res.Err = err
+		return res, nil
 	}
 
-	// Run the user's tests.
-	f()
-
-	done := make(chan struct{})
+	done = make(chan struct{})
 	go func() {
-		cmd.Wait()
+		res.Err = cmd.Wait()
+		if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Exited() {
+			res.ExitCode = status.ExitStatus()
+		}
 		close(done)
 	}()
+	res.process = cmd.Process
+	return res, done
+}
 
+// stop shuts down a running process.
+func (r *Runner) stop(res *Result, done chan struct{}) {
 	// Try to gracefully kill the process.
-	if err := cmd.Process.Signal(syscall.SIGINT); err != nil {
+	if err := res.process.Signal(syscall.SIGINT); err != nil {
+		if exited(done) {
+			return
+		}
 		r.t.Error(err)
 	}
 
 	select {
 	case <-time.After(5 * time.Second):
 		r.t.Error("Timed out with SIGINT, trying SIGKILL.")
-		if err := cmd.Process.Kill(); err != nil {
-			r.t.Error(err)
-		}
+		r.kill(res, done)
+	case <-done:
+	}
+}
+
+// kill kills a running process, and waits for it to exit.
+func (r *Runner) kill(res *Result, done chan struct{}) {
+	if err := res.process.Kill(); err != nil && !exited(done) {
+		r.t.Error(err)
+	}
+	<-done
+}
+
+// exited reports whether done is closed.
+func exited(done chan struct{}) bool {
+	select {
 	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *Runner) describe(c Cmd) string {
+	return fmt.Sprintf("%q", append([]string{r.name}, c.Args...))
+}
+
+// errExited is returned by waitReady if the process exits.
+var errExited = errors.New("process exited")
+
+// waitReady waits for the server at addr to be ready.
+func (r *Runner) waitReady(c Cmd, addr string, done chan struct{}) error {
+	const retryDelay = 100 * time.Millisecond
+	deadline := time.Now().Add(c.timeout())
+	client := &http.Client{Timeout: 5 * time.Second}
+	var err error
+	for {
+		if exited(done) {
+			return errExited
+		}
+		if err = ready(client, addr, c.ReadyPath); err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(retryDelay)
+	}
+}
+
+// ready returns nil if the server at addr accepts connections, or, if path
+// isn't empty, responds to a GET request for path with a 2xx status.
+func ready(client *http.Client, addr, path string) error {
+	if path == "" {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	resp, err := client.Get("http://" + addr + path)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return nil
+}
+
+// freePort returns a TCP port that is free on localhost.
+func freePort() (string, error) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return "", err
 	}
+	defer l.Close()
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	return port, err
 }
@@ -0,0 +1,89 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package testutil
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExec(t *testing.T) {
+	m := buildMain(t, "testdata/runnertest")
+	defer m.Cleanup()
+	if !m.Built() {
+		t.Fatal("runnertest didn't build")
+	}
+
+	res := m.Exec(Cmd{Args: []string{"echo", "a", "b c"}, Env: map[string]string{"GREETING": "hello"}})
+	if !res.Success() || res.Stdout.String() != "a b c\n" || res.Stderr.String() != "hello\n" {
+		t.Errorf("echo: got %v; want success, printing the arguments and greeting", res)
+	}
+
+	res = m.Exec(Cmd{Args: []string{"cat"}, Stdin: strings.NewReader("some input")})
+	if !res.Success() || res.Stdout.String() != "some input" {
+		t.Errorf("cat: got %v; want the input", res)
+	}
+
+	res = m.Exec(Cmd{Args: []string{"fail"}})
+	if res.Success() || res.ExitCode != 3 || res.Err == nil || res.Stderr.String() != "failing\n" {
+		t.Errorf("fail: got %v, error %v; want exit status 3", res, res.Err)
+	}
+}
+
+func TestExecTimeout(t *testing.T) {
+	m := buildMain(t, "testdata/runnertest")
+	defer m.Cleanup()
+
+	// Exec reports the timeout as an error of the test, so record the errors
+	// of the test instead.
+	ft := &recordingTB{TB: t}
+	res := (&Runner{t: ft, bin: m.bin, name: m.name}).Exec(Cmd{Args: []string{"sleep"}, Timeout: 200 * time.Millisecond})
+	if !res.TimedOut || res.ExitCode != -1 || len(ft.errors) != 1 {
+		t.Errorf("sleep: got %v, timed out %v, errors %q; want it timed out and killed, failing the test", res, res.TimedOut, ft.errors)
+	}
+}
+
+// recordingTB records the errors of a test, rather than failing it.
+type recordingTB struct {
+	testing.TB
+	errors []string
+}
+
+func (t *recordingTB) Error(args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprint(args...))
+}
+
+func (t *recordingTB) Errorf(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func TestServe(t *testing.T) {
+	m := buildMain(t, "testdata/runnertest")
+	defer m.Cleanup()
+
+	var body string
+	res := m.Serve(Cmd{Args: []string{"serve"}, ReadyPath: "/ready", Timeout: 10 * time.Second}, func(addr string) {
+		resp, err := http.Get("http://" + addr + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body = string(b)
+	})
+	if body != "Hello from runnertest\n" {
+		t.Errorf("got %q from the server, want its greeting", body)
+	}
+	if !strings.HasPrefix(res.Stdout.String(), "Listening on port ") {
+		t.Errorf("the server printed %q, want the port it listened on", res.Stdout.String())
+	}
+}
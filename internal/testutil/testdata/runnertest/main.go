@@ -0,0 +1,54 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Command runnertest is run by the tests of Runner.
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: runnertest echo|cat|fail|sleep|serve [args]")
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	case "echo":
+		fmt.Println(strings.Join(os.Args[2:], " "))
+		fmt.Fprintln(os.Stderr, os.Getenv("GREETING"))
+	case "cat":
+		io.Copy(os.Stdout, os.Stdin)
+	case "fail":
+		fmt.Fprintln(os.Stderr, "failing")
+		os.Exit(3)
+	case "sleep":
+		time.Sleep(time.Minute)
+	case "serve":
+		start := time.Now()
+		http.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+			if time.Since(start) < 300*time.Millisecond {
+				http.Error(w, "starting", http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprintln(w, "ok")
+		})
+		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, "Hello from runnertest")
+		})
+		fmt.Println("Listening on port", os.Getenv("PORT"))
+		if err := http.ListenAndServe(":"+os.Getenv("PORT"), nil); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "unknown command", os.Args[1])
+		os.Exit(2)
+	}
+}
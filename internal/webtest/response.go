@@ -0,0 +1,199 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package webtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+// Response is a response whose body was read, to check with its assertion
+// methods. A failed assertion reports an error with t.Errorf, and the methods
+// return the response, so that assertions can be chained:
+//
+//	w.Check(w.Get("/")).Status(http.StatusOK).HasHTML("form#login")
+type Response struct {
+	*http.Response
+	t    *testing.T
+	Body []byte
+}
+
+// Check reads and closes the body of a response returned by one of the
+// request methods, such as Get. It calls t.Fatal if the request failed.
+func (w *W) Check(resp *http.Response, err error) *Response {
+	if err != nil {
+		w.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		w.t.Fatalf("reading the response of %s %s: %v", resp.Request.Method, resp.Request.URL, err)
+	}
+	return &Response{Response: resp, t: w.t, Body: b}
+}
+
+// Text returns the body as a string.
+func (r *Response) Text() string {
+	return string(r.Body)
+}
+
+// errorf reports an error about the response's request.
+func (r *Response) errorf(format string, args ...interface{}) {
+	r.t.Errorf("%s %s: %s", r.Request.Method, r.Request.URL, fmt.Sprintf(format, args...))
+}
+
+// Status checks the status code.
+func (r *Response) Status(code int) *Response {
+	if r.StatusCode != code {
+		r.errorf("got status %d, want %d", r.StatusCode, code)
+	}
+	return r
+}
+
+// HasHeader checks the value of a header.
+func (r *Response) HasHeader(key, want string) *Response {
+	if got := r.Header.Get(key); got != want {
+		r.errorf("header %s = %q, want %q", key, got, want)
+	}
+	return r
+}
+
+// BodyContains checks that the body contains s.
+func (r *Response) BodyContains(s string) *Response {
+	if !bytes.Contains(r.Body, []byte(s)) {
+		r.errorf("body doesn't contain %q:\n%s", s, r.Body)
+	}
+	return r
+}
+
+// BodyMatches checks that the body matches a regular expression.
+func (r *Response) BodyMatches(pattern string) *Response {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		r.t.Fatalf("webtest: invalid pattern %q: %v", pattern, err)
+	}
+	if !re.Match(r.Body) {
+		r.errorf("body doesn't match %q:\n%s", pattern, r.Body)
+	}
+	return r
+}
+
+// JSONPath checks the value at a path in a JSON body. The path is a list of
+// object keys and array indexes separated by dots, such as "books.0.title";
+// the empty path is the whole body. The value is compared with want as JSON,
+// so that numbers of any type, structs and maps can be compared.
+func (r *Response) JSONPath(path string, want interface{}) *Response {
+	var body interface{}
+	if err := json.Unmarshal(r.Body, &body); err != nil {
+		r.errorf("invalid JSON body: %v\n%s", err, r.Body)
+		return r
+	}
+	got, err := lookupJSON(body, path)
+	if err != nil {
+		r.errorf("%v", err)
+		return r
+	}
+	b, err := json.Marshal(want)
+	if err != nil {
+		r.t.Fatalf("webtest: encoding %v: %v", want, err)
+	}
+	var wantJSON interface{}
+	if err := json.Unmarshal(b, &wantJSON); err != nil {
+		r.t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, wantJSON) {
+		r.errorf("JSON at %q = %s, want %s", path, mustMarshal(got), b)
+	}
+	return r
+}
+
+// lookupJSON returns the value at path in v, a decoded JSON value.
+func lookupJSON(v interface{}, path string) (interface{}, error) {
+	if path == "" {
+		return v, nil
+	}
+	for i, key := range strings.Split(path, ".") {
+		switch x := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = x[key]; !ok {
+				return nil, fmt.Errorf("JSON has no %q", strings.Join(strings.Split(path, ".")[:i+1], "."))
+			}
+		case []interface{}:
+			n, err := strconv.Atoi(key)
+			if err != nil || n < 0 || n >= len(x) {
+				return nil, fmt.Errorf("JSON has no %q: not an index of an array of %d", strings.Join(strings.Split(path, ".")[:i+1], "."), len(x))
+			}
+			v = x[n]
+		default:
+			return nil, fmt.Errorf("JSON has no %q: %s is not an object or array", path, mustMarshal(v))
+		}
+	}
+	return v, nil
+}
+
+func mustMarshal(v interface{}) []byte {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// HTML returns the parsed body. It calls t.Fatal if the body is not HTML.
+func (r *Response) HTML() *html.Node {
+	doc, err := html.Parse(bytes.NewReader(r.Body))
+	if err != nil {
+		r.t.Fatalf("%s %s: parsing HTML: %v", r.Request.Method, r.Request.URL, err)
+	}
+	return doc
+}
+
+// HasHTML checks that an HTML body has an element matching selector, a CSS
+// selector of the form documented by Select.
+func (r *Response) HasHTML(selector string) *Response {
+	if nodes := r.selectHTML(selector); len(nodes) == 0 {
+		r.errorf("no element matches %q:\n%s", selector, r.Body)
+	}
+	return r
+}
+
+// HTMLText checks that the text of an element matching selector contains
+// substr.
+func (r *Response) HTMLText(selector, substr string) *Response {
+	nodes := r.selectHTML(selector)
+	var texts []string
+	for _, n := range nodes {
+		text := Text(n)
+		if strings.Contains(text, substr) {
+			return r
+		}
+		texts = append(texts, strconv.Quote(text))
+	}
+	if len(nodes) == 0 {
+		r.errorf("no element matches %q:\n%s", selector, r.Body)
+	} else {
+		r.errorf("no element matching %q contains %q; their text is %s", selector, substr, strings.Join(texts, ", "))
+	}
+	return r
+}
+
+func (r *Response) selectHTML(selector string) []*html.Node {
+	nodes, err := Select(r.HTML(), selector)
+	if err != nil {
+		r.t.Fatalf("webtest: %v", err)
+	}
+	return nodes
+}
@@ -0,0 +1,213 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package webtest
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+)
+
+// A selector is a simple CSS selector: a list of compound selectors, each
+// matching an element that is a descendant of an element matching the
+// previous one.
+type selector []compound
+
+// compound matches elements with a tag name, id, classes and attributes.
+type compound struct {
+	tag     string // "" matches any tag.
+	id      string
+	classes []string
+	attrs   []attrSelector
+}
+
+type attrSelector struct {
+	name     string
+	value    string
+	hasValue bool // whether the value of the attribute must equal value.
+}
+
+// parseSelector parses a selector. It supports:
+//
+//	tag, *      elements with a tag name, or any element
+//	#id         elements with an id
+//	.class      elements with a class
+//	[attr]      elements with an attribute
+//	[attr=val]  elements with an attribute of a value, which may be quoted
+//	a b         elements matching b, descendants of elements matching a
+func parseSelector(s string) (selector, error) {
+	var sel selector
+	for _, part := range strings.Fields(s) {
+		c, err := parseCompound(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector %q: %v", s, err)
+		}
+		sel = append(sel, c)
+	}
+	if len(sel) == 0 {
+		return nil, fmt.Errorf("empty selector")
+	}
+	return sel, nil
+}
+
+func parseCompound(s string) (compound, error) {
+	var c compound
+	name, s := splitName(s)
+	if name != "*" {
+		c.tag = strings.ToLower(name)
+	}
+	for s != "" {
+		switch s[0] {
+		case '#':
+			c.id, s = splitName(s[1:])
+			if c.id == "" {
+				return c, fmt.Errorf("missing id after #")
+			}
+		case '.':
+			var class string
+			class, s = splitName(s[1:])
+			if class == "" {
+				return c, fmt.Errorf("missing class after .")
+			}
+			c.classes = append(c.classes, class)
+		case '[':
+			end := strings.IndexByte(s, ']')
+			if end < 0 {
+				return c, fmt.Errorf("missing ]")
+			}
+			var a attrSelector
+			a.name = s[1:end]
+			if i := strings.IndexByte(a.name, '='); i >= 0 {
+				a.name, a.value, a.hasValue = a.name[:i], strings.Trim(a.name[i+1:], `"'`), true
+			}
+			if a.name == "" {
+				return c, fmt.Errorf("missing attribute name")
+			}
+			a.name = strings.ToLower(a.name)
+			c.attrs = append(c.attrs, a)
+			s = s[end+1:]
+		default:
+			return c, fmt.Errorf("unexpected %q", s[0])
+		}
+	}
+	return c, nil
+}
+
+// splitName splits a name, or "*", from the start of s.
+func splitName(s string) (name, rest string) {
+	if strings.HasPrefix(s, "*") {
+		return "*", s[1:]
+	}
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return !(r == '-' || r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r))
+	})
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i:]
+}
+
+func (c *compound) match(n *html.Node) bool {
+	if n.Type != html.ElementNode || (c.tag != "" && n.Data != c.tag) {
+		return false
+	}
+	if c.id != "" && attr(n, "id") != c.id {
+		return false
+	}
+	classes := strings.Fields(attr(n, "class"))
+	for _, class := range c.classes {
+		if !contains(classes, class) {
+			return false
+		}
+	}
+	for _, a := range c.attrs {
+		v, ok := lookupAttr(n, a.name)
+		if !ok || (a.hasValue && v != a.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// match reports whether n matches the selector.
+func (sel selector) match(n *html.Node) bool {
+	last := len(sel) - 1
+	if !sel[last].match(n) {
+		return false
+	}
+	// Match the other compound selectors to ancestors, nearest first.
+	i := last - 1
+	for p := n.Parent; p != nil && i >= 0; p = p.Parent {
+		if sel[i].match(p) {
+			i--
+		}
+	}
+	return i < 0
+}
+
+// Select returns the elements of the tree rooted at n matching a CSS
+// selector, in document order. It supports tag names, ids, classes,
+// attributes, and descendants, as in `form#login input[name="user"]`.
+func Select(n *html.Node, selector string) ([]*html.Node, error) {
+	sel, err := parseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []*html.Node
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if sel.match(n) {
+			nodes = append(nodes, n)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return nodes, nil
+}
+
+// Text returns the text of n and its descendants, with runs of spaces
+// collapsed.
+func Text(n *html.Node) string {
+	var b bytes.Buffer
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			b.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+func attr(n *html.Node, name string) string {
+	v, _ := lookupAttr(n, name)
+	return v
+}
+
+func lookupAttr(n *html.Node, name string) (string, bool) {
+	for _, a := range n.Attr {
+		if a.Namespace == "" && a.Key == name {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -3,24 +3,45 @@
 // license that can be found in the LICENSE file.
 
 // Package webtest provides helpers for testing web applications.
+//
+// A web test sends requests to a server, given by its host or base URL, or
+// directly to an http.Handler, without a network:
+//
+//	w := webtest.NewHandler(t, handler)
+//	w.Check(w.Get("/books")).Status(http.StatusOK).BodyContains("Books")
 package webtest
 
 import (
+	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 )
 
 // W holds the configuration for a web test.
 type W struct {
-	t    *testing.T
-	host string
+	t       *testing.T
+	host    string // the host and port to wait for.
+	base    string // the URL that paths are relative to, without a trailing slash.
+	handler http.Handler
 
 	Client *http.Client
+
+	// WaitTimeout is how long WaitForNet waits for the server. It defaults
+	// to 30 seconds.
+	WaitTimeout time.Duration
+
+	// ReadyPath, if set, is polled by WaitForNet until it responds with a
+	// 2xx status, rather than waiting for the server to accept connections.
+	ReadyPath string
 }
 
 // New creates a web test for a given a host tring (e.g. "localhost:8080")
@@ -28,29 +49,150 @@ func New(t *testing.T, host string) *W {
 	return &W{
 		t:      t,
 		host:   host,
+		base:   "http://" + host,
+		Client: http.DefaultClient,
+	}
+}
+
+// NewWithURL creates a web test for a server at a base URL, such as
+// "https://example.com/app". Paths are relative to the base URL.
+//
+// To test a server with a self-signed certificate, such as an
+// httptest.NewTLSServer, set Client to a client trusting it.
+func NewWithURL(t *testing.T, baseURL string) *W {
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		t.Fatalf("webtest: invalid base URL %q", baseURL)
+	}
+	host := u.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(strings.Trim(host, "[]"), port)
+	}
+	return &W{
+		t:      t,
+		host:   host,
+		base:   strings.TrimSuffix(u.Scheme+"://"+u.Host+u.Path, "/"),
 		Client: http.DefaultClient,
 	}
 }
 
-// WaitForNet waits for the host to come live.
-// After a 30s timeout, it will call t.Fatal
+// handlerHost is the host of the requests of web tests of handlers.
+const handlerHost = "webtest.local"
+
+// NewHandler creates a web test that sends requests directly to h, in the
+// test's process, without listening on a port.
+func NewHandler(t *testing.T, h http.Handler) *W {
+	return &W{
+		t:       t,
+		host:    handlerHost,
+		base:    "http://" + handlerHost,
+		handler: h,
+		Client:  &http.Client{Transport: handlerTransport{h}},
+	}
+}
+
+// handlerTransport is an http.RoundTripper that serves requests with a
+// handler.
+type handlerTransport struct {
+	h http.Handler
+}
+
+func (t handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Make the request look like one received by a server.
+	r := new(http.Request)
+	*r = *req
+	r.RequestURI = req.URL.RequestURI()
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Host = req.URL.Host
+	if r.Body == nil {
+		r.Body = ioutil.NopCloser(bytes.NewReader(nil))
+	}
+	rec := httptest.NewRecorder()
+	t.h.ServeHTTP(rec, r)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", rec.Code, http.StatusText(rec.Code)),
+		StatusCode:    rec.Code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        rec.HeaderMap,
+		Body:          ioutil.NopCloser(bytes.NewReader(rec.Body.Bytes())),
+		ContentLength: int64(rec.Body.Len()),
+		Request:       req,
+	}, nil
+}
+
+// UseCookies makes the web test keep the cookies set by the server, and
+// send them back, as a browser does, such as to stay logged in. It replaces
+// the cookies kept so far.
+func (w *W) UseCookies() {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		w.t.Fatal(err)
+	}
+	c := *w.Client
+	c.Jar = jar
+	w.Client = &c
+}
+
+// URL returns the URL of a path.
+func (w *W) URL(path string) string {
+	return w.base + path
+}
+
+// WaitForNet waits for the host to come live, or, if ReadyPath is set, to
+// be ready. After WaitTimeout, it will call t.Fatal.
+// It returns immediately for web tests of handlers.
 func (w *W) WaitForNet() {
+	if w.handler != nil {
+		return
+	}
 	const retryDelay = 100 * time.Millisecond
-	deadline := time.Now().Add(30 * time.Second)
+	timeout := w.WaitTimeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	deadline := time.Now().Add(timeout)
 
+	var lastErr error
 	for time.Now().Before(deadline) {
-		conn, err := net.Dial("tcp", w.host)
-		if err != nil {
-			time.Sleep(retryDelay)
-			continue
+		if lastErr = w.ready(); lastErr == nil {
+			return
 		}
-		conn.Close()
-		return
+		time.Sleep(retryDelay)
 	}
 
+	if w.ReadyPath != "" {
+		w.t.Fatalf("Timed out waiting for %s to be ready: %v", w.URL(w.ReadyPath), lastErr)
+	}
 	w.t.Fatalf("Timed out wating for net %s", w.host)
 }
 
+// ready returns nil if the server is ready.
+func (w *W) ready() error {
+	if w.ReadyPath == "" {
+		conn, err := net.Dial("tcp", w.host)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	resp, err := w.Get(w.ReadyPath)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("got status %s", resp.Status)
+	}
+	return nil
+}
+
 // GetBody performs a GET request to a given path.
 func (w *W) GetBody(path string) (body string, resp *http.Response, err error) {
 	resp, err = w.Get(path)
@@ -67,22 +209,27 @@ func (w *W) GetBody(path string) (body string, resp *http.Response, err error) {
 
 // Get performs a GET request to a given path.
 func (w *W) Get(path string) (*http.Response, error) {
-	return w.Client.Get("http://" + w.host + path)
+	return w.Client.Get(w.URL(path))
 }
 
 // Post performs a POST request to a given path.
 func (w *W) Post(path, bodyType string, body io.Reader) (*http.Response, error) {
-	return w.Client.Post("http://"+w.host+path, bodyType, body)
+	return w.Client.Post(w.URL(path), bodyType, body)
 }
 
 // PostForm performs a POST request to a given path.
 func (w *W) PostForm(path string, v url.Values) (*http.Response, error) {
-	return w.Client.PostForm("http://"+w.host+path, v)
+	return w.Client.PostForm(w.URL(path), v)
+}
+
+// Do sends a request, such as one made by NewRequest.
+func (w *W) Do(r *http.Request) (*http.Response, error) {
+	return w.Client.Do(r)
 }
 
 // NewRequest constructs a http.Request for the web tests's host.
 func (w *W) NewRequest(method, path string, body io.Reader) *http.Request {
-	r, err := http.NewRequest(method, "http://"+w.host+path, body)
+	r, err := http.NewRequest(method, w.URL(path), body)
 	if err != nil {
 		w.t.Fatal(err)
 	}
@@ -0,0 +1,202 @@
+// Copyright 2018 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package webtest
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+const testPage = `<!DOCTYPE html>
+<html><body>
+<h1 id="title" class="big header">Books</h1>
+<form id="login" action="/login">
+	<input name="user" type="text">
+	<p class="hint">Use your <b>email</b> address.</p>
+</form>
+</body></html>`
+
+func testHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, testPage)
+	})
+	mux.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"total": 2, "books": [{"title": "Dune", "year": 1965}, {"title": "Emma"}]}`)
+	})
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "user", Value: r.FormValue("user"), Path: "/"})
+		http.Redirect(w, r, "/whoami", http.StatusFound)
+	})
+	mux.HandleFunc("/whoami", func(w http.ResponseWriter, r *http.Request) {
+		c, err := r.Cookie("user")
+		if err != nil {
+			http.Error(w, "Not logged in", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, "Hello, %s (from %s)", c.Value, r.Host)
+	})
+	return mux
+}
+
+func TestHandler(t *testing.T) {
+	w := NewHandler(t, testHandler())
+	w.WaitForNet()
+	w.Check(w.Get("/page")).
+		Status(http.StatusOK).
+		HasHeader("Content-Type", "text/html").
+		BodyContains("<h1").
+		BodyMatches(`(?s)<form.*</form>`).
+		HasHTML("h1#title.big").
+		HasHTML(`form#login input[name="user"]`).
+		HasHTML("body [type=text]").
+		HTMLText("form .hint", "your email address")
+	w.Check(w.Get("/missing")).Status(http.StatusNotFound)
+	w.Check(w.Get("/api")).
+		JSONPath("total", 2).
+		JSONPath("books.0", map[string]interface{}{"title": "Dune", "year": 1965}).
+		JSONPath("books.1.title", "Emma")
+	w.Check(w.Do(w.NewRequest("GET", "/login", nil))).Status(http.StatusMethodNotAllowed)
+}
+
+func TestCookies(t *testing.T) {
+	w := NewHandler(t, testHandler())
+	w.UseCookies()
+	w.Check(w.Get("/whoami")).Status(http.StatusUnauthorized)
+	w.Check(w.PostForm("/login", map[string][]string{"user": {"gopher"}})).
+		Status(http.StatusOK).
+		BodyContains("Hello, gopher")
+	w.Check(w.Get("/whoami")).BodyContains("Hello, gopher")
+
+	// Another web test doesn't share the cookies.
+	other := NewHandler(t, testHandler())
+	other.UseCookies()
+	other.Check(other.Get("/whoami")).Status(http.StatusUnauthorized)
+}
+
+func TestTLSServer(t *testing.T) {
+	srv := httptest.NewTLSServer(testHandler())
+	defer srv.Close()
+	w := NewWithURL(t, srv.URL+"/")
+	w.Client = &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // The test server's certificate is self-signed.
+	}}
+	w.WaitTimeout = 5 * time.Second
+	w.ReadyPath = "/page"
+	w.WaitForNet()
+	if !strings.HasPrefix(w.URL("/page"), "https://") {
+		t.Errorf("URL(/page) = %q, want an https URL", w.URL("/page"))
+	}
+	w.Check(w.Get("/page")).Status(http.StatusOK).HTMLText("h1", "Books")
+}
+
+func TestBaseURL(t *testing.T) {
+	srv := httptest.NewServer(http.StripPrefix("/app", testHandler()))
+	defer srv.Close()
+	w := NewWithURL(t, srv.URL+"/app")
+	w.Check(w.Get("/api")).JSONPath("books.1.title", "Emma")
+
+	// The host of New is still the server's.
+	w = New(t, srv.Listener.Addr().String())
+	w.Check(w.Get("/app/api")).JSONPath("total", 2)
+
+	for _, tc := range []struct{ url, host string }{
+		{"http://example.com", "example.com:80"},
+		{"https://example.com/a/", "example.com:443"},
+		{"https://example.com:8443", "example.com:8443"},
+	} {
+		if w := NewWithURL(t, tc.url); w.host != tc.host {
+			t.Errorf("NewWithURL(%q) waits for %q, want %q", tc.url, w.host, tc.host)
+		}
+	}
+	if w := NewWithURL(t, "https://example.com/a/"); w.URL("/b") != "https://example.com/a/b" {
+		t.Errorf("URL(/b) = %q, want https://example.com/a/b", w.URL("/b"))
+	}
+}
+
+func TestReadyPath(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			http.Error(w, "Starting", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+	w := NewWithURL(t, srv.URL)
+	w.ReadyPath = "/healthz"
+	w.WaitTimeout = 5 * time.Second
+	w.WaitForNet()
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("WaitForNet made %d requests, want 3", n)
+	}
+}
+
+func TestSelect(t *testing.T) {
+	doc, err := html.Parse(strings.NewReader(testPage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		selector string
+		want     []string // the text of the elements.
+	}{
+		{"h1", []string{"Books"}},
+		{".header.big", []string{"Books"}},
+		{"#login p", []string{"Use your email address."}},
+		{"form b", []string{"email"}},
+		{"form * b", []string{"email"}},
+		{"h1 b", nil},
+		{"[name]", []string{""}},
+		{"input[type=password]", nil},
+		{"p.big", nil},
+	} {
+		nodes, err := Select(doc, tc.selector)
+		if err != nil {
+			t.Errorf("Select(%q): %v", tc.selector, err)
+			continue
+		}
+		var got []string
+		for _, n := range nodes {
+			got = append(got, Text(n))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) || len(got) != len(tc.want) {
+			t.Errorf("Select(%q) = %q, want %q", tc.selector, got, tc.want)
+		}
+	}
+
+	for _, s := range []string{"", "h1[", "#", "h1.", "a>b"} {
+		if _, err := Select(doc, s); err == nil {
+			t.Errorf("Select(%q): got no error", s)
+		}
+	}
+}
+
+func TestLookupJSON(t *testing.T) {
+	v := map[string]interface{}{"a": []interface{}{"x"}}
+	for _, path := range []string{"b", "a.1", "a.x", "a.0.c"} {
+		if _, err := lookupJSON(v, path); err == nil {
+			t.Errorf("lookupJSON(%q): got no error", path)
+		}
+	}
+	if got, err := lookupJSON(v, "a.0"); err != nil || got != "x" {
+		t.Errorf("lookupJSON(a.0) = %v, %v; want x", got, err)
+	}
+}
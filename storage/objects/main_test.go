@@ -232,3 +232,48 @@ func cleanBucket(t *testing.T, ctx context.Context, client *storage.Client, proj
 		t.Fatalf("Bucket.Create(%q): %v", bucket, err)
 	}
 }
+
+func TestMainCommands(t *testing.T) {
+	tc := testutil.SystemTest(t)
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket := tc.ProjectID + "-samples-object-bucket-3"
+	cleanBucket(t, ctx, client, tc.ProjectID, bucket)
+
+	m := testutil.BuildMain(t)
+	defer m.Cleanup()
+	if !m.Built() {
+		t.Fatal("failed to build the sample")
+	}
+	run := func(args ...string) *testutil.Result {
+		return m.Exec(testutil.Cmd{
+			Args: append([]string{"-o=" + bucket + ":foo.txt"}, args...),
+			Env:  map[string]string{"GOOGLE_CLOUD_PROJECT": tc.ProjectID},
+		})
+	}
+
+	if res := run("write"); !res.Success() {
+		t.Fatalf("write: %v", res)
+	}
+	if res := run("read"); !res.Success() || !strings.Contains(res.Stdout.String(), "Object contents: Hello\nworld") {
+		t.Errorf("read: got %v; want the contents of notes.txt", res)
+	}
+	if res := run("metadata"); !res.Success() || !strings.Contains(res.Stdout.String(), "Object metadata:") {
+		t.Errorf("metadata: got %v; want the metadata", res)
+	}
+	if res := run("delete"); !res.Success() {
+		t.Errorf("delete: %v", res)
+	}
+	if res := run("read"); res.Success() || !strings.Contains(res.Stderr.String(), "Cannot read object") {
+		t.Errorf("read after delete: got %v; want an error", res)
+	}
+
+	testutil.Retry(t, 10, time.Second, func(r *testutil.R) {
+		if err := client.Bucket(bucket).Delete(ctx); err != nil {
+			r.Errorf("cleanup of bucket failed: %v", err)
+		}
+	})
+}